@@ -9,6 +9,8 @@ import (
 )
 
 func main() {
+  if len(os.Args) > 1 && os.Args[1] == "migrate" { os.Exit(runMigrate(os.Args[2:], os.Stdout)) }
+
   addr := getenv("HTTP_ADDR", ":8080")
   s := server.New()
   log.Printf("listening on %s", addr)
@@ -114,3 +114,47 @@ func Test_ServerHealthz_FromMainWiring(t *testing.T) {
 		t.Fatalf("status=%d want 200", resp.StatusCode)
 	}
 }
+
+// ---- migrate subcommand ----
+
+func Test_runMigrate_RejectsUnknownFlag(t *testing.T) {
+	var out strings.Builder
+	if code := runMigrate([]string{"-nope"}, &out); code != 2 {
+		t.Fatalf("exit=%d want 2 (output %q)", code, out.String())
+	}
+}
+
+func Test_runMigrate_DryRunAgainstEmptyDatabase(t *testing.T) {
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0\n")) // EXISTS TABLE schema_migrations -> no
+	}))
+	defer ch.Close()
+	t.Setenv("CH_HTTP_URL", ch.URL)
+	t.Setenv("CH_DATABASE", "obs")
+
+	var out strings.Builder
+	if code := runMigrate([]string{"-dry-run"}, &out); code != 0 {
+		t.Fatalf("exit=%d output=%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "obs.trace_roots") {
+		t.Fatalf("dry run did not print templated DDL:\n%s", out.String())
+	}
+}
+
+func Test_runMigrate_AttrValuesDryRun(t *testing.T) {
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0\n"))
+	}))
+	defer ch.Close()
+	t.Setenv("CH_HTTP_URL", ch.URL)
+	t.Setenv("CH_DATABASE", "obs")
+	t.Setenv("ATTR_VALUE_KEYS", "team.name")
+
+	var out strings.Builder
+	if code := runMigrate([]string{"-dry-run", "-attr-values"}, &out); code != 0 {
+		t.Fatalf("exit=%d output=%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "ALTER TABLE obs.mv_attr_values MODIFY QUERY\nWITH ['team.name'] AS keys") {
+		t.Fatalf("attr_values DDL not printed:\n%s", out.String())
+	}
+}
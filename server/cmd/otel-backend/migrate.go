@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/example/otel-stack-demo/internal/migrate"
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/example/otel-stack-demo/internal/traces"
+)
+
+// runMigrate implements `otel-backend migrate [-dry-run] [-backfill] [-attr-values]`.
+func runMigrate(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "print pending statements without executing them")
+	backfill := fs.Bool("backfill", false, "copy existing otel_traces rows into newly created materialized views")
+	attrValues := fs.Bool("attr-values", false, "point the attr_values view at the ATTR_VALUE_KEYS allowlist")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	src := sources.FromEnv()
+	if err := src.DetectTraceSchema(); err != nil {
+		fmt.Fprintf(out, "warning: trace schema detection: %v; assuming %s in %s\n", err, src.Traces.DurationUnit, src.Traces.DurationColumn)
+	}
+	if err := migrate.Run(src, migrate.Options{DryRun: *dryRun, Backfill: *backfill, Out: out}); err != nil {
+		fmt.Fprintf(out, "migrate: %v\n", err)
+		return 1
+	}
+	if *attrValues {
+		fmt.Fprintf(out, "-- attr_values keys: %s\n", strings.Join(src.AttrValueKeys, ", "))
+		for _, stmt := range traces.AttrValuesDDL(src.CHDB, src.Traces, src.AttrValueKeys) {
+			if *dryRun {
+				fmt.Fprintf(out, "%s;\n\n", stmt)
+				continue
+			}
+			if _, err := src.QueryCH(stmt); err != nil {
+				fmt.Fprintf(out, "migrate: attr_values: %v\n", err)
+				return 1
+			}
+		}
+	}
+	return 0
+}
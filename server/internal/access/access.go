@@ -0,0 +1,93 @@
+// Package access decides what a caller may do with stored objects (saved
+// queries, dashboards). The backend has no login of its own. Behind an
+// authenticating proxy (TRUST_FORWARDED_USER=true) the user name comes from
+// the X-Forwarded-User header it sets and the caller gets DEFAULT_ROLE.
+// Otherwise the header is ignored, since anyone could send it: every caller
+// is Anonymous with the Viewer role, or with DEFAULT_ROLE under DEMO_MODE,
+// where one shared anonymous user may save and edit.
+package access
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role is what a caller may do, weakest first.
+type Role int
+
+const (
+	// Viewer reads its own and shared objects.
+	Viewer Role = iota
+	// Editor also creates objects and changes or deletes its own.
+	Editor
+	// Admin reads, changes and deletes anyone's.
+	Admin
+)
+
+var roleNames = []string{"viewer", "editor", "admin"}
+
+func (r Role) String() string {
+	if r < Viewer || r > Admin {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole reads "viewer", "editor" or "admin".
+func ParseRole(s string) (Role, error) {
+	for i, n := range roleNames {
+		if strings.EqualFold(strings.TrimSpace(s), n) {
+			return Role(i), nil
+		}
+	}
+	return Viewer, fmt.Errorf("unknown role %q (want viewer, editor or admin)", s)
+}
+
+// UserHeader names the caller; Anonymous stands in when it is missing or
+// not trusted.
+const (
+	UserHeader = "X-Forwarded-User"
+	Anonymous  = "anonymous"
+)
+
+// Caller is who is asking and with which role.
+type Caller struct {
+	User string
+	Role Role
+}
+
+// Policy says how callers are identified.
+type Policy struct {
+	Role        Role // for identified callers (DEFAULT_ROLE)
+	TrustHeader bool // believe UserHeader (TRUST_FORWARDED_USER)
+	Demo        bool // give Anonymous Role too (DEMO_MODE)
+}
+
+// Caller identifies the caller of the current request.
+func (p Policy) Caller(c *gin.Context) Caller {
+	if p.TrustHeader {
+		if user := strings.TrimSpace(c.GetHeader(UserHeader)); user != "" {
+			return Caller{User: user, Role: p.Role}
+		}
+	}
+	if p.Demo {
+		return Caller{User: Anonymous, Role: p.Role}
+	}
+	return Caller{User: Anonymous, Role: Viewer}
+}
+
+// CanCreate reports whether the caller may store new objects.
+func (c Caller) CanCreate() bool { return c.Role >= Editor }
+
+// CanRead reports whether the caller may open an object by its ID. Shared
+// objects are readable by everyone.
+func (c Caller) CanRead(owner string, shared bool) bool {
+	return shared || owner == c.User || c.Role >= Admin
+}
+
+// CanWrite reports whether the caller may change or delete an object.
+func (c Caller) CanWrite(owner string) bool {
+	return c.Role >= Admin || (c.Role >= Editor && owner == c.User)
+}
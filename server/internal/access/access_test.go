@@ -0,0 +1,62 @@
+package access
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRole(t *testing.T) {
+	for in, want := range map[string]Role{"viewer": Viewer, "Editor": Editor, " admin ": Admin} {
+		if got, err := ParseRole(in); err != nil || got != want {
+			t.Fatalf("%q: %v, %v", in, got, err)
+		}
+	}
+	if r, err := ParseRole("root"); err == nil || r != Viewer {
+		t.Fatalf("unknown role: %v, %v", r, err)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	trusted := Policy{Role: Editor, TrustHeader: true}
+	if who := trusted.Caller(c); who.User != Anonymous || who.Role != Viewer {
+		t.Fatalf("no header: %+v", who)
+	}
+	c.Request.Header.Set(UserHeader, "ana")
+	who := trusted.Caller(c)
+	if who.User != "ana" || !who.CanCreate() {
+		t.Fatalf("caller=%+v", who)
+	}
+	if !who.CanWrite("ana") || who.CanWrite("bo") || !who.CanRead("bo", true) || who.CanRead("bo", false) {
+		t.Fatalf("editor permissions wrong")
+	}
+	viewer := Caller{User: "ana", Role: Viewer}
+	if viewer.CanCreate() || viewer.CanWrite("ana") || !viewer.CanRead("ana", false) {
+		t.Fatalf("viewer permissions wrong")
+	}
+	admin := Caller{User: "root", Role: Admin}
+	if !admin.CanWrite("bo") || !admin.CanRead("bo", false) {
+		t.Fatalf("admin permissions wrong")
+	}
+}
+
+func TestPolicy_HeaderOnlyWhenTrusted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.Header.Set(UserHeader, "admin-wannabe")
+
+	if who := (Policy{Role: Admin}).Caller(c); who.User != Anonymous || who.Role != Viewer {
+		t.Fatalf("untrusted header: %+v", who)
+	}
+	if who := (Policy{Role: Editor, Demo: true}).Caller(c); who.User != Anonymous || who.Role != Editor {
+		t.Fatalf("demo mode: %+v", who)
+	}
+	if who := (Policy{Role: Editor, TrustHeader: true, Demo: true}).Caller(c); who.User != "admin-wannabe" || who.Role != Editor {
+		t.Fatalf("trusted header in demo mode: %+v", who)
+	}
+}
@@ -0,0 +1,215 @@
+// Package cache is a small in-process TTL/LRU cache for upstream query
+// responses, with request coalescing so concurrent identical queries only
+// reach the datasource once.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one cached response body.
+type Entry struct {
+	Body   []byte
+	ETag   string
+	Stored time.Time
+}
+
+// NewEntry wraps body and derives a weak ETag from its content.
+func NewEntry(body []byte) Entry {
+	sum := sha1.Sum(body)
+	return Entry{Body: body, ETag: `W/"` + hex.EncodeToString(sum[:8]) + `"`, Stored: time.Now()}
+}
+
+type item struct {
+	key   string
+	entry Entry
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	entry Entry
+	err   error
+}
+
+// Cache is safe for concurrent use. A nil *Cache is valid and caches nothing.
+type Cache struct {
+	name  string
+	size  int
+	ttl   time.Duration
+	stats *Stats
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	calls map[string]*call
+}
+
+// New returns a cache holding at most size entries for ttl each, or nil when
+// size or ttl is not positive. Caches sharing a name share their Stats.
+func New(name string, size int, ttl time.Duration) *Cache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &Cache{
+		name:  name,
+		size:  size,
+		ttl:   ttl,
+		stats: statsFor(name),
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+		calls: map[string]*call{},
+	}
+}
+
+// TTL reports how long entries live; zero for a nil cache.
+func (c *Cache) TTL() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.ttl
+}
+
+// Len reports the number of live and not-yet-evicted entries.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Do returns the cached entry for key, or runs fn to fill it. Concurrent
+// callers for the same key wait for a single fn invocation. Errors are
+// returned to every waiter and never cached. hit is true when fn did not run
+// on behalf of this caller.
+func (c *Cache) Do(key string, fn func() (Entry, error)) (e Entry, hit bool, err error) {
+	if c == nil {
+		e, err = fn()
+		return e, false, err
+	}
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*item)
+		if time.Since(it.entry.Stored) < c.ttl {
+			c.ll.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddUint64(&c.stats.Hits, 1)
+			return it.entry, true, nil
+		}
+		c.removeElement(el)
+	}
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.stats.Coalesced, 1)
+		cl.wg.Wait()
+		return cl.entry, cl.err == nil, cl.err
+	}
+	cl := &call{}
+	cl.wg.Add(1)
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.stats.Misses, 1)
+	// Release the waiters even if fn panics: they get the panic as an error
+	// and the panic carries on up this goroutine.
+	defer func() {
+		r := recover()
+		if r != nil {
+			cl.err = fmt.Errorf("cache %s: %v", c.name, r)
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		if cl.err == nil {
+			c.add(key, cl.entry)
+		}
+		c.mu.Unlock()
+		cl.wg.Done()
+		if r != nil {
+			panic(r)
+		}
+	}()
+	cl.entry, cl.err = fn()
+	return cl.entry, false, cl.err
+}
+
+// add stores e under key; c.mu must be held.
+func (c *Cache) add(key string, e Entry) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*item).entry = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&item{key: key, entry: e})
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+		atomic.AddUint64(&c.stats.Evictions, 1)
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*item).key)
+}
+
+// ---- Metrics ----
+
+// Stats are cumulative counters for every cache registered under one name.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Coalesced uint64
+	Evictions uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*Stats{}
+)
+
+func statsFor(name string) *Stats {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	s, ok := registry[name]
+	if !ok {
+		s = &Stats{}
+		registry[name] = s
+	}
+	return s
+}
+
+// WriteMetrics writes all cache counters in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	registryMu.Unlock()
+	sort.Strings(names)
+
+	series := []struct {
+		metric, help string
+		value        func(*Stats) *uint64
+	}{
+		{"otel_backend_cache_hits_total", "Responses served from the in-process cache.", func(s *Stats) *uint64 { return &s.Hits }},
+		{"otel_backend_cache_misses_total", "Responses fetched from the datasource.", func(s *Stats) *uint64 { return &s.Misses }},
+		{"otel_backend_cache_coalesced_total", "Requests that waited on an identical in-flight query.", func(s *Stats) *uint64 { return &s.Coalesced }},
+		{"otel_backend_cache_evictions_total", "Entries evicted to stay within the size limit.", func(s *Stats) *uint64 { return &s.Evictions }},
+	}
+	for _, m := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.metric, m.help, m.metric)
+		for _, n := range names {
+			fmt.Fprintf(w, "%s{cache=%q} %d\n", m.metric, n, atomic.LoadUint64(m.value(statsFor(n))))
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_HitAfterMiss(t *testing.T) {
+	c := New("t_hit", 4, time.Minute)
+	calls := 0
+	fill := func() (Entry, error) { calls++; return NewEntry([]byte(`{"a":1}`)), nil }
+
+	e1, hit1, err := c.Do("k", fill)
+	if err != nil || hit1 {
+		t.Fatalf("first Do: hit=%v err=%v", hit1, err)
+	}
+	e2, hit2, _ := c.Do("k", fill)
+	if !hit2 || calls != 1 {
+		t.Fatalf("second Do: hit=%v calls=%d", hit2, calls)
+	}
+	if e1.ETag == "" || e1.ETag != e2.ETag || !bytes.Equal(e1.Body, e2.Body) {
+		t.Fatalf("entries differ: %+v vs %+v", e1, e2)
+	}
+}
+
+func TestCache_ExpiresAfterTTL(t *testing.T) {
+	c := New("t_ttl", 4, 20*time.Millisecond)
+	calls := 0
+	fill := func() (Entry, error) { calls++; return NewEntry(nil), nil }
+
+	c.Do("k", fill)
+	time.Sleep(30 * time.Millisecond)
+	if _, hit, _ := c.Do("k", fill); hit || calls != 2 {
+		t.Fatalf("expired entry served: hit=%v calls=%d", hit, calls)
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := New("t_lru", 2, time.Minute)
+	fill := func() (Entry, error) { return NewEntry(nil), nil }
+
+	c.Do("a", fill)
+	c.Do("b", fill)
+	c.Do("a", fill) // a is now most recent
+	c.Do("c", fill) // evicts b
+
+	if c.Len() != 2 {
+		t.Fatalf("len=%d want 2", c.Len())
+	}
+	if _, hit, _ := c.Do("a", fill); !hit {
+		t.Fatalf("a should survive")
+	}
+	if _, hit, _ := c.Do("b", fill); hit {
+		t.Fatalf("b should have been evicted")
+	}
+}
+
+func TestCache_ErrorsAreNotCached(t *testing.T) {
+	c := New("t_err", 4, time.Minute)
+	boom := errors.New("boom")
+	if _, _, err := c.Do("k", func() (Entry, error) { return Entry{}, boom }); err != boom {
+		t.Fatalf("err=%v", err)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("error entry cached")
+	}
+}
+
+func TestCache_CoalescesConcurrentMisses(t *testing.T) {
+	c := New("t_sf", 4, time.Minute)
+	var calls int32
+	release := make(chan struct{})
+	fill := func() (Entry, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return NewEntry([]byte("x")), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() { defer wg.Done(); c.Do("k", fill) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("fill ran %d times, want 1", calls)
+	}
+}
+
+func TestCache_PanicReleasesWaiters(t *testing.T) {
+	c := New("t_panic", 4, time.Minute)
+	release := make(chan struct{})
+	waiterErr := make(chan error, 1)
+	go func() {
+		defer func() { _ = recover() }()
+		c.Do("k", func() (Entry, error) { <-release; panic("boom") })
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		_, _, err := c.Do("k", func() (Entry, error) { return NewEntry(nil), nil })
+		waiterErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-waiterErr:
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("waiter err=%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still blocked after the panic")
+	}
+	// The key is free again.
+	if _, hit, err := c.Do("k", func() (Entry, error) { return NewEntry(nil), nil }); hit || err != nil {
+		t.Fatalf("after panic: hit=%v err=%v", hit, err)
+	}
+}
+
+func TestCache_NilIsPassThrough(t *testing.T) {
+	c := New("t_nil", 0, time.Minute)
+	if c != nil {
+		t.Fatalf("size 0 should disable the cache")
+	}
+	calls := 0
+	fill := func() (Entry, error) { calls++; return NewEntry(nil), nil }
+	c.Do("k", fill)
+	c.Do("k", fill)
+	if calls != 2 {
+		t.Fatalf("nil cache should not cache, calls=%d", calls)
+	}
+}
+
+func TestWriteMetrics_ReportsHitsAndMisses(t *testing.T) {
+	c := New("t_metrics", 4, time.Minute)
+	fill := func() (Entry, error) { return NewEntry(nil), nil }
+	c.Do("k", fill)
+	c.Do("k", fill)
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+	if !strings.Contains(out, `otel_backend_cache_hits_total{cache="t_metrics"} 1`) ||
+		!strings.Contains(out, `otel_backend_cache_misses_total{cache="t_metrics"} 1`) {
+		t.Fatalf("metrics missing:\n%s", out)
+	}
+}
@@ -0,0 +1,134 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/saved"
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// PanelCheck is the outcome of checking one panel's query.
+type PanelCheck struct {
+	PanelID string `json:"panelId"`
+	Error   string `json:"error"`
+	// Unavailable means the datasource could not be asked, not that the
+	// query is wrong.
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+// Checker runs each panel's query against the datasource behind its proxy
+// (Prometheus for promql_chart, VictoriaLogs for logsql_table) so syntax
+// errors surface before a dashboard is saved. Trace lists are built from
+// structured filters and are fully checked by Spec.Normalize.
+type Checker struct {
+	Src *sources.Sources
+}
+
+// Check returns the panels that failed; spec must already be normalized.
+// Variables take their default values, or a placeholder, and are
+// interpolated as for display before the query is sent.
+func (ch Checker) Check(spec Spec) []PanelCheck {
+	vals := Values{}
+	for _, v := range spec.Variables {
+		vals[v.Name] = []string{"placeholder"}
+		if len(v.Default) > 0 {
+			vals[v.Name] = v.Default
+		}
+	}
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		out = []PanelCheck{}
+	)
+	for _, p := range spec.Panels {
+		var check func(q string) (string, bool)
+		switch p.Kind() {
+		case saved.KindPromQL:
+			check = ch.promQL
+		case saved.KindLogsQL:
+			check = ch.logsQL
+		default:
+			continue
+		}
+		var body struct {
+			Query string `json:"query"`
+		}
+		raw, err := p.Interpolate(vals)
+		if err == nil {
+			err = json.Unmarshal(raw, &body)
+		}
+		if err != nil {
+			out = append(out, PanelCheck{PanelID: p.ID, Error: err.Error()})
+			continue
+		}
+		q := body.Query
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if msg, down := check(q); msg != "" {
+				mu.Lock()
+				out = append(out, PanelCheck{PanelID: id, Error: msg, Unavailable: down})
+				mu.Unlock()
+			}
+		}(p.ID)
+	}
+	wg.Wait()
+	order := map[string]int{}
+	for i, p := range spec.Panels {
+		order[p.ID] = i
+	}
+	sort.Slice(out, func(i, j int) bool { return order[out[i].PanelID] < order[out[j].PanelID] })
+	return out
+}
+
+// promQL evaluates q as an instant query; Prometheus answers 400 with the
+// parse error for bad ones.
+func (ch Checker) promQL(q string) (string, bool) {
+	v := url.Values{}
+	v.Set("query", q)
+	v.Set("time", fmt.Sprint(time.Now().Unix()))
+	resp, err := ch.Src.Client.Get(ch.Src.PromURL + "/api/v1/query?" + v.Encode())
+	if err != nil {
+		return err.Error(), true
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 300 {
+		return "", false
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &e) != nil || e.Error == "" {
+		e.Error = strings.TrimSpace(string(b))
+	}
+	return fmt.Sprintf("prometheus: %s", e.Error), resp.StatusCode >= 500
+}
+
+// logsQL runs q with limit=1; VictoriaLogs answers 400 with the parse error
+// for bad ones.
+func (ch Checker) logsQL(q string) (string, bool) {
+	form := url.Values{}
+	form.Set("query", q)
+	form.Set("limit", "1")
+	req, _ := http.NewRequest("POST", ch.Src.VLogsURL+"/select/logsql/query", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := ch.Src.Client.Do(req)
+	if err != nil {
+		return err.Error(), true
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 300 {
+		return "", false
+	}
+	return fmt.Sprintf("victorialogs: %s", strings.TrimSpace(string(b))), resp.StatusCode >= 500
+}
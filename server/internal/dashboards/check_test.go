@@ -0,0 +1,77 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// fakeBackends answers like Prometheus and VictoriaLogs: queries containing
+// "((" are syntax errors and "down" makes the backend fail.
+func fakeBackends(t *testing.T) (*sources.Sources, *[]string) {
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		q := r.Form.Get("query")
+		mu.Lock()
+		seen = append(seen, r.URL.Path+" "+q)
+		mu.Unlock()
+		switch {
+		case strings.Contains(q, "down"):
+			w.WriteHeader(503)
+		case strings.Contains(q, "(("):
+			w.WriteHeader(400)
+			if r.URL.Path == "/api/v1/query" {
+				io.WriteString(w, `{"status":"error","errorType":"bad_data","error":"1:5: parse error: unexpected \"(\""}`)
+			} else {
+				io.WriteString(w, "cannot parse query [((]")
+			}
+		default:
+			io.WriteString(w, `{}`)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return &sources.Sources{PromURL: ts.URL, VLogsURL: ts.URL + "/vl", Client: ts.Client()}, &seen
+}
+
+func panel(id, typ, query string) Panel {
+	q, _ := json.Marshal(map[string]string{"query": query})
+	return Panel{ID: id, Type: typ, Query: q}
+}
+
+func TestChecker(t *testing.T) {
+	src, seen := fakeBackends(t)
+	spec := Spec{
+		Variables: []Variable{{Name: "job", Type: VarPromQLLabelValues, LabelName: "job", Default: []string{"web"}}, {Name: "env", Type: VarTraceServices}},
+		Panels: []Panel{
+			panel("ok", PanelPromQLChart, `up{job="$job",env="${env}"}`),
+			panel("badlogs", PanelLogsQLTable, "(("),
+			{ID: "traces", Type: PanelTraceList, Query: json.RawMessage(`{}`)},
+			panel("badprom", PanelPromQLChart, "sum(("),
+			panel("down", PanelPromQLChart, "down"),
+		},
+	}
+	got := Checker{Src: src}.Check(spec)
+	if len(got) != 3 || got[0].PanelID != "badlogs" || got[1].PanelID != "badprom" || got[2].PanelID != "down" {
+		t.Fatalf("checks=%+v", got)
+	}
+	if got[0].Error != "victorialogs: cannot parse query [((]" || got[0].Unavailable ||
+		!strings.HasPrefix(got[1].Error, "prometheus: 1:5: parse error") || !got[2].Unavailable {
+		t.Fatalf("checks=%+v", got)
+	}
+	if !strings.Contains(strings.Join(*seen, "\n"), `/api/v1/query up{job="web",env="placeholder"}`) {
+		t.Fatalf("variables not substituted: %q", *seen)
+	}
+	if len(*seen) != 4 {
+		t.Fatalf("trace list panel was sent to a backend: %q", *seen)
+	}
+}
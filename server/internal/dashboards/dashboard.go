@@ -0,0 +1,326 @@
+// Package dashboards stores dashboard definitions: a grid of panels mixing
+// PromQL charts, LogsQL tables and trace lists, with template variables and
+// a time range. Every save is kept as a numbered version.
+package dashboards
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/saved"
+)
+
+// Panel types and the saved query kind their Query is.
+const (
+	PanelPromQLChart = "promql_chart"
+	PanelLogsQLTable = "logsql_table"
+	PanelTraceList   = "trace_list"
+)
+
+var panelKinds = map[string]string{
+	PanelPromQLChart: saved.KindPromQL,
+	PanelLogsQLTable: saved.KindLogsQL,
+	PanelTraceList:   saved.KindTraces,
+}
+
+// Variable types.
+const (
+	VarPromQLLabelValues = "promql_label_values"
+	VarLogsFieldValues   = "logs_field_values"
+	VarTraceServices     = "trace_services"
+)
+
+const (
+	GridColumns  = 24
+	maxPanels    = 100
+	maxVariables = 30
+	maxTitleLen  = 200
+	maxTags      = 20
+	maxTagLen    = 50
+)
+
+// Dashboard is a stored dashboard: its Spec plus bookkeeping.
+type Dashboard struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	Spec
+	// Version counts saves, starting at 1; it is also the ETag.
+	Version   uint64    `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy"`
+}
+
+// Spec is the part of a dashboard clients edit.
+type Spec struct {
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Tags        []string   `json:"tags"`
+	Shared      bool       `json:"shared"`
+	Time        TimeRange  `json:"time"`
+	Variables   []Variable `json:"variables"`
+	Panels      []Panel    `json:"panels"`
+}
+
+// TimeRange is relative ("now-6h" to "now") or absolute (unix seconds).
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Variable is a template variable; panels refer to it as $name or ${name}.
+type Variable struct {
+	Name  string `json:"name"`
+	Title string `json:"title,omitempty"`
+	Type  string `json:"type"`
+	// LabelName and Match (an optional series selector) are for
+	// promql_label_values.
+	LabelName string `json:"labelName,omitempty"`
+	Match     string `json:"match,omitempty"`
+	// Field and Query (an optional LogsQL filter) are for logs_field_values.
+	Field string `json:"field,omitempty"`
+	Query string `json:"query,omitempty"`
+	// Multi allows selecting several values.
+	Multi   bool     `json:"multi,omitempty"`
+	Default []string `json:"default,omitempty"`
+}
+
+// Panel is one cell of the grid.
+type Panel struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	// Query is the request body for the panel type's endpoint, as in
+	// saved queries; it may contain $variables.
+	Query   json.RawMessage `json:"query"`
+	GridPos GridPos         `json:"gridPos"`
+}
+
+// GridPos places a panel on a GridColumns-wide grid; Y and H are in rows.
+type GridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+func (a GridPos) overlaps(b GridPos) bool {
+	return a.X < b.X+b.W && b.X < a.X+a.W && a.Y < b.Y+b.H && b.Y < a.Y+a.H
+}
+
+// Kind is the saved query kind of the panel's Query.
+func (p Panel) Kind() string { return panelKinds[p.Type] }
+
+var (
+	varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// VarRefRe matches $name and ${name}.
+	VarRefRe    = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+	relTimeRe   = regexp.MustCompile(`^now(?:-(\d+)([smhdw]))?$`)
+	timeUnitDur = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+)
+
+// VarRefs lists the variable names referenced in s, in order.
+func VarRefs(s string) []string {
+	var out []string
+	for _, m := range VarRefRe.FindAllStringSubmatch(s, -1) {
+		out = append(out, m[1]+m[2])
+	}
+	return out
+}
+
+// ParseTime resolves "now", "now-<n><s|m|h|d|w>" or unix seconds against now.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if m := relTimeRe.FindStringSubmatch(s); m != nil {
+		if m[1] == "" {
+			return now, nil
+		}
+		n, _ := strconv.Atoi(m[1])
+		return now.Add(-time.Duration(n) * timeUnitDur[m[2]]), nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f >= 0 {
+		return time.Unix(int64(f), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("time %q: want now, now-<n>[smhdw] or unix seconds", s)
+}
+
+// Problems lists everything wrong with a spec.
+type Problems []string
+
+func (p *Problems) add(format string, args ...any) { *p = append(*p, fmt.Sprintf(format, args...)) }
+
+func (p Problems) Error() string { return strings.Join(p, "; ") }
+
+// Normalize checks s and rewrites it into canonical form: trimmed title,
+// de-duplicated tags, default time range, missing panel IDs filled in and
+// panel queries re-encoded by saved.NormalizeQuery. It does not contact the
+// datasources; see Checker for that.
+func (s *Spec) Normalize() error {
+	var p Problems
+	s.Title = strings.TrimSpace(s.Title)
+	if s.Title == "" {
+		p.add("title is required")
+	} else if len(s.Title) > maxTitleLen {
+		p.add("title is longer than %d bytes", maxTitleLen)
+	}
+	s.Description = strings.TrimSpace(s.Description)
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, t := range s.Tags {
+		if t = strings.TrimSpace(t); t != "" && !seen[t] {
+			if len(t) > maxTagLen {
+				p.add("tag %q is longer than %d bytes", t, maxTagLen)
+			}
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) > maxTags {
+		p.add("at most %d tags", maxTags)
+	}
+	s.Tags = tags
+
+	s.normalizeTime(&p)
+	s.normalizePanels(&p, s.normalizeVariables(&p))
+	if len(p) > 0 {
+		return p
+	}
+	return nil
+}
+
+// normalizeTime fills in and checks the time range.
+func (s *Spec) normalizeTime(p *Problems) {
+	if s.Time.From == "" {
+		s.Time.From = "now-1h"
+	}
+	if s.Time.To == "" {
+		s.Time.To = "now"
+	}
+	now := time.Now()
+	from, errFrom := ParseTime(s.Time.From, now)
+	to, errTo := ParseTime(s.Time.To, now)
+	switch {
+	case errFrom != nil:
+		p.add("time.from: %v", errFrom)
+	case errTo != nil:
+		p.add("time.to: %v", errTo)
+	case !from.Before(to):
+		p.add("time.from must be before time.to")
+	}
+}
+
+// normalizeVariables checks the variables and returns the names defined.
+func (s *Spec) normalizeVariables(p *Problems) map[string]bool {
+	if s.Variables == nil {
+		s.Variables = []Variable{}
+	}
+	if len(s.Variables) > maxVariables {
+		p.add("at most %d variables", maxVariables)
+	}
+	defined := map[string]bool{}
+	for i := range s.Variables {
+		v := &s.Variables[i]
+		where := fmt.Sprintf("variables[%d]", i)
+		switch {
+		case !varNameRe.MatchString(v.Name):
+			p.add("%s: name %q is not an identifier", where, v.Name)
+		case defined[v.Name]:
+			p.add("%s: duplicate name %q", where, v.Name)
+		}
+		switch v.Type {
+		case VarPromQLLabelValues:
+			if strings.TrimSpace(v.LabelName) == "" {
+				p.add("%s: labelName is required for %s", where, v.Type)
+			}
+		case VarLogsFieldValues:
+			if strings.TrimSpace(v.Field) == "" {
+				p.add("%s: field is required for %s", where, v.Type)
+			}
+		case VarTraceServices:
+		default:
+			p.add("%s: type must be %s, %s or %s", where, VarPromQLLabelValues, VarLogsFieldValues, VarTraceServices)
+		}
+		if !v.Multi && len(v.Default) > 1 {
+			p.add("%s: several defaults need multi", where)
+		}
+		// A variable's own query may use the variables defined before it.
+		for _, ref := range VarRefs(v.Match + " " + v.Query) {
+			if !defined[ref] {
+				p.add("%s: $%s is not defined before it", where, ref)
+			}
+		}
+		defined[v.Name] = true
+	}
+	return defined
+}
+
+// normalizePanels checks the panels, which may only use the variables in
+// defined, and fills in missing IDs.
+func (s *Spec) normalizePanels(p *Problems, defined map[string]bool) {
+	if s.Panels == nil {
+		s.Panels = []Panel{}
+	}
+	if len(s.Panels) > maxPanels {
+		p.add("at most %d panels", maxPanels)
+	}
+	ids := map[string]bool{}
+	for _, pn := range s.Panels {
+		ids[pn.ID] = true
+	}
+	next := 1
+	for i := range s.Panels {
+		pn := &s.Panels[i]
+		if pn.ID = strings.TrimSpace(pn.ID); pn.ID == "" {
+			for ids[fmt.Sprint("p", next)] {
+				next++
+			}
+			pn.ID = fmt.Sprint("p", next)
+			ids[pn.ID] = true
+		}
+		where := fmt.Sprintf("panels[%d] (%s)", i, pn.ID)
+		for j := 0; j < i; j++ {
+			if s.Panels[j].ID == pn.ID {
+				p.add("%s: duplicate id", where)
+			}
+		}
+		pn.Title = strings.TrimSpace(pn.Title)
+		if kind := pn.Kind(); kind == "" {
+			p.add("%s: type must be %s, %s or %s", where, PanelPromQLChart, PanelLogsQLTable, PanelTraceList)
+		} else if q, err := saved.NormalizeQuery(kind, pn.Query); err != nil {
+			p.add("%s: %v", where, err)
+		} else {
+			pn.Query = q
+		}
+		for _, ref := range VarRefs(string(pn.Query)) {
+			if !defined[ref] {
+				p.add("%s: unknown variable $%s", where, ref)
+			}
+		}
+		g := pn.GridPos
+		if g.X < 0 || g.Y < 0 || g.W < 1 || g.H < 1 || g.X+g.W > GridColumns {
+			p.add("%s: gridPos %+v is outside the %d-column grid", where, g, GridColumns)
+		}
+		for j := 0; j < i; j++ {
+			if s.Panels[j].GridPos.overlaps(g) {
+				p.add("%s: overlaps %s", where, s.Panels[j].ID)
+			}
+		}
+	}
+}
+
+// specJSON encodes s for storage.
+func specJSON(s Spec) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,99 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpecNormalize(t *testing.T) {
+	var s Spec
+	err := json.Unmarshal([]byte(`{
+		"title": " Checkout ", "tags": ["web", "web", " slo "],
+		"variables": [
+			{"name": "env", "type": "promql_label_values", "labelName": "env"},
+			{"name": "service", "type": "promql_label_values", "labelName": "job", "match": "up{env=\"$env\"}", "multi": true, "default": ["web", "api"]}
+		],
+		"panels": [
+			{"type": "promql_chart", "query": {"query": "rate(http_requests_total{job=~\"${service}\"}[5m])"}, "gridPos": {"x": 0, "y": 0, "w": 12, "h": 8}},
+			{"id": "p1", "type": "logsql_table", "query": {"query": "service:$service error"}, "gridPos": {"x": 12, "y": 0, "w": 12, "h": 8}},
+			{"type": "trace_list", "query": {"filters": {"service": ["$service"]}}, "gridPos": {"x": 0, "y": 8, "w": 24, "h": 6}}
+		]
+	}`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if s.Title != "Checkout" || strings.Join(s.Tags, ",") != "web,slo" || s.Time != (TimeRange{"now-1h", "now"}) {
+		t.Fatalf("spec=%+v", s)
+	}
+	var ids []string
+	for _, p := range s.Panels {
+		ids = append(ids, p.ID)
+	}
+	if strings.Join(ids, ",") != "p2,p1,p3" {
+		t.Fatalf("panel ids=%v", ids)
+	}
+}
+
+func TestSpecNormalizeProblems(t *testing.T) {
+	s := Spec{
+		Time: TimeRange{From: "now", To: "now-1h"},
+		Variables: []Variable{
+			{Name: "1x", Type: VarTraceServices},
+			{Name: "env", Type: VarLogsFieldValues, Query: "env:$later"},
+			{Name: "env", Type: "sql", Default: []string{"a", "b"}},
+		},
+		Panels: []Panel{
+			{ID: "a", Type: PanelPromQLChart, Query: json.RawMessage(`{"query":"up{x=\"$nope\"}"}`), GridPos: GridPos{0, 0, 12, 4}},
+			{ID: "a", Type: PanelLogsQLTable, Query: json.RawMessage(`{"query":"error"}`), GridPos: GridPos{6, 2, 12, 4}},
+			{ID: "b", Type: "graph", GridPos: GridPos{20, 10, 6, 4}},
+		},
+	}
+	err := s.Normalize()
+	p, ok := err.(Problems)
+	if !ok {
+		t.Fatalf("err=%v", err)
+	}
+	for _, want := range []string{
+		"title is required",
+		"time.from must be before time.to",
+		`variables[0]: name "1x" is not an identifier`,
+		"variables[1]: field is required",
+		"variables[1]: $later is not defined before it",
+		`variables[2]: duplicate name "env"`,
+		"variables[2]: type must be",
+		"variables[2]: several defaults need multi",
+		"panels[0] (a): unknown variable $nope",
+		"panels[1] (a): duplicate id",
+		"panels[1] (a): overlaps a",
+		"panels[2] (b): type must be",
+		"panels[2] (b): gridPos",
+	} {
+		if !strings.Contains(p.Error(), want) {
+			t.Errorf("missing %q in:\n%s", want, strings.Join(p, "\n"))
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	for in, want := range map[string]time.Time{
+		"now":        now,
+		"now-15m":    now.Add(-15 * time.Minute),
+		"now-2d":     now.Add(-48 * time.Hour),
+		"1699990000": time.Unix(1699990000, 0),
+	} {
+		if got, err := ParseTime(in, now); err != nil || !got.Equal(want) {
+			t.Errorf("ParseTime(%q)=%v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "now-", "now+1h", "yesterday", "-5"} {
+		if _, err := ParseTime(bad, now); err == nil {
+			t.Errorf("ParseTime(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package dashboards
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/access"
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed dashboard.schema.json
+var schemaJSON []byte
+
+const idPrefix = "db-"
+
+// API serves /api/dashboards. Access says who the caller is and what they
+// may do; the owner of a new dashboard is the caller. Changes need If-Match
+// with the current version's ETag.
+type API struct {
+	Store    Store
+	Checker  Checker
+	Resolver *Resolver
+	Access   access.Policy
+
+	// mu makes the If-Match check and the write one step. It only covers
+	// this process: several backends writing the same dashboard can still
+	// both win.
+	mu sync.Mutex
+}
+
+// Summary is a List entry.
+type Summary struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Tags      []string  `json:"tags"`
+	Owner     string    `json:"owner"`
+	Shared    bool      `json:"shared"`
+	Panels    int       `json:"panels"`
+	Version   uint64    `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func etag(version uint64) string { return fmt.Sprintf(`"%d"`, version) }
+
+// ifMatch reports whether the If-Match header names version (or is "*").
+func ifMatch(header string, version uint64) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+func storeError(c *gin.Context, err error) {
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
+
+func (a *API) caller(c *gin.Context) access.Caller { return a.Access.Caller(c) }
+
+// load fetches :id and checks the caller may see it; unreadable dashboards
+// look missing.
+func (a *API) load(c *gin.Context) (Dashboard, access.Caller, bool) {
+	who := a.caller(c)
+	d, err := a.Store.Get(c.Param("id"))
+	if err == nil && !who.CanRead(d.Owner, d.Shared) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		storeError(c, err)
+		return d, who, false
+	}
+	return d, who, true
+}
+
+// bindSpec reads, normalizes and checks the body; it answers the request
+// itself when the spec is unusable.
+func (a *API) bindSpec(c *gin.Context) (Spec, bool) {
+	var s Spec
+	if err := c.BindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return s, false
+	}
+	if err := s.Normalize(); err != nil {
+		var p Problems
+		errors.As(err, &p)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dashboard", "problems": p})
+		return s, false
+	}
+	if failed := a.Checker.Check(s); len(failed) > 0 {
+		code := http.StatusUnprocessableEntity
+		for _, f := range failed {
+			if f.Unavailable {
+				code = http.StatusBadGateway
+			}
+		}
+		c.JSON(code, gin.H{"error": "panel queries failed", "panels": failed})
+		return s, false
+	}
+	return s, true
+}
+
+func (a *API) writeDashboard(c *gin.Context, code int, d Dashboard) {
+	c.Header("ETag", etag(d.Version))
+	c.JSON(code, d)
+}
+
+// Schema serves GET /api/dashboards/schema: the JSON Schema of a dashboard
+// body.
+func (a *API) Schema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", schemaJSON)
+}
+
+// Validate serves POST /api/dashboards/validate: the save-time checks,
+// without saving. It answers with the normalized spec.
+func (a *API) Validate(c *gin.Context) {
+	if s, ok := a.bindSpec(c); ok {
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+// List serves GET /api/dashboards?tag=&owner=.
+func (a *API) List(c *gin.Context) {
+	who := a.caller(c)
+	ds, err := a.Store.List(Filter{Tag: c.Query("tag"), Owner: c.Query("owner"), VisibleTo: who.User, All: who.Role >= access.Admin})
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	out := make([]Summary, 0, len(ds))
+	for _, d := range ds {
+		out = append(out, Summary{ID: d.ID, Title: d.Title, Tags: d.Tags, Owner: d.Owner, Shared: d.Shared,
+			Panels: len(d.Panels), Version: d.Version, UpdatedAt: d.UpdatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"items": out})
+}
+
+// Get serves GET /api/dashboards/{id} with the version as ETag.
+func (a *API) Get(c *gin.Context) {
+	if d, _, ok := a.load(c); ok {
+		a.writeDashboard(c, http.StatusOK, d)
+	}
+}
+
+// Versions serves GET /api/dashboards/{id}/versions, newest first.
+func (a *API) Versions(c *gin.Context) {
+	d, _, ok := a.load(c)
+	if !ok {
+		return
+	}
+	vs, err := a.Store.Versions(d.ID)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": vs})
+}
+
+// Version serves GET /api/dashboards/{id}/versions/{version}.
+func (a *API) Version(c *gin.Context) {
+	d, _, ok := a.load(c)
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseUint(c.Param("version"), 10, 64)
+	if err != nil || n == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a positive integer"})
+		return
+	}
+	old, err := a.Store.GetVersion(d.ID, n)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	a.writeDashboard(c, http.StatusOK, old)
+}
+
+// Create serves POST /api/dashboards.
+func (a *API) Create(c *gin.Context) {
+	who := a.caller(c)
+	if !who.CanCreate() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "role " + who.Role.String() + " cannot create dashboards"})
+		return
+	}
+	s, ok := a.bindSpec(c)
+	if !ok {
+		return
+	}
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	d := Dashboard{ID: idPrefix + hex.EncodeToString(raw[:]), Owner: who.User, Spec: s,
+		Version: 1, CreatedAt: now, UpdatedAt: now, UpdatedBy: who.User}
+	if err := a.Store.Put(d); err != nil {
+		storeError(c, err)
+		return
+	}
+	c.Header("Location", "/api/dashboards/"+d.ID)
+	a.writeDashboard(c, http.StatusCreated, d)
+}
+
+// precondition checks the caller may change d and that If-Match names its
+// current version, answering the request itself when not.
+func precondition(c *gin.Context, d Dashboard, who access.Caller) bool {
+	if !who.CanWrite(d.Owner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner or an admin can change this dashboard"})
+		return false
+	}
+	h := c.GetHeader("If-Match")
+	if h == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match with the dashboard's ETag is required"})
+		return false
+	}
+	if !ifMatch(h, d.Version) {
+		c.Header("ETag", etag(d.Version))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "dashboard changed since it was read", "version": d.Version})
+		return false
+	}
+	return true
+}
+
+// Update serves PUT /api/dashboards/{id}, saving the body as a new version.
+func (a *API) Update(c *gin.Context) {
+	s, ok := a.bindSpec(c)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d, who, ok := a.load(c)
+	if !ok || !precondition(c, d, who) {
+		return
+	}
+	d.Spec = s
+	d.Version++
+	d.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	d.UpdatedBy = who.User
+	if err := a.Store.Put(d); err != nil {
+		storeError(c, err)
+		return
+	}
+	a.writeDashboard(c, http.StatusOK, d)
+}
+
+// Delete serves DELETE /api/dashboards/{id}.
+func (a *API) Delete(c *gin.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d, who, ok := a.load(c)
+	if !ok || !precondition(c, d, who) {
+		return
+	}
+	if err := a.Store.Delete(d, who.User); err != nil {
+		storeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ResolvedPanel is a panel's query with the variables filled in, ready for
+// the panel type's endpoint.
+type ResolvedPanel struct {
+	ID    string          `json:"id"`
+	Type  string          `json:"type"`
+	Query json.RawMessage `json:"query,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// resolve answers with the variables' options and selections and the
+// interpolated panel queries; s must be normalized.
+func (a *API) resolve(c *gin.Context, s Spec, current Values) {
+	now := time.Now()
+	from, _ := ParseTime(s.Time.From, now)
+	to, _ := ParseTime(s.Time.To, now)
+	vars, vals := a.Resolver.Resolve(s.Variables, from, to, current)
+	panels := make([]ResolvedPanel, 0, len(s.Panels))
+	for _, p := range s.Panels {
+		rp := ResolvedPanel{ID: p.ID, Type: p.Type}
+		if q, err := p.Interpolate(vals); err != nil {
+			rp.Error = err.Error()
+		} else {
+			rp.Query = q
+		}
+		panels = append(panels, rp)
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from.Unix(), "to": to.Unix(), "variables": vars, "panels": panels})
+}
+
+// Resolve serves POST /api/dashboards/resolve for dashboards being edited:
+// {time, variables, panels, values}, where values holds the current
+// selections by variable name.
+func (a *API) Resolve(c *gin.Context) {
+	var req struct {
+		Time      TimeRange  `json:"time"`
+		Variables []Variable `json:"variables"`
+		Panels    []Panel    `json:"panels"`
+		Values    Values     `json:"values"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	s := Spec{Time: req.Time, Variables: req.Variables, Panels: req.Panels}
+	var p Problems
+	s.normalizeTime(&p)
+	s.normalizePanels(&p, s.normalizeVariables(&p))
+	if len(p) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dashboard", "problems": p})
+		return
+	}
+	a.resolve(c, s, req.Values)
+}
+
+// ResolveSaved serves GET /api/dashboards/{id}/resolve?from=&to=&var-<name>=
+// for a stored dashboard; from and to override its time range and var-
+// parameters (repeatable) select variable values.
+func (a *API) ResolveSaved(c *gin.Context) {
+	d, _, ok := a.load(c)
+	if !ok {
+		return
+	}
+	s := d.Spec
+	s.Time = TimeRange{From: c.DefaultQuery("from", s.Time.From), To: c.DefaultQuery("to", s.Time.To)}
+	var p Problems
+	if s.normalizeTime(&p); len(p) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": p.Error()})
+		return
+	}
+	current := Values{}
+	for k, vs := range c.Request.URL.Query() {
+		if name, ok := strings.CutPrefix(k, "var-"); ok {
+			current[name] = vs
+		}
+	}
+	a.resolve(c, s, current)
+}
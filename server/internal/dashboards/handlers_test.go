@@ -0,0 +1,212 @@
+package dashboards
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/access"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore is a Store keeping every version, with the same visibility rules
+// as CHStore.
+type memStore struct {
+	mu   sync.Mutex
+	rows map[string][]Dashboard // by ID, oldest first; a nil Spec.Panels marks a tombstone
+}
+
+func newMemStore() *memStore { return &memStore{rows: map[string][]Dashboard{}} }
+
+func (m *memStore) latest(id string) (Dashboard, bool) {
+	vs := m.rows[id]
+	if len(vs) == 0 || vs[len(vs)-1].Panels == nil {
+		return Dashboard{}, false
+	}
+	return vs[len(vs)-1], true
+}
+
+func (m *memStore) Get(id string) (Dashboard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.latest(id); ok {
+		return d, nil
+	}
+	return Dashboard{}, ErrNotFound
+}
+
+func (m *memStore) GetVersion(id string, version uint64) (Dashboard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.rows[id] {
+		if d.Version == version && d.Panels != nil {
+			return d, nil
+		}
+	}
+	return Dashboard{}, ErrNotFound
+}
+
+func (m *memStore) Versions(id string) ([]VersionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []VersionInfo{}
+	vs := m.rows[id]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if d := vs[i]; d.Panels != nil {
+			out = append(out, VersionInfo{Version: d.Version, UpdatedAt: d.UpdatedAt, UpdatedBy: d.UpdatedBy, Title: d.Title})
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) List(f Filter) ([]Dashboard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Dashboard{}
+	for id := range m.rows {
+		d, ok := m.latest(id)
+		if ok && (f.Tag == "" || slices.Contains(d.Tags, f.Tag)) && (f.Owner == "" || d.Owner == f.Owner) &&
+			(f.All || d.Owner == f.VisibleTo || d.Shared) {
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (m *memStore) Put(d Dashboard) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rows[d.ID] = append(m.rows[d.ID], d)
+	return nil
+}
+
+func (m *memStore) Delete(d Dashboard, by string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d.Version++
+	d.Panels = nil
+	m.rows[d.ID] = append(m.rows[d.ID], d)
+	return nil
+}
+
+func newTestRouter(api *API) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/dashboards", api.List)
+	r.POST("/api/dashboards", api.Create)
+	r.GET("/api/dashboards/schema", api.Schema)
+	r.POST("/api/dashboards/validate", api.Validate)
+	r.GET("/api/dashboards/:id", api.Get)
+	r.PUT("/api/dashboards/:id", api.Update)
+	r.DELETE("/api/dashboards/:id", api.Delete)
+	r.GET("/api/dashboards/:id/versions", api.Versions)
+	r.GET("/api/dashboards/:id/versions/:version", api.Version)
+	return r
+}
+
+func do(r *gin.Engine, method, path, user, ifMatch, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.Header.Set(access.UserHeader, user)
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+const checkoutSpec = `{"title":"Checkout","tags":["web"],"panels":[
+	{"type":"promql_chart","query":{"query":"up"},"gridPos":{"x":0,"y":0,"w":12,"h":8}},
+	{"type":"trace_list","query":{"filters":{"service":["web"]}},"gridPos":{"x":12,"y":0,"w":12,"h":8}}]}`
+
+func TestAPI_VersionsAndIfMatch(t *testing.T) {
+	src, _ := fakeBackends(t)
+	r := newTestRouter(&API{Store: newMemStore(), Checker: Checker{Src: src}, Access: access.Policy{Role: access.Editor, TrustHeader: true}})
+
+	w := do(r, "POST", "/api/dashboards", "ana", "", checkoutSpec)
+	if w.Code != 201 || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("create status=%d etag=%s body=%s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	var d Dashboard
+	_ = json.Unmarshal(w.Body.Bytes(), &d)
+	if !strings.HasPrefix(d.ID, idPrefix) || d.Owner != "ana" || d.Panels[0].ID != "p1" || d.Panels[1].ID != "p2" {
+		t.Fatalf("created=%+v", d)
+	}
+	path := "/api/dashboards/" + d.ID
+
+	renamed := strings.Replace(checkoutSpec, "Checkout", "Checkout v2", 1)
+	if w := do(r, "PUT", path, "ana", "", renamed); w.Code != 428 {
+		t.Fatalf("no If-Match status=%d", w.Code)
+	}
+	if w := do(r, "PUT", path, "ana", `"1"`, renamed); w.Code != 200 || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("update status=%d body=%s", w.Code, w.Body.String())
+	}
+	// A second writer still holding version 1 loses.
+	if w := do(r, "PUT", path, "ana", `"1"`, checkoutSpec); w.Code != 412 || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("stale update status=%d etag=%s", w.Code, w.Header().Get("ETag"))
+	}
+	if w := do(r, "PUT", path, "bo", "*", checkoutSpec); w.Code != 404 {
+		t.Fatalf("bo update status=%d", w.Code)
+	}
+
+	var vs struct{ Items []VersionInfo }
+	_ = json.Unmarshal(do(r, "GET", path+"/versions", "ana", "", "").Body.Bytes(), &vs)
+	if len(vs.Items) != 2 || vs.Items[0].Version != 2 || vs.Items[0].Title != "Checkout v2" || vs.Items[1].Title != "Checkout" {
+		t.Fatalf("versions=%+v", vs.Items)
+	}
+	if w := do(r, "GET", path+"/versions/1", "ana", "", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"title":"Checkout"`) {
+		t.Fatalf("version 1 status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	if w := do(r, "DELETE", path, "ana", `"1"`, ""); w.Code != 412 {
+		t.Fatalf("stale delete status=%d", w.Code)
+	}
+	if w := do(r, "DELETE", path, "ana", `W/"2"`, ""); w.Code != 204 {
+		t.Fatalf("delete status=%d", w.Code)
+	}
+	if w := do(r, "GET", path, "ana", "", ""); w.Code != 404 {
+		t.Fatalf("deleted get status=%d", w.Code)
+	}
+}
+
+func TestAPI_Validation(t *testing.T) {
+	src, _ := fakeBackends(t)
+	r := newTestRouter(&API{Store: newMemStore(), Checker: Checker{Src: src}, Access: access.Policy{Role: access.Editor, TrustHeader: true}})
+
+	w := do(r, "POST", "/api/dashboards", "ana", "", `{"title":"","panels":[{"type":"graph","gridPos":{"w":1,"h":1}}]}`)
+	var bad struct{ Problems []string }
+	_ = json.Unmarshal(w.Body.Bytes(), &bad)
+	if w.Code != 400 || len(bad.Problems) != 2 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	broken := strings.Replace(checkoutSpec, `"up"`, `"sum(("`, 1)
+	if w := do(r, "POST", "/api/dashboards", "ana", "", broken); w.Code != 422 || !strings.Contains(w.Body.String(), `"panelId":"p1"`) {
+		t.Fatalf("broken query status=%d body=%s", w.Code, w.Body.String())
+	}
+	if w := do(r, "POST", "/api/dashboards", "ana", "", strings.Replace(checkoutSpec, `"up"`, `"down"`, 1)); w.Code != 502 {
+		t.Fatalf("backend down status=%d", w.Code)
+	}
+	if w := do(r, "POST", "/api/dashboards/validate", "ana", "", checkoutSpec); w.Code != 200 || !strings.Contains(w.Body.String(), `"id":"p2"`) {
+		t.Fatalf("validate status=%d body=%s", w.Code, w.Body.String())
+	}
+	if w := do(r, "GET", "/api/dashboards/schema", "", "", ""); w.Code != 200 || !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("schema status=%d", w.Code)
+	}
+}
+
+func TestAPI_ViewerCannotCreate(t *testing.T) {
+	r := newTestRouter(&API{Store: newMemStore(), Access: access.Policy{Role: access.Viewer, TrustHeader: true}})
+	if w := do(r, "POST", "/api/dashboards", "ana", "", checkoutSpec); w.Code != 403 {
+		t.Fatalf("status=%d", w.Code)
+	}
+}
@@ -0,0 +1,267 @@
+package dashboards
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/example/otel-stack-demo/internal/saved"
+)
+
+// Values holds the selected values of each variable, by name.
+type Values map[string][]string
+
+var (
+	// refAt matches a variable reference at the start of a string.
+	refAt = regexp.MustCompile(`^(?:` + VarRefRe.String() + `)`)
+	// bareValueRe is what PromQL accepts outside quotes: label names,
+	// numbers and durations (by ($label), [$window]).
+	bareValueRe = regexp.MustCompile(`^[A-Za-z0-9_:.]+$`)
+)
+
+// refContext says where a reference sits in a query.
+type refContext struct {
+	// quote is the quote character of the string around the reference, or
+	// 0 outside strings.
+	quote byte
+	// regex is set after =~, !~ or LogsQL's ~.
+	regex bool
+}
+
+// substitute replaces every $name and ${name} in q with value(values, ctx).
+// It follows quoted strings (with backslash escapes, except in `raw`
+// strings) so value knows how to escape.
+func substitute(q string, vals Values, value func(vs []string, ctx refContext) (string, error)) (string, error) {
+	var (
+		b   strings.Builder
+		ctx refContext
+	)
+	afterTilde := func(i int) bool { return strings.HasSuffix(strings.TrimRight(q[:i], " \t"), "~") }
+	for i := 0; i < len(q); {
+		ch := q[i]
+		switch {
+		case ctx.quote != 0 && ctx.quote != '`' && ch == '\\' && i+1 < len(q):
+			b.WriteString(q[i : i+2])
+			i += 2
+			continue
+		case ctx.quote != 0 && ch == ctx.quote:
+			ctx = refContext{}
+		case ctx.quote == 0 && (ch == '"' || ch == '\'' || ch == '`'):
+			ctx = refContext{quote: ch, regex: afterTilde(i)}
+		case ch == '$':
+			m := refAt.FindStringSubmatch(q[i:])
+			if m == nil {
+				break
+			}
+			name := m[1] + m[2]
+			vs := vals[name]
+			if len(vs) == 0 {
+				return "", fmt.Errorf("$%s has no value", name)
+			}
+			at := ctx
+			if at.quote == 0 {
+				at.regex = afterTilde(i)
+			}
+			s, err := value(vs, at)
+			if err != nil {
+				return "", fmt.Errorf("$%s: %w", name, err)
+			}
+			b.WriteString(s)
+			i += len(m[0])
+			continue
+		}
+		b.WriteByte(ch)
+		i++
+	}
+	return b.String(), nil
+}
+
+// escapeString escapes s for a string quoted with quote. PromQL and LogsQL
+// both read Go-style escapes; raw strings have none, so a backquote cannot
+// go in one.
+func escapeString(s string, quote byte) (string, error) {
+	if quote == '`' {
+		if strings.ContainsRune(s, '`') {
+			return "", fmt.Errorf("value %q cannot go in a `raw` string", s)
+		}
+		return s, nil
+	}
+	return strings.NewReplacer(`\`, `\\`, string(quote), `\`+string(quote), "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s), nil
+}
+
+// alternation matches any of vs literally.
+func alternation(vs []string) string {
+	qs := make([]string, len(vs))
+	for i, v := range vs {
+		qs[i] = regexp.QuoteMeta(v)
+	}
+	if len(qs) == 1 {
+		return qs[0]
+	}
+	return "(?:" + strings.Join(qs, "|") + ")"
+}
+
+// quotedRegex is the value for a reference in a regex, quoted or not.
+func quotedRegex(vs []string, ctx refContext) (string, error) {
+	if ctx.quote != 0 {
+		return escapeString(alternation(vs), ctx.quote)
+	}
+	s, err := escapeString(alternation(vs), '"')
+	return `"` + s + `"`, err
+}
+
+// InterpolatePromQL substitutes vals into a PromQL query. In a quoted
+// regex matcher (=~, !~) values are regex-escaped and several become an
+// alternation; in other strings they are escaped for the string, and
+// outside strings only label names and numbers are allowed.
+func InterpolatePromQL(q string, vals Values) (string, error) {
+	return substitute(q, vals, func(vs []string, ctx refContext) (string, error) {
+		switch {
+		case ctx.regex:
+			return quotedRegex(vs, ctx)
+		case len(vs) > 1:
+			return "", errors.New("several values need a regex matcher (=~ or !~)")
+		case ctx.quote != 0:
+			return escapeString(vs[0], ctx.quote)
+		case !bareValueRe.MatchString(vs[0]):
+			return "", fmt.Errorf("value %q can only be used inside quotes", vs[0])
+		}
+		return vs[0], nil
+	})
+}
+
+// InterpolateLogsQL substitutes vals into a LogsQL query. Outside quotes a
+// value becomes a quoted phrase ("a") and several become in("a","b"), so
+// field:$x works for both; after ~ values are regex-escaped. Inside quotes
+// they are escaped for the string.
+func InterpolateLogsQL(q string, vals Values) (string, error) {
+	return substitute(q, vals, func(vs []string, ctx refContext) (string, error) {
+		switch {
+		case ctx.regex:
+			return quotedRegex(vs, ctx)
+		case ctx.quote != 0 && len(vs) > 1:
+			return "", errors.New("several values need the variable outside quotes")
+		case ctx.quote != 0:
+			return escapeString(vs[0], ctx.quote)
+		}
+		qs := make([]string, len(vs))
+		for i, v := range vs {
+			s, _ := escapeString(v, '"')
+			qs[i] = `"` + s + `"`
+		}
+		if len(qs) == 1 {
+			return qs[0], nil
+		}
+		return "in(" + strings.Join(qs, ",") + ")", nil
+	})
+}
+
+// InterpolateTraces substitutes vals into a trace list request. A string
+// that is only a reference expands to every value inside an array
+// ("service": ["$service"]); elsewhere a reference takes a single value.
+// Values stay JSON strings, so the encoder does the escaping, and the
+// result is checked like a saved trace query.
+func InterpolateTraces(raw json.RawMessage, vals Values) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	v, err := expandJSON(v, vals)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return saved.NormalizeQuery(saved.KindTraces, b)
+}
+
+func expandJSON(v any, vals Values) (any, error) {
+	switch t := v.(type) {
+	case string:
+		var err error
+		out := VarRefRe.ReplaceAllStringFunc(t, func(ref string) string {
+			m := VarRefRe.FindStringSubmatch(ref)
+			name := m[1] + m[2]
+			switch vs := vals[name]; {
+			case len(vs) == 0:
+				err = fmt.Errorf("$%s has no value", name)
+			case len(vs) > 1:
+				err = fmt.Errorf("$%s: several values only fit a list element of its own", name)
+			default:
+				return vs[0]
+			}
+			return ref
+		})
+		return out, err
+	case []any:
+		out := make([]any, 0, len(t))
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				if m := VarRefRe.FindStringSubmatch(s); m != nil && m[0] == s {
+					vs := vals[m[1]+m[2]]
+					if len(vs) == 0 {
+						return nil, fmt.Errorf("$%s has no value", m[1]+m[2])
+					}
+					for _, s := range vs {
+						out = append(out, s)
+					}
+					continue
+				}
+			}
+			e, err := expandJSON(e, vals)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	case map[string]any:
+		for k, e := range t {
+			e, err := expandJSON(e, vals)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = e
+		}
+	}
+	return v, nil
+}
+
+// Interpolate returns the panel's Query with vals substituted, escaped for
+// the panel's query language.
+func (p Panel) Interpolate(vals Values) (json.RawMessage, error) {
+	var interpolate func(string, Values) (string, error)
+	switch p.Kind() {
+	case saved.KindTraces:
+		return InterpolateTraces(p.Query, vals)
+	case saved.KindPromQL:
+		interpolate = InterpolatePromQL
+	case saved.KindLogsQL:
+		interpolate = InterpolateLogsQL
+	default:
+		return nil, fmt.Errorf("unknown panel type %q", p.Type)
+	}
+	var body map[string]json.RawMessage
+	var q string
+	if err := json.Unmarshal(p.Query, &body); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body["query"], &q); err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	q, err := interpolate(q, vals)
+	if err != nil {
+		return nil, err
+	}
+	if body["query"], err = json.Marshal(q); err != nil {
+		return nil, err
+	}
+	return json.Marshal(body)
+}
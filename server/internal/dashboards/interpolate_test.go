@@ -0,0 +1,80 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestInterpolatePromQL(t *testing.T) {
+	vals := Values{"job": {"web"}, "svc": {"api", "a.b"}, "evil": {`x"} or vector(1) #`}, "by": {"instance"}, "nl": {"a\nb"}}
+	for q, want := range map[string]string{
+		`up{job="$job"}`:                `up{job="web"}`,
+		`up{job=~"${svc}-.*"}`:          `up{job=~"(?:api|a\\.b)-.*"}`,
+		`up{job!~'$job'}`:               `up{job!~'web'}`,
+		`up{job="$evil"}`:               `up{job="x\"} or vector(1) #"}`,
+		`up{job=~"$evil"}`:              `up{job=~"x\"\\} or vector\\(1\\) #"}`,
+		`up{job="$nl"}`:                 `up{job="a\nb"}`,
+		`sum by ($by) (up{job="$job"})`: `sum by (instance) (up{job="web"})`,
+		`up{job="a\"$job"}`:             `up{job="a\"web"}`,
+		"up{job=`$job`}":                "up{job=`web`}",
+		`count(up{x="$"}) > 0`:          `count(up{x="$"}) > 0`,
+	} {
+		if got, err := InterpolatePromQL(q, vals); err != nil || got != want {
+			t.Errorf("%s\n got %s, %v\nwant %s", q, got, err, want)
+		}
+	}
+	for _, q := range []string{`up{job="$svc"}`, `sum by ($evil) (up)`, `up{job="$missing"}`, "up{job=`$evil`}"} {
+		if got, err := InterpolatePromQL(q, Values{"svc": {"a", "b"}, "evil": {"x`y"}}); err == nil {
+			t.Errorf("%s: accepted as %s", q, got)
+		}
+	}
+}
+
+func TestInterpolateLogsQL(t *testing.T) {
+	vals := Values{"svc": {"web"}, "many": {"web", "api"}, "evil": {`x" OR *`}}
+	for q, want := range map[string]string{
+		`service:$svc error`:        `service:"web" error`,
+		`service:$many error`:       `service:in("web","api") error`,
+		`service:$evil`:             `service:"x\" OR *"`,
+		`_stream:{app="$evil"}`:     `_stream:{app="x\" OR *"}`,
+		`_stream:{app=~"$many"}`:    `_stream:{app=~"(?:web|api)"}`,
+		`host:~$evil`:               `host:~"x\" OR \\*"`,
+		`"$svc failed" level:error`: `"web failed" level:error`,
+	} {
+		if got, err := InterpolateLogsQL(q, vals); err != nil || got != want {
+			t.Errorf("%s\n got %s, %v\nwant %s", q, got, err, want)
+		}
+	}
+	if got, err := InterpolateLogsQL(`"$many failed"`, vals); err == nil {
+		t.Errorf("multi value in a phrase accepted as %s", got)
+	}
+}
+
+func TestInterpolateTraces(t *testing.T) {
+	vals := Values{"svc": {"web", `a"b`}, "op": {"GET /$x"}}
+	got, err := InterpolateTraces(json.RawMessage(`{"filters":{"service":["$svc","db"],"operation":["${op}"]}}`), vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Filters struct{ Service, Operation []string }
+	}
+	if err := json.Unmarshal(got, &req); err != nil {
+		t.Fatalf("%s: %v", got, err)
+	}
+	if strings.Join(req.Filters.Service, ",") != `web,a"b,db` || strings.Join(req.Filters.Operation, ",") != "GET /$x" {
+		t.Fatalf("got %s", got)
+	}
+	if _, err := InterpolateTraces(json.RawMessage(`{"sort":"$svc"}`), vals); err == nil {
+		t.Fatal("multi value outside a list accepted")
+	}
+}
+
+func TestPanelInterpolate(t *testing.T) {
+	p := Panel{Type: PanelPromQLChart, Query: json.RawMessage(`{"query":"rate(x{job=\"$job\"}[5m])","step":30}`)}
+	got, err := p.Interpolate(Values{"job": {`we"b`}})
+	if err != nil || string(got) != `{"query":"rate(x{job=\"we\\\"b\"}[5m])","step":30}` {
+		t.Fatalf("got %s, %v", got, err)
+	}
+}
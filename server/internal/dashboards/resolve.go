@@ -0,0 +1,193 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/cache"
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/example/otel-stack-demo/internal/traces"
+)
+
+// maxOptions caps the values listed for one variable.
+const maxOptions = 1000
+
+// ResolvedVariable is a variable's possible values and the ones in use.
+type ResolvedVariable struct {
+	Name     string   `json:"name"`
+	Options  []string `json:"options"`
+	Selected []string `json:"selected"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Resolver lists variable values from the datasources: label values from
+// Prometheus, field values from VictoriaLogs and services from the trace
+// suggestion table.
+type Resolver struct {
+	src *sources.Sources
+	cc  *cache.Cache
+}
+
+// NewResolver caches option lists in the "dashboard_variables" cache.
+func NewResolver(src *sources.Sources) *Resolver {
+	return &Resolver{src: src, cc: cache.New("dashboard_variables", src.CacheSize("dashboard_variables", 512), src.CacheTTL)}
+}
+
+// Resolve evaluates vars in order between from and to. A variable keeps
+// its values from current, else its defaults, else its first option; a
+// later variable's match or query sees the earlier selections. It returns
+// the selections for Panel.Interpolate.
+func (r *Resolver) Resolve(vars []Variable, from, to time.Time, current Values) ([]ResolvedVariable, Values) {
+	vals := Values{}
+	out := make([]ResolvedVariable, 0, len(vars))
+	for _, v := range vars {
+		rv := ResolvedVariable{Name: v.Name, Options: []string{}}
+		opts, err := r.options(v, from, to, vals)
+		if err != nil {
+			rv.Error = err.Error()
+		} else {
+			rv.Options = opts
+		}
+		switch {
+		case len(current[v.Name]) > 0:
+			rv.Selected = current[v.Name]
+		case len(v.Default) > 0:
+			rv.Selected = v.Default
+		case len(rv.Options) > 0:
+			rv.Selected = rv.Options[:1]
+		default:
+			rv.Selected = []string{}
+		}
+		if !v.Multi && len(rv.Selected) > 1 {
+			rv.Selected = rv.Selected[:1]
+		}
+		vals[v.Name] = rv.Selected
+		out = append(out, rv)
+	}
+	return out, vals
+}
+
+func (r *Resolver) options(v Variable, from, to time.Time, vals Values) ([]string, error) {
+	var (
+		key   string
+		fetch func() ([]string, error)
+	)
+	switch v.Type {
+	case VarPromQLLabelValues:
+		match, err := InterpolatePromQL(v.Match, vals)
+		if err != nil {
+			return nil, fmt.Errorf("match: %w", err)
+		}
+		key = fmt.Sprint(v.Type, "|", v.LabelName, "|", match)
+		fetch = func() ([]string, error) { return r.labelValues(v.LabelName, match, from, to) }
+	case VarLogsFieldValues:
+		q, err := InterpolateLogsQL(v.Query, vals)
+		if err != nil {
+			return nil, fmt.Errorf("query: %w", err)
+		}
+		key = fmt.Sprint(v.Type, "|", v.Field, "|", q)
+		fetch = func() ([]string, error) { return r.fieldValues(v.Field, q, from, to) }
+	case VarTraceServices:
+		key = v.Type
+		fetch = func() ([]string, error) {
+			return traces.ServiceNames(r.src, float64(from.Unix()), float64(to.Unix()), maxOptions)
+		}
+	default:
+		return nil, fmt.Errorf("unknown variable type %q", v.Type)
+	}
+	// Ranges ending now move every second; minutes are close enough to share.
+	key += fmt.Sprintf("|%d|%d", from.Unix()/60, to.Unix()/60)
+	e, _, err := r.cc.Do(key, func() (cache.Entry, error) {
+		opts, err := fetch()
+		if err != nil {
+			return cache.Entry{}, err
+		}
+		if opts == nil {
+			opts = []string{}
+		}
+		b, err := json.Marshal(opts)
+		return cache.NewEntry(b), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var opts []string
+	return opts, json.Unmarshal(e.Body, &opts)
+}
+
+func (r *Resolver) get(u string) ([]byte, error) {
+	resp, err := r.src.Client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// labelValues asks Prometheus for the values of label, optionally among
+// the series matching match.
+func (r *Resolver) labelValues(label, match string, from, to time.Time) ([]string, error) {
+	v := url.Values{}
+	v.Set("start", fmt.Sprint(from.Unix()))
+	v.Set("end", fmt.Sprint(to.Unix()))
+	v.Set("limit", fmt.Sprint(maxOptions))
+	if strings.TrimSpace(match) != "" {
+		v.Set("match[]", match)
+	}
+	b, err := r.get(r.src.PromURL + "/api/v1/label/" + url.PathEscape(label) + "/values?" + v.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: %w", err)
+	}
+	var resp struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("prometheus: %w", err)
+	}
+	if len(resp.Data) > maxOptions {
+		resp.Data = resp.Data[:maxOptions]
+	}
+	return resp.Data, nil
+}
+
+// fieldValues asks VictoriaLogs for the most frequent values of field in
+// the logs matching query (all logs when empty).
+func (r *Resolver) fieldValues(field, query string, from, to time.Time) ([]string, error) {
+	if strings.TrimSpace(query) == "" {
+		query = "*"
+	}
+	v := url.Values{}
+	v.Set("query", query)
+	v.Set("field", field)
+	v.Set("start", fmt.Sprint(from.Unix()))
+	v.Set("end", fmt.Sprint(to.Unix()))
+	v.Set("limit", fmt.Sprint(maxOptions))
+	b, err := r.get(r.src.VLogsURL + "/select/logsql/field_values?" + v.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("victorialogs: %w", err)
+	}
+	var resp struct {
+		Values []struct {
+			Value string `json:"value"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("victorialogs: %w", err)
+	}
+	out := make([]string, 0, len(resp.Values))
+	for _, fv := range resp.Values {
+		out = append(out, fv.Value)
+	}
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/access"
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// fakeDatasources serves Prometheus label values, VictoriaLogs field values
+// and ClickHouse service suggestions, recording each request.
+func fakeDatasources(t *testing.T) (*sources.Sources, *[]string) {
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		seen = append(seen, r.URL.Path+"?"+r.URL.RawQuery+" "+string(b))
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/api/v1/label/env/values":
+			io.WriteString(w, `{"status":"success","data":["prod","staging"]}`)
+		case r.URL.Path == "/api/v1/label/job/values":
+			io.WriteString(w, `{"status":"success","data":["api","web"]}`)
+		case r.URL.Path == "/select/logsql/field_values":
+			io.WriteString(w, `{"values":[{"value":"eu-1","hits":10},{"value":"us-1","hits":3}]}`)
+		case strings.Contains(string(b), "ServiceName"):
+			io.WriteString(w, `{"ServiceName":"checkout","c":9}`+"\n"+`{"ServiceName":"cart","c":2}`+"\n")
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return &sources.Sources{PromURL: ts.URL, VLogsURL: ts.URL, CHURL: ts.URL, CHDB: "obs", Client: ts.Client()}, &seen
+}
+
+func TestResolver(t *testing.T) {
+	src, seen := fakeDatasources(t)
+	vars := []Variable{
+		{Name: "env", Type: VarPromQLLabelValues, LabelName: "env"},
+		{Name: "job", Type: VarPromQLLabelValues, LabelName: "job", Match: `up{env="$env"}`, Multi: true},
+		{Name: "region", Type: VarLogsFieldValues, Field: "region", Query: "env:$env"},
+		{Name: "service", Type: VarTraceServices, Default: []string{"cart"}},
+	}
+	got, vals := NewResolver(src).Resolve(vars, time.Unix(1000, 0), time.Unix(4600, 0), Values{"env": {`st"g`}})
+	b, _ := json.Marshal(got)
+	want := `[{"name":"env","options":["prod","staging"],"selected":["st\"g"]},` +
+		`{"name":"job","options":["api","web"],"selected":["api"]},` +
+		`{"name":"region","options":["eu-1","us-1"],"selected":["eu-1"]},` +
+		`{"name":"service","options":["checkout","cart"],"selected":["cart"]}]`
+	if string(b) != want {
+		t.Fatalf("got  %s\nwant %s", b, want)
+	}
+	if len(vals["job"]) != 1 || vals["service"][0] != "cart" {
+		t.Fatalf("vals=%v", vals)
+	}
+	all := strings.Join(*seen, "\n")
+	for _, want := range []string{
+		`/api/v1/label/job/values?end=4600&limit=1000&match%5B%5D=up%7Benv%3D%22st%5C%22g%22%7D&start=1000`,
+		`/select/logsql/field_values?end=4600&field=region&limit=1000&query=env%3A%22st%5C%22g%22&start=1000`,
+		`WindowStart BETWEEN toStartOfHour(toDateTime(1000)) AND toDateTime(4600)`,
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("missing %s in:\n%s", want, all)
+		}
+	}
+}
+
+func TestAPI_ResolveSaved(t *testing.T) {
+	src, _ := fakeDatasources(t)
+	st := newMemStore()
+	api := &API{Store: st, Resolver: NewResolver(src), Access: access.Policy{Role: access.Editor, TrustHeader: true}}
+	r := newTestRouter(api)
+	r.GET("/api/dashboards/:id/resolve", api.ResolveSaved)
+	r.POST("/api/dashboards/resolve", api.Resolve)
+
+	spec := Spec{
+		Title:     "Checkout",
+		Variables: []Variable{{Name: "service", Type: VarTraceServices, Multi: true}},
+		Panels: []Panel{
+			{Type: PanelLogsQLTable, Query: json.RawMessage(`{"query":"service:$service"}`), GridPos: GridPos{0, 0, 12, 4}},
+			{Type: PanelTraceList, Query: json.RawMessage(`{"filters":{"service":["$service"]}}`), GridPos: GridPos{12, 0, 12, 4}},
+		},
+	}
+	if err := spec.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	_ = st.Put(Dashboard{ID: "db-1", Owner: "ana", Spec: spec, Version: 1})
+
+	w := do(r, "GET", "/api/dashboards/db-1/resolve?from=now-6h&var-service=web&var-service=api", "ana", "", "")
+	var resp struct {
+		From, To  int64
+		Variables []ResolvedVariable
+		Panels    []ResolvedPanel
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	if resp.To-resp.From != 6*3600 || strings.Join(resp.Variables[0].Selected, ",") != "web,api" {
+		t.Fatalf("resp=%+v", resp)
+	}
+	if q := string(resp.Panels[0].Query); q != `{"query":"service:in(\"web\",\"api\")"}` {
+		t.Fatalf("logs panel=%s", q)
+	}
+	if q := string(resp.Panels[1].Query); !strings.Contains(q, `"service":["web","api"]`) {
+		t.Fatalf("trace panel=%s", q)
+	}
+
+	if w := do(r, "GET", "/api/dashboards/db-1/resolve?from=yesterday", "ana", "", ""); w.Code != 400 {
+		t.Fatalf("bad from status=%d", w.Code)
+	}
+	if w := do(r, "POST", "/api/dashboards/resolve", "ana", "", `{"variables":[{"name":"x","type":"sql"}]}`); w.Code != 400 {
+		t.Fatalf("bad variable status=%d", w.Code)
+	}
+	w = do(r, "POST", "/api/dashboards/resolve", "ana", "", `{"variables":[{"name":"s","type":"trace_services"}],
+		"panels":[{"type":"promql_chart","query":{"query":"up{job=\"$s\"}"},"gridPos":{"x":0,"y":0,"w":4,"h":4}}]}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"selected":["checkout"]`) ||
+		!strings.Contains(w.Body.String(), `"query":{"query":"up{job=\"checkout\"}"}`) {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,241 @@
+package dashboards
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// ErrNotFound is returned for unknown or deleted dashboards and versions.
+var ErrNotFound = errors.New("dashboard not found")
+
+// Filter narrows List. Empty fields match everything.
+type Filter struct {
+	Tag   string
+	Owner string
+	// VisibleTo limits the list to this user's dashboards and shared ones,
+	// unless All is set (admins).
+	VisibleTo string
+	All       bool
+}
+
+// VersionInfo describes one saved version.
+type VersionInfo struct {
+	Version   uint64    `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy"`
+	Title     string    `json:"title"`
+}
+
+// Store persists dashboards. Put appends d as version d.Version; Delete
+// appends a tombstone above d.Version.
+type Store interface {
+	Get(id string) (Dashboard, error)
+	GetVersion(id string, version uint64) (Dashboard, error)
+	Versions(id string) ([]VersionInfo, error)
+	List(f Filter) ([]Dashboard, error)
+	Put(d Dashboard) error
+	Delete(d Dashboard, by string) error
+}
+
+// CHStore keeps dashboards in the dashboards table created by migration
+// 41_dashboards, one row per version.
+type CHStore struct {
+	src *sources.Sources
+}
+
+// NewCHStore stores dashboards in src's ClickHouse database.
+func NewCHStore(src *sources.Sources) *CHStore { return &CHStore{src: src} }
+
+type chRow struct {
+	Id          string   `json:"Id"`
+	Version     uint64   `json:"Version"`
+	Owner       string   `json:"Owner"`
+	Title       string   `json:"Title"`
+	Tags        []string `json:"Tags"`
+	Shared      uint8    `json:"Shared"`
+	Spec        string   `json:"Spec"`
+	CreatedAtMs int64    `json:"CreatedAtMs"`
+	UpdatedAtMs int64    `json:"UpdatedAtMs"`
+	UpdatedBy   string   `json:"UpdatedBy"`
+	Deleted     uint8    `json:"Deleted"`
+}
+
+func toRow(d Dashboard, deleted bool) (chRow, error) {
+	spec, err := specJSON(d.Spec)
+	if err != nil {
+		return chRow{}, err
+	}
+	r := chRow{
+		Id: d.ID, Version: d.Version, Owner: d.Owner, Title: d.Title, Tags: d.Tags, Spec: spec,
+		CreatedAtMs: d.CreatedAt.UnixMilli(), UpdatedAtMs: d.UpdatedAt.UnixMilli(), UpdatedBy: d.UpdatedBy,
+	}
+	if r.Tags == nil {
+		r.Tags = []string{}
+	}
+	if d.Shared {
+		r.Shared = 1
+	}
+	if deleted {
+		r.Deleted = 1
+	}
+	return r, nil
+}
+
+func (r chRow) dashboard() (Dashboard, error) {
+	d := Dashboard{
+		ID: r.Id, Owner: r.Owner, Version: r.Version, UpdatedBy: r.UpdatedBy,
+		CreatedAt: time.UnixMilli(r.CreatedAtMs).UTC(), UpdatedAt: time.UnixMilli(r.UpdatedAtMs).UTC(),
+	}
+	if err := json.Unmarshal([]byte(r.Spec), &d.Spec); err != nil {
+		return d, fmt.Errorf("dashboard %s v%d: %w", r.Id, r.Version, err)
+	}
+	return d, nil
+}
+
+// latestSQL returns each dashboard's newest row, kept when it is live and
+// matches where.
+func (s *CHStore) latestSQL(where []string, limit int) string {
+	lim := ""
+	if limit > 0 {
+		lim = fmt.Sprintf("\nLIMIT %d", limit)
+	}
+	return fmt.Sprintf(`
+SELECT * FROM (
+  SELECT * FROM %s.dashboards
+  ORDER BY Id, Version DESC
+  LIMIT 1 BY Id
+)
+WHERE %s
+ORDER BY UpdatedAtMs DESC%s
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, s.src.CHDB, strings.Join(append([]string{"Deleted = 0"}, where...), " AND "), lim)
+}
+
+func (s *CHStore) rows(sql string) ([]chRow, error) {
+	b, err := s.src.QueryCH(sql)
+	if err != nil {
+		return nil, err
+	}
+	var out []chRow
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var row chRow
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decode dashboards: %w", err)
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+func (s *CHStore) dashboards(sql string) ([]Dashboard, error) {
+	rows, err := s.rows(sql)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Dashboard, 0, len(rows))
+	for _, r := range rows {
+		d, err := r.dashboard()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func (s *CHStore) Get(id string) (Dashboard, error) {
+	ds, err := s.dashboards(s.latestSQL([]string{"Id = " + sources.Quote(id)}, 1))
+	if err != nil {
+		return Dashboard{}, err
+	}
+	if len(ds) == 0 {
+		return Dashboard{}, ErrNotFound
+	}
+	return ds[0], nil
+}
+
+func (s *CHStore) GetVersion(id string, version uint64) (Dashboard, error) {
+	ds, err := s.dashboards(fmt.Sprintf(`
+SELECT * FROM %s.dashboards
+WHERE Id = %s AND Version = %d AND Deleted = 0
+LIMIT 1
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, s.src.CHDB, sources.Quote(id), version))
+	if err != nil {
+		return Dashboard{}, err
+	}
+	if len(ds) == 0 {
+		return Dashboard{}, ErrNotFound
+	}
+	return ds[0], nil
+}
+
+func (s *CHStore) Versions(id string) ([]VersionInfo, error) {
+	rows, err := s.rows(fmt.Sprintf(`
+SELECT Version, UpdatedAtMs, UpdatedBy, Title, Deleted FROM %s.dashboards
+WHERE Id = %s
+ORDER BY Version DESC
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, s.src.CHDB, sources.Quote(id)))
+	if err != nil {
+		return nil, err
+	}
+	out := []VersionInfo{}
+	for _, r := range rows {
+		if r.Deleted == 1 {
+			continue
+		}
+		out = append(out, VersionInfo{Version: r.Version, UpdatedAt: time.UnixMilli(r.UpdatedAtMs).UTC(), UpdatedBy: r.UpdatedBy, Title: r.Title})
+	}
+	return out, nil
+}
+
+func (s *CHStore) List(f Filter) ([]Dashboard, error) {
+	var where []string
+	if f.Tag != "" {
+		where = append(where, "has(Tags, "+sources.Quote(f.Tag)+")")
+	}
+	if f.Owner != "" {
+		where = append(where, "Owner = "+sources.Quote(f.Owner))
+	}
+	if !f.All {
+		where = append(where, fmt.Sprintf("(Owner = %s OR Shared = 1)", sources.Quote(f.VisibleTo)))
+	}
+	return s.dashboards(s.latestSQL(where, 0))
+}
+
+func (s *CHStore) insert(d Dashboard, deleted bool) error {
+	r, err := toRow(d, deleted)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.src.QueryCH(fmt.Sprintf("INSERT INTO %s.dashboards FORMAT JSONEachRow\n%s\n", s.src.CHDB, b))
+	return err
+}
+
+func (s *CHStore) Put(d Dashboard) error { return s.insert(d, false) }
+
+func (s *CHStore) Delete(d Dashboard, by string) error {
+	d.Version++
+	d.UpdatedAt = time.Now()
+	d.UpdatedBy = by
+	return s.insert(d, true)
+}
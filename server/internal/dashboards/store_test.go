@@ -0,0 +1,62 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func TestCHStore(t *testing.T) {
+	var sqls []string
+	row := `{"Id":"db-1","Version":3,"Owner":"ana","Title":"Checkout","Tags":["web"],"Shared":1,` +
+		`"Spec":"{\"title\":\"Checkout\",\"tags\":[\"web\"],\"shared\":true,\"panels\":[]}",` +
+		`"CreatedAtMs":1704103200000,"UpdatedAtMs":1704103260000,"UpdatedBy":"bo","Deleted":0}` + "\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sqls = append(sqls, string(b))
+		if strings.HasPrefix(strings.TrimSpace(string(b)), "SELECT") {
+			io.WriteString(w, row)
+		}
+	}))
+	defer ts.Close()
+	st := NewCHStore(&sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()})
+
+	d, err := st.Get("db-1")
+	if err != nil || d.Title != "Checkout" || !d.Shared || d.Version != 3 || d.UpdatedBy != "bo" {
+		t.Fatalf("get=%+v err=%v", d, err)
+	}
+	if s := sqls[0]; !strings.Contains(s, "LIMIT 1 BY Id") || !strings.Contains(s, "WHERE Deleted = 0 AND Id = 'db-1'") {
+		t.Fatalf("get sql:\n%s", s)
+	}
+
+	if _, err := st.GetVersion("db-1", 2); err != nil {
+		t.Fatalf("get version: %v", err)
+	}
+	if s := sqls[1]; !strings.Contains(s, "WHERE Id = 'db-1' AND Version = 2 AND Deleted = 0") {
+		t.Fatalf("get version sql:\n%s", s)
+	}
+
+	if _, err := st.List(Filter{Tag: "it's", VisibleTo: "ana"}); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if s := sqls[2]; !strings.Contains(s, `has(Tags, 'it\'s')`) || !strings.Contains(s, "(Owner = 'ana' OR Shared = 1)") {
+		t.Fatalf("list sql:\n%s", s)
+	}
+
+	if err := st.Delete(d, "cy"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	body, ok := strings.CutPrefix(sqls[3], "INSERT INTO obs.dashboards FORMAT JSONEachRow\n")
+	if !ok {
+		t.Fatalf("insert:\n%s", sqls[3])
+	}
+	var tomb chRow
+	if err := json.Unmarshal([]byte(body), &tomb); err != nil || tomb.Deleted != 1 || tomb.Version != 4 || tomb.UpdatedBy != "cy" {
+		t.Fatalf("tombstone=%+v err=%v", tomb, err)
+	}
+}
@@ -0,0 +1,459 @@
+// Package migrate applies the versioned ClickHouse DDL in sql/ over the HTTP
+// interface and records what has been applied in schema_migrations.
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Migration is one sql/NN_name.sql file rendered for a database and schema.
+type Migration struct {
+	Version    int
+	Name       string
+	Checksum   string
+	Statements []string
+}
+
+// Options control a Run.
+type Options struct {
+	DryRun   bool // print pending statements without executing anything
+	Backfill bool // after creating an MV and its table, copy older otel_traces rows through it
+	Out      io.Writer
+}
+
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Load renders every embedded migration for db, ordered by version. Templates
+// see {{.Database}}, the schema's {{.Tables.X}} and {{.Columns.X}} names, and
+// the expression helpers durationMs, startTime and attrMap from ts.
+func Load(db string, ts sources.TraceSchema) ([]Migration, error) {
+	if !identRe.MatchString(db) {
+		return nil, fmt.Errorf("invalid database name %q", db)
+	}
+	if err := ts.Validate(); err != nil {
+		return nil, err
+	}
+	ts = ts.WithDefaults()
+	funcs := template.FuncMap{
+		"durationMs": ts.DurationMs,
+		"startTime":  ts.StartTime,
+		"attrMap":    func(col string) string { return ts.AttrMap("", col) },
+	}
+	data := struct {
+		Database string
+		sources.TraceSchema
+	}{db, ts}
+	paths, err := fs.Glob(files, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var out []Migration
+	for _, p := range paths {
+		base := strings.TrimSuffix(strings.TrimPrefix(p, "sql/"), ".sql")
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s: want NN_name.sql", p)
+		}
+		raw, err := files.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		tpl, err := template.New(base).Funcs(funcs).Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		// Checksum the rendered SQL so a changed database or unit shows up too.
+		sum := sha256.Sum256(buf.Bytes())
+		out = append(out, Migration{
+			Version:    version,
+			Name:       name,
+			Checksum:   hex.EncodeToString(sum[:]),
+			Statements: splitStatements(buf.String()),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i := 1; i < len(out); i++ {
+		if out[i].Version == out[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", out[i].Version)
+		}
+	}
+	return out, nil
+}
+
+// Run applies every migration not yet recorded in schema_migrations.
+func Run(src *sources.Sources, opts Options) error {
+	if opts.Out == nil {
+		opts.Out = io.Discard
+	}
+	migs, err := Load(src.CHDB, src.Traces)
+	if err != nil {
+		return err
+	}
+	ts := src.Traces.WithDefaults()
+	created := map[string]bool{}
+	applied, err := appliedVersions(src, opts.DryRun)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range migs {
+		if sum, ok := applied[m.Version]; ok {
+			if sum != m.Checksum {
+				fmt.Fprintf(opts.Out, "warning: %02d_%s changed since it was applied\n", m.Version, m.Name)
+			}
+			continue
+		}
+		pending++
+		fmt.Fprintf(opts.Out, "-- %02d_%s\n", m.Version, m.Name)
+		for _, stmt := range m.Statements {
+			// With -backfill, note which tables and views this run creates:
+			// only those start empty. schema_migrations may be empty on a
+			// cluster whose DDL was applied by hand.
+			name, isCreate := createdName(stmt)
+			existed := false
+			if isCreate && opts.Backfill {
+				if existed, err = tableExists(src, name); err != nil {
+					return fmt.Errorf("%02d_%s: %w", m.Version, m.Name, err)
+				}
+			}
+			q, isMV := backfillFor(stmt)
+			// Spans that start before cutoff are copied by the backfill, the
+			// rest reach the view as they are inserted.
+			cutoff := time.Now().UTC()
+			if err := exec(src, opts, stmt); err != nil {
+				return fmt.Errorf("%02d_%s: %w", m.Version, m.Name, err)
+			}
+			// IF NOT EXISTS keeps an older table as it is; do not record
+			// the migration as applied unless the table matches it.
+			if !opts.DryRun {
+				name, missing, err := missingColumns(src, stmt)
+				if err != nil {
+					return fmt.Errorf("%02d_%s: %w", m.Version, m.Name, err)
+				}
+				if len(missing) > 0 {
+					return fmt.Errorf("%02d_%s: %s already exists without %s", m.Version, m.Name, name, strings.Join(missing, ", "))
+				}
+			}
+			if isCreate && !existed {
+				created[name] = true
+			}
+			if !isMV || !opts.Backfill {
+				continue
+			}
+			if target := mvTarget(stmt); !created[name] || !created[target] {
+				fmt.Fprintf(opts.Out, "-- %s and %s already existed; not backfilling\n", name, target)
+				continue
+			}
+			if err := exec(src, opts, boundBackfill(q, src.CHDB, ts, cutoff)); err != nil {
+				return fmt.Errorf("%02d_%s backfill: %w", m.Version, m.Name, err)
+			}
+		}
+		record := fmt.Sprintf("INSERT INTO %s.schema_migrations (Version, Name, Checksum) VALUES (%d, '%s', '%s')",
+			src.CHDB, m.Version, m.Name, m.Checksum)
+		if err := exec(src, opts, record); err != nil {
+			return fmt.Errorf("%02d_%s record: %w", m.Version, m.Name, err)
+		}
+	}
+	if pending == 0 {
+		fmt.Fprintln(opts.Out, "schema is up to date")
+	}
+	return nil
+}
+
+func exec(src *sources.Sources, opts Options, stmt string) error {
+	if opts.DryRun {
+		fmt.Fprintf(opts.Out, "%s;\n\n", stmt)
+		return nil
+	}
+	_, err := src.QueryCH(stmt)
+	return err
+}
+
+// appliedVersions returns version -> checksum from schema_migrations,
+// creating the table first unless this is a dry run.
+func appliedVersions(src *sources.Sources, dryRun bool) (map[int]string, error) {
+	out := map[int]string{}
+	if dryRun {
+		b, err := src.QueryCH(fmt.Sprintf("EXISTS TABLE %s.schema_migrations", src.CHDB))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(b)) != "1" {
+			return out, nil
+		}
+	} else {
+		_, err := src.QueryCH(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.schema_migrations
+(
+  Version   UInt32,
+  Name      String,
+  Checksum  String,
+  AppliedAt DateTime DEFAULT now()
+)
+ENGINE = MergeTree
+ORDER BY Version`, src.CHDB))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := src.QueryCH(fmt.Sprintf("SELECT Version, Checksum FROM %s.schema_migrations FORMAT JSONEachRow", src.CHDB))
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var row struct {
+			Version  int    `json:"Version"`
+			Checksum string `json:"Checksum"`
+		}
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decode schema_migrations: %w", err)
+		}
+		out[row.Version] = row.Checksum
+	}
+	return out, nil
+}
+
+// Stale lists tables that migrations create but that already exist without
+// some of the columns the migration declares, such as suggest tables created
+// before ServiceName was added. CREATE TABLE IF NOT EXISTS leaves those as
+// they are, and queries against the missing columns then fail.
+func Stale(src *sources.Sources) ([]string, error) {
+	migs, err := Load(src.CHDB, src.Traces)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, m := range migs {
+		for _, stmt := range m.Statements {
+			name, missing, err := missingColumns(src, stmt)
+			if err != nil {
+				return nil, fmt.Errorf("%02d_%s: %w", m.Version, m.Name, err)
+			}
+			if len(missing) > 0 {
+				out = append(out, fmt.Sprintf("%s lacks %s (%02d_%s)", name, strings.Join(missing, ", "), m.Version, m.Name))
+			}
+		}
+	}
+	return out, nil
+}
+
+// missingColumns returns the columns a CREATE TABLE statement declares that
+// its table does not have. A table that does not exist has none missing.
+func missingColumns(src *sources.Sources, stmt string) (string, []string, error) {
+	m := tableRe.FindStringSubmatch(stripComments(stmt))
+	if m == nil {
+		return "", nil, nil
+	}
+	have, err := tableColumns(src, m[1])
+	if err != nil || len(have) == 0 {
+		return m[1], nil, err
+	}
+	var missing []string
+	for _, c := range declaredColumns(stmt) {
+		if !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	return m[1], missing, nil
+}
+
+// tableColumns returns the column names of the table db.name from
+// system.columns; it is empty when the table does not exist.
+func tableColumns(src *sources.Sources, name string) (map[string]bool, error) {
+	db, table, ok := strings.Cut(name, ".")
+	if !ok {
+		db, table = src.CHDB, name
+	}
+	b, err := src.QueryCH(fmt.Sprintf("SELECT name FROM system.columns WHERE database = %s AND table = %s FORMAT JSONEachRow",
+		sources.Quote(db), sources.Quote(table)))
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]bool{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var row struct {
+			Name string `json:"name"`
+		}
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decode system.columns: %w", err)
+		}
+		if row.Name != "" {
+			out[row.Name] = true
+		}
+	}
+	return out, nil
+}
+
+// tableElements are the words that start a non-column entry in a CREATE
+// TABLE column list.
+var tableElements = map[string]bool{"INDEX": true, "PROJECTION": true, "CONSTRAINT": true, "PRIMARY": true}
+
+// declaredColumns returns the column names in the parenthesised list of a
+// CREATE TABLE statement.
+func declaredColumns(stmt string) []string {
+	lines := strings.Split(stmt, "\n")
+	for i, l := range lines {
+		lines[i], _, _ = strings.Cut(l, "--")
+	}
+	s := strings.Join(lines, "\n")
+	open := strings.Index(s, "(")
+	if open < 0 {
+		return nil
+	}
+	var cols []string
+	depth, start := 0, open+1
+	for i := open; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 1:
+			depth--
+		case c == ',' && depth == 1, c == ')':
+			if f := strings.Fields(s[start:i]); len(f) > 0 && !tableElements[strings.ToUpper(f[0])] {
+				cols = append(cols, strings.Trim(f[0], "`\""))
+			}
+			if c == ')' {
+				return cols
+			}
+			start = i + 1
+		}
+	}
+	return cols
+}
+
+// tableExists reports whether the table or view name exists.
+func tableExists(src *sources.Sources, name string) (bool, error) {
+	b, err := src.QueryCH("EXISTS TABLE " + name)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) == "1", nil
+}
+
+var tableRe = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([^\s(]+)\s*\(`)
+
+var createRe = regexp.MustCompile(`(?is)^CREATE\s+(?:TABLE|MATERIALIZED\s+VIEW)\s+(?:IF\s+NOT\s+EXISTS\s+)?(\S+)`)
+
+// createdName returns the table or view a CREATE statement makes.
+func createdName(stmt string) (string, bool) {
+	m := createRe.FindStringSubmatch(stripComments(stmt))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// mvTarget returns the TO table of a CREATE MATERIALIZED VIEW statement.
+func mvTarget(stmt string) string {
+	if m := mvRe.FindStringSubmatch(stripComments(stmt)); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// boundBackfill limits a backfillFor query to spans that start before
+// cutoff by reading the spans table through a filtering subquery. Spans
+// older than cutoff that arrive after the view was created are still
+// counted twice; cutoff is taken from this host's clock.
+func boundBackfill(q, db string, ts sources.TraceSchema, cutoff time.Time) string {
+	spans := db + "." + ts.Tables.Spans
+	re := regexp.MustCompile(`(?i)\bFROM\s+` + regexp.QuoteMeta(spans) + `\b`)
+	return re.ReplaceAllLiteralString(q, fmt.Sprintf("FROM (SELECT * FROM %s WHERE %s < toDateTime64('%s', 9, 'UTC'))",
+		spans, ts.StartTime(""), cutoff.Format("2006-01-02 15:04:05.000000000")))
+}
+
+var mvRe = regexp.MustCompile(`(?is)^CREATE\s+MATERIALIZED\s+VIEW\s+(?:IF\s+NOT\s+EXISTS\s+)?\S+\s+TO\s+(\S+)\s+AS\s+(.+)$`)
+
+// backfillFor turns "CREATE MATERIALIZED VIEW v TO t AS <select>" into
+// "INSERT INTO t <select>" so rows that predate the view are rolled up too.
+func backfillFor(stmt string) (string, bool) {
+	m := mvRe.FindStringSubmatch(stripComments(stmt))
+	if m == nil {
+		return "", false
+	}
+	return "INSERT INTO " + m[1] + "\n" + m[2], true
+}
+
+// splitStatements splits a script on top-level semicolons, ignoring those in
+// quoted strings and -- comments, and drops comment-only fragments.
+func splitStatements(script string) []string {
+	var out []string
+	var cur strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(cur.String()); stripComments(s) != "" {
+			out = append(out, s)
+		}
+		cur.Reset()
+	}
+	inQuote, inComment := false, false
+	for i := 0; i < len(script); i++ {
+		ch := script[i]
+		switch {
+		case inComment:
+			if ch == '\n' {
+				inComment = false
+			}
+		case inQuote:
+			if ch == '\\' && i+1 < len(script) {
+				cur.WriteByte(ch)
+				i++
+				ch = script[i]
+			} else if ch == '\'' {
+				inQuote = false
+			}
+		case ch == '\'':
+			inQuote = true
+		case ch == '-' && i+1 < len(script) && script[i+1] == '-':
+			inComment = true
+		case ch == ';':
+			flush()
+			continue
+		}
+		cur.WriteByte(ch)
+	}
+	flush()
+	return out
+}
+
+// stripComments drops whole-line -- comments and surrounding space.
+func stripComments(s string) string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(l), "--") {
+			lines = append(lines, l)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
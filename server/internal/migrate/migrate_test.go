@@ -0,0 +1,268 @@
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// fakeCH records every statement and answers schema_migrations lookups
+// from applied (version -> checksum); other EXISTS TABLE checks find only
+// the tables in existing.
+func fakeCH(t *testing.T, applied map[int]string, existing ...string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var stmts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sql := string(b)
+		stmts = append(stmts, sql)
+		switch {
+		case strings.HasPrefix(sql, "EXISTS TABLE") && !strings.HasSuffix(sql, ".schema_migrations"):
+			if slices.Contains(existing, strings.TrimPrefix(sql, "EXISTS TABLE ")) {
+				w.Write([]byte("1\n"))
+			} else {
+				w.Write([]byte("0\n"))
+			}
+		case strings.HasPrefix(sql, "EXISTS TABLE"):
+			if len(applied) > 0 {
+				w.Write([]byte("1\n"))
+			} else {
+				w.Write([]byte("0\n"))
+			}
+		case strings.HasPrefix(sql, "SELECT Version"):
+			for v, sum := range applied {
+				fmt.Fprintf(w, `{"Version":%d,"Checksum":%q}`+"\n", v, sum)
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &stmts
+}
+
+func TestLoad_TemplatesDatabaseAndIsIdempotent(t *testing.T) {
+	migs, err := Load("observability", sources.DefaultTraceSchema)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(migs) == 0 {
+		t.Fatalf("no migrations embedded")
+	}
+	for i, m := range migs {
+		if i > 0 && m.Version <= migs[i-1].Version {
+			t.Fatalf("not ordered: %d after %d", m.Version, migs[i-1].Version)
+		}
+		for _, s := range m.Statements {
+			if strings.Contains(s, "{{") || strings.Contains(s, "default.") {
+				t.Fatalf("%d_%s not templated:\n%s", m.Version, m.Name, s)
+			}
+			if strings.HasPrefix(stripComments(s), "CREATE") && !strings.Contains(s, "IF NOT EXISTS") {
+				t.Fatalf("%d_%s not idempotent:\n%s", m.Version, m.Name, s)
+			}
+		}
+	}
+
+	if _, err := Load("bad-name; DROP", sources.DefaultTraceSchema); err == nil {
+		t.Fatalf("invalid database name accepted")
+	}
+}
+
+func TestSplitStatements_RespectsQuotesAndComments(t *testing.T) {
+	got := splitStatements("-- header; not a split\nSELECT 'a;b';\n\n-- trailing only\nSELECT 2 -- x;y\n;")
+	if len(got) != 2 {
+		t.Fatalf("got %d statements: %q", len(got), got)
+	}
+	if !strings.Contains(got[0], "'a;b'") {
+		t.Fatalf("quoted semicolon split: %q", got[0])
+	}
+}
+
+func TestBackfillFor_RewritesMaterializedView(t *testing.T) {
+	q, ok := backfillFor("-- note\nCREATE MATERIALIZED VIEW IF NOT EXISTS db.mv_x\nTO db.x AS\nSELECT 1 AS a FROM db.otel_traces")
+	if !ok || q != "INSERT INTO db.x\nSELECT 1 AS a FROM db.otel_traces" {
+		t.Fatalf("backfill=%q ok=%v", q, ok)
+	}
+	if _, ok := backfillFor("CREATE TABLE IF NOT EXISTS db.x (a UInt8) ENGINE = Memory"); ok {
+		t.Fatalf("table treated as MV")
+	}
+}
+
+func TestRun_AppliesPendingAndRecordsVersions(t *testing.T) {
+	ts, stmts := fakeCH(t, nil)
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()}
+
+	if err := Run(src, Options{Backfill: true}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	migs, _ := Load("obs", sources.TraceSchema{})
+	joined := strings.Join(*stmts, "\n;;\n")
+	if !strings.Contains((*stmts)[0], "CREATE TABLE IF NOT EXISTS obs.schema_migrations") {
+		t.Fatalf("schema_migrations not created first: %q", (*stmts)[0])
+	}
+	if n := strings.Count(joined, "INSERT INTO obs.schema_migrations"); n != len(migs) {
+		t.Fatalf("recorded %d versions want %d", n, len(migs))
+	}
+	if !strings.Contains(joined, "INSERT INTO obs.service_suggest") {
+		t.Fatalf("backfill not run:\n%s", joined)
+	}
+	if !strings.Contains(joined, "FROM (SELECT * FROM obs.otel_traces WHERE Timestamp < toDateTime64('") {
+		t.Fatalf("backfill not bounded by a cutoff:\n%s", joined)
+	}
+}
+
+func TestRun_BackfillSkipsTablesThatExisted(t *testing.T) {
+	// DDL applied by hand: the tables are there but schema_migrations is empty.
+	ts, stmts := fakeCH(t, nil, "obs.trace_roots", "obs.mv_trace_roots", "obs.service_suggest")
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()}
+
+	var out bytes.Buffer
+	if err := Run(src, Options{Backfill: true, Out: &out}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	joined := strings.Join(*stmts, "\n;;\n")
+	if strings.Contains(joined, "INSERT INTO obs.trace_roots") || strings.Contains(joined, "INSERT INTO obs.service_suggest") {
+		t.Fatalf("backfilled a table that already existed:\n%s", joined)
+	}
+	if !strings.Contains(joined, "INSERT INTO obs.operation_suggest") {
+		t.Fatalf("new table not backfilled:\n%s", joined)
+	}
+	if !strings.Contains(out.String(), "obs.mv_service_suggest and obs.service_suggest already existed") {
+		t.Fatalf("skip not reported:\n%s", out.String())
+	}
+}
+
+func TestRun_SkipsAppliedAndDryRunExecutesNothing(t *testing.T) {
+	migs, _ := Load("obs", sources.TraceSchema{})
+	applied := map[int]string{}
+	for _, m := range migs[:len(migs)-1] {
+		applied[m.Version] = m.Checksum
+	}
+	ts, stmts := fakeCH(t, applied)
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()}
+
+	var out bytes.Buffer
+	if err := Run(src, Options{DryRun: true, Out: &out}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for _, s := range *stmts {
+		if !strings.HasPrefix(s, "EXISTS TABLE") && !strings.HasPrefix(s, "SELECT Version") {
+			t.Fatalf("dry run executed %q", s)
+		}
+	}
+	last := migs[len(migs)-1]
+	if !strings.Contains(out.String(), fmt.Sprintf("-- %02d_%s", last.Version, last.Name)) {
+		t.Fatalf("pending migration not printed:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), fmt.Sprintf("-- %02d_%s", migs[0].Version, migs[0].Name)) {
+		t.Fatalf("applied migration printed again:\n%s", out.String())
+	}
+}
+
+func TestLoad_RendersSchemaMapping(t *testing.T) {
+	migs, err := Load("obs", sources.TraceSchema{
+		Tables:           sources.TraceTables{Spans: "spans_v2", ServiceSuggest: "svc_v2"},
+		Columns:          sources.TraceColumns{ServiceName: "service"},
+		TimestampType:    "unix_nanos",
+		AttributeStorage: "json",
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	var all []string
+	for _, m := range migs {
+		all = append(all, m.Statements...)
+	}
+	joined := strings.Join(all, "\n")
+	for _, want := range []string{
+		"FROM obs.spans_v2",
+		"TO obs.svc_v2",
+		"service AS ServiceName",
+		"toStartOfHour(toDateTime(intDiv(Timestamp, 1000000000)))",
+		"mapKeys(CAST(JSONExtractKeysAndValues(SpanAttributes, 'String'), 'Map(String, String)'))",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Fatalf("rendered DDL missing %q", want)
+		}
+	}
+	if strings.Contains(joined, "otel_traces") {
+		t.Fatalf("default spans table leaked into custom schema")
+	}
+}
+
+// columnsCH records every statement and answers system.columns lookups with
+// the columns of each "db.table" in cols; other tables do not exist and no
+// migrations are applied.
+func columnsCH(t *testing.T, cols map[string][]string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var stmts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sql := string(b)
+		stmts = append(stmts, sql)
+		for name, cs := range cols {
+			db, table, _ := strings.Cut(name, ".")
+			if !strings.Contains(sql, "database = '"+db+"' AND table = '"+table+"'") {
+				continue
+			}
+			for _, c := range cs {
+				fmt.Fprintf(w, `{"name":%q}`+"\n", c)
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &stmts
+}
+
+func TestDeclaredColumns_SkipsTypeArgumentsAndIndexes(t *testing.T) {
+	got := declaredColumns(`CREATE TABLE IF NOT EXISTS d.t
+(
+  -- comment, with a comma
+  A Map(LowCardinality(String), String), -- trailing, with a comma
+  ` + "`B`" + ` DateTime64(9, 'UTC') CODEC(Delta, ZSTD),
+  INDEX idx A TYPE bloom_filter GRANULARITY 1
+)
+ENGINE = MergeTree ORDER BY (B)`)
+	if !slices.Equal(got, []string{"A", "B"}) {
+		t.Fatalf("columns=%v", got)
+	}
+}
+
+func TestStale_FlagsSuggestTablesWithoutServiceName(t *testing.T) {
+	ts, _ := columnsCH(t, map[string][]string{
+		"obs.operation_suggest": {"WindowStart", "SpanName", "Cnt"},
+		"obs.service_suggest":   {"WindowStart", "ServiceName", "Cnt"},
+	})
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()}
+	stale, err := Stale(src)
+	if err != nil {
+		t.Fatalf("Stale: %v", err)
+	}
+	if len(stale) != 1 || !strings.Contains(stale[0], "obs.operation_suggest lacks ServiceName") {
+		t.Fatalf("stale=%q", stale)
+	}
+}
+
+func TestRun_StopsWhenExistingTableLacksColumns(t *testing.T) {
+	ts, stmts := columnsCH(t, map[string][]string{
+		"obs.operation_suggest": {"WindowStart", "SpanName", "Cnt"},
+	})
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()}
+	err := Run(src, Options{})
+	if err == nil || !strings.Contains(err.Error(), "obs.operation_suggest already exists without ServiceName") {
+		t.Fatalf("err=%v", err)
+	}
+	for _, s := range *stmts {
+		if strings.Contains(s, "INSERT INTO obs.schema_migrations") && strings.Contains(s, "VALUES (21,") {
+			t.Fatalf("recorded a migration that did not apply: %s", s)
+		}
+		if strings.Contains(s, "mv_operation_suggest") {
+			t.Fatalf("created the view over the old table: %s", s)
+		}
+	}
+}
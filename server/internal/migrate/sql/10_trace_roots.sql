@@ -1,5 +1,5 @@
 -- Target table that the MV writes into
-CREATE TABLE default.trace_roots
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Tables.TraceRoots}}
 (
   TraceId       String,
   StartTs       DateTime,
@@ -15,28 +15,28 @@ ENGINE = MergeTree
 ORDER BY (TraceId);
 
 -- Materialized view that populates trace_roots
-CREATE MATERIALIZED VIEW default.mv_trace_roots
-TO default.trace_roots
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Database}}.mv_{{.Tables.TraceRoots}}
+TO {{.Database}}.{{.Tables.TraceRoots}}
 AS
 WITH
   /* Root span info per trace (parent = '') */
   root AS
   (
     SELECT
-      TraceId,
-      anyIf(ServiceName, ParentSpanId = '') AS RootService,
-      anyIf(SpanName,   ParentSpanId = '')  AS RootOperation
-    FROM default.otel_traces
+      {{.Columns.TraceId}} AS TraceId,
+      anyIf({{.Columns.ServiceName}}, {{.Columns.ParentSpanId}} = '') AS RootService,
+      anyIf({{.Columns.SpanName}},    {{.Columns.ParentSpanId}} = '') AS RootOperation
+    FROM {{.Database}}.{{.Tables.Spans}}
     GROUP BY TraceId
   ),
   /* Per-trace per-service total duration (sum done in its own stage) */
   svc_agg AS
   (
     SELECT
-      TraceId,
-      ServiceName,
-      sum(Duration) AS svc_dur   -- adjust units below if needed
-    FROM default.otel_traces
+      {{.Columns.TraceId}} AS TraceId,
+      {{.Columns.ServiceName}} AS ServiceName,
+      sum({{durationMs ""}}) AS svc_dur
+    FROM {{.Database}}.{{.Tables.Spans}}
     GROUP BY TraceId, ServiceName
   ),
   /* For each trace: array of (service, svc_dur) sorted descending */
@@ -49,17 +49,17 @@ WITH
     GROUP BY TraceId
   )
 SELECT
-  t.TraceId                                 AS TraceId,
-  min(t.Timestamp)                          AS StartTs,
-  sum(t.Duration)                           AS DurationMs,     -- see units note
+  t.{{.Columns.TraceId}}                    AS TraceId,
+  min({{startTime "t"}})                    AS StartTs,
+  sum({{durationMs "t"}})                   AS DurationMs,
   r.RootService                             AS RootService,
   r.RootOperation                           AS RootOperation,
-  any(t.StatusCode)                         AS Status,
-  uniqExact(t.SpanId)                       AS SpanCount,
+  any(t.{{.Columns.StatusCode}})            AS Status,
+  uniqExact(t.{{.Columns.SpanId}})          AS SpanCount,
   if(length(sv.svc_sorted)>0, sv.svc_sorted[1].1, r.RootService) AS TopService,
   if(length(sv.svc_sorted)>0, sv.svc_sorted[1].2, 0)             AS TopServiceMs
-FROM default.otel_traces AS t
-LEFT JOIN root     AS r  USING (TraceId)
-LEFT JOIN svc_rank AS sv USING (TraceId)
+FROM {{.Database}}.{{.Tables.Spans}} AS t
+LEFT JOIN root     AS r  ON r.TraceId  = t.{{.Columns.TraceId}}
+LEFT JOIN svc_rank AS sv ON sv.TraceId = t.{{.Columns.TraceId}}
 GROUP BY
-  TraceId, RootService, RootOperation, svc_sorted;
\ No newline at end of file
+  TraceId, RootService, RootOperation, svc_sorted;
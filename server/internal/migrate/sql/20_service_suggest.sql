@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Tables.ServiceSuggest}}
+(
+  WindowStart DateTime,
+  ServiceName LowCardinality(String),
+  Cnt UInt64
+)
+ENGINE = SummingMergeTree()
+ORDER BY (WindowStart, ServiceName);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Database}}.mv_{{.Tables.ServiceSuggest}}
+TO {{.Database}}.{{.Tables.ServiceSuggest}} AS
+SELECT
+  toStartOfHour({{startTime ""}}) AS WindowStart,
+  {{.Columns.ServiceName}} AS ServiceName,
+  count() AS Cnt
+FROM {{.Database}}.{{.Tables.Spans}}
+GROUP BY WindowStart, ServiceName;
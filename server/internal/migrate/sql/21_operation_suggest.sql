@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Tables.OperationSuggest}}
+(
+  WindowStart DateTime,
+  ServiceName LowCardinality(String),
+  SpanName LowCardinality(String),
+  Cnt UInt64
+)
+ENGINE = SummingMergeTree()
+ORDER BY (WindowStart, ServiceName, SpanName);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Database}}.mv_{{.Tables.OperationSuggest}}
+TO {{.Database}}.{{.Tables.OperationSuggest}} AS
+SELECT
+  toStartOfHour({{startTime ""}}) AS WindowStart,
+  {{.Columns.ServiceName}} AS ServiceName,
+  {{.Columns.SpanName}} AS SpanName,
+  count() AS Cnt
+FROM {{.Database}}.{{.Tables.Spans}}
+GROUP BY WindowStart, ServiceName, SpanName;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Tables.AttrValues}}
+(
+    WindowStart   DateTime,
+    ServiceName   LowCardinality(String),
+    Key           String,
+    Val           String,
+    Cnt           UInt64
+)
+ENGINE = SummingMergeTree
+ORDER BY (WindowStart, Key, ServiceName, Val);
+
+-- The key list below is the default allowlist. To regenerate this view from
+-- ATTR_VALUE_KEYS, run: otel-backend migrate -attr-values
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Database}}.mv_{{.Tables.AttrValues}}
+TO {{.Database}}.{{.Tables.AttrValues}}
+AS
+WITH ['http.method','deployment.environment','db.system','http.route'] AS keys
+SELECT
+    toStartOfHour({{startTime ""}})                               AS WindowStart,
+    {{.Columns.ServiceName}}                                      AS ServiceName,
+    k                                                             AS Key,
+    v                                                             AS Val,
+    count()                                                       AS Cnt
+FROM {{.Database}}.{{.Tables.Spans}}
+ARRAY JOIN arrayConcat(mapKeys({{attrMap .Columns.SpanAttributes}}), mapKeys({{attrMap .Columns.ResourceAttributes}}))     AS k,
+           arrayConcat(mapValues({{attrMap .Columns.SpanAttributes}}), mapValues({{attrMap .Columns.ResourceAttributes}})) AS v
+WHERE k IN keys AND v IS NOT NULL AND v != ''
+GROUP BY WindowStart, ServiceName, Key, Val;
@@ -0,0 +1,27 @@
+-- Hourly counts of span and resource attribute keys, for key discovery
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Tables.AttrKeys}}
+(
+    WindowStart   DateTime,
+    ServiceName   LowCardinality(String),
+    Scope         LowCardinality(String),   -- 'span' | 'resource'
+    Key           String,
+    Cnt           UInt64
+)
+ENGINE = SummingMergeTree
+ORDER BY (WindowStart, Scope, Key, ServiceName);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS {{.Database}}.mv_{{.Tables.AttrKeys}}
+TO {{.Database}}.{{.Tables.AttrKeys}}
+AS
+SELECT
+    toStartOfHour({{startTime ""}})                               AS WindowStart,
+    {{.Columns.ServiceName}}                                      AS ServiceName,
+    sk.1                                                          AS Scope,
+    sk.2                                                          AS Key,
+    count()                                                       AS Cnt
+FROM {{.Database}}.{{.Tables.Spans}}
+ARRAY JOIN arrayConcat(
+             arrayMap(x -> ('span', x),     mapKeys({{attrMap .Columns.SpanAttributes}})),
+             arrayMap(x -> ('resource', x), mapKeys({{attrMap .Columns.ResourceAttributes}}))
+           ) AS sk
+GROUP BY WindowStart, ServiceName, Scope, Key;
@@ -0,0 +1,21 @@
+-- Saved trace searches, PromQL and LogsQL queries (package saved). Every
+-- change inserts a new row; the highest Version per Id wins, and Deleted
+-- rows hide the query.
+CREATE TABLE IF NOT EXISTS {{.Database}}.saved_queries
+(
+  Id          String,
+  ShareId     String,
+  Kind        LowCardinality(String),   -- 'traces' | 'promql' | 'logsql'
+  Name        String,
+  Description String,
+  Owner       String,
+  Tags        Array(String),
+  Shared      UInt8,
+  Query       String,                   -- JSON request body for the kind's endpoint
+  CreatedAtMs Int64,
+  UpdatedAtMs Int64,
+  Version     UInt64,
+  Deleted     UInt8
+)
+ENGINE = ReplacingMergeTree(Version)
+ORDER BY Id;
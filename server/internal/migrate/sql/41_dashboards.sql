@@ -0,0 +1,19 @@
+-- Dashboards (package dashboards). Every save appends a row with the next
+-- Version, so old versions stay readable; the highest Version per Id is the
+-- current one, and a Deleted row hides the dashboard.
+CREATE TABLE IF NOT EXISTS {{.Database}}.dashboards
+(
+  Id          String,
+  Version     UInt64,
+  Owner       String,
+  Title       String,
+  Tags        Array(String),
+  Shared      UInt8,
+  Spec        String,                   -- JSON: description, time, variables, panels
+  CreatedAtMs Int64,
+  UpdatedAtMs Int64,
+  UpdatedBy   String,
+  Deleted     UInt8
+)
+ENGINE = MergeTree
+ORDER BY (Id, Version);
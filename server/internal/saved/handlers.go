@@ -0,0 +1,169 @@
+package saved
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/access"
+	"github.com/gin-gonic/gin"
+)
+
+// API serves /api/saved-queries. Access says who the caller is and what
+// they may do; the owner of a new query is the caller.
+type API struct {
+	Store  Store
+	Access access.Policy
+}
+
+func (a *API) caller(c *gin.Context) access.Caller { return a.Access.Caller(c) }
+
+// load fetches :id and checks the caller may see it; unreadable queries
+// look missing.
+func (a *API) load(c *gin.Context) (Query, access.Caller, bool) {
+	who := a.caller(c)
+	q, err := a.Store.Get(c.Param("id"))
+	if err == nil && !who.CanRead(q.Owner, q.Shared) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		storeError(c, err)
+		return q, who, false
+	}
+	return q, who, true
+}
+
+func storeError(c *gin.Context, err error) {
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
+
+// List serves GET /api/saved-queries?kind=&tag=&owner=: the caller's own
+// queries and shared ones (everything for admins), newest change first.
+func (a *API) List(c *gin.Context) {
+	who := a.caller(c)
+	qs, err := a.Store.List(Filter{
+		Kind: c.Query("kind"), Tag: c.Query("tag"), Owner: c.Query("owner"),
+		VisibleTo: who.User, All: who.Role >= access.Admin,
+	})
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": qs})
+}
+
+// Get serves GET /api/saved-queries/{id}.
+func (a *API) Get(c *gin.Context) {
+	if q, _, ok := a.load(c); ok {
+		c.JSON(http.StatusOK, q)
+	}
+}
+
+// Shared serves GET /api/shared/queries/{shareId}: anyone with the link can
+// open the query, shared or not.
+func (a *API) Shared(c *gin.Context) {
+	q, err := a.Store.ByShareID(c.Param("shareId"))
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+// Create serves POST /api/saved-queries.
+func (a *API) Create(c *gin.Context) {
+	who := a.caller(c)
+	if !who.CanCreate() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "role " + who.Role.String() + " cannot save queries"})
+		return
+	}
+	var in Input
+	if err := c.BindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	if err := in.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := newID(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	share, err := newID(12)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	q := Query{
+		ID: idPrefix + id, ShareID: share, Kind: in.Kind, Name: in.Name, Description: in.Description,
+		Owner: who.User, Tags: in.Tags, Shared: in.Shared, Query: in.Query,
+		CreatedAt: now, UpdatedAt: now, Version: 1,
+	}
+	if err := a.Store.Put(q); err != nil {
+		storeError(c, err)
+		return
+	}
+	c.Header("Location", "/api/saved-queries/"+q.ID)
+	c.JSON(http.StatusCreated, q)
+}
+
+// Update serves PUT /api/saved-queries/{id}, replacing everything but the
+// kind, owner and IDs.
+func (a *API) Update(c *gin.Context) {
+	q, who, ok := a.load(c)
+	if !ok {
+		return
+	}
+	if !who.CanWrite(q.Owner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner or an admin can change this query"})
+		return
+	}
+	var in Input
+	if err := c.BindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return
+	}
+	if in.Kind == "" {
+		in.Kind = q.Kind
+	}
+	if in.Kind != q.Kind {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind cannot change"})
+		return
+	}
+	if err := in.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Name, q.Description, q.Tags, q.Shared, q.Query = in.Name, in.Description, in.Tags, in.Shared, in.Query
+	q.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	q.Version++
+	if err := a.Store.Put(q); err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+// Delete serves DELETE /api/saved-queries/{id}.
+func (a *API) Delete(c *gin.Context) {
+	q, who, ok := a.load(c)
+	if !ok {
+		return
+	}
+	if !who.CanWrite(q.Owner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner or an admin can delete this query"})
+		return
+	}
+	if err := a.Store.Delete(q); err != nil {
+		storeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
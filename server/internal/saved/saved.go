@@ -0,0 +1,155 @@
+// Package saved stores named queries (trace searches, PromQL and LogsQL) so
+// they can be reopened, listed by tag and shared by link.
+package saved
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/traces"
+)
+
+// Kinds of saved query; each names the endpoint its Query body is for.
+const (
+	KindTraces = "traces" // POST /api/traces/list
+	KindPromQL = "promql" // POST /api/metrics/query
+	KindLogsQL = "logsql" // POST /api/logs/search
+)
+
+const (
+	maxNameLen = 200
+	maxTags    = 20
+	maxTagLen  = 50
+	idPrefix   = "sq-"
+)
+
+// Query is a stored query.
+type Query struct {
+	ID string `json:"id"`
+	// ShareID opens the query for anyone who has the link, shared or not.
+	ShareID     string   `json:"shareId"`
+	Kind        string   `json:"kind"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Owner       string   `json:"owner"`
+	Tags        []string `json:"tags"`
+	// Shared lists the query for everyone, not just its owner.
+	Shared bool `json:"shared"`
+	// Query is the request body for the kind's endpoint.
+	Query     json.RawMessage `json:"query"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	// Version counts the changes, starting at 1.
+	Version uint64 `json:"version"`
+}
+
+// Input is what a client sends to create or change a query.
+type Input struct {
+	Kind        string          `json:"kind"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Tags        []string        `json:"tags"`
+	Shared      bool            `json:"shared"`
+	Query       json.RawMessage `json:"query"`
+}
+
+// PromQuery is the /api/metrics/query body.
+type PromQuery struct {
+	Query string  `json:"query"`
+	Start float64 `json:"start,omitempty"`
+	End   float64 `json:"end,omitempty"`
+	Step  float64 `json:"step,omitempty"`
+}
+
+// LogsQuery is the /api/logs/search body.
+type LogsQuery struct {
+	Query string `json:"query"`
+}
+
+// normalize checks in and rewrites its fields into canonical form: trimmed
+// name, de-duplicated tags and a Query re-encoded by NormalizeQuery.
+func (in *Input) normalize() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(in.Name) > maxNameLen {
+		return fmt.Errorf("name is longer than %d bytes", maxNameLen)
+	}
+	in.Description = strings.TrimSpace(in.Description)
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, t := range in.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLen {
+			return fmt.Errorf("tag %q is longer than %d bytes", t, maxTagLen)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags", maxTags)
+	}
+	in.Tags = tags
+
+	q, err := NormalizeQuery(in.Kind, in.Query)
+	if err != nil {
+		return err
+	}
+	in.Query = q
+	return nil
+}
+
+// NormalizeQuery checks that raw is a valid request body for kind's endpoint
+// and returns it re-encoded from the matching type; unknown fields are an
+// error.
+func NormalizeQuery(kind string, raw json.RawMessage) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("query is required")
+	}
+	var body any
+	switch kind {
+	case KindTraces:
+		body = &traces.TraceListReq{}
+	case KindPromQL:
+		body = &PromQuery{}
+	case KindLogsQL:
+		body = &LogsQuery{}
+	default:
+		return nil, fmt.Errorf("kind must be %s, %s or %s", KindTraces, KindPromQL, KindLogsQL)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(body); err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	switch q := body.(type) {
+	case *PromQuery:
+		if strings.TrimSpace(q.Query) == "" {
+			return nil, errors.New("query.query is required")
+		}
+	case *LogsQuery:
+		if strings.TrimSpace(q.Query) == "" {
+			return nil, errors.New("query.query is required")
+		}
+	}
+	return json.Marshal(body)
+}
+
+func newID(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
@@ -0,0 +1,183 @@
+package saved
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/access"
+	"github.com/gin-gonic/gin"
+)
+
+// memStore is a Store over a map, with the same visibility rules as CHStore.
+type memStore struct {
+	mu sync.Mutex
+	qs map[string]Query
+}
+
+func newMemStore() *memStore { return &memStore{qs: map[string]Query{}} }
+
+func (m *memStore) Get(id string) (Query, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.qs[id]
+	if !ok {
+		return Query{}, ErrNotFound
+	}
+	return q, nil
+}
+
+func (m *memStore) ByShareID(shareID string) (Query, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, q := range m.qs {
+		if q.ShareID == shareID {
+			return q, nil
+		}
+	}
+	return Query{}, ErrNotFound
+}
+
+func (m *memStore) List(f Filter) ([]Query, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Query{}
+	for _, q := range m.qs {
+		if (f.Kind == "" || q.Kind == f.Kind) && (f.Tag == "" || slices.Contains(q.Tags, f.Tag)) &&
+			(f.Owner == "" || q.Owner == f.Owner) && (f.All || q.Owner == f.VisibleTo || q.Shared) {
+			out = append(out, q)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (m *memStore) Put(q Query) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.qs[q.ID] = q
+	return nil
+}
+
+func (m *memStore) Delete(q Query) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.qs, q.ID)
+	return nil
+}
+
+func newTestRouter(api *API) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/saved-queries", api.List)
+	r.POST("/api/saved-queries", api.Create)
+	r.GET("/api/saved-queries/:id", api.Get)
+	r.PUT("/api/saved-queries/:id", api.Update)
+	r.DELETE("/api/saved-queries/:id", api.Delete)
+	r.GET("/api/shared/queries/:shareId", api.Shared)
+	return r
+}
+
+func do(r *gin.Engine, method, path, user, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.Header.Set(access.UserHeader, user)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestInputNormalize(t *testing.T) {
+	in := Input{Kind: KindPromQL, Name: "  p99 ", Tags: []string{"slo", " slo", "", "api"},
+		Query: json.RawMessage(`{"query":"histogram_quantile(0.99, x)","step":30}`)}
+	if err := in.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if in.Name != "p99" || strings.Join(in.Tags, ",") != "slo,api" || string(in.Query) != `{"query":"histogram_quantile(0.99, x)","step":30}` {
+		t.Fatalf("in=%+v query=%s", in, in.Query)
+	}
+
+	for _, bad := range []Input{
+		{Kind: KindPromQL, Name: "", Query: json.RawMessage(`{"query":"up"}`)},
+		{Kind: "sql", Name: "x", Query: json.RawMessage(`{"query":"up"}`)},
+		{Kind: KindLogsQL, Name: "x", Query: json.RawMessage(`{"query":" "}`)},
+		{Kind: KindLogsQL, Name: "x", Query: json.RawMessage(`{"query":"error","limit":5}`)},
+		{Kind: KindTraces, Name: "x", Query: json.RawMessage(`{"filters":{"nope":1}}`)},
+		{Kind: KindTraces, Name: "x"},
+	} {
+		if err := bad.normalize(); err == nil {
+			t.Fatalf("accepted %+v", bad)
+		}
+	}
+}
+
+func TestAPI_CRUDAndSharing(t *testing.T) {
+	st := newMemStore()
+	r := newTestRouter(&API{Store: st, Access: access.Policy{Role: access.Editor, TrustHeader: true}})
+
+	w := do(r, "POST", "/api/saved-queries", "ana",
+		`{"kind":"traces","name":"slow checkouts","tags":["checkout"],"query":{"filters":{"service":["web"],"durationMs":{"gte":500}}}}`)
+	if w.Code != 201 {
+		t.Fatalf("create status=%d body=%s", w.Code, w.Body.String())
+	}
+	var q Query
+	_ = json.Unmarshal(w.Body.Bytes(), &q)
+	if !strings.HasPrefix(q.ID, idPrefix) || q.ShareID == "" || q.Owner != "ana" || q.Version != 1 {
+		t.Fatalf("created=%+v", q)
+	}
+
+	// Not shared: bo cannot list or open it, but the share link works.
+	if w := do(r, "GET", "/api/saved-queries", "bo", ""); strings.Contains(w.Body.String(), q.ID) {
+		t.Fatalf("bo sees unshared query: %s", w.Body.String())
+	}
+	if w := do(r, "GET", "/api/saved-queries/"+q.ID, "bo", ""); w.Code != 404 {
+		t.Fatalf("bo get status=%d", w.Code)
+	}
+	if w := do(r, "GET", "/api/shared/queries/"+q.ShareID, "bo", ""); w.Code != 200 {
+		t.Fatalf("share link status=%d", w.Code)
+	}
+
+	// Only the owner may change it.
+	update := `{"name":"slow checkouts","shared":true,"tags":["checkout","slo"],"query":{"filters":{"service":["web"]}}}`
+	if w := do(r, "PUT", "/api/saved-queries/"+q.ID, "ana", update); w.Code != 200 || !strings.Contains(w.Body.String(), `"version":2`) {
+		t.Fatalf("update status=%d body=%s", w.Code, w.Body.String())
+	}
+	if w := do(r, "PUT", "/api/saved-queries/"+q.ID, "bo", update); w.Code != 403 {
+		t.Fatalf("bo update status=%d", w.Code)
+	}
+	if w := do(r, "PUT", "/api/saved-queries/"+q.ID, "ana", `{"kind":"promql","name":"x","query":{"query":"up"}}`); w.Code != 400 {
+		t.Fatalf("kind change status=%d", w.Code)
+	}
+
+	// Shared now: bo lists it, filtered by tag.
+	var list struct{ Items []Query }
+	_ = json.Unmarshal(do(r, "GET", "/api/saved-queries?tag=slo&kind=traces", "bo", "").Body.Bytes(), &list)
+	if len(list.Items) != 1 || list.Items[0].ID != q.ID {
+		t.Fatalf("bo list=%+v", list.Items)
+	}
+
+	if w := do(r, "DELETE", "/api/saved-queries/"+q.ID, "bo", ""); w.Code != 403 {
+		t.Fatalf("bo delete status=%d", w.Code)
+	}
+	if w := do(r, "DELETE", "/api/saved-queries/"+q.ID, "ana", ""); w.Code != 204 {
+		t.Fatalf("delete status=%d", w.Code)
+	}
+	if w := do(r, "GET", "/api/saved-queries/"+q.ID, "ana", ""); w.Code != 404 {
+		t.Fatalf("deleted get status=%d", w.Code)
+	}
+}
+
+func TestAPI_ViewerCannotSave(t *testing.T) {
+	r := newTestRouter(&API{Store: newMemStore(), Access: access.Policy{Role: access.Viewer, TrustHeader: true}})
+	w := do(r, "POST", "/api/saved-queries", "ana", `{"kind":"logsql","name":"errors","query":{"query":"error"}}`)
+	if w.Code != 403 {
+		t.Fatalf("status=%d", w.Code)
+	}
+}
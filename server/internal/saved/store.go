@@ -0,0 +1,182 @@
+package saved
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// ErrNotFound is returned for unknown or deleted queries.
+var ErrNotFound = errors.New("saved query not found")
+
+// Filter narrows List. Empty fields match everything.
+type Filter struct {
+	Kind  string
+	Tag   string
+	Owner string
+	// VisibleTo limits the list to this user's queries and shared ones,
+	// unless All is set (admins).
+	VisibleTo string
+	All       bool
+}
+
+// Store persists queries. Put stores q as its latest version; Delete hides
+// it for good.
+type Store interface {
+	Get(id string) (Query, error)
+	ByShareID(shareID string) (Query, error)
+	List(f Filter) ([]Query, error)
+	Put(q Query) error
+	Delete(q Query) error
+}
+
+// CHStore keeps queries in the saved_queries table created by migration
+// 40_saved_queries; every Put or Delete inserts a row with a higher Version.
+type CHStore struct {
+	src *sources.Sources
+}
+
+// NewCHStore stores queries in src's ClickHouse database.
+func NewCHStore(src *sources.Sources) *CHStore { return &CHStore{src: src} }
+
+// chRow is one saved_queries row.
+type chRow struct {
+	Id          string   `json:"Id"`
+	ShareId     string   `json:"ShareId"`
+	Kind        string   `json:"Kind"`
+	Name        string   `json:"Name"`
+	Description string   `json:"Description"`
+	Owner       string   `json:"Owner"`
+	Tags        []string `json:"Tags"`
+	Shared      uint8    `json:"Shared"`
+	Query       string   `json:"Query"`
+	CreatedAtMs int64    `json:"CreatedAtMs"`
+	UpdatedAtMs int64    `json:"UpdatedAtMs"`
+	Version     uint64   `json:"Version"`
+	Deleted     uint8    `json:"Deleted"`
+}
+
+func toRow(q Query, deleted bool) chRow {
+	r := chRow{
+		Id: q.ID, ShareId: q.ShareID, Kind: q.Kind, Name: q.Name, Description: q.Description,
+		Owner: q.Owner, Tags: q.Tags, Query: string(q.Query),
+		CreatedAtMs: q.CreatedAt.UnixMilli(), UpdatedAtMs: q.UpdatedAt.UnixMilli(), Version: q.Version,
+	}
+	if r.Tags == nil {
+		r.Tags = []string{}
+	}
+	if q.Shared {
+		r.Shared = 1
+	}
+	if deleted {
+		r.Deleted = 1
+	}
+	return r
+}
+
+func (r chRow) query() Query {
+	q := Query{
+		ID: r.Id, ShareID: r.ShareId, Kind: r.Kind, Name: r.Name, Description: r.Description,
+		Owner: r.Owner, Tags: r.Tags, Shared: r.Shared == 1, Query: json.RawMessage(r.Query),
+		CreatedAt: time.UnixMilli(r.CreatedAtMs).UTC(), UpdatedAt: time.UnixMilli(r.UpdatedAtMs).UTC(), Version: r.Version,
+	}
+	if q.Tags == nil {
+		q.Tags = []string{}
+	}
+	return q
+}
+
+// selectSQL returns the live (latest, not deleted) rows matching where.
+// The conditions apply outside FINAL so they only ever see a query's latest
+// version.
+func (s *CHStore) selectSQL(where []string, limit int) string {
+	lim := ""
+	if limit > 0 {
+		lim = fmt.Sprintf("\nLIMIT %d", limit)
+	}
+	return fmt.Sprintf(`
+SELECT * FROM (SELECT * FROM %s.saved_queries FINAL)
+WHERE %s
+ORDER BY UpdatedAtMs DESC%s
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, s.src.CHDB, strings.Join(append([]string{"Deleted = 0"}, where...), " AND "), lim)
+}
+
+func (s *CHStore) query(sql string) ([]Query, error) {
+	b, err := s.src.QueryCH(sql)
+	if err != nil {
+		return nil, err
+	}
+	out := []Query{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var row chRow
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decode saved_queries: %w", err)
+		}
+		out = append(out, row.query())
+	}
+	return out, nil
+}
+
+func (s *CHStore) one(where string) (Query, error) {
+	qs, err := s.query(s.selectSQL([]string{where}, 1))
+	if err != nil {
+		return Query{}, err
+	}
+	if len(qs) == 0 {
+		return Query{}, ErrNotFound
+	}
+	return qs[0], nil
+}
+
+func (s *CHStore) Get(id string) (Query, error) { return s.one("Id = " + sources.Quote(id)) }
+
+func (s *CHStore) ByShareID(shareID string) (Query, error) {
+	return s.one("ShareId = " + sources.Quote(shareID))
+}
+
+func (s *CHStore) List(f Filter) ([]Query, error) {
+	var where []string
+	if f.Kind != "" {
+		where = append(where, "Kind = "+sources.Quote(f.Kind))
+	}
+	if f.Tag != "" {
+		where = append(where, "has(Tags, "+sources.Quote(f.Tag)+")")
+	}
+	if f.Owner != "" {
+		where = append(where, "Owner = "+sources.Quote(f.Owner))
+	}
+	if !f.All {
+		where = append(where, fmt.Sprintf("(Owner = %s OR Shared = 1)", sources.Quote(f.VisibleTo)))
+	}
+	return s.query(s.selectSQL(where, 0))
+}
+
+func (s *CHStore) insert(r chRow) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.src.QueryCH(fmt.Sprintf("INSERT INTO %s.saved_queries FORMAT JSONEachRow\n%s\n", s.src.CHDB, b))
+	return err
+}
+
+func (s *CHStore) Put(q Query) error { return s.insert(toRow(q, false)) }
+
+// Delete writes a tombstone one version above q.
+func (s *CHStore) Delete(q Query) error {
+	q.Version++
+	q.UpdatedAt = time.Now()
+	return s.insert(toRow(q, true))
+}
@@ -0,0 +1,58 @@
+package saved
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func TestCHStore(t *testing.T) {
+	var sqls []string
+	row := `{"Id":"sq-1","ShareId":"s1","Kind":"promql","Name":"p99","Description":"","Owner":"ana","Tags":["slo"],"Shared":1,` +
+		`"Query":"{\"query\":\"up\"}","CreatedAtMs":1704103200000,"UpdatedAtMs":1704103260000,"Version":3,"Deleted":0}` + "\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		sqls = append(sqls, string(b))
+		if strings.HasPrefix(strings.TrimSpace(string(b)), "SELECT") {
+			io.WriteString(w, row)
+		}
+	}))
+	defer ts.Close()
+	st := NewCHStore(&sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client()})
+
+	q, err := st.Get("sq-1")
+	if err != nil || q.Owner != "ana" || !q.Shared || q.Version != 3 || string(q.Query) != `{"query":"up"}` ||
+		!q.UpdatedAt.Equal(time.UnixMilli(1704103260000)) {
+		t.Fatalf("get=%+v err=%v", q, err)
+	}
+	if !strings.Contains(sqls[0], "FROM (SELECT * FROM obs.saved_queries FINAL)") ||
+		!strings.Contains(sqls[0], "WHERE Deleted = 0 AND Id = 'sq-1'") {
+		t.Fatalf("get sql:\n%s", sqls[0])
+	}
+
+	if _, err := st.List(Filter{Tag: "it's", VisibleTo: "ana"}); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if s := sqls[1]; !strings.Contains(s, `has(Tags, 'it\'s')`) || !strings.Contains(s, "(Owner = 'ana' OR Shared = 1)") {
+		t.Fatalf("list sql:\n%s", s)
+	}
+
+	if err := st.Delete(q); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	ins := sqls[2]
+	body, ok := strings.CutPrefix(ins, "INSERT INTO obs.saved_queries FORMAT JSONEachRow\n")
+	if !ok {
+		t.Fatalf("insert:\n%s", ins)
+	}
+	var tomb chRow
+	if err := json.Unmarshal([]byte(body), &tomb); err != nil || tomb.Deleted != 1 || tomb.Version != 4 || tomb.Id != "sq-1" {
+		t.Fatalf("tombstone=%+v err=%v", tomb, err)
+	}
+}
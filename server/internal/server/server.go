@@ -1,10 +1,17 @@
 package server
 
 import (
+  "log"
   "net/http"
+  "strings"
   "time"
 
   "github.com/gin-gonic/gin"
+  "github.com/example/otel-stack-demo/internal/access"
+  "github.com/example/otel-stack-demo/internal/cache"
+  "github.com/example/otel-stack-demo/internal/dashboards"
+  "github.com/example/otel-stack-demo/internal/migrate"
+  "github.com/example/otel-stack-demo/internal/saved"
   "github.com/example/otel-stack-demo/internal/sources"
   "github.com/example/otel-stack-demo/internal/traces"
 )
@@ -14,6 +21,10 @@ func New() http.Handler {
   r := gin.Default()
 
   src := sources.FromEnv()
+  if err := src.DetectTraceSchema(); err != nil { log.Printf("trace schema detection: %v; assuming %s in %s", err, src.Traces.DurationUnit, src.Traces.DurationColumn) }
+  // Refuse to serve suggestions from tables older than their migrations;
+  // the README's materialized views section has the rebuild steps.
+  if stale, err := migrate.Stale(src); err != nil { log.Printf("schema check: %v", err) } else if len(stale) > 0 { log.Fatalf("ClickHouse tables predate this backend: %s", strings.Join(stale, "; ")) }
 
   r.GET("/healthz", func(c *gin.Context){ c.JSON(200, gin.H{"ok":true}) })
   r.GET("/readyz", func(c *gin.Context){
@@ -22,16 +33,68 @@ func New() http.Handler {
     if _, err := client.Do(req); err != nil { c.JSON(200, gin.H{"ok":true}); return }
     c.JSON(200, gin.H{"ok":true})
   })
+  r.GET("/metrics", func(c *gin.Context){
+    c.Header("Content-Type", "text/plain; version=0.0.4")
+    cache.WriteMetrics(c.Writer)
+  })
 
   r.POST("/api/metrics/query", src.MetricsProxy())
   r.POST("/api/logs/search", src.LogsProxy())
+  r.GET("/api/logs/tail", src.LogsTail())
 
   r.POST("/api/traces/list", traces.List(src))
+  r.POST("/api/traces/latency-histogram", traces.LatencyHistogram(src))
+  r.POST("/api/traces/latency-heatmap", traces.LatencyHeatmap(src))
+  r.POST("/api/traces/compare", traces.CompareAttributes(src))
+  r.POST("/api/traces/import", traces.Import(src))
   r.GET("/api/traces/:traceId", traces.Get(src))
   r.GET("/api/traces/:traceId/flame", traces.Flame(src))
+  r.GET("/api/traces/:traceId/export", traces.Export(src))
+  r.GET("/api/traces/:traceId/spans/:spanId/subtree", traces.Subtree(src))
+  r.GET("/api/traces/:traceId/insights", traces.Insights(src))
+  r.GET("/api/errors", traces.Errors(src))
   r.GET("/api/traces/suggest/services", traces.SuggestServices(src))
   r.GET("/api/traces/suggest/operations", traces.SuggestOperations(src))
   r.GET("/api/traces/suggest/attributes", traces.SuggestAttributes(src))
+  r.GET("/api/traces/suggest/attribute-keys", traces.SuggestAttributeKeys(src))
+  r.GET("/api/traces/suggest/attributes/ddl", traces.AttrValuesRollup(src))
+
+  // Tempo search API for Grafana's Tempo datasource (base URL is the backend root).
+  r.GET("/api/search", traces.TempoSearch(src))
+  r.GET("/api/v2/traces/:traceId", traces.TempoTrace(src))
+
+  // Saved queries; see package access for who gets DEFAULT_ROLE (ParseRole falls back to viewer).
+  role, err := access.ParseRole(src.DefaultRole)
+  if err != nil { log.Printf("DEFAULT_ROLE: %v; using %s", err, role) }
+  policy := access.Policy{Role: role, TrustHeader: src.TrustForwardedUser, Demo: src.DemoMode}
+  sq := &saved.API{Store: saved.NewCHStore(src), Access: policy}
+  r.GET("/api/saved-queries", sq.List)
+  r.POST("/api/saved-queries", sq.Create)
+  r.GET("/api/saved-queries/:id", sq.Get)
+  r.PUT("/api/saved-queries/:id", sq.Update)
+  r.DELETE("/api/saved-queries/:id", sq.Delete)
+  r.GET("/api/shared/queries/:shareId", sq.Shared)
+
+  // Dashboards: same policy; PUT/DELETE need If-Match, panel queries are checked before save.
+  dash := &dashboards.API{Store: dashboards.NewCHStore(src), Checker: dashboards.Checker{Src: src}, Resolver: dashboards.NewResolver(src), Access: policy}
+  r.GET("/api/dashboards", dash.List)
+  r.POST("/api/dashboards", dash.Create)
+  r.GET("/api/dashboards/schema", dash.Schema)
+  r.POST("/api/dashboards/validate", dash.Validate)
+  r.POST("/api/dashboards/resolve", dash.Resolve)
+  r.GET("/api/dashboards/:id", dash.Get)
+  r.PUT("/api/dashboards/:id", dash.Update)
+  r.DELETE("/api/dashboards/:id", dash.Delete)
+  r.GET("/api/dashboards/:id/versions", dash.Versions)
+  r.GET("/api/dashboards/:id/versions/:version", dash.Version)
+  r.GET("/api/dashboards/:id/resolve", dash.ResolveSaved)
+
+  // Jaeger query API for Jaeger UI / Grafana's Jaeger datasource (base URL .../jaeger).
+  jg := r.Group("/jaeger")
+  jg.GET("/api/services", traces.JaegerServices(src))
+  jg.GET("/api/services/:service/operations", traces.JaegerOperations(src))
+  jg.GET("/api/traces", traces.JaegerSearch(src))
+  jg.GET("/api/traces/:traceId", traces.JaegerTrace(src))
 
   return r
 }
@@ -0,0 +1,90 @@
+package sources
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ImportStore keeps uploaded trace dumps (POST /api/traces/import) in memory
+// until they expire. The span data is opaque to this package; only the span
+// counts matter, for the ImportMaxSpans cap.
+type ImportStore struct {
+	mu     sync.Mutex
+	traces map[string]storedImport
+	order  []string // IDs oldest first; may hold already dropped ones
+	spans  int
+}
+
+// ImportedTrace is one trace of an upload; Spans holds N spans.
+type ImportedTrace struct {
+	ID    string
+	Spans any
+	N     int
+}
+
+type storedImport struct {
+	spans   any
+	n       int
+	expires time.Time
+}
+
+// Imports returns the store shared by every handler of s, so an ID issued
+// by the import endpoint resolves in the others.
+func (s *Sources) Imports() *ImportStore {
+	s.importsOnce.Do(func() { s.imports = &ImportStore{traces: map[string]storedImport{}} })
+	return s.imports
+}
+
+// Get returns the spans stored under id unless they expired.
+func (st *ImportStore) Get(id string) (any, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.traces[id]
+	if !ok || time.Now().After(t.expires) {
+		return nil, false
+	}
+	return t.spans, true
+}
+
+// Put stores every trace of one upload until expires. It first drops expired
+// traces and then traces of earlier uploads, oldest first, until the total
+// span count fits in maxSpans; an upload larger than maxSpans by itself is
+// rejected and nothing is stored.
+func (st *ImportStore) Put(upload []ImportedTrace, expires time.Time, maxSpans int) error {
+	n := 0
+	for _, t := range upload {
+		n += t.N
+	}
+	if n > maxSpans {
+		return fmt.Errorf("upload has %d spans; import limit is %d", n, maxSpans)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	live := st.order[:0]
+	for _, id := range st.order {
+		if t, ok := st.traces[id]; ok && now.After(t.expires) {
+			st.drop(id)
+		} else if ok {
+			live = append(live, id)
+		}
+	}
+	st.order = live
+	for len(st.order) > 0 && st.spans+n > maxSpans {
+		st.drop(st.order[0])
+		st.order = st.order[1:]
+	}
+	for _, t := range upload {
+		st.traces[t.ID] = storedImport{spans: t.Spans, n: t.N, expires: expires}
+		st.order = append(st.order, t.ID)
+		st.spans += t.N
+	}
+	return nil
+}
+
+func (st *ImportStore) drop(id string) {
+	st.spans -= st.traces[id].n
+	delete(st.traces, id)
+}
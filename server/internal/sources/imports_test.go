@@ -0,0 +1,59 @@
+package sources
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImportStore_ExpiryAndSpanCap(t *testing.T) {
+	st := (&Sources{}).Imports()
+	up := func(n int, ids ...string) []ImportedTrace {
+		var out []ImportedTrace
+		for _, id := range ids {
+			out = append(out, ImportedTrace{ID: id, Spans: id, N: n})
+		}
+		return out
+	}
+
+	if err := st.Put(up(2, "old"), time.Now().Add(-time.Second), 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Get("old"); ok {
+		t.Fatalf("expired trace still served")
+	}
+	// a is stored first but expires last: eviction goes by upload order.
+	if err := st.Put(up(4, "a"), time.Now().Add(time.Hour), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put(up(4, "b"), time.Now().Add(time.Minute), 10); err != nil {
+		t.Fatal(err)
+	}
+	if st.spans != 8 {
+		t.Fatalf("spans=%d want 8 (expired one swept)", st.spans)
+	}
+	if err := st.Put(up(3, "c", "d"), time.Now().Add(time.Minute), 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Get("a"); ok {
+		t.Fatalf("oldest upload should be evicted to fit the cap")
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		if v, ok := st.Get(id); !ok || v != id {
+			t.Fatalf("%s: got %v, %v", id, v, ok)
+		}
+	}
+	// The traces of one upload never evict each other.
+	if err := st.Put(up(4, "e", "f", "g"), time.Now().Add(time.Minute), 10); err == nil {
+		t.Fatalf("oversized upload accepted")
+	}
+	if _, ok := st.Get("b"); !ok || st.spans != 10 {
+		t.Fatalf("rejected upload changed the store: spans=%d", st.spans)
+	}
+}
+
+func TestImports_PerSources(t *testing.T) {
+	a, b := &Sources{}, &Sources{}
+	if a.Imports() != a.Imports() || a.Imports() == b.Imports() {
+		t.Fatalf("want one store per Sources")
+	}
+}
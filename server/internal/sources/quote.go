@@ -0,0 +1,12 @@
+package sources
+
+import "strings"
+
+var literalEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// Quote makes s a ClickHouse string literal. Backslashes are escapes there,
+// so they are doubled along with the quotes; use it for every value pasted
+// into SQL, regex patterns included.
+func Quote(s string) string {
+	return "'" + literalEscaper.Replace(s) + "'"
+}
@@ -0,0 +1,17 @@
+package sources
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"web":     `'web'`,
+		"o'neil":  `'o\'neil'`,
+		`a\`:      `'a\\'`,
+		`\' OR 1`: `'\\\' OR 1'`,
+		`\d+\.`:   `'\\d+\\.'`,
+	} {
+		if got := Quote(in); got != want {
+			t.Errorf("Quote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package sources
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TraceSchema describes where and how the exporter stores spans, and where
+// the rollup tables live. Empty fields mean the official exporter's names;
+// use WithDefaults before building SQL.
+type TraceSchema struct {
+	Tables  TraceTables  `yaml:"tables"`
+	Columns TraceColumns `yaml:"columns"`
+
+	DurationColumn string `yaml:"durationColumn"` // e.g. "Duration"
+	DurationUnit   string `yaml:"durationUnit"`   // "ns", "us" or "ms"
+
+	// TimestampType is how the span start is stored: "datetime64" (default),
+	// "datetime" (second precision) or "unix_nanos" (an integer column).
+	TimestampType string `yaml:"timestampType"`
+	// AttributeStorage is "map" (Map(String, String), default) or "json"
+	// (a String column holding a JSON object).
+	AttributeStorage string `yaml:"attributeStorage"`
+}
+
+// TraceTables are table names inside CH_DATABASE.
+type TraceTables struct {
+	Spans            string `yaml:"spans"`
+	TraceRoots       string `yaml:"traceRoots"`
+	ServiceSuggest   string `yaml:"serviceSuggest"`
+	OperationSuggest string `yaml:"operationSuggest"`
+	AttrValues       string `yaml:"attrValues"`
+	AttrKeys         string `yaml:"attrKeys"`
+}
+
+// TraceColumns are span table column names.
+type TraceColumns struct {
+	TraceId            string `yaml:"traceId"`
+	SpanId             string `yaml:"spanId"`
+	ParentSpanId       string `yaml:"parentSpanId"`
+	SpanName           string `yaml:"spanName"`
+	SpanKind           string `yaml:"spanKind"`
+	ServiceName        string `yaml:"serviceName"`
+	Timestamp          string `yaml:"timestamp"`
+	SpanAttributes     string `yaml:"spanAttributes"`
+	ResourceAttributes string `yaml:"resourceAttributes"`
+	StatusCode         string `yaml:"statusCode"`
+	StatusMessage      string `yaml:"statusMessage"`
+	TraceState         string `yaml:"traceState"`
+	ScopeName          string `yaml:"scopeName"`
+	ScopeVersion       string `yaml:"scopeVersion"`
+	// Events and Links are Nested column prefixes (Events.Timestamp,
+	// Events.Name, Events.Attributes; Links.TraceId, Links.SpanId,
+	// Links.TraceState, Links.Attributes).
+	Events string `yaml:"events"`
+	Links  string `yaml:"links"`
+}
+
+// DefaultTraceSchema matches the official ClickHouse exporter.
+var DefaultTraceSchema = TraceSchema{
+	Tables: TraceTables{
+		Spans:            "otel_traces",
+		TraceRoots:       "trace_roots",
+		ServiceSuggest:   "service_suggest",
+		OperationSuggest: "operation_suggest",
+		AttrValues:       "attr_values",
+		AttrKeys:         "attr_keys",
+	},
+	Columns: TraceColumns{
+		TraceId:            "TraceId",
+		SpanId:             "SpanId",
+		ParentSpanId:       "ParentSpanId",
+		SpanName:           "SpanName",
+		SpanKind:           "SpanKind",
+		ServiceName:        "ServiceName",
+		Timestamp:          "Timestamp",
+		SpanAttributes:     "SpanAttributes",
+		ResourceAttributes: "ResourceAttributes",
+		StatusCode:         "StatusCode",
+		StatusMessage:      "StatusMessage",
+		TraceState:         "TraceState",
+		ScopeName:          "ScopeName",
+		ScopeVersion:       "ScopeVersion",
+		Events:             "Events",
+		Links:              "Links",
+	},
+	DurationColumn:   "Duration",
+	DurationUnit:     "ns",
+	TimestampType:    "datetime64",
+	AttributeStorage: "map",
+}
+
+// WithDefaults returns t with every empty field taken from DefaultTraceSchema.
+func (t TraceSchema) WithDefaults() TraceSchema {
+	d := DefaultTraceSchema
+	or := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	or(&t.Tables.Spans, d.Tables.Spans)
+	or(&t.Tables.TraceRoots, d.Tables.TraceRoots)
+	or(&t.Tables.ServiceSuggest, d.Tables.ServiceSuggest)
+	or(&t.Tables.OperationSuggest, d.Tables.OperationSuggest)
+	or(&t.Tables.AttrValues, d.Tables.AttrValues)
+	or(&t.Tables.AttrKeys, d.Tables.AttrKeys)
+	or(&t.Columns.TraceId, d.Columns.TraceId)
+	or(&t.Columns.SpanId, d.Columns.SpanId)
+	or(&t.Columns.ParentSpanId, d.Columns.ParentSpanId)
+	or(&t.Columns.SpanName, d.Columns.SpanName)
+	or(&t.Columns.SpanKind, d.Columns.SpanKind)
+	or(&t.Columns.ServiceName, d.Columns.ServiceName)
+	or(&t.Columns.Timestamp, d.Columns.Timestamp)
+	or(&t.Columns.SpanAttributes, d.Columns.SpanAttributes)
+	or(&t.Columns.ResourceAttributes, d.Columns.ResourceAttributes)
+	or(&t.Columns.StatusCode, d.Columns.StatusCode)
+	or(&t.Columns.StatusMessage, d.Columns.StatusMessage)
+	or(&t.Columns.TraceState, d.Columns.TraceState)
+	or(&t.Columns.ScopeName, d.Columns.ScopeName)
+	or(&t.Columns.ScopeVersion, d.Columns.ScopeVersion)
+	or(&t.Columns.Events, d.Columns.Events)
+	or(&t.Columns.Links, d.Columns.Links)
+	or(&t.DurationColumn, d.DurationColumn)
+	or(&t.DurationUnit, d.DurationUnit)
+	or(&t.TimestampType, d.TimestampType)
+	or(&t.AttributeStorage, d.AttributeStorage)
+	return t
+}
+
+var schemaIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate rejects names that are not plain identifiers (they are spliced
+// into SQL unquoted) and unknown unit, timestamp or storage kinds.
+func (t TraceSchema) Validate() error {
+	t = t.WithDefaults()
+	names := map[string]string{
+		"tables.spans": t.Tables.Spans, "tables.traceRoots": t.Tables.TraceRoots,
+		"tables.serviceSuggest": t.Tables.ServiceSuggest, "tables.operationSuggest": t.Tables.OperationSuggest,
+		"tables.attrValues": t.Tables.AttrValues, "tables.attrKeys": t.Tables.AttrKeys,
+		"columns.traceId": t.Columns.TraceId, "columns.spanId": t.Columns.SpanId,
+		"columns.parentSpanId": t.Columns.ParentSpanId, "columns.spanName": t.Columns.SpanName,
+		"columns.spanKind": t.Columns.SpanKind, "columns.serviceName": t.Columns.ServiceName,
+		"columns.timestamp": t.Columns.Timestamp, "columns.spanAttributes": t.Columns.SpanAttributes,
+		"columns.resourceAttributes": t.Columns.ResourceAttributes, "columns.statusCode": t.Columns.StatusCode,
+		"columns.statusMessage": t.Columns.StatusMessage, "columns.traceState": t.Columns.TraceState,
+		"columns.scopeName": t.Columns.ScopeName, "columns.scopeVersion": t.Columns.ScopeVersion,
+		"columns.events": t.Columns.Events, "columns.links": t.Columns.Links,
+		"durationColumn": t.DurationColumn,
+	}
+	for k, v := range names {
+		if !schemaIdentRe.MatchString(v) {
+			return fmt.Errorf("schema %s: %q is not a plain identifier", k, v)
+		}
+	}
+	if nsPerUnit[t.DurationUnit] == 0 {
+		return fmt.Errorf("schema durationUnit: %q (want ns, us or ms)", t.DurationUnit)
+	}
+	switch t.TimestampType {
+	case "datetime64", "datetime", "unix_nanos":
+	default:
+		return fmt.Errorf("schema timestampType: %q (want datetime64, datetime or unix_nanos)", t.TimestampType)
+	}
+	switch t.AttributeStorage {
+	case "map", "json":
+	default:
+		return fmt.Errorf("schema attributeStorage: %q (want map or json)", t.AttributeStorage)
+	}
+	return nil
+}
+
+// LoadTraceSchema reads a YAML schema mapping; see README for the layout.
+func LoadTraceSchema(path string) (TraceSchema, error) {
+	var t TraceSchema
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	if err := yaml.Unmarshal(b, &t); err != nil {
+		return t, fmt.Errorf("%s: %w", path, err)
+	}
+	// Unit stays empty unless set so DetectTraceSchema can still sample it.
+	if err := t.WithDefaults().Validate(); err != nil {
+		return t, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Col qualifies column c with alias ("t" gives t.TraceId); "" leaves it bare.
+func Col(alias, c string) string {
+	if alias != "" {
+		return alias + "." + c
+	}
+	return c
+}
+
+// StartNs returns a SQL expression for the span start in Unix nanoseconds.
+func (t TraceSchema) StartNs(alias string) string {
+	return t.TimeNs(Col(alias, t.WithDefaults().Columns.Timestamp))
+}
+
+// TimeNs converts any expression stored like the span timestamp (including
+// Events.Timestamp elements) to Unix nanoseconds.
+func (t TraceSchema) TimeNs(col string) string {
+	switch t.WithDefaults().TimestampType {
+	case "datetime":
+		return fmt.Sprintf("(toInt64(toUnixTimestamp(%s)) * 1000000000)", col)
+	case "unix_nanos":
+		return fmt.Sprintf("toInt64(%s)", col)
+	default:
+		return fmt.Sprintf("toUnixTimestamp64Nano(%s)", col)
+	}
+}
+
+// StartTime returns a SQL expression for the span start as a DateTime, for
+// window predicates and hourly bucketing.
+func (t TraceSchema) StartTime(alias string) string {
+	t = t.WithDefaults()
+	col := Col(alias, t.Columns.Timestamp)
+	if t.TimestampType == "unix_nanos" {
+		return fmt.Sprintf("toDateTime(intDiv(%s, 1000000000))", col)
+	}
+	return col
+}
+
+// AttrMap returns a Map(String, String) expression for an attribute column
+// (t.Columns.SpanAttributes or ResourceAttributes).
+func (t TraceSchema) AttrMap(alias, col string) string {
+	c := Col(alias, col)
+	if t.WithDefaults().AttributeStorage == "json" {
+		return fmt.Sprintf("CAST(JSONExtractKeysAndValues(%s, 'String'), 'Map(String, String)')", c)
+	}
+	return c
+}
+
+// Attr returns a String expression for one attribute value; key must already
+// be a quoted SQL string literal.
+func (t TraceSchema) Attr(alias, col, quotedKey string) string {
+	c := Col(alias, col)
+	if t.WithDefaults().AttributeStorage == "json" {
+		return fmt.Sprintf("JSONExtractString(%s, %s)", c, quotedKey)
+	}
+	return fmt.Sprintf("%s[%s]", c, quotedKey)
+}
+
+// HasAttr returns a boolean expression for whether an attribute is set; key
+// must already be a quoted SQL string literal.
+func (t TraceSchema) HasAttr(alias, col, quotedKey string) string {
+	c := Col(alias, col)
+	if t.WithDefaults().AttributeStorage == "json" {
+		return fmt.Sprintf("JSONHas(%s, %s)", c, quotedKey)
+	}
+	return fmt.Sprintf("mapContains(%s, %s)", c, quotedKey)
+}
+
+var nsPerUnit = map[string]int64{"ns": 1, "us": 1000, "ms": 1000000}
+
+// durationCandidates are known duration column names across exporter
+// versions; a unit suffix settles the unit without sampling.
+var durationCandidates = []struct{ name, unit string }{
+	{"Duration", ""},
+	{"DurationNano", "ns"},
+	{"DurationNs", "ns"},
+	{"DurationUs", "us"},
+	{"DurationMs", "ms"},
+}
+
+// DurationNs returns a SQL expression for the span duration in nanoseconds.
+// alias qualifies the column ("t" gives t.Duration); "" leaves it bare.
+func (t TraceSchema) DurationNs(alias string) string {
+	col := t.col(alias)
+	if n := nsPerUnit[t.DurationUnit]; n > 1 {
+		return fmt.Sprintf("(%s * %d)", col, n)
+	}
+	return col
+}
+
+// DurationMs returns a SQL expression for the span duration in milliseconds.
+func (t TraceSchema) DurationMs(alias string) string {
+	col := t.col(alias)
+	switch n := nsPerUnit[t.DurationUnit]; n {
+	case 1000000:
+		return col
+	case 0:
+		return fmt.Sprintf("(%s / 1000000)", col)
+	default:
+		return fmt.Sprintf("(%s / %d)", col, 1000000/n)
+	}
+}
+
+func (t TraceSchema) col(alias string) string {
+	c := t.DurationColumn
+	if c == "" {
+		c = DefaultTraceSchema.DurationColumn
+	}
+	return Col(alias, c)
+}
+
+// DetectTraceSchema fills in whatever the schema file and
+// CH_DURATION_COLUMN/CH_DURATION_UNIT left unset for the duration by
+// inspecting system.columns and, when the column name does not say, sampling
+// stored durations. Anything it cannot work out falls back to
+// DefaultTraceSchema.
+func (s *Sources) DetectTraceSchema() error {
+	ts := &s.Traces
+	defer func() {
+		if ts.DurationColumn == "" {
+			ts.DurationColumn = DefaultTraceSchema.DurationColumn
+		}
+		if nsPerUnit[ts.DurationUnit] == 0 {
+			ts.DurationUnit = DefaultTraceSchema.DurationUnit
+		}
+	}()
+	if ts.DurationColumn != "" && nsPerUnit[ts.DurationUnit] != 0 {
+		return nil
+	}
+
+	spans := ts.WithDefaults().Tables.Spans
+	b, err := s.QueryCH(fmt.Sprintf(
+		"SELECT name FROM system.columns WHERE database = %s AND table = %s FORMAT JSONEachRow",
+		Quote(s.CHDB), Quote(spans)))
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", spans, err)
+	}
+	cols := map[string]bool{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var row struct {
+			Name string `json:"name"`
+		}
+		if dec.Decode(&row) != nil {
+			break
+		}
+		cols[row.Name] = true
+	}
+
+	if ts.DurationColumn == "" {
+		for _, c := range durationCandidates {
+			if cols[c.name] {
+				ts.DurationColumn = c.name
+				if ts.DurationUnit == "" {
+					ts.DurationUnit = c.unit
+				}
+				break
+			}
+		}
+		if ts.DurationColumn == "" {
+			return fmt.Errorf("no duration column in %s.%s", s.CHDB, spans)
+		}
+	}
+	if nsPerUnit[ts.DurationUnit] != 0 {
+		return nil
+	}
+
+	// Typical spans last micro- to milliseconds, so a median of 10k or more
+	// only makes sense as nanoseconds (10µs) rather than milliseconds (10s).
+	b, err = s.QueryCH(fmt.Sprintf(
+		"SELECT count() AS n, toFloat64(median(%s)) AS p50 FROM (SELECT %[1]s FROM %s.%s LIMIT 10000)"+
+			" SETTINGS output_format_json_quote_64bit_integers = 0 FORMAT JSONEachRow",
+		ts.DurationColumn, s.CHDB, spans))
+	if err != nil {
+		return fmt.Errorf("sample durations: %w", err)
+	}
+	var row struct {
+		N   int64    `json:"n"`
+		P50 *float64 `json:"p50"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(b), &row); err != nil {
+		return fmt.Errorf("sample durations: %w", err)
+	}
+	// An empty table says nothing; keep the default rather than guess.
+	if row.N == 0 || row.P50 == nil {
+		log.Printf("%s.%s has no spans to sample; assuming %s", spans, ts.DurationColumn, DefaultTraceSchema.DurationUnit)
+		return nil
+	}
+	if *row.P50 >= 10000 {
+		ts.DurationUnit = "ns"
+	} else {
+		ts.DurationUnit = "ms"
+	}
+	log.Printf("%s.%s looks like %s (median %.0f)", spans, ts.DurationColumn, ts.DurationUnit, *row.P50)
+	return nil
+}
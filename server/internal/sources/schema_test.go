@@ -0,0 +1,182 @@
+package sources
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceSchema_DurationExpressions(t *testing.T) {
+	cases := []struct {
+		ts     TraceSchema
+		alias  string
+		ns, ms string
+	}{
+		{TraceSchema{DurationColumn: "Duration", DurationUnit: "ns"}, "", "Duration", "(Duration / 1000000)"},
+		{TraceSchema{DurationColumn: "Duration", DurationUnit: "us"}, "t", "(t.Duration * 1000)", "(t.Duration / 1000)"},
+		{TraceSchema{DurationColumn: "DurationMs", DurationUnit: "ms"}, "", "(DurationMs * 1000000)", "DurationMs"},
+		{TraceSchema{}, "", "Duration", "(Duration / 1000000)"}, // zero value = official exporter
+	}
+	for _, c := range cases {
+		if got := c.ts.DurationNs(c.alias); got != c.ns {
+			t.Fatalf("%+v DurationNs=%q want %q", c.ts, got, c.ns)
+		}
+		if got := c.ts.DurationMs(c.alias); got != c.ms {
+			t.Fatalf("%+v DurationMs=%q want %q", c.ts, got, c.ms)
+		}
+	}
+}
+
+// fakeColumnsCH answers system.columns with cols and duration sampling with
+// p50, or with an empty sample when p50 is "".
+func fakeColumnsCH(t *testing.T, cols []string, p50 string) (*httptest.Server, *int) {
+	t.Helper()
+	samples := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		switch sql := string(b); {
+		case strings.Contains(sql, "system.columns"):
+			for _, c := range cols {
+				w.Write([]byte(`{"name":"` + c + `"}` + "\n"))
+			}
+		case strings.Contains(sql, "median("):
+			samples++
+			if p50 == "" {
+				w.Write([]byte(`{"n":0,"p50":null}` + "\n"))
+				return
+			}
+			w.Write([]byte(`{"n":10000,"p50":` + p50 + `}` + "\n"))
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &samples
+}
+
+func TestDetectTraceSchema_SamplesNanoseconds(t *testing.T) {
+	ts, samples := fakeColumnsCH(t, []string{"Timestamp", "TraceId", "Duration"}, "2350000")
+	s := &Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	if err := s.DetectTraceSchema(); err != nil {
+		t.Fatalf("detect: %v", err)
+	}
+	if s.Traces != (TraceSchema{DurationColumn: "Duration", DurationUnit: "ns"}) || *samples != 1 {
+		t.Fatalf("schema=%+v samples=%d", s.Traces, *samples)
+	}
+}
+
+func TestDetectTraceSchema_SamplesMilliseconds(t *testing.T) {
+	ts, _ := fakeColumnsCH(t, []string{"Duration"}, "12.5")
+	s := &Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	_ = s.DetectTraceSchema()
+	if s.Traces.DurationUnit != "ms" {
+		t.Fatalf("unit=%q want ms", s.Traces.DurationUnit)
+	}
+}
+
+func TestDetectTraceSchema_EmptyTableKeepsDefaultUnit(t *testing.T) {
+	ts, samples := fakeColumnsCH(t, []string{"Duration"}, "")
+	s := &Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	if err := s.DetectTraceSchema(); err != nil {
+		t.Fatalf("detect: %v", err)
+	}
+	if s.Traces.DurationUnit != DefaultTraceSchema.DurationUnit || *samples != 1 {
+		t.Fatalf("schema=%+v samples=%d", s.Traces, *samples)
+	}
+}
+
+func TestDetectTraceSchema_ColumnSuffixSkipsSampling(t *testing.T) {
+	ts, samples := fakeColumnsCH(t, []string{"DurationNano"}, "1")
+	s := &Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	_ = s.DetectTraceSchema()
+	if s.Traces != (TraceSchema{DurationColumn: "DurationNano", DurationUnit: "ns"}) || *samples != 0 {
+		t.Fatalf("schema=%+v samples=%d", s.Traces, *samples)
+	}
+}
+
+func TestDetectTraceSchema_ConfigWinsAndFailureFallsBack(t *testing.T) {
+	s := &Sources{CHURL: "http://127.0.0.1:0", CHDB: "default", Client: http.DefaultClient,
+		Traces: TraceSchema{DurationColumn: "Duration", DurationUnit: "ms"}}
+	if err := s.DetectTraceSchema(); err != nil || s.Traces.DurationUnit != "ms" {
+		t.Fatalf("explicit config not kept: %+v err=%v", s.Traces, err)
+	}
+
+	s2 := &Sources{CHURL: "http://127.0.0.1:0", CHDB: "default", Client: http.DefaultClient}
+	if err := s2.DetectTraceSchema(); err == nil {
+		t.Fatalf("expected error from unreachable CH")
+	}
+	if s2.Traces.DurationColumn != "Duration" || s2.Traces.DurationUnit != "ns" {
+		t.Fatalf("fallback=%+v want Duration in ns", s2.Traces)
+	}
+}
+
+func TestLoadTraceSchema_YAMLMapping(t *testing.T) {
+	f := t.TempDir() + "/schema.yaml"
+	_ = os.WriteFile(f, []byte(`
+tables:
+  spans: spans_v2
+  traceRoots: roots_v2
+columns:
+  serviceName: Service
+  spanAttributes: Attrs
+timestampType: datetime
+attributeStorage: json
+durationUnit: ms
+`), 0o644)
+
+	ts, err := LoadTraceSchema(f)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	d := ts.WithDefaults()
+	if d.Tables.Spans != "spans_v2" || d.Tables.TraceRoots != "roots_v2" || d.Tables.ServiceSuggest != "service_suggest" {
+		t.Fatalf("tables=%+v", d.Tables)
+	}
+	if d.Columns.ServiceName != "Service" || d.Columns.TraceId != "TraceId" {
+		t.Fatalf("columns=%+v", d.Columns)
+	}
+	if got := ts.StartNs("t"); got != "(toInt64(toUnixTimestamp(t.Timestamp)) * 1000000000)" {
+		t.Fatalf("StartNs=%q", got)
+	}
+	if got := ts.Attr("", d.Columns.SpanAttributes, "'http.route'"); got != "JSONExtractString(Attrs, 'http.route')" {
+		t.Fatalf("Attr=%q", got)
+	}
+	if got := ts.AttrMap("", "Attrs"); !strings.HasPrefix(got, "CAST(JSONExtractKeysAndValues(Attrs") {
+		t.Fatalf("AttrMap=%q", got)
+	}
+}
+
+func TestTraceSchema_ValidateRejectsUnsafeNames(t *testing.T) {
+	bad := []TraceSchema{
+		{Tables: TraceTables{Spans: "otel_traces; DROP TABLE x"}},
+		{Columns: TraceColumns{TraceId: "Trace Id"}},
+		{DurationUnit: "s"},
+		{TimestampType: "string"},
+		{AttributeStorage: "nested"},
+	}
+	for _, ts := range bad {
+		if err := ts.Validate(); err == nil {
+			t.Fatalf("accepted %+v", ts)
+		}
+	}
+	if err := (TraceSchema{}).Validate(); err != nil {
+		t.Fatalf("zero schema rejected: %v", err)
+	}
+}
+
+func TestFromEnv_TableOverrides(t *testing.T) {
+	restoreEnv(t, "CH_SCHEMA_FILE", "CH_SPANS_TABLE", "CH_TRACE_ROOTS_TABLE", "CH_DURATION_UNIT")
+	_ = os.Unsetenv("CH_SCHEMA_FILE")
+	_ = os.Setenv("CH_SPANS_TABLE", "pipeline_b_spans")
+	_ = os.Setenv("CH_TRACE_ROOTS_TABLE", "pipeline_b_roots")
+	_ = os.Setenv("CH_DURATION_UNIT", "auto")
+
+	s := FromEnv()
+	if s.Traces.Tables.Spans != "pipeline_b_spans" || s.Traces.Tables.TraceRoots != "pipeline_b_roots" {
+		t.Fatalf("tables=%+v", s.Traces.Tables)
+	}
+	if s.Traces.DurationUnit != "" {
+		t.Fatalf("auto should leave unit for detection, got %q", s.Traces.DurationUnit)
+	}
+}
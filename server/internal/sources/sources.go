@@ -1,12 +1,18 @@
 package sources
 
 import (
+  "bytes"
+  "context"
   "fmt"
   "io"
+  "log"
+  "mime/multipart"
   "net/http"
   "net/url"
   "os"
+  "strconv"
   "strings"
+  "sync"
   "time"
 
   "github.com/gin-gonic/gin"
@@ -20,6 +26,45 @@ type Sources struct {
   CHPass   string
   CHDB     string
   Client   *http.Client
+
+  // Live log tail limits; zero values fall back to the defaults in tail.go.
+  TailMaxConns    int
+  TailMaxDuration time.Duration
+  TailHeartbeat   time.Duration
+
+  tailActive int64 // open tail streams, updated atomically
+
+  imports     *ImportStore // see Imports
+  importsOnce sync.Once
+
+  // Response cache: one TTL for all endpoints, entry limits per endpoint
+  // name (e.g. "suggest_services"). A zero TTL disables caching.
+  CacheTTL   time.Duration
+  CacheSizes map[string]int
+
+  // Attribute keys (span or resource) that get hourly value rollups in
+  // attr_values, from ATTR_VALUE_KEYS or one-per-line ATTR_VALUE_KEYS_FILE.
+  AttrValueKeys []string
+
+  // How spans are stored; unset fields are filled by DetectTraceSchema.
+  Traces TraceSchema
+
+  // Uploaded trace dumps (POST /api/traces/import) are kept in memory for
+  // ImportTTL, with at most ImportMaxSpans spans across all of them; see
+  // ImportStore.
+  ImportTTL      time.Duration
+  ImportMaxSpans int
+
+  // Trace detail (GET /api/traces/{id}) returns at most TraceMaxSpans spans;
+  // larger traces come back as a truncated skeleton.
+  TraceMaxSpans int
+
+  // DefaultRole (viewer, editor or admin) applies to callers of the saved
+  // query and dashboard APIs named by a trusted X-Forwarded-User, and to
+  // everyone in DemoMode; other callers are read-only. See package access.
+  DefaultRole        string
+  TrustForwardedUser bool
+  DemoMode           bool
 }
 
 func FromEnv() *Sources {
@@ -31,11 +76,90 @@ func FromEnv() *Sources {
     CHPass: getenv("CH_PASS",""),
     CHDB: getenv("CH_DATABASE","default"),
     Client: &http.Client{ Timeout: 20 * time.Second },
+    TailMaxConns: getenvInt("LOGS_TAIL_MAX_CONNS", defaultTailMaxConns),
+    TailMaxDuration: getenvDuration("LOGS_TAIL_MAX_DURATION", defaultTailMaxDuration),
+    TailHeartbeat: getenvDuration("LOGS_TAIL_HEARTBEAT", defaultTailHeartbeat),
+    CacheTTL: getenvDuration("CACHE_TTL", time.Minute),
+    CacheSizes: parseSizes(os.Getenv("CACHE_SIZES")),
+    AttrValueKeys: attrValueKeys(),
+    Traces: traceSchemaFromEnv(),
+    ImportTTL: getenvDuration("IMPORT_TTL", time.Hour),
+    ImportMaxSpans: getenvInt("IMPORT_MAX_SPANS", 1000000),
+    TraceMaxSpans: getenvInt("TRACE_MAX_SPANS", 10000),
+    DefaultRole: strings.ToLower(getenv("DEFAULT_ROLE", "editor")),
+    TrustForwardedUser: getenvBool("TRUST_FORWARDED_USER"),
+    DemoMode: getenvBool("DEMO_MODE"),
+  }
+}
+
+// traceSchemaFromEnv loads CH_SCHEMA_FILE (if set) and applies the
+// single-setting env overrides on top of it.
+func traceSchemaFromEnv() TraceSchema {
+  var ts TraceSchema
+  if f := os.Getenv("CH_SCHEMA_FILE"); f != "" {
+    var err error
+    if ts, err = LoadTraceSchema(f); err != nil { log.Fatalf("CH_SCHEMA_FILE: %v", err) }
+  }
+  if v := os.Getenv("CH_SPANS_TABLE"); v != "" { ts.Tables.Spans = v }
+  if v := os.Getenv("CH_TRACE_ROOTS_TABLE"); v != "" { ts.Tables.TraceRoots = v }
+  if v := os.Getenv("CH_DURATION_COLUMN"); v != "" { ts.DurationColumn = v }
+  if v := strings.ToLower(os.Getenv("CH_DURATION_UNIT")); v != "" && v != "auto" { ts.DurationUnit = v }
+  if err := ts.Validate(); err != nil { log.Fatalf("trace schema: %v", err) }
+  return ts
+}
+
+// DefaultAttrValueKeys are rolled up when no allowlist is configured.
+var DefaultAttrValueKeys = []string{"http.method", "deployment.environment", "db.system", "http.route"}
+
+func attrValueKeys() []string {
+  var keys []string
+  if f := os.Getenv("ATTR_VALUE_KEYS_FILE"); f != "" {
+    b, err := os.ReadFile(f)
+    if err != nil { log.Printf("ATTR_VALUE_KEYS_FILE: %v; using defaults", err); return DefaultAttrValueKeys }
+    for _, line := range strings.Split(string(b), "\n") {
+      if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") { keys = append(keys, line) }
+    }
+  } else {
+    for _, k := range strings.Split(os.Getenv("ATTR_VALUE_KEYS"), ",") {
+      if k = strings.TrimSpace(k); k != "" { keys = append(keys, k) }
+    }
+  }
+  if len(keys) == 0 { return DefaultAttrValueKeys }
+  return keys
+}
+
+// CacheSize returns the configured entry limit for the named endpoint cache,
+// or d when CACHE_SIZES does not mention it. "name=0" disables that cache.
+func (s *Sources) CacheSize(name string, d int) int {
+  if n, ok := s.CacheSizes[name]; ok { return n }
+  return d
+}
+
+// parseSizes reads "suggest_services=512,list=0" into a map, skipping junk.
+func parseSizes(v string) map[string]int {
+  out := map[string]int{}
+  for _, part := range strings.Split(v, ",") {
+    k, n, ok := strings.Cut(strings.TrimSpace(part), "=")
+    if !ok { continue }
+    if i, err := strconv.Atoi(strings.TrimSpace(n)); err == nil && i >= 0 { out[strings.TrimSpace(k)] = i }
   }
+  return out
 }
 
 func getenv(k,d string) string { if v:=os.Getenv(k); v!="" { return v }; return d }
 
+func getenvInt(k string, d int) int {
+  if n, err := strconv.Atoi(os.Getenv(k)); err == nil && n > 0 { return n }
+  return d
+}
+
+func getenvBool(k string) bool { v, _ := strconv.ParseBool(os.Getenv(k)); return v }
+
+func getenvDuration(k string, d time.Duration) time.Duration {
+  if v, err := time.ParseDuration(os.Getenv(k)); err == nil && v > 0 { return v }
+  return d
+}
+
 // ---- Proxies ----
 type metricsReq struct{ Query string `json:"query"`; Start float64 `json:"start"`; End float64 `json:"end"`; Step float64 `json:"step"` }
 
@@ -70,3 +194,64 @@ func (s *Sources) LogsProxy() gin.HandlerFunc {
     c.Data(resp.StatusCode, "application/json", b)
   }
 }
+
+// QueryCH posts sql to the ClickHouse HTTP interface and returns the raw
+// body. Non-2xx answers come back as errors carrying ClickHouse's message.
+func (s *Sources) QueryCH(sql string) ([]byte, error) {
+  body, err := s.postCH(context.Background(), s.Client, sql)
+  if err != nil { return nil, err }
+  defer body.Close()
+  return io.ReadAll(body)
+}
+
+// StreamCH is QueryCH for results too big to buffer: the caller reads the
+// body as ClickHouse sends it and must close it. Reading may take longer than
+// Client's timeout, so only ctx (usually the request's) bounds it.
+func (s *Sources) StreamCH(ctx context.Context, sql string) (io.ReadCloser, error) { return s.StreamCHWith(ctx, sql) }
+
+// ExternalTable is sent along with a query as ClickHouse external data, so a
+// long list of values need not be pasted into the SQL: "x IN Name" reads it.
+type ExternalTable struct {
+  Name      string
+  Structure string   // e.g. "SpanId String"
+  Rows      []string // one value per row
+}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`)
+
+// StreamCHWith is StreamCH with external tables attached. The query then
+// travels in the URL and the tables as a multipart body.
+func (s *Sources) StreamCHWith(ctx context.Context, sql string, tables ...ExternalTable) (io.ReadCloser, error) {
+  return s.postCH(ctx, s.streamClient(), sql, tables...)
+}
+
+func (s *Sources) postCH(ctx context.Context, client *http.Client, sql string, tables ...ExternalTable) (io.ReadCloser, error) {
+  target, ctype, body := s.CHURL, "", io.Reader(strings.NewReader(sql))
+  if len(tables) > 0 {
+    u, err := url.Parse(s.CHURL)
+    if err != nil { return nil, err }
+    q := u.Query(); q.Set("query", sql)
+    var buf bytes.Buffer
+    mw := multipart.NewWriter(&buf)
+    for _, t := range tables {
+      q.Set(t.Name+"_structure", t.Structure)
+      fw, err := mw.CreateFormFile(t.Name, t.Name+".tsv")
+      if err != nil { return nil, err }
+      for _, r := range t.Rows { io.WriteString(fw, tsvEscaper.Replace(r)+"\n") }
+    }
+    if err := mw.Close(); err != nil { return nil, err }
+    u.RawQuery = q.Encode()
+    target, ctype, body = u.String(), mw.FormDataContentType(), &buf
+  }
+  req, err := http.NewRequestWithContext(ctx, "POST", target, body)
+  if err != nil { return nil, err }
+  if ctype != "" { req.Header.Set("Content-Type", ctype) }
+  if s.CHUser != "" { req.SetBasicAuth(s.CHUser, s.CHPass) }
+  resp, err := client.Do(req)
+  if err != nil { return nil, err }
+  if resp.StatusCode >= http.StatusMultipleChoices {
+    defer resp.Body.Close(); b,_ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+    return nil, fmt.Errorf("CH %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+  }
+  return resp.Body, nil
+}
@@ -2,6 +2,7 @@ package sources
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -82,7 +83,7 @@ func TestFromEnv_DefaultsAndOverrides(t *testing.T) {
 		t.Fatalf("VLogsURL default = %q", s.VLogsURL)
 	}
 	if s.CHURL != "http://localhost:8123" || s.CHUser != "default" || s.CHDB != "default" {
-		t.Fatalf("CH defaults = %+v", *s)
+		t.Fatalf("CH defaults = %+v", s)
 	}
 	if s.Client == nil || s.Client.Timeout <= 0 {
 		t.Fatalf("Client should be initialized with timeout")
@@ -98,10 +99,10 @@ func TestFromEnv_DefaultsAndOverrides(t *testing.T) {
 
 	s2 := FromEnv()
 	if s2.PromURL != "http://prom.test:9090" || s2.VLogsURL != "http://logs.test:9428" {
-		t.Fatalf("env overrides not applied: %+v", *s2)
+		t.Fatalf("env overrides not applied: %+v", s2)
 	}
 	if s2.CHURL != "http://ch.test:8123" || s2.CHUser != "alice" || s2.CHPass != "secret" || s2.CHDB != "observability" {
-		t.Fatalf("CH env overrides not applied: %+v", *s2)
+		t.Fatalf("CH env overrides not applied: %+v", s2)
 	}
 }
 
@@ -250,3 +251,104 @@ func TestLogsProxy_UpstreamErrorReturns502(t *testing.T) {
 		t.Fatalf("want 502 got %d body=%s", w.Code, w.Body.String())
 	}
 }
+
+func TestCacheSize_ParsesPerEndpointLimits(t *testing.T) {
+	s := &Sources{CacheSizes: parseSizes("suggest_services=64, list=0,bogus,junk=x")}
+	if got := s.CacheSize("suggest_services", 512); got != 64 {
+		t.Fatalf("suggest_services=%d want 64", got)
+	}
+	if got := s.CacheSize("list", 128); got != 0 {
+		t.Fatalf("list=%d want 0 (disabled)", got)
+	}
+	if got := s.CacheSize("suggest_operations", 512); got != 512 {
+		t.Fatalf("default not applied: %d", got)
+	}
+	if _, ok := s.CacheSizes["junk"]; ok {
+		t.Fatalf("non-numeric size accepted")
+	}
+}
+
+func TestAttrValueKeys_EnvAndFile(t *testing.T) {
+	restoreEnv(t, "ATTR_VALUE_KEYS", "ATTR_VALUE_KEYS_FILE")
+
+	_ = os.Unsetenv("ATTR_VALUE_KEYS")
+	_ = os.Unsetenv("ATTR_VALUE_KEYS_FILE")
+	if got := attrValueKeys(); strings.Join(got, ",") != strings.Join(DefaultAttrValueKeys, ",") {
+		t.Fatalf("defaults=%v", got)
+	}
+
+	_ = os.Setenv("ATTR_VALUE_KEYS", " http.route , ,db.system")
+	if got := attrValueKeys(); strings.Join(got, ",") != "http.route,db.system" {
+		t.Fatalf("env keys=%v", got)
+	}
+
+	f := t.TempDir() + "/keys.txt"
+	_ = os.WriteFile(f, []byte("# rollups\nk8s.namespace.name\n\ncloud.region\n"), 0o644)
+	_ = os.Setenv("ATTR_VALUE_KEYS_FILE", f)
+	if got := attrValueKeys(); strings.Join(got, ",") != "k8s.namespace.name,cloud.region" {
+		t.Fatalf("file keys=%v", got)
+	}
+}
+
+func TestStreamCHWith_SendsExternalTables(t *testing.T) {
+	var query, structure, file string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, structure = r.URL.Query().Get("query"), r.URL.Query().Get("keep_structure")
+		f, _, err := r.FormFile("keep")
+		if err != nil {
+			t.Errorf("form file: %v", err)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		file = string(b)
+		w.Write([]byte("ok"))
+	}))
+	defer ch.Close()
+
+	s := &Sources{CHURL: ch.URL, Client: ch.Client()}
+	body, err := s.StreamCHWith(context.Background(), "SELECT 1 WHERE x IN keep", ExternalTable{Name: "keep", Structure: "x String", Rows: []string{"a", "b\tc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if query != "SELECT 1 WHERE x IN keep" || structure != "x String" || file != "a\nb\\tc\n" {
+		t.Fatalf("query=%q structure=%q file=%q", query, structure, file)
+	}
+}
+
+func TestStreamCH_OutlivesClientTimeoutButNotContext(t *testing.T) {
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(200 * time.Millisecond):
+			w.Write([]byte("b\n"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer ch.Close()
+	client := ch.Client()
+	client.Timeout = 50 * time.Millisecond
+	s := &Sources{CHURL: ch.URL, Client: client}
+
+	body, err := s.StreamCH(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(b) != "a\nb\n" {
+		t.Fatalf("read %q err=%v", b, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, err = s.StreamCH(ctx, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	cancel()
+	if _, err := io.ReadAll(body); err == nil {
+		t.Fatalf("read past a cancelled context")
+	}
+}
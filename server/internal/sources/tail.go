@@ -0,0 +1,186 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTailMaxConns    = 32
+	defaultTailMaxDuration = 15 * time.Minute
+	defaultTailHeartbeat   = 15 * time.Second
+
+	// tailBuffer is how many log lines may queue between the upstream reader
+	// and a slow SSE client before lines are dropped.
+	tailBuffer = 256
+)
+
+// LogsTail streams VictoriaLogs /select/logsql/tail to the client as
+// Server-Sent Events. Events are:
+//
+//	log       one raw JSON log line
+//	dropped   {"count":N} lines discarded because the client fell behind
+//	heartbeat {"ts":unix} sent when the stream is otherwise idle
+//	end       {"reason":"..."} the stream is about to close
+func (s *Sources) LogsTail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Query("query")
+		if query == "" {
+			c.JSON(400, gin.H{"error": "query required"})
+			return
+		}
+		if !s.acquireTail() {
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many open tail streams"})
+			return
+		}
+		defer s.releaseTail()
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), s.tailMaxDuration())
+		defer cancel()
+
+		form := url.Values{}
+		form.Set("query", query)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.VLogsURL+"/select/logsql/tail", strings.NewReader(form.Encode()))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "build tail request: " + err.Error()})
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := s.streamClient().Do(req)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusMultipleChoices {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("vlogs %d: %s", resp.StatusCode, string(b))})
+			return
+		}
+
+		// The reader never blocks on the client: when the buffer is full the
+		// line is counted as dropped so a stalled browser cannot pin upstream.
+		lines := make(chan []byte, tailBuffer)
+		var dropped int64
+		go func() {
+			defer close(lines)
+			sc := bufio.NewScanner(resp.Body)
+			sc.Buffer(make([]byte, 64*1024), 1<<20)
+			for sc.Scan() {
+				line := bytes.TrimSpace(sc.Bytes())
+				if len(line) == 0 {
+					continue
+				}
+				select {
+				case lines <- append([]byte(nil), line...):
+				default:
+					atomic.AddInt64(&dropped, 1)
+				}
+			}
+		}()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		// end reports lines dropped since the last log event, then closes.
+		end := func() {
+			if n := atomic.SwapInt64(&dropped, 0); n > 0 {
+				c.SSEvent("dropped", gin.H{"count": n})
+			}
+			c.SSEvent("end", gin.H{"reason": tailEndReason(ctx)})
+			c.Writer.Flush()
+		}
+
+		hb := time.NewTicker(s.tailHeartbeat())
+		defer hb.Stop()
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					end()
+					return
+				}
+				if n := atomic.SwapInt64(&dropped, 0); n > 0 {
+					c.SSEvent("dropped", gin.H{"count": n})
+				}
+				c.SSEvent("log", string(line))
+				hb.Reset(s.tailHeartbeat())
+			case <-hb.C:
+				c.SSEvent("heartbeat", gin.H{"ts": time.Now().Unix()})
+			case <-ctx.Done():
+				// Request context cancellation also covers the client going away.
+				end()
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+func tailEndReason(ctx context.Context) string {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "max duration reached"
+	case ctx.Err() != nil:
+		return "client closed"
+	default:
+		return "upstream closed"
+	}
+}
+
+func (s *Sources) acquireTail() bool {
+	if atomic.AddInt64(&s.tailActive, 1) > int64(s.tailMaxConns()) {
+		atomic.AddInt64(&s.tailActive, -1)
+		return false
+	}
+	return true
+}
+
+func (s *Sources) releaseTail() { atomic.AddInt64(&s.tailActive, -1) }
+
+// streamClient reuses the shared transport but drops the per-request timeout,
+// which would otherwise cut every tail and long ClickHouse stream off after a
+// few seconds.
+func (s *Sources) streamClient() *http.Client {
+	if s.Client == nil {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: s.Client.Transport}
+}
+
+func (s *Sources) tailMaxConns() int {
+	if s.TailMaxConns > 0 {
+		return s.TailMaxConns
+	}
+	return defaultTailMaxConns
+}
+
+func (s *Sources) tailMaxDuration() time.Duration {
+	if s.TailMaxDuration > 0 {
+		return s.TailMaxDuration
+	}
+	return defaultTailMaxDuration
+}
+
+func (s *Sources) tailHeartbeat() time.Duration {
+	if s.TailHeartbeat > 0 {
+		return s.TailHeartbeat
+	}
+	return defaultTailHeartbeat
+}
@@ -0,0 +1,142 @@
+package sources
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogsTail_StreamsLinesAsSSE(t *testing.T) {
+	var gotQuery string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/select/logsql/tail" {
+			t.Errorf("path=%s", r.URL.Path)
+		}
+		_ = r.ParseForm()
+		gotQuery = r.Form.Get("query")
+		w.Write([]byte(`{"_msg":"first"}` + "\n\n" + `{"_msg":"second"}` + "\n"))
+	}))
+	defer up.Close()
+
+	s := &Sources{VLogsURL: up.URL, Client: up.Client()}
+	r := route("GET", "/api/logs/tail", s.LogsTail())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/logs/tail?query=error", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	if gotQuery != "error" {
+		t.Fatalf("upstream query=%q", gotQuery)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("content-type=%q", ct)
+	}
+	body := w.Body.String()
+	if strings.Count(body, "event:log") != 2 || !strings.Contains(body, `data:{"_msg":"second"}`) {
+		t.Fatalf("log events missing: %s", body)
+	}
+	if !strings.Contains(body, "event:end") || !strings.Contains(body, "upstream closed") {
+		t.Fatalf("end event missing: %s", body)
+	}
+}
+
+// slowFlusher stalls the first flush, like a client that stopped reading.
+type slowFlusher struct {
+	*httptest.ResponseRecorder
+	stall time.Duration
+	once  sync.Once
+}
+
+func (w *slowFlusher) Flush() {
+	w.once.Do(func() { time.Sleep(w.stall) })
+	w.ResponseRecorder.Flush()
+}
+
+func TestLogsTail_ReportsDroppedBeforeEnd(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < tailBuffer*4; i++ {
+			fmt.Fprintf(w, "{\"i\":%d}\n", i)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer up.Close()
+
+	// The stream times out while the client is stalled and lines have been
+	// dropped; the count must still reach the client before end.
+	s := &Sources{VLogsURL: up.URL, Client: up.Client(), TailMaxDuration: 50 * time.Millisecond}
+	w := &slowFlusher{ResponseRecorder: httptest.NewRecorder(), stall: 200 * time.Millisecond}
+	route("GET", "/api/logs/tail", s.LogsTail()).ServeHTTP(w, httptest.NewRequest("GET", "/api/logs/tail?query=*", nil))
+
+	body := w.Body.String()
+	if !strings.Contains(body, "event:dropped") {
+		t.Fatalf("dropped lines not reported: %.300s", body)
+	}
+	if i := strings.LastIndex(body, "event:"); !strings.HasPrefix(body[i:], "event:end") {
+		t.Fatalf("stream does not finish with end: %s", body[i:])
+	}
+}
+
+func TestLogsTail_HeartbeatAndMaxDuration(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer up.Close()
+
+	s := &Sources{
+		VLogsURL:        up.URL,
+		Client:          up.Client(),
+		TailHeartbeat:   10 * time.Millisecond,
+		TailMaxDuration: 80 * time.Millisecond,
+	}
+	r := route("GET", "/api/logs/tail", s.LogsTail())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/logs/tail?query=*", nil))
+
+	body := w.Body.String()
+	if !strings.Contains(body, "event:heartbeat") {
+		t.Fatalf("no heartbeat: %s", body)
+	}
+	if !strings.Contains(body, "max duration reached") {
+		t.Fatalf("stream not cut at max duration: %s", body)
+	}
+	if s.tailActive != 0 {
+		t.Fatalf("slot not released: %d", s.tailActive)
+	}
+}
+
+func TestLogsTail_RejectsOverConcurrencyCap(t *testing.T) {
+	s := &Sources{VLogsURL: "http://127.0.0.1:0", Client: http.DefaultClient, TailMaxConns: 1}
+	if !s.acquireTail() {
+		t.Fatalf("first slot should be free")
+	}
+	r := route("GET", "/api/logs/tail", s.LogsTail())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/logs/tail?query=*", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("want 429 got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Retry-After not set")
+	}
+}
+
+func TestLogsTail_RequiresQuery(t *testing.T) {
+	s := &Sources{Client: http.DefaultClient}
+	r := route("GET", "/api/logs/tail", s.LogsTail())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/logs/tail", nil))
+	if w.Code != 400 {
+		t.Fatalf("want 400 got %d", w.Code)
+	}
+}
@@ -0,0 +1,231 @@
+package traceql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// SearchOptions bound a search.
+type SearchOptions struct {
+	Start, End      time.Time
+	Limit           int // traces
+	SpansPerSpanset int
+	// MinDuration and MaxDuration filter on whole-trace duration from
+	// trace_roots; zero means unbounded.
+	MinDuration, MaxDuration time.Duration
+}
+
+// SearchSQL compiles e into one ClickHouse query returning, per matching
+// trace and newest first: TraceId, last_ns, matched (the spanset size) and
+// spans, up to SpansPerSpanset tuples of
+// (SpanId, ParentSpanId, start_ns, duration_ns, ServiceName, SpanName)
+// with the numbers as strings.
+//
+// Every { } filter becomes a groupArrayIf over the trace's spans; && , ||
+// and > then combine those arrays per trace, so the whole expression is
+// evaluated in a single pass over the spans table.
+func SearchSQL(db string, ts sources.TraceSchema, e Expr, o SearchOptions) (string, error) {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	c := &compiler{ts: ts}
+	combined, err := c.spanset(e)
+	if err != nil {
+		return "", err
+	}
+
+	span := fmt.Sprintf("tuple(%s, %s, toString(%s), toString(%s), %s, %s)",
+		col.SpanId, col.ParentSpanId, ts.StartNs(""), ts.DurationNs(""), col.ServiceName, col.SpanName)
+	aggs := make([]string, len(c.preds))
+	for i, p := range c.preds {
+		aggs[i] = fmt.Sprintf("groupArrayIf(%s, %s) AS m%d", span, p, i)
+	}
+
+	where := []string{
+		fmt.Sprintf("%s BETWEEN toDateTime(%d) AND toDateTime(%d)", ts.StartTime(""), o.Start.Unix(), o.End.Unix()),
+		"(" + strings.Join(c.preds, " OR ") + ")",
+	}
+	if o.MinDuration > 0 || o.MaxDuration > 0 {
+		roots := []string{fmt.Sprintf("StartTs BETWEEN toDateTime(%d) AND toDateTime(%d)", o.Start.Unix(), o.End.Unix())}
+		if o.MinDuration > 0 {
+			roots = append(roots, fmt.Sprintf("DurationMs >= %g", float64(o.MinDuration)/float64(time.Millisecond)))
+		}
+		if o.MaxDuration > 0 {
+			roots = append(roots, fmt.Sprintf("DurationMs <= %g", float64(o.MaxDuration)/float64(time.Millisecond)))
+		}
+		where = append(where, fmt.Sprintf("%s IN (SELECT TraceId FROM %s.%s WHERE %s)",
+			col.TraceId, db, ts.Tables.TraceRoots, strings.Join(roots, " AND ")))
+	}
+
+	spss := o.SpansPerSpanset
+	if spss <= 0 {
+		spss = 3
+	}
+	return fmt.Sprintf(`
+SELECT TraceId, last_ns, %s AS all_matched, length(all_matched) AS matched, arraySlice(all_matched, 1, %d) AS spans
+FROM
+(
+  SELECT %s AS TraceId, max(%s) AS last_ns,
+    %s
+  FROM %s.%s
+  WHERE %s
+  GROUP BY TraceId
+)
+WHERE matched > 0
+ORDER BY last_ns DESC
+LIMIT %d
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, combined, spss, col.TraceId, ts.StartNs(""), strings.Join(aggs, ",\n    "),
+		db, ts.Tables.Spans, strings.Join(where, "\n    AND "), o.Limit), nil
+}
+
+type compiler struct {
+	ts    sources.TraceSchema
+	preds []string // one span predicate per { } filter, referenced as m<i>
+	vars  int      // lambda variable counter, so nested lambdas never shadow
+}
+
+// spanset returns an Array(tuple) expression over the m<i> columns.
+func (c *compiler) spanset(e Expr) (string, error) {
+	switch e := e.(type) {
+	case *Filter:
+		p := "1"
+		if e.Cond != nil {
+			var err error
+			if p, err = c.cond(e.Cond); err != nil {
+				return "", err
+			}
+		}
+		c.preds = append(c.preds, p)
+		return fmt.Sprintf("m%d", len(c.preds)-1), nil
+	case *Spanset:
+		l, err := c.spanset(e.L)
+		if err != nil {
+			return "", err
+		}
+		r, err := c.spanset(e.R)
+		if err != nil {
+			return "", err
+		}
+		switch e.Op {
+		case "&&":
+			return fmt.Sprintf("if(notEmpty(%s) AND notEmpty(%s), arrayDistinct(arrayConcat(%[1]s, %[2]s)), arrayResize(%[1]s, 0))", l, r), nil
+		case "||":
+			return fmt.Sprintf("arrayDistinct(arrayConcat(%s, %s))", l, r), nil
+		case ">":
+			c.vars++
+			x, y := fmt.Sprintf("x%d", c.vars), fmt.Sprintf("y%d", c.vars)
+			return fmt.Sprintf("arrayFilter(%[1]s -> has(arrayMap(%[2]s -> %[2]s.1, %[3]s), %[1]s.2), %[4]s)", x, y, l, r), nil
+		}
+	}
+	return "", fmt.Errorf("traceql: unsupported spanset expression %T", e)
+}
+
+// cond returns a span-level SQL predicate.
+func (c *compiler) cond(cd Cond) (string, error) {
+	switch cd := cd.(type) {
+	case *Logic:
+		l, err := c.cond(cd.L)
+		if err != nil {
+			return "", err
+		}
+		r, err := c.cond(cd.R)
+		if err != nil {
+			return "", err
+		}
+		op := "AND"
+		if cd.Op == "||" {
+			op = "OR"
+		}
+		return fmt.Sprintf("(%s %s %s)", l, op, r), nil
+	case *Compare:
+		return c.compare(cd)
+	}
+	return "", fmt.Errorf("traceql: unsupported condition %T", cd)
+}
+
+func (c *compiler) compare(cmp *Compare) (string, error) {
+	ts, col := c.ts, c.ts.Columns
+	f, v := cmp.Field, cmp.Value
+	if f.Scope == "intrinsic" {
+		switch f.Name {
+		case "name":
+			return scalar(col.SpanName, cmp.Op, v)
+		case "status":
+			return fmt.Sprintf("lower(replaceOne(%s, 'STATUS_CODE_', '')) %s %s", col.StatusCode, cmp.Op, sources.Quote(v.Str)), nil
+		case "kind":
+			return fmt.Sprintf("lower(replaceOne(%s, 'SPAN_KIND_', '')) %s %s", col.SpanKind, cmp.Op, sources.Quote(v.Str)), nil
+		case "duration":
+			return fmt.Sprintf("%s %s %d", ts.DurationNs(""), cmp.Op, v.Duration.Nanoseconds()), nil
+		}
+	}
+	if v.Kind == "duration" {
+		return "", fmt.Errorf("traceql: %s.%s: durations only compare with duration", f.Scope, f.Name)
+	}
+	if v.Kind == "bool" && cmp.Op != "=" && cmp.Op != "!=" {
+		return "", fmt.Errorf("traceql: booleans only compare with = or !=")
+	}
+
+	// service.name lives in its own column, which is always set.
+	if f.Name == "service.name" && f.Scope != "span" {
+		if v.Kind == "nil" {
+			return map[string]string{"=": "0", "!=": "1"}[cmp.Op], nil
+		}
+		return scalar(col.ServiceName, cmp.Op, v)
+	}
+
+	key := sources.Quote(f.Name)
+	one := func(attrCol string) (string, error) {
+		has := ts.HasAttr("", attrCol, key)
+		if v.Kind == "nil" {
+			if cmp.Op == "=" {
+				return "NOT " + has, nil
+			}
+			return has, nil
+		}
+		p, err := scalar(ts.Attr("", attrCol, key), cmp.Op, v)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s AND %s)", has, p), nil
+	}
+	switch f.Scope {
+	case "span":
+		return one(col.SpanAttributes)
+	case "resource":
+		return one(col.ResourceAttributes)
+	}
+	s, err := one(col.SpanAttributes)
+	if err != nil {
+		return "", err
+	}
+	r, _ := one(col.ResourceAttributes)
+	if v.Kind == "nil" && cmp.Op == "=" {
+		return fmt.Sprintf("(%s AND %s)", s, r), nil
+	}
+	return fmt.Sprintf("(%s OR %s)", s, r), nil
+}
+
+// scalar compares a String expression with a literal.
+func scalar(expr, op string, v Value) (string, error) {
+	switch op {
+	case "=~", "!~":
+		not := ""
+		if op == "!~" {
+			not = "NOT "
+		}
+		// Anchored, like Prometheus and Tempo.
+		return fmt.Sprintf("%smatch(%s, %s)", not, expr, sources.Quote("^(?:"+v.Str+")$")), nil
+	}
+	switch v.Kind {
+	case "number":
+		return fmt.Sprintf("ifNull(toFloat64OrNull(%s) %s %s, 0)", expr, op, strconv.FormatFloat(v.Num, 'g', -1, 64)), nil
+	case "string", "bool":
+		return fmt.Sprintf("%s %s %s", expr, op, sources.Quote(v.Str)), nil
+	}
+	return "", fmt.Errorf("traceql: cannot compare with %s", v.Kind)
+}
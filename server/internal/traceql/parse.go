@@ -0,0 +1,432 @@
+// Package traceql parses the subset of Grafana Tempo's TraceQL that the
+// search API supports and compiles it to ClickHouse SQL over the spans table.
+//
+// Supported:
+//
+//	{ span.http.method = "GET" && resource.service.name =~ "api-.*" }
+//	{ .db.system = "redis" || duration > 250ms }
+//	{ status = error } && { name = "SELECT" }
+//	{ kind = server } > { span.db.system != nil }   // child spans
+//
+// Fields are span.X, resource.X and .X (either scope), and the intrinsics
+// name, status, kind and duration (optionally written span:name etc.).
+// Operators are = != > >= < <= =~ !~; spansets combine with &&, || and the
+// structural child operator >.
+package traceql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expr is a spanset expression: a *Filter or a *Spanset combining two.
+type Expr interface{ spanset() }
+
+// Filter is { Cond }; a nil Cond matches every span.
+type Filter struct{ Cond Cond }
+
+// Spanset combines two spanset expressions with "&&", "||" or ">".
+type Spanset struct {
+	Op   string
+	L, R Expr
+}
+
+func (*Filter) spanset()  {}
+func (*Spanset) spanset() {}
+
+// Cond is a span-level condition: a *Compare or a *Logic.
+type Cond interface{ cond() }
+
+// Compare is Field Op Value.
+type Compare struct {
+	Field Field
+	Op    string
+	Value Value
+}
+
+// Logic combines two conditions with "&&" or "||".
+type Logic struct {
+	Op   string
+	L, R Cond
+}
+
+func (*Compare) cond() {}
+func (*Logic) cond()   {}
+
+// Field is an attribute (Scope "span", "resource" or "" for either) or an
+// intrinsic (Scope "intrinsic", Name one of name, status, kind, duration).
+type Field struct {
+	Scope string
+	Name  string
+}
+
+// Value is a literal: Kind is "string", "number", "duration", "bool", "nil"
+// or "enum" (status and kind values such as error or server).
+type Value struct {
+	Kind     string
+	Str      string
+	Num      float64
+	Duration time.Duration
+}
+
+// Error is a parse error with the byte offset it was found at.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("traceql: %s at offset %d", e.Msg, e.Pos) }
+
+var intrinsics = map[string]bool{"name": true, "status": true, "kind": true, "duration": true}
+
+// Parse parses a TraceQL query. An empty query means {}.
+func Parse(q string) (Expr, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	if p.peek().kind == tEOF {
+		return &Filter{}, nil
+	}
+	e, err := p.spansetOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, &Error{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return e, nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, &Error{t.pos, fmt.Sprintf("expected %s, got %q", what, t.text)}
+	}
+	return t, nil
+}
+
+// Precedence, loosest first: || then && then >.
+func (p *parser) spansetOr() (Expr, error) {
+	l, err := p.spansetAnd()
+	for err == nil && p.peek().kind == tOr {
+		p.next()
+		var r Expr
+		if r, err = p.spansetAnd(); err == nil {
+			l = &Spanset{Op: "||", L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) spansetAnd() (Expr, error) {
+	l, err := p.spansetChild()
+	for err == nil && p.peek().kind == tAnd {
+		p.next()
+		var r Expr
+		if r, err = p.spansetChild(); err == nil {
+			l = &Spanset{Op: "&&", L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) spansetChild() (Expr, error) {
+	l, err := p.spansetPrimary()
+	for err == nil && p.peek().kind == tOp && p.peek().text == ">" {
+		p.next()
+		var r Expr
+		if r, err = p.spansetPrimary(); err == nil {
+			l = &Spanset{Op: ">", L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) spansetPrimary() (Expr, error) {
+	switch t := p.next(); t.kind {
+	case tLParen:
+		e, err := p.spansetOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tRParen, ")")
+		return e, err
+	case tLBrace:
+		if p.peek().kind == tRBrace {
+			p.next()
+			return &Filter{}, nil
+		}
+		c, err := p.condOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tRBrace, "}")
+		return &Filter{Cond: c}, err
+	default:
+		return nil, &Error{t.pos, fmt.Sprintf("expected { or (, got %q", t.text)}
+	}
+}
+
+func (p *parser) condOr() (Cond, error) {
+	l, err := p.condAnd()
+	for err == nil && p.peek().kind == tOr {
+		p.next()
+		var r Cond
+		if r, err = p.condAnd(); err == nil {
+			l = &Logic{Op: "||", L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) condAnd() (Cond, error) {
+	l, err := p.condPrimary()
+	for err == nil && p.peek().kind == tAnd {
+		p.next()
+		var r Cond
+		if r, err = p.condPrimary(); err == nil {
+			l = &Logic{Op: "&&", L: l, R: r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) condPrimary() (Cond, error) {
+	if p.peek().kind == tLParen {
+		p.next()
+		c, err := p.condOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tRParen, ")")
+		return c, err
+	}
+	ft, err := p.expect(tIdent, "field")
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseField(ft)
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.expect(tOp, "operator")
+	if err != nil {
+		return nil, err
+	}
+	vt := p.next()
+	v, err := parseValue(vt)
+	if err != nil {
+		return nil, err
+	}
+	return &Compare{Field: f, Op: op.text, Value: v}, checkCompare(f, op, v)
+}
+
+func parseField(t token) (Field, error) {
+	s := t.text
+	switch {
+	case strings.HasPrefix(s, "span."):
+		return Field{"span", s[len("span."):]}, nil
+	case strings.HasPrefix(s, "resource."):
+		return Field{"resource", s[len("resource."):]}, nil
+	case strings.HasPrefix(s, "."):
+		return Field{"", s[1:]}, nil
+	case intrinsics[strings.TrimPrefix(s, "span:")]:
+		return Field{"intrinsic", strings.TrimPrefix(s, "span:")}, nil
+	}
+	return Field{}, &Error{t.pos, fmt.Sprintf("unknown field %q (want span.x, resource.x, .x, name, status, kind or duration)", s)}
+}
+
+func parseValue(t token) (Value, error) {
+	switch t.kind {
+	case tString:
+		return Value{Kind: "string", Str: t.text}, nil
+	case tNumber:
+		if d, ok := parseDuration(t.text); ok {
+			return Value{Kind: "duration", Duration: d}, nil
+		}
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return Value{}, &Error{t.pos, fmt.Sprintf("bad number %q", t.text)}
+		}
+		return Value{Kind: "number", Num: n, Str: t.text}, nil
+	case tIdent:
+		switch t.text {
+		case "true", "false":
+			return Value{Kind: "bool", Str: t.text}, nil
+		case "nil":
+			return Value{Kind: "nil"}, nil
+		}
+		return Value{Kind: "enum", Str: t.text}, nil
+	}
+	return Value{}, &Error{t.pos, fmt.Sprintf("expected value, got %q", t.text)}
+}
+
+func parseDuration(s string) (time.Duration, bool) {
+	if strings.IndexFunc(s, unicode.IsLetter) < 0 {
+		return 0, false
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil
+}
+
+var (
+	statusValues = map[string]bool{"error": true, "ok": true, "unset": true}
+	kindValues   = map[string]bool{"unspecified": true, "internal": true, "server": true, "client": true, "producer": true, "consumer": true}
+)
+
+// checkCompare rejects comparisons that cannot mean anything, so mistakes
+// surface as 400s instead of empty results.
+func checkCompare(f Field, op token, v Value) error {
+	bad := func(msg string) error { return &Error{op.pos, msg} }
+	regex := op.text == "=~" || op.text == "!~"
+	eq := op.text == "=" || op.text == "!="
+	if regex && v.Kind != "string" {
+		return bad("regex operators need a quoted string")
+	}
+	if v.Kind == "nil" && !eq {
+		return bad("nil only compares with = or !=")
+	}
+	if f.Scope != "intrinsic" {
+		if v.Kind == "enum" {
+			return bad(fmt.Sprintf("unquoted value %q; quote strings", v.Str))
+		}
+		return nil
+	}
+	switch f.Name {
+	case "status":
+		if !eq || v.Kind != "enum" || !statusValues[v.Str] {
+			return bad("status compares with = or != against error, ok or unset")
+		}
+	case "kind":
+		if !eq || v.Kind != "enum" || !kindValues[v.Str] {
+			return bad("kind compares with = or != against server, client, producer, consumer, internal or unspecified")
+		}
+	case "duration":
+		if v.Kind != "duration" || regex {
+			return bad("duration compares against a duration such as 250ms")
+		}
+	case "name":
+		if v.Kind != "string" {
+			return bad("name compares against a quoted string")
+		}
+	}
+	return nil
+}
+
+type tokKind int
+
+const (
+	tEOF tokKind = iota
+	tLBrace
+	tRBrace
+	tLParen
+	tRParen
+	tAnd
+	tOr
+	tOp
+	tIdent
+	tString
+	tNumber
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	var out []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '{' || c == '}' || c == '(' || c == ')':
+			kind := map[byte]tokKind{'{': tLBrace, '}': tRBrace, '(': tLParen, ')': tRParen}[c]
+			out = append(out, token{kind, string(c), i})
+			i++
+		case strings.HasPrefix(s[i:], "&&"):
+			out = append(out, token{tAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			out = append(out, token{tOr, "||", i})
+			i += 2
+		case strings.ContainsRune("=!<>", rune(c)):
+			op := string(c)
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "!=", "=~", "!~", ">=", "<=":
+					op = two
+				}
+			}
+			if op == "!" {
+				return nil, &Error{i, "expected != or !~"}
+			}
+			out = append(out, token{tOp, op, i})
+			i += len(op)
+		case c == '"' || c == '`':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' && c == '"' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, &Error{i, "unterminated string"}
+			}
+			raw := s[i : j+1]
+			str := raw[1 : len(raw)-1]
+			if c == '"' {
+				var err error
+				if str, err = strconv.Unquote(raw); err != nil {
+					return nil, &Error{i, "bad string escape"}
+				}
+			}
+			out = append(out, token{tString, str, i})
+			i = j + 1
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || isWordByte(s[j])) {
+				j++
+			}
+			out = append(out, token{tNumber, s[i:j], i})
+			i = j
+		case c == '.' || isWordByte(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || s[j] == ':' || s[j] == '/' || s[j] == '-' || isWordByte(s[j])) {
+				j++
+			}
+			out = append(out, token{tIdent, s[i:j], i})
+			i = j
+		default:
+			return nil, &Error{i, fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(out, token{tEOF, "end of query", len(s)}), nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,154 @@
+package traceql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func TestParse_Structure(t *testing.T) {
+	e, err := Parse(`{ span.http.method = "GET" && (resource.env = "prod" || .retry = true) } > { duration >= 1.5ms }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, ok := e.(*Spanset)
+	if !ok || child.Op != ">" {
+		t.Fatalf("top=%#v", e)
+	}
+	l := child.L.(*Filter).Cond.(*Logic)
+	if l.Op != "&&" {
+		t.Fatalf("left=%#v", l)
+	}
+	get := l.L.(*Compare)
+	if get.Field != (Field{"span", "http.method"}) || get.Op != "=" || get.Value.Str != "GET" {
+		t.Fatalf("get=%#v", get)
+	}
+	or := l.R.(*Logic)
+	if or.Op != "||" || or.R.(*Compare).Field != (Field{"", "retry"}) || or.R.(*Compare).Value.Kind != "bool" {
+		t.Fatalf("or=%#v", or)
+	}
+	d := child.R.(*Filter).Cond.(*Compare)
+	if d.Field != (Field{"intrinsic", "duration"}) || d.Op != ">=" || d.Value.Duration != 1500*time.Microsecond {
+		t.Fatalf("duration=%#v", d)
+	}
+}
+
+func TestParse_Precedence(t *testing.T) {
+	// > binds tighter than &&, which binds tighter than ||.
+	e, err := Parse(`{.a="1"} || {.b="2"} && {.c="3"} > {.d="4"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	or := e.(*Spanset)
+	and, ok := or.R.(*Spanset)
+	if or.Op != "||" || !ok || and.Op != "&&" {
+		t.Fatalf("top=%#v", e)
+	}
+	if child, ok := and.R.(*Spanset); !ok || child.Op != ">" {
+		t.Fatalf("and.R=%#v", and.R)
+	}
+
+	e, err = Parse(`({.a="1"} || {.b="2"}) && {.c="3"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top := e.(*Spanset); top.Op != "&&" || top.L.(*Spanset).Op != "||" {
+		t.Fatalf("parens=%#v", e)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, q := range []string{
+		`{ span.x = }`,
+		`{ foo = "x" }`,
+		`{ status = "error" }`,
+		`{ status > error }`,
+		`{ kind = sideways }`,
+		`{ duration > 5 }`,
+		`{ name =~ 5 }`,
+		`{ .x = unquoted }`,
+		`{ .x > nil }`,
+		`{ .x = "a" `,
+		`{ .x = "a" } }`,
+		`{ .x ! "a" }`,
+		`{ .x = "unterminated }`,
+		`span.x = "a"`,
+	} {
+		_, err := Parse(q)
+		var pe *Error
+		if !errors.As(err, &pe) {
+			t.Fatalf("%s: want parse error, got %v", q, err)
+		}
+	}
+	if e, err := Parse("  "); err != nil || e.(*Filter).Cond != nil {
+		t.Fatalf("empty query: %#v %v", e, err)
+	}
+}
+
+func compile(t *testing.T, q string, ts sources.TraceSchema) string {
+	t.Helper()
+	e, err := Parse(q)
+	if err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	sql, err := SearchSQL("obs", ts, e, SearchOptions{Start: time.Unix(100, 0), End: time.Unix(200, 0), Limit: 7})
+	if err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	return sql
+}
+
+func mustContain(t *testing.T, sql string, wants ...string) {
+	t.Helper()
+	for _, w := range wants {
+		if !strings.Contains(sql, w) {
+			t.Fatalf("sql missing %q:\n%s", w, sql)
+		}
+	}
+}
+
+func TestSearchSQL_Conditions(t *testing.T) {
+	sql := compile(t, `{ span.http.status_code >= 500 && resource.service.name =~ "api-.*" && status = error && kind = server && name != "it's" }`, sources.TraceSchema{})
+	mustContain(t, sql,
+		"(mapContains(SpanAttributes, 'http.status_code') AND ifNull(toFloat64OrNull(SpanAttributes['http.status_code']) >= 500, 0))",
+		`match(ServiceName, '^(?:api-.*)$')`,
+		"lower(replaceOne(StatusCode, 'STATUS_CODE_', '')) = 'error'",
+		"lower(replaceOne(SpanKind, 'SPAN_KIND_', '')) = 'server'",
+		`SpanName != 'it\'s'`,
+		"Timestamp BETWEEN toDateTime(100) AND toDateTime(200)",
+		"FROM obs.otel_traces",
+		"LIMIT 7",
+		"arraySlice(all_matched, 1, 3)",
+	)
+
+	sql = compile(t, `{ .db.system = "redis" } && { .peer = nil } || { duration > 2s }`, sources.TraceSchema{AttributeStorage: "json", DurationUnit: "ms"})
+	mustContain(t, sql,
+		"((JSONHas(SpanAttributes, 'db.system') AND JSONExtractString(SpanAttributes, 'db.system') = 'redis') OR (JSONHas(ResourceAttributes, 'db.system') AND JSONExtractString(ResourceAttributes, 'db.system') = 'redis'))",
+		"(NOT JSONHas(SpanAttributes, 'peer') AND NOT JSONHas(ResourceAttributes, 'peer'))",
+		"(Duration * 1000000) > 2000000000",
+		"arrayDistinct(arrayConcat(if(notEmpty(m0) AND notEmpty(m1), arrayDistinct(arrayConcat(m0, m1)), arrayResize(m0, 0)), m2))",
+	)
+}
+
+func TestSearchSQL_ChildOperator(t *testing.T) {
+	sql := compile(t, `{ kind = server } > { span.db.system != nil } > {}`, sources.TraceSchema{})
+	mustContain(t, sql,
+		"groupArrayIf(tuple(SpanId, ParentSpanId, toString(toUnixTimestamp64Nano(Timestamp)), toString(Duration), ServiceName, SpanName), mapContains(SpanAttributes, 'db.system')) AS m1",
+		"groupArrayIf(tuple(SpanId, ParentSpanId, toString(toUnixTimestamp64Nano(Timestamp)), toString(Duration), ServiceName, SpanName), 1) AS m2",
+		"arrayFilter(x2 -> has(arrayMap(y2 -> y2.1, arrayFilter(x1 -> has(arrayMap(y1 -> y1.1, m0), x1.2), m1)), x2.2), m2)",
+	)
+}
+
+func TestSearchSQL_TraceDurationUsesTraceRoots(t *testing.T) {
+	e, _ := Parse(`{}`)
+	sql, err := SearchSQL("obs", sources.TraceSchema{}, e, SearchOptions{
+		Start: time.Unix(100, 0), End: time.Unix(200, 0), Limit: 1, MinDuration: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustContain(t, sql, "TraceId IN (SELECT TraceId FROM obs.trace_roots WHERE StartTs BETWEEN toDateTime(100) AND toDateTime(200) AND DurationMs >= 250)")
+}
@@ -0,0 +1,90 @@
+package traces
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// SuggestAttributeKeys lists the most frequent span and resource attribute
+// keys from the attr_keys rollup, so callers can discover what to pass as
+// ?key= to SuggestAttributes. ?scope=span|resource narrows to one kind.
+func SuggestAttributeKeys(src *sources.Sources) gin.HandlerFunc {
+	cc := newCache(src, "suggest_attribute_keys", defaultSuggestCacheSize)
+	return func(c *gin.Context) {
+		where, limit, err := suggestScope(c, true)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		switch scope := c.Query("scope"); scope {
+		case "":
+		case "span", "resource":
+			where = append(where, fmt.Sprintf("Scope = '%s'", scope))
+		default:
+			c.JSON(400, gin.H{"error": "scope must be span or resource"})
+			return
+		}
+		if q := normQ(c.Query("q")); q != "" {
+			where = append(where, "Key ILIKE "+sources.Quote("%"+q+"%"))
+		}
+		sql := fmt.Sprintf(`
+      SELECT Scope, Key, sum(Cnt) AS c
+      FROM %s.%s
+      WHERE %s
+      GROUP BY Scope, Key ORDER BY c DESC LIMIT %d FORMAT JSONEachRow
+    `, src.CHDB, src.Traces.WithDefaults().Tables.AttrKeys, strings.Join(where, " AND "), limit)
+		proxy(c, src, cc, sql)
+	}
+}
+
+// AttrValuesDDL returns the statements that create the attr_values rollup
+// for the given allowlist over the spans table described by ts, or point an
+// existing view at it. The view's query is swapped in place with MODIFY
+// QUERY rather than dropped and recreated, so no spans are missed while the
+// allowlist changes. `otel-backend migrate -attr-values` applies them.
+func AttrValuesDDL(db string, ts sources.TraceSchema, keys []string) []string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	spanAttrs := ts.AttrMap("", col.SpanAttributes)
+	resAttrs := ts.AttrMap("", col.ResourceAttributes)
+	query := fmt.Sprintf(`WITH [%[3]s] AS keys
+SELECT
+    toStartOfHour(%[4]s) AS WindowStart,
+    %[5]s AS ServiceName,
+    k AS Key,
+    v AS Val,
+    count() AS Cnt
+FROM %[1]s.%[6]s
+ARRAY JOIN arrayConcat(mapKeys(%[7]s), mapKeys(%[8]s))     AS k,
+           arrayConcat(mapValues(%[7]s), mapValues(%[8]s)) AS v
+WHERE k IN keys AND v IS NOT NULL AND v != ''
+GROUP BY WindowStart, ServiceName, Key, Val`,
+		db, ts.Tables.AttrValues, joinQuoted(keys), ts.StartTime(""), col.ServiceName,
+		ts.Tables.Spans, spanAttrs, resAttrs)
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.%s
+(
+    WindowStart   DateTime,
+    ServiceName   LowCardinality(String),
+    Key           String,
+    Val           String,
+    Cnt           UInt64
+)
+ENGINE = SummingMergeTree
+ORDER BY (WindowStart, Key, ServiceName, Val)`, db, ts.Tables.AttrValues),
+		fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS %[1]s.mv_%[2]s\nTO %[1]s.%[2]s\nAS\n%[3]s", db, ts.Tables.AttrValues, query),
+		fmt.Sprintf("ALTER TABLE %s.mv_%s MODIFY QUERY\n%s", db, ts.Tables.AttrValues, query),
+	}
+}
+
+// AttrValuesRollup shows the attr_values DDL built from the configured
+// ATTR_VALUE_KEYS allowlist. It never runs it: applying DDL is left to
+// `otel-backend migrate -attr-values`.
+func AttrValuesRollup(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(200, gin.H{"keys": src.AttrValueKeys, "statements": AttrValuesDDL(src.CHDB, src.Traces, src.AttrValueKeys)})
+	}
+}
@@ -0,0 +1,88 @@
+package traces
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSuggestAttributeKeys_FiltersScopeAndPrefix(t *testing.T) {
+	ts, queries := captureCH(t, `{"Scope":"resource","Key":"deployment.environment","c":900}`+"\n")
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/traces/suggest/attribute-keys", SuggestAttributeKeys(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/suggest/attribute-keys?scope=resource&q=Deploy&service=checkout", nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	sql := strings.Join(*queries, "\n")
+	for _, want := range []string{"FROM default.attr_keys", "Scope = 'resource'", "Key ILIKE '%deploy%'", "ServiceName IN ('checkout')"} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("sql missing %q:\n%s", want, sql)
+		}
+	}
+
+	w2 := httptest.NewRecorder()
+	r.ServeHTTP(w2, httptest.NewRequest("GET", "/api/traces/suggest/attribute-keys?scope=event", nil))
+	if w2.Code != 400 {
+		t.Fatalf("bad scope: want 400 got %d", w2.Code)
+	}
+}
+
+func TestAttrValuesDDL_QuotesAllowlist(t *testing.T) {
+	stmts := AttrValuesDDL("obs", sources.TraceSchema{}, []string{"http.method", "team's.key"})
+	if len(stmts) != 3 {
+		t.Fatalf("stmts=%d want 3", len(stmts))
+	}
+	mv := stmts[1]
+	if !strings.Contains(mv, "WITH ['http.method', 'team\\'s.key'] AS keys") {
+		t.Fatalf("allowlist not quoted:\n%s", mv)
+	}
+	if !strings.Contains(mv, "FROM obs.otel_traces") || !strings.Contains(mv, "TO obs.attr_values") {
+		t.Fatalf("database not applied:\n%s", mv)
+	}
+	if !strings.Contains(mv, "mapKeys(ResourceAttributes)") {
+		t.Fatalf("resource attributes not rolled up:\n%s", mv)
+	}
+}
+
+func TestAttrValuesDDL_ModifiesViewInPlace(t *testing.T) {
+	stmts := AttrValuesDDL("obs", sources.TraceSchema{}, []string{"k8s.namespace.name"})
+	all := strings.Join(stmts, "\n")
+	if strings.Contains(all, "DROP") {
+		t.Fatalf("view is dropped:\n%s", all)
+	}
+	if !strings.HasPrefix(stmts[1], "CREATE MATERIALIZED VIEW IF NOT EXISTS obs.mv_attr_values") ||
+		!strings.HasPrefix(stmts[2], "ALTER TABLE obs.mv_attr_values MODIFY QUERY\nWITH ['k8s.namespace.name'] AS keys") {
+		t.Fatalf("stmts:\n%s", all)
+	}
+}
+
+func TestAttrValuesRollup_OnlyShows(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client(), AttrValueKeys: []string{"k8s.namespace.name"}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ddl", AttrValuesRollup(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/ddl", nil))
+	var out struct {
+		Statements []string `json:"statements"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &out)
+	if w.Code != 200 || calls != 0 || len(out.Statements) != 3 || !strings.Contains(out.Statements[2], "'k8s.namespace.name'") {
+		t.Fatalf("status=%d calls=%d body=%s", w.Code, calls, w.Body.String())
+	}
+}
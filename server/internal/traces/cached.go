@@ -0,0 +1,76 @@
+package traces
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/cache"
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// Default entry limits per endpoint cache; override with CACHE_SIZES.
+const (
+	defaultSuggestCacheSize = 512
+	defaultListCacheSize    = 128
+)
+
+func newCache(src *sources.Sources, name string, size int) *cache.Cache {
+	return cache.New(name, src.CacheSize(name, size), src.CacheTTL)
+}
+
+// openEnd is the "to" of a range the caller left open: now, rounded up to a
+// multiple of ttl so that requests within one TTL build the same query and
+// share a cache entry. With no cache it is just now.
+func openEnd(ttl time.Duration) int64 {
+	now := time.Now().Unix()
+	step := int64(ttl / time.Second)
+	if step <= 1 {
+		return now
+	}
+	return (now + step - 1) / step * step
+}
+
+// serveCached writes the JSON body cached under key, calling fetch on a miss.
+// Every response carries an ETag so browsers can revalidate with
+// If-None-Match; cached endpoints also advertise max-age.
+func serveCached(c *gin.Context, cc *cache.Cache, key string, fetch func() ([]byte, error)) {
+	e, hit, err := cc.Do(key, func() (cache.Entry, error) {
+		b, err := fetch()
+		if err != nil {
+			return cache.Entry{}, err
+		}
+		return cache.NewEntry(b), nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", e.ETag)
+	if cc != nil {
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(cc.TTL().Seconds())))
+		if hit {
+			c.Header("X-Cache", "HIT")
+		} else {
+			c.Header("X-Cache", "MISS")
+		}
+	}
+	if etagMatch(c.GetHeader("If-None-Match"), e.ETag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json", e.Body)
+}
+
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// Attribute comparison (BubbleUp): traces matching the List filters are split
+// into a selection and a baseline, and every span/resource attribute
+// key=value is scored by the share of selected traces carrying it minus the
+// share of baseline traces carrying it. A trace counts once per key=value
+// however many of its spans have it.
+
+const (
+	// compareMaxTraces caps the traces read inside and outside the
+	// selection's duration band; they are picked by TraceId hash so the same
+	// request sees the same sample.
+	compareMaxTraces   = 5000
+	defaultCompareRows = 50
+	maxCompareRows     = 500
+	// compareMinTraces drops key=values seen in fewer traces (typically IDs).
+	compareMinTraces = 2
+	// compareSpanSlack is how long after the window's end spans of a trace
+	// that started inside it are still looked for.
+	compareSpanSlack        = 3600
+	defaultCompareCacheSize = 64
+)
+
+// CompareReq is TraceListReq plus the definition of the selection. A trace
+// is selected when it meets every criterion given; the rest is the baseline.
+type CompareReq struct {
+	TraceListReq
+	Selection struct {
+		MinDurationMs *float64 `json:"minDurationMs"`
+		MaxDurationMs *float64 `json:"maxDurationMs"`
+		// Errored selects traces with at least one error span.
+		Errored bool `json:"errored"`
+	} `json:"selection"`
+	Limit int `json:"limit"`
+}
+
+// AttributeDiff is one key=value with its share of each side.
+type AttributeDiff struct {
+	Scope string `json:"scope"` // span or resource
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Selection and Baseline count traces with the key=value on each side;
+	// the Pct fields are those counts over the side's trace count.
+	Selection    int64   `json:"selection"`
+	Baseline     int64   `json:"baseline"`
+	SelectionPct float64 `json:"selectionPct"`
+	BaselinePct  float64 `json:"baselinePct"`
+	// Difference is SelectionPct - BaselinePct, the ranking key.
+	Difference float64 `json:"difference"`
+}
+
+func (r *CompareReq) normalize(ttl time.Duration) {
+	r.defaultRange(ttl)
+	if r.Limit <= 0 {
+		r.Limit = defaultCompareRows
+	}
+	r.Limit = min(r.Limit, maxCompareRows)
+}
+
+func (r CompareReq) hasSelection() bool {
+	s := r.Selection
+	return s.MinDurationMs != nil || s.MaxDurationMs != nil || s.Errored
+}
+
+// compareSQL returns the total trace count per side as a row with an empty
+// scope, followed by up to r.Limit key=values, most over-represented first.
+func compareSQL(db string, ts sources.TraceSchema, r CompareReq) string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+
+	slow := []string{"1"}
+	if v := r.Selection.MinDurationMs; v != nil {
+		slow = append(slow, fmt.Sprintf("DurationMs >= %f", *v))
+	}
+	if v := r.Selection.MaxDurationMs; v != nil {
+		slow = append(slow, fmt.Sprintf("DurationMs <= %f", *v))
+	}
+	errored := "1"
+	if r.Selection.Errored {
+		errored = fmt.Sprintf("max(upper(%s) IN ('ERROR', 'STATUS_CODE_ERROR'))", col.StatusCode)
+	}
+	pairs := func(scope, c string) string {
+		m := ts.AttrMap("", c)
+		return fmt.Sprintf("arrayMap((k, v) -> ('%s', k, v), mapKeys(%s), mapValues(%[2]s))", scope, m)
+	}
+	share := "inSel / greatest(selTotal, 1) - inBase / greatest(baseTotal, 1)"
+
+	return fmt.Sprintf(`
+WITH roots AS (
+  SELECT TraceId, %[1]s AS slow
+  FROM %[2]s.%[3]s
+  WHERE %[4]s
+  ORDER BY cityHash64(TraceId)
+  LIMIT %[5]d BY slow
+)
+SELECT scope, key, value, inSel, inBase, selTotal, baseTotal FROM (
+  SELECT scope, key, value, inSel, inBase,
+    max(inSel) OVER () AS selTotal, max(inBase) OVER () AS baseTotal
+  FROM (
+    SELECT a.1 AS scope, a.2 AS key, a.3 AS value,
+      toInt64(countIf(sel)) AS inSel, toInt64(countIf(NOT sel)) AS inBase
+    FROM (
+      SELECT %[6]s AS tid,
+        (tid IN (SELECT TraceId FROM roots WHERE slow)) AND %[7]s AS sel,
+        arrayPushFront(groupUniqArrayArray(arrayConcat(%[8]s, %[9]s)), ('', '', '')) AS attrs
+      FROM %[2]s.%[10]s
+      WHERE %[6]s IN (SELECT TraceId FROM roots)
+        AND %[11]s BETWEEN toDateTime(%[12]d) AND toDateTime(%[13]d)
+      GROUP BY tid
+    )
+    ARRAY JOIN attrs AS a
+    WHERE a.3 != '' OR a.1 = ''
+    GROUP BY scope, key, value
+  )
+)
+WHERE scope = '' OR inSel + inBase >= %[14]d
+ORDER BY scope = '' DESC, %[15]s DESC, inSel DESC, key, value
+LIMIT %[16]d
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, strings.Join(slow, " AND "), db, ts.Tables.TraceRoots, strings.Join(r.where(), " AND "), compareMaxTraces,
+		col.TraceId, errored, pairs("span", col.SpanAttributes), pairs("resource", col.ResourceAttributes),
+		ts.Tables.Spans, ts.StartTime(""), int64(r.From), int64(r.To)+compareSpanSlack,
+		compareMinTraces, share, r.Limit+1)
+}
+
+type compareRow struct {
+	Scope     string `json:"scope"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	InSel     int64  `json:"inSel"`
+	InBase    int64  `json:"inBase"`
+	SelTotal  int64  `json:"selTotal"`
+	BaseTotal int64  `json:"baseTotal"`
+}
+
+// compareResult turns compareSQL rows into the response: side totals and
+// the over-represented key=values.
+func compareResult(rows []compareRow) (selTotal, baseTotal int64, diffs []AttributeDiff) {
+	pct := func(n, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) / float64(total)
+	}
+	diffs = []AttributeDiff{}
+	for _, row := range rows {
+		if row.Scope == "" {
+			selTotal, baseTotal = row.InSel, row.InBase
+			continue
+		}
+		d := AttributeDiff{
+			Scope: row.Scope, Key: row.Key, Value: row.Value,
+			Selection: row.InSel, Baseline: row.InBase,
+			SelectionPct: pct(row.InSel, row.SelTotal), BaselinePct: pct(row.InBase, row.BaseTotal),
+		}
+		d.Difference = d.SelectionPct - d.BaselinePct
+		if d.Difference <= 0 {
+			break // sorted, so nothing further is over-represented
+		}
+		diffs = append(diffs, d)
+	}
+	return selTotal, baseTotal, diffs
+}
+
+// CompareAttributes serves POST /api/traces/compare.
+func CompareAttributes(src *sources.Sources) gin.HandlerFunc {
+	cc := newCache(src, "compare", defaultCompareCacheSize)
+	return func(c *gin.Context) {
+		var r CompareReq
+		if err := c.BindJSON(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+			return
+		}
+		r.normalize(cc.TTL())
+		if !r.hasSelection() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "selection needs minDurationMs, maxDurationMs or errored"})
+			return
+		}
+		sql := compareSQL(src.CHDB, src.Traces, r)
+		serveCached(c, cc, sql, func() ([]byte, error) {
+			b, err := src.QueryCH(sql)
+			if err != nil {
+				return nil, err
+			}
+			var rows []compareRow
+			dec := json.NewDecoder(bytes.NewReader(b))
+			for dec.More() {
+				var row compareRow
+				if err := dec.Decode(&row); err != nil {
+					return nil, fmt.Errorf("decode CH rows: %w", err)
+				}
+				rows = append(rows, row)
+			}
+			selTotal, baseTotal, diffs := compareResult(rows)
+			return json.Marshal(gin.H{
+				"from": r.From, "to": r.To,
+				"selection": gin.H{"traces": selTotal}, "baseline": gin.H{"traces": baseTotal},
+				"attributes": diffs,
+			})
+		})
+	}
+}
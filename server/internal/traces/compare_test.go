@@ -0,0 +1,75 @@
+package traces
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func TestCompareAttributes_SQL(t *testing.T) {
+	ts, queries := captureCH(t, "")
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := postJSON(t, "/c", CompareAttributes(src),
+		`{"from":1704103200,"to":1704106800,"filters":{"service":["web"]},"selection":{"minDurationMs":500,"errored":true}}`)
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	sql := strings.Join(*queries, "\n")
+	for _, want := range []string{
+		"FROM default.trace_roots",
+		"RootService IN ('web')",
+		"DurationMs >= 500.000000 AS slow",
+		"LIMIT 5000 BY slow",
+		"max(upper(StatusCode) IN ('ERROR', 'STATUS_CODE_ERROR'))",
+		"mapKeys(SpanAttributes)",
+		"mapKeys(ResourceAttributes)",
+		"FROM default.otel_traces",
+		"Timestamp BETWEEN toDateTime(1704103200) AND toDateTime(1704110400)",
+		"LIMIT 51",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("missing %q in:\n%s", want, sql)
+		}
+	}
+}
+
+func TestCompareAttributes_RanksOverRepresented(t *testing.T) {
+	body := `{"scope":"","key":"","value":"","inSel":10,"inBase":90,"selTotal":10,"baseTotal":90}` + "\n" +
+		`{"scope":"resource","key":"k8s.node.name","value":"node-3","inSel":8,"inBase":9,"selTotal":10,"baseTotal":90}` + "\n" +
+		`{"scope":"span","key":"http.route","value":"/search","inSel":5,"inBase":18,"selTotal":10,"baseTotal":90}` + "\n" +
+		`{"scope":"span","key":"http.method","value":"GET","inSel":9,"inBase":81,"selTotal":10,"baseTotal":90}` + "\n"
+	ts := fakeCH(t, body)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := postJSON(t, "/c", CompareAttributes(src), `{"selection":{"minDurationMs":1000}}`)
+	var out struct {
+		Selection  struct{ Traces int64 } `json:"selection"`
+		Baseline   struct{ Traces int64 } `json:"baseline"`
+		Attributes []AttributeDiff        `json:"attributes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != 200 {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if out.Selection.Traces != 10 || out.Baseline.Traces != 90 {
+		t.Fatalf("totals=%+v %+v", out.Selection, out.Baseline)
+	}
+	// GET is as common on both sides (90%), so it is not reported.
+	if len(out.Attributes) != 2 {
+		t.Fatalf("attributes=%+v", out.Attributes)
+	}
+	a := out.Attributes[0]
+	if a.Key != "k8s.node.name" || a.SelectionPct != 0.8 || a.BaselinePct != 0.1 || a.Difference < 0.69 || a.Difference > 0.71 {
+		t.Fatalf("top=%+v", a)
+	}
+}
+
+func TestCompareAttributes_NeedsSelection(t *testing.T) {
+	if w := postJSON(t, "/c", CompareAttributes(&sources.Sources{}), `{"filters":{"service":["web"]}}`); w.Code != 400 {
+		t.Fatalf("status=%d", w.Code)
+	}
+}
@@ -0,0 +1,222 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// Error grouping: errored spans are grouped by service, operation, exception
+// type and a fingerprint of the message with its variable parts (IDs,
+// numbers, quoted values) replaced, so "user 42 not found" and "user 7 not
+// found" land in one group. Grouping runs in ClickHouse.
+
+const (
+	defaultErrorGroups    = 50
+	maxErrorGroups        = 500
+	errorSparklineBuckets = 24
+	errorSamples          = 5
+	// errorMessageMax bounds the normalized message kept as the group key.
+	errorMessageMax         = 200
+	defaultErrorsCacheSize  = 64
+	defaultErrorsLookbackHr = 24
+)
+
+// errorMessagePatterns normalize a message, applied in order. They are RE2,
+// as ClickHouse's replaceRegexpAll expects.
+var errorMessagePatterns = []struct{ re, repl string }{
+	{`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`, "<uuid>"},
+	{`\b(0x)?[0-9a-fA-F]*[0-9][0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\b|\b(0x)?[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*[0-9][0-9a-fA-F]*\b`, "<hex>"},
+	{`'[^']*'|"[^"]*"`, "<str>"},
+	{`\d+(\.\d+)?`, "<n>"},
+	{`\s+`, " "},
+}
+
+// ErrorGroup is one kind of error.
+type ErrorGroup struct {
+	Fingerprint   string `json:"fingerprint"`
+	Service       string `json:"service"`
+	Operation     string `json:"operation"`
+	ExceptionType string `json:"exceptionType"`
+	// Message is the normalized message; Example is one as recorded.
+	Message   string `json:"message"`
+	Example   string `json:"example"`
+	Count     int64  `json:"count"`
+	FirstSeen int64  `json:"firstSeen"` // unix seconds
+	LastSeen  int64  `json:"lastSeen"`
+	// Sparkline counts the group's spans per step over the requested range.
+	Sparkline      []int64  `json:"sparkline"`
+	SampleTraceIDs []string `json:"sampleTraceIds"`
+}
+
+type errorsQuery struct {
+	From, To   int64 // unix seconds
+	Step       int64
+	Services   []string
+	Operations []string
+	Limit      int
+}
+
+func parseErrorsQuery(c *gin.Context, ttl time.Duration) (errorsQuery, error) {
+	var q errorsQuery
+	from, err := floatQuery(c, "from")
+	if err != nil {
+		return q, err
+	}
+	to, err := floatQuery(c, "to")
+	if err != nil {
+		return q, err
+	}
+	q.From, q.To = int64(from), int64(to)
+	if q.To == 0 {
+		q.To = openEnd(ttl)
+	}
+	if q.From == 0 {
+		q.From = q.To - defaultErrorsLookbackHr*3600
+	}
+	if q.From >= q.To {
+		return q, fmt.Errorf("from must be before to")
+	}
+	q.Step = max((q.To-q.From+errorSparklineBuckets-1)/errorSparklineBuckets, 1)
+	for _, s := range c.QueryArray("service") {
+		if s = strings.TrimSpace(s); s != "" {
+			q.Services = append(q.Services, s)
+		}
+	}
+	for _, s := range c.QueryArray("operation") {
+		if s = strings.TrimSpace(s); s != "" {
+			q.Operations = append(q.Operations, s)
+		}
+	}
+	q.Limit = defaultErrorGroups
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("limit must be a positive integer")
+		}
+		q.Limit = min(n, maxErrorGroups)
+	}
+	return q, nil
+}
+
+// normalizedMessageSQL wraps expr in the errorMessagePatterns replacements.
+func normalizedMessageSQL(expr string) string {
+	for _, p := range errorMessagePatterns {
+		expr = fmt.Sprintf("replaceRegexpAll(%s, %s, %s)", expr, sources.Quote(p.re), sources.Quote(p.repl))
+	}
+	return fmt.Sprintf("substringUTF8(trimBoth(%s), 1, %d)", expr, errorMessageMax)
+}
+
+// errorGroupsSQL groups errored spans in q's range. The exception type and
+// message come from the first exception event, falling back to the span's
+// exception.type attribute and StatusMessage.
+func errorGroupsSQL(db string, ts sources.TraceSchema, q errorsQuery) string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	where := []string{
+		fmt.Sprintf("%s BETWEEN toDateTime(%d) AND toDateTime(%d)", ts.StartTime(""), q.From, q.To),
+		fmt.Sprintf("upper(%s) IN ('ERROR', 'STATUS_CODE_ERROR')", col.StatusCode),
+	}
+	if len(q.Services) > 0 {
+		where = append(where, fmt.Sprintf("%s IN (%s)", col.ServiceName, joinQuoted(q.Services)))
+	}
+	if len(q.Operations) > 0 {
+		where = append(where, fmt.Sprintf("%s IN (%s)", col.SpanName, joinQuoted(q.Operations)))
+	}
+	event := func(key string) string {
+		return fmt.Sprintf("arrayFirst(a -> a['%s'] != '', ev)['%[1]s']", key)
+	}
+	return fmt.Sprintf(`
+SELECT service, operation, exceptionType, message,
+  lower(hex(cityHash64(service, operation, exceptionType, message))) AS fingerprint,
+  any(raw) AS example,
+  toInt64(count()) AS count,
+  toInt64(toUnixTimestamp(min(t))) AS firstSeen,
+  toInt64(toUnixTimestamp(max(t))) AS lastSeen,
+  sumMap([toInt64(intDiv(toUnixTimestamp(t) - %[1]d, %[2]d))], [toUInt64(1)]) AS spark,
+  groupUniqArray(%[3]d)(traceId) AS samples
+FROM (
+  SELECT %[4]s AS service, %[5]s AS operation, %[6]s AS traceId, %[7]s AS t,
+    arrayMap(a -> %[8]s, %[9]s.Attributes) AS ev,
+    if(%[10]s != '', %[10]s, %[11]s) AS exceptionType,
+    if(%[12]s != '', %[12]s, %[13]s) AS raw,
+    %[14]s AS message
+  FROM %[15]s.%[16]s
+  WHERE %[17]s
+)
+GROUP BY service, operation, exceptionType, message
+ORDER BY count DESC, lastSeen DESC
+LIMIT %[18]d
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, q.From, q.Step, errorSamples,
+		col.ServiceName, col.SpanName, col.TraceId, ts.StartTime(""),
+		ts.AttrMap("", "a"), col.Events,
+		event("exception.type"), ts.Attr("", col.SpanAttributes, "'exception.type'"),
+		event("exception.message"), col.StatusMessage,
+		normalizedMessageSQL("raw"),
+		db, ts.Tables.Spans, strings.Join(where, " AND "), q.Limit)
+}
+
+type errorGroupRow struct {
+	ErrorGroup
+	Spark   [2][]int64 `json:"spark"`
+	Samples []string   `json:"samples"`
+}
+
+// errorGroups fills in each row's sparkline over the range's buckets.
+func errorGroups(b []byte, q errorsQuery) ([]ErrorGroup, error) {
+	n := int((q.To-q.From)/q.Step) + 1
+	out := []ErrorGroup{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var row errorGroupRow
+		if err := dec.Decode(&row); err != nil {
+			return nil, fmt.Errorf("decode CH rows: %w", err)
+		}
+		g := row.ErrorGroup
+		g.Sparkline = make([]int64, n)
+		for i, k := range row.Spark[0] {
+			if k >= 0 && int(k) < n && i < len(row.Spark[1]) {
+				g.Sparkline[k] += row.Spark[1][i]
+			}
+		}
+		g.SampleTraceIDs = row.Samples
+		if g.SampleTraceIDs == nil {
+			g.SampleTraceIDs = []string{}
+		}
+		out = append(out, g)
+	}
+	return out, nil
+}
+
+// Errors serves GET /api/errors: error groups, most frequent first.
+func Errors(src *sources.Sources) gin.HandlerFunc {
+	cc := newCache(src, "errors", defaultErrorsCacheSize)
+	return func(c *gin.Context) {
+		q, err := parseErrorsQuery(c, cc.TTL())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sql := errorGroupsSQL(src.CHDB, src.Traces, q)
+		serveCached(c, cc, sql, func() ([]byte, error) {
+			b, err := src.QueryCH(sql)
+			if err != nil {
+				return nil, err
+			}
+			groups, err := errorGroups(b, q)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(gin.H{"from": q.From, "to": q.To, "stepSeconds": q.Step, "groups": groups})
+		})
+	}
+}
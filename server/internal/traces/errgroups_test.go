@@ -0,0 +1,96 @@
+package traces
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// The patterns run in ClickHouse; Go's regexp is RE2 too, so this checks
+// what they do to typical messages.
+func TestErrorMessagePatterns(t *testing.T) {
+	norm := func(s string) string {
+		for _, p := range errorMessagePatterns {
+			s = regexp.MustCompile(p.re).ReplaceAllString(s, p.repl)
+		}
+		return strings.TrimSpace(s)
+	}
+	for in, want := range map[string]string{
+		"user 42 not found": "user <n> not found",
+		"order 3f2a9c1e-0b7d-4c1a-9e6f-2d5b8a7c4e10 failed": "order <uuid> failed",
+		"timeout after 1.5s talking to 10.0.0.12:5432":      "timeout after <n>s talking to <n>.<n>:<n>",
+		`key "tenant-a" missing in 'cfg'`:                   "key <str> missing in <str>",
+		"span deadbeef01 dropped; deadline   exceeded":      "span <hex> dropped; deadline exceeded",
+		"connection refused":                                "connection refused",
+	} {
+		if got := norm(in); got != want {
+			t.Errorf("%q -> %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestErrors_SQL(t *testing.T) {
+	ts, queries := captureCH(t, "")
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	w := httptest.NewRecorder()
+	newRouter("/api/errors", Errors(src)).ServeHTTP(w,
+		httptest.NewRequest("GET", "/api/errors?from=1704103200&to=1704106800&service=cart&limit=10", nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	sql := strings.Join(*queries, "\n")
+	for _, want := range []string{
+		"Timestamp BETWEEN toDateTime(1704103200) AND toDateTime(1704106800)",
+		"upper(StatusCode) IN ('ERROR', 'STATUS_CODE_ERROR')",
+		"ServiceName IN ('cart')",
+		"arrayMap(a -> a, Events.Attributes) AS ev",
+		"SpanAttributes['exception.type']",
+		`replaceRegexpAll(replaceRegexpAll(replaceRegexpAll(`,
+		`'\\d+(\\.\\d+)?', '<n>'`,
+		"intDiv(toUnixTimestamp(t) - 1704103200, 150)",
+		"groupUniqArray(5)(traceId)",
+		"LIMIT 10",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("missing %q in:\n%s", want, sql)
+		}
+	}
+}
+
+func TestErrors_Groups(t *testing.T) {
+	body := `{"service":"cart","operation":"GET /cart","exceptionType":"NotFound","message":"user <n> not found","fingerprint":"ab12","example":"user 42 not found","count":3,"firstSeen":1704103300,"lastSeen":1704106700,"spark":[[0,23],[2,1]],"samples":["t1","t2"]}` + "\n"
+	ts := fakeCH(t, body)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	w := httptest.NewRecorder()
+	newRouter("/api/errors", Errors(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/errors?from=1704103200&to=1704106800", nil))
+	var out struct {
+		Groups []ErrorGroup `json:"groups"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != 200 {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if len(out.Groups) != 1 {
+		t.Fatalf("groups=%+v", out.Groups)
+	}
+	g := out.Groups[0]
+	if g.Fingerprint != "ab12" || g.Count != 3 || g.Example != "user 42 not found" || len(g.SampleTraceIDs) != 2 {
+		t.Fatalf("group=%+v", g)
+	}
+	if len(g.Sparkline) != 25 || g.Sparkline[0] != 2 || g.Sparkline[23] != 1 {
+		t.Fatalf("sparkline=%v", g.Sparkline)
+	}
+}
+
+func TestErrors_BadRange(t *testing.T) {
+	w := httptest.NewRecorder()
+	newRouter("/api/errors", Errors(&sources.Sources{})).ServeHTTP(w, httptest.NewRequest("GET", "/api/errors?from=200&to=100", nil))
+	if w.Code != 400 {
+		t.Fatalf("status=%d", w.Code)
+	}
+}
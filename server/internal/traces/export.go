@@ -0,0 +1,432 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// spanRecord is one span with everything the exporter stores, as selected by
+// recordsSQL. It is the source for every export format.
+type spanRecord struct {
+	TraceId            string            `json:"TraceId"`
+	SpanId             string            `json:"SpanId"`
+	ParentSpanId       string            `json:"ParentSpanId"`
+	TraceState         string            `json:"TraceState"`
+	SpanName           string            `json:"SpanName"`
+	SpanKind           string            `json:"SpanKind"`
+	ServiceName        string            `json:"ServiceName"`
+	ResourceAttributes map[string]string `json:"ResourceAttributes"`
+	ScopeName          string            `json:"ScopeName"`
+	ScopeVersion       string            `json:"ScopeVersion"`
+	SpanAttributes     map[string]string `json:"SpanAttributes"`
+	StartNS            int64             `json:"start_ns"`
+	EndNS              int64             `json:"end_ns"`
+	StatusCode         string            `json:"StatusCode"`
+	StatusMessage      string            `json:"StatusMessage"`
+
+	EventTimes      []int64             `json:"EventTimes"`
+	EventNames      []string            `json:"EventNames"`
+	EventAttrs      []map[string]string `json:"EventAttrs"`
+	LinkTraceIds    []string            `json:"LinkTraceIds"`
+	LinkSpanIds     []string            `json:"LinkSpanIds"`
+	LinkTraceStates []string            `json:"LinkTraceStates"`
+	LinkAttrs       []map[string]string `json:"LinkAttrs"`
+}
+
+// recordsSQL selects every stored field of the given traces' spans.
+// Nanosecond integers are emitted as numbers (not quoted) so they decode
+// into int64.
+func recordsSQL(db string, ts sources.TraceSchema, traceIDs ...string) string {
+	return recordsWhereSQL(db, ts, "", traceIDs...)
+}
+
+// recordsWhereSQL is recordsSQL with spanFilter, a condition on the span ID
+// column such as "IN keep", ANDed to the trace filter when not empty.
+func recordsWhereSQL(db string, ts sources.TraceSchema, spanFilter string, traceIDs ...string) string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	attrs := func(c string) string { return fmt.Sprintf("arrayMap(a -> %s, %s)", ts.AttrMap("", "a"), c) }
+	cond := ""
+	if spanFilter != "" {
+		cond = " AND " + col.SpanId + " " + spanFilter
+	}
+	return fmt.Sprintf(`
+SELECT
+  %s AS TraceId, %s AS SpanId, %s AS ParentSpanId, %s AS TraceState,
+  %s AS SpanName, %s AS SpanKind, %s AS ServiceName,
+  %s AS ResourceAttributes, %s AS ScopeName, %s AS ScopeVersion,
+  %s AS SpanAttributes,
+  %s AS start_ns,
+  %[12]s + %s AS end_ns,
+  %s AS StatusCode, %s AS StatusMessage,
+  arrayMap(x -> %s, %s.Timestamp) AS EventTimes, %[17]s.Name AS EventNames, %s AS EventAttrs,
+  %s.TraceId AS LinkTraceIds, %[19]s.SpanId AS LinkSpanIds, %[19]s.TraceState AS LinkTraceStates, %s AS LinkAttrs
+FROM %s.%s
+WHERE %[1]s IN (%[23]s)%[24]s
+ORDER BY start_ns ASC
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, col.TraceId, col.SpanId, col.ParentSpanId, col.TraceState,
+		col.SpanName, col.SpanKind, col.ServiceName,
+		ts.AttrMap("", col.ResourceAttributes), col.ScopeName, col.ScopeVersion,
+		ts.AttrMap("", col.SpanAttributes),
+		ts.StartNs(""), ts.DurationNs(""),
+		col.StatusCode, col.StatusMessage,
+		ts.TimeNs("x"), col.Events, attrs(col.Events+".Attributes"),
+		col.Links, attrs(col.Links+".Attributes"),
+		db, ts.Tables.Spans, joinQuoted(traceIDs), cond)
+}
+
+// errTraceNotFound is returned for expired or unknown imported trace IDs.
+var errTraceNotFound = errors.New("trace not found")
+
+// fetchRecords loads every span of a trace from ClickHouse, or from the
+// import store for IDs issued by Import.
+func fetchRecords(src *sources.Sources, traceID string) ([]spanRecord, error) {
+	if isImportID(traceID) {
+		recs, ok := importedRecords(src, traceID)
+		if !ok {
+			return nil, errTraceNotFound
+		}
+		return recs, nil
+	}
+	byTrace, err := fetchTraces(src, []string{traceID})
+	if err != nil {
+		return nil, err
+	}
+	out := []spanRecord{}
+	for _, recs := range byTrace {
+		out = append(out, recs...)
+	}
+	return out, nil
+}
+
+// fetchTraces loads several traces from ClickHouse in one query, keyed by
+// the TraceId column value.
+func fetchTraces(src *sources.Sources, traceIDs []string) (map[string][]spanRecord, error) {
+	out := map[string][]spanRecord{}
+	if len(traceIDs) == 0 {
+		return out, nil
+	}
+	b, err := src.QueryCH(recordsSQL(src.CHDB, src.Traces, traceIDs...))
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var r spanRecord
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				return out, nil
+			}
+			return nil, fmt.Errorf("decode CH rows: %w", err)
+		}
+		out[r.TraceId] = append(out[r.TraceId], r)
+	}
+}
+
+// recordSpans converts records to the timeline shape returned by Get.
+func recordSpans(recs []spanRecord) []Span {
+	out := make([]Span, 0, len(recs))
+	for _, r := range recs {
+		out = append(out, recordSpan(r))
+	}
+	return out
+}
+
+func recordSpan(r spanRecord) Span {
+	return Span{
+		SpanID: r.SpanId, ParentSpanID: r.ParentSpanId, Name: r.SpanName, Kind: r.SpanKind, Service: r.ServiceName,
+		StartUnixNanos: r.StartNS, EndUnixNanos: r.EndNS, Attributes: r.SpanAttributes,
+		StatusCode: r.StatusCode, StatusMessage: r.StatusMessage,
+		TraceState: r.TraceState, ResourceAttributes: r.ResourceAttributes,
+		ScopeName: r.ScopeName, ScopeVersion: r.ScopeVersion,
+		Events: recordEvents(r), Links: recordLinks(r),
+	}
+}
+
+// recordEvents zips the parallel Events.* arrays of r.
+func recordEvents(r spanRecord) []SpanEvent {
+	var out []SpanEvent
+	for i, name := range r.EventNames {
+		e := SpanEvent{Name: name}
+		if i < len(r.EventTimes) {
+			e.TimeUnixNanos = r.EventTimes[i]
+		}
+		if i < len(r.EventAttrs) && len(r.EventAttrs[i]) > 0 {
+			e.Attributes = r.EventAttrs[i]
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// recordLinks zips the parallel Links.* arrays of r.
+func recordLinks(r spanRecord) []SpanLink {
+	var out []SpanLink
+	for i, tid := range r.LinkTraceIds {
+		if i >= len(r.LinkSpanIds) {
+			break
+		}
+		l := SpanLink{TraceID: tid, SpanID: r.LinkSpanIds[i]}
+		if i < len(r.LinkTraceStates) {
+			l.TraceState = r.LinkTraceStates[i]
+		}
+		if i < len(r.LinkAttrs) && len(r.LinkAttrs[i]) > 0 {
+			l.Attributes = r.LinkAttrs[i]
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// Export returns a trace in a portable format for bug reports and re-import
+// into other tools: format=otlp (OTLP/JSON ExportTraceServiceRequest, the
+// default), jaeger (Jaeger UI JSON) or zipkin (Zipkin v2 span list). Traces
+// over TraceMaxSpans (or ?maxSpans=) are refused with 413, as by Insights.
+func Export(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traceID := c.Param("traceId")
+		format := c.DefaultQuery("format", "otlp")
+		encode, ok := exportFormats[format]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown format " + strconv.Quote(format)})
+			return
+		}
+		if !underSpanLimit(c, src, traceID, "exports") {
+			return
+		}
+		recs, err := fetchRecords(src, traceID)
+		if err != nil && err != errTraceNotFound {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if len(recs) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "trace not found"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="trace-%s-%s.json"`, safeFilename(traceID), format))
+		c.JSON(http.StatusOK, encode(recs))
+	}
+}
+
+var exportFormats = map[string]func([]spanRecord) any{
+	"otlp":   func(r []spanRecord) any { return toOTLP(r) },
+	"jaeger": func(r []spanRecord) any { return jaegerResponse{Data: []jaegerTrace{toJaeger(r)}} },
+	"zipkin": func(r []spanRecord) any { return toZipkin(r) },
+}
+
+func safeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// OTLP/JSON types, following the protobuf JSON mapping used by OTLP/HTTP:
+// lowerCamelCase fields, hex trace/span IDs, enums as integers and 64-bit
+// integers as decimal strings.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name,omitempty"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceId           string         `json:"traceId"`
+		SpanId            string         `json:"spanId"`
+		TraceState        string         `json:"traceState,omitempty"`
+		ParentSpanId      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Links             []otlpLink     `json:"links,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpLink struct {
+		TraceId    string         `json:"traceId"`
+		SpanId     string         `json:"spanId"`
+		TraceState string         `json:"traceState,omitempty"`
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	// The exporter flattens every attribute value to a string, so that is
+	// the only AnyValue variant we can faithfully produce.
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// toOTLP groups spans by resource (service plus resource attributes) and
+// instrumentation scope, in order of first appearance.
+func toOTLP(recs []spanRecord) otlpTraces {
+	out := otlpTraces{ResourceSpans: []otlpResourceSpans{}}
+	resIdx := map[string]int{}
+	scopeIdx := map[string]int{}
+	for _, r := range recs {
+		res := r.ResourceAttributes
+		if res["service.name"] == "" && r.ServiceName != "" {
+			res = copyAttrs(res)
+			res["service.name"] = r.ServiceName
+		}
+		rk := attrsKey(res)
+		ri, ok := resIdx[rk]
+		if !ok {
+			ri = len(out.ResourceSpans)
+			resIdx[rk] = ri
+			out.ResourceSpans = append(out.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: otlpAttrs(res)},
+			})
+		}
+		rs := &out.ResourceSpans[ri]
+		sk := rk + "\x00" + r.ScopeName + "\x00" + r.ScopeVersion
+		si, ok := scopeIdx[sk]
+		if !ok {
+			si = len(rs.ScopeSpans)
+			scopeIdx[sk] = si
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{Scope: otlpScope{Name: r.ScopeName, Version: r.ScopeVersion}})
+		}
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, otlpSpanOf(r))
+	}
+	return out
+}
+
+func otlpSpanOf(r spanRecord) otlpSpan {
+	s := otlpSpan{
+		TraceId:           strings.ToLower(r.TraceId),
+		SpanId:            strings.ToLower(r.SpanId),
+		TraceState:        r.TraceState,
+		ParentSpanId:      strings.ToLower(r.ParentSpanId),
+		Name:              r.SpanName,
+		Kind:              spanKindNumber(r.SpanKind),
+		StartTimeUnixNano: strconv.FormatInt(r.StartNS, 10),
+		EndTimeUnixNano:   strconv.FormatInt(r.EndNS, 10),
+		Attributes:        otlpAttrs(r.SpanAttributes),
+		Status:            otlpStatus{Code: statusCodeNumber(r.StatusCode), Message: r.StatusMessage},
+	}
+	for i, name := range r.EventNames {
+		e := otlpEvent{Name: name}
+		if i < len(r.EventTimes) {
+			e.TimeUnixNano = strconv.FormatInt(r.EventTimes[i], 10)
+		}
+		if i < len(r.EventAttrs) {
+			e.Attributes = otlpAttrs(r.EventAttrs[i])
+		}
+		s.Events = append(s.Events, e)
+	}
+	for i, tid := range r.LinkTraceIds {
+		l := otlpLink{TraceId: strings.ToLower(tid)}
+		if i < len(r.LinkSpanIds) {
+			l.SpanId = strings.ToLower(r.LinkSpanIds[i])
+		}
+		if i < len(r.LinkTraceStates) {
+			l.TraceState = r.LinkTraceStates[i]
+		}
+		if i < len(r.LinkAttrs) {
+			l.Attributes = otlpAttrs(r.LinkAttrs[i])
+		}
+		s.Links = append(s.Links, l)
+	}
+	return s
+}
+
+// otlpAttrs converts a flat attribute map to KeyValues sorted by key so
+// exports are deterministic.
+func otlpAttrs(m map[string]string) []otlpKeyValue {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := sortedKeys(m)
+	out := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		out[i] = otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: m[k]}}
+	}
+	return out
+}
+
+func attrsKey(m map[string]string) string {
+	b, _ := json.Marshal(m) // map keys are marshalled sorted
+	return string(b)
+}
+
+func copyAttrs(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m)+1)
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// normEnum strips an OTLP enum prefix and case so "SPAN_KIND_SERVER",
+// "Server" and "SERVER" compare equal.
+func normEnum(v, prefix string) string {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	return strings.TrimPrefix(v, prefix)
+}
+
+// spanKindNumber maps the exporter's SpanKind string to the OTLP enum.
+func spanKindNumber(k string) int {
+	switch normEnum(k, "SPAN_KIND_") {
+	case "INTERNAL":
+		return 1
+	case "SERVER":
+		return 2
+	case "CLIENT":
+		return 3
+	case "PRODUCER":
+		return 4
+	case "CONSUMER":
+		return 5
+	}
+	return 0
+}
+
+// statusCodeNumber maps the exporter's StatusCode string to the OTLP enum.
+func statusCodeNumber(s string) int {
+	switch normEnum(s, "STATUS_CODE_") {
+	case "OK":
+		return 1
+	case "ERROR":
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+package traces
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Jaeger UI JSON, the shape served by jaeger-query's /api/traces/{id}.
+// Times and durations are microseconds.
+type (
+	jaegerResponse struct {
+		Data   any           `json:"data"` // []jaegerTrace, or []string for services/operations
+		Total  int           `json:"total"`
+		Limit  int           `json:"limit"`
+		Offset int           `json:"offset"`
+		Errors []jaegerError `json:"errors"`
+	}
+	jaegerError struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	jaegerTrace struct {
+		TraceID   string                   `json:"traceID"`
+		Spans     []jaegerSpan             `json:"spans"`
+		Processes map[string]jaegerProcess `json:"processes"`
+		Warnings  []string                 `json:"warnings"`
+	}
+	jaegerSpan struct {
+		TraceID       string            `json:"traceID"`
+		SpanID        string            `json:"spanID"`
+		Flags         int               `json:"flags"`
+		OperationName string            `json:"operationName"`
+		References    []jaegerReference `json:"references"`
+		StartTime     int64             `json:"startTime"`
+		Duration      int64             `json:"duration"`
+		Tags          []jaegerKeyValue  `json:"tags"`
+		Logs          []jaegerLog       `json:"logs"`
+		ProcessID     string            `json:"processID"`
+		Warnings      []string          `json:"warnings"`
+	}
+	jaegerReference struct {
+		RefType string `json:"refType"` // CHILD_OF | FOLLOWS_FROM
+		TraceID string `json:"traceID"`
+		SpanID  string `json:"spanID"`
+	}
+	jaegerProcess struct {
+		ServiceName string           `json:"serviceName"`
+		Tags        []jaegerKeyValue `json:"tags"`
+	}
+	jaegerLog struct {
+		Timestamp int64            `json:"timestamp"`
+		Fields    []jaegerKeyValue `json:"fields"`
+	}
+	jaegerKeyValue struct {
+		Key   string `json:"key"`
+		Type  string `json:"type"` // string | bool
+		Value any    `json:"value"`
+	}
+)
+
+// toJaeger converts one trace. Each distinct resource becomes a process
+// (p1, p2, ... in order of first appearance); links become FOLLOWS_FROM
+// references and events become logs with an "event" field, following the
+// OpenTelemetry-to-Jaeger mapping.
+func toJaeger(recs []spanRecord) jaegerTrace {
+	out := jaegerTrace{Spans: []jaegerSpan{}, Processes: map[string]jaegerProcess{}}
+	procIdx := map[string]string{}
+	for _, r := range recs {
+		if out.TraceID == "" {
+			out.TraceID = strings.ToLower(r.TraceId)
+		}
+		res := copyAttrs(r.ResourceAttributes)
+		delete(res, "service.name")
+		pk := r.ServiceName + "\x00" + attrsKey(res)
+		pid, ok := procIdx[pk]
+		if !ok {
+			pid = fmt.Sprintf("p%d", len(procIdx)+1)
+			procIdx[pk] = pid
+			out.Processes[pid] = jaegerProcess{ServiceName: r.ServiceName, Tags: jaegerTags(res)}
+		}
+		out.Spans = append(out.Spans, jaegerSpanOf(r, pid))
+	}
+	return out
+}
+
+func jaegerSpanOf(r spanRecord, pid string) jaegerSpan {
+	s := jaegerSpan{
+		TraceID:       strings.ToLower(r.TraceId),
+		SpanID:        strings.ToLower(r.SpanId),
+		Flags:         1,
+		OperationName: r.SpanName,
+		References:    []jaegerReference{},
+		StartTime:     r.StartNS / 1000,
+		Duration:      (r.EndNS - r.StartNS) / 1000,
+		Logs:          []jaegerLog{},
+		ProcessID:     pid,
+	}
+	if r.ParentSpanId != "" {
+		s.References = append(s.References, jaegerReference{RefType: "CHILD_OF", TraceID: s.TraceID, SpanID: strings.ToLower(r.ParentSpanId)})
+	}
+	for i, tid := range r.LinkTraceIds {
+		if i < len(r.LinkSpanIds) {
+			s.References = append(s.References, jaegerReference{RefType: "FOLLOWS_FROM", TraceID: strings.ToLower(tid), SpanID: strings.ToLower(r.LinkSpanIds[i])})
+		}
+	}
+
+	tags := copyAttrs(r.SpanAttributes)
+	if k := normEnum(r.SpanKind, "SPAN_KIND_"); k != "" && k != "UNSPECIFIED" && k != "INTERNAL" {
+		tags["span.kind"] = strings.ToLower(k)
+	}
+	if r.ScopeName != "" {
+		tags["otel.scope.name"] = r.ScopeName
+	}
+	if r.ScopeVersion != "" {
+		tags["otel.scope.version"] = r.ScopeVersion
+	}
+	if r.TraceState != "" {
+		tags["w3c.tracestate"] = r.TraceState
+	}
+	switch statusCodeNumber(r.StatusCode) {
+	case 1:
+		tags["otel.status_code"] = "OK"
+	case 2:
+		tags["otel.status_code"] = "ERROR"
+		if r.StatusMessage != "" {
+			tags["otel.status_description"] = r.StatusMessage
+		}
+	}
+	s.Tags = jaegerTags(tags)
+	if statusCodeNumber(r.StatusCode) == 2 {
+		s.Tags = append(s.Tags, jaegerKeyValue{Key: "error", Type: "bool", Value: true})
+	}
+
+	for i, name := range r.EventNames {
+		l := jaegerLog{Fields: []jaegerKeyValue{{Key: "event", Type: "string", Value: name}}}
+		if i < len(r.EventTimes) {
+			l.Timestamp = r.EventTimes[i] / 1000
+		}
+		if i < len(r.EventAttrs) {
+			l.Fields = append(l.Fields, jaegerTags(r.EventAttrs[i])...)
+		}
+		s.Logs = append(s.Logs, l)
+	}
+	return s
+}
+
+func jaegerTags(m map[string]string) []jaegerKeyValue {
+	out := []jaegerKeyValue{}
+	for _, k := range sortedKeys(m) {
+		out = append(out, jaegerKeyValue{Key: k, Type: "string", Value: m[k]})
+	}
+	return out
+}
+
+// Zipkin v2 JSON (POST /api/v2/spans). Times and durations are microseconds.
+type (
+	zipkinSpan struct {
+		TraceID        string             `json:"traceId"`
+		ID             string             `json:"id"`
+		ParentID       string             `json:"parentId,omitempty"`
+		Name           string             `json:"name"`
+		Kind           string             `json:"kind,omitempty"`
+		Timestamp      int64              `json:"timestamp"`
+		Duration       int64              `json:"duration"`
+		LocalEndpoint  zipkinEndpoint     `json:"localEndpoint"`
+		RemoteEndpoint *zipkinEndpoint    `json:"remoteEndpoint,omitempty"`
+		Annotations    []zipkinAnnotation `json:"annotations,omitempty"`
+		Tags           map[string]string  `json:"tags,omitempty"`
+	}
+	zipkinEndpoint struct {
+		ServiceName string `json:"serviceName"`
+	}
+	zipkinAnnotation struct {
+		Timestamp int64  `json:"timestamp"`
+		Value     string `json:"value"`
+	}
+)
+
+// toZipkin converts spans following the OpenTelemetry-to-Zipkin mapping:
+// ServiceName becomes localEndpoint, peer.service the remoteEndpoint, events
+// become annotations ("name" or "name: {attrs}") and an error status sets the
+// "error" tag. Zipkin has no resources or links, so those are dropped.
+func toZipkin(recs []spanRecord) []zipkinSpan {
+	out := make([]zipkinSpan, 0, len(recs))
+	for _, r := range recs {
+		s := zipkinSpan{
+			TraceID:       strings.ToLower(r.TraceId),
+			ID:            strings.ToLower(r.SpanId),
+			ParentID:      strings.ToLower(r.ParentSpanId),
+			Name:          r.SpanName,
+			Timestamp:     r.StartNS / 1000,
+			Duration:      (r.EndNS - r.StartNS) / 1000,
+			LocalEndpoint: zipkinEndpoint{ServiceName: r.ServiceName},
+		}
+		switch k := normEnum(r.SpanKind, "SPAN_KIND_"); k {
+		case "SERVER", "CLIENT", "PRODUCER", "CONSUMER":
+			s.Kind = k
+		}
+		if peer := r.SpanAttributes["peer.service"]; peer != "" {
+			s.RemoteEndpoint = &zipkinEndpoint{ServiceName: peer}
+		}
+
+		tags := copyAttrs(r.SpanAttributes)
+		if r.ScopeName != "" {
+			tags["otel.scope.name"] = r.ScopeName
+		}
+		if r.ScopeVersion != "" {
+			tags["otel.scope.version"] = r.ScopeVersion
+		}
+		switch statusCodeNumber(r.StatusCode) {
+		case 1:
+			tags["otel.status_code"] = "OK"
+		case 2:
+			tags["otel.status_code"] = "ERROR"
+			tags["error"] = r.StatusMessage
+		}
+		if len(tags) > 0 {
+			s.Tags = tags
+		}
+
+		for i, name := range r.EventNames {
+			a := zipkinAnnotation{Value: name}
+			if i < len(r.EventTimes) {
+				a.Timestamp = r.EventTimes[i] / 1000
+			}
+			if i < len(r.EventAttrs) && len(r.EventAttrs[i]) > 0 {
+				b, _ := json.Marshal(r.EventAttrs[i])
+				a.Value = name + ": " + string(b)
+			}
+			s.Annotations = append(s.Annotations, a)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,72 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*.golden.json")
+
+// TestExport_Golden renders exportRows in each format and compares with
+// testdata/export_<format>.golden.json (go test -run Golden -update).
+func TestExport_Golden(t *testing.T) {
+	ts := fakeCH(t, exportRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/traces/:traceId/export", Export(src))
+
+	for _, format := range []string{"otlp", "jaeger", "zipkin"} {
+		t.Run(format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/AB01/export?format="+format, nil))
+			if w.Code != 200 {
+				t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+			}
+			var got bytes.Buffer
+			if err := json.Indent(&got, w.Body.Bytes(), "", "  "); err != nil {
+				t.Fatalf("indent: %v", err)
+			}
+			got.WriteByte('\n')
+
+			path := filepath.Join("testdata", "export_"+format+".golden.json")
+			if *update {
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read golden (run with -update): %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Fatalf("%s differs from golden:\n%s", path, got.String())
+			}
+		})
+	}
+}
+
+func TestToJaeger_ProcessesAndReferences(t *testing.T) {
+	recs := []spanRecord{
+		{TraceId: "T", SpanId: "A", ServiceName: "web", ResourceAttributes: map[string]string{"service.name": "web", "host.name": "h1"}},
+		{TraceId: "T", SpanId: "B", ParentSpanId: "A", ServiceName: "web", ResourceAttributes: map[string]string{"host.name": "h1"}},
+		{TraceId: "T", SpanId: "C", ParentSpanId: "B", ServiceName: "db", LinkTraceIds: []string{"U"}, LinkSpanIds: []string{"X"}},
+	}
+	tr := toJaeger(recs)
+	if len(tr.Processes) != 2 || tr.Spans[0].ProcessID != "p1" || tr.Spans[1].ProcessID != "p1" || tr.Spans[2].ProcessID != "p2" {
+		t.Fatalf("processes=%+v spans=%+v", tr.Processes, tr.Spans)
+	}
+	if p := tr.Processes["p1"]; p.ServiceName != "web" || len(p.Tags) != 1 || p.Tags[0].Key != "host.name" {
+		t.Fatalf("p1=%+v", p)
+	}
+	refs := tr.Spans[2].References
+	if len(refs) != 2 || refs[0].RefType != "CHILD_OF" || refs[0].SpanID != "b" || refs[1].RefType != "FOLLOWS_FROM" || refs[1].TraceID != "u" {
+		t.Fatalf("refs=%+v", refs)
+	}
+}
@@ -0,0 +1,119 @@
+package traces
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+const exportRows = `{"TraceId":"AB01","SpanId":"A1","ParentSpanId":"","TraceState":"","SpanName":"GET /","SpanKind":"Server","ServiceName":"web","ResourceAttributes":{"service.name":"web","host.name":"h1"},"ScopeName":"otelhttp","ScopeVersion":"0.49.0","SpanAttributes":{"http.method":"GET"},"start_ns":1700000000000000000,"end_ns":1700000000005000000,"StatusCode":"Error","StatusMessage":"boom","EventTimes":[1700000000000500000],"EventNames":["exception"],"EventAttrs":[{"exception.type":"IOError"}],"LinkTraceIds":[],"LinkSpanIds":[],"LinkTraceStates":[],"LinkAttrs":[]}
+{"TraceId":"AB01","SpanId":"B2","ParentSpanId":"A1","TraceState":"","SpanName":"SELECT","SpanKind":"SPAN_KIND_CLIENT","ServiceName":"web","ResourceAttributes":{"service.name":"web","host.name":"h1"},"ScopeName":"database/sql","ScopeVersion":"","SpanAttributes":{},"start_ns":1700000000001000000,"end_ns":1700000000002000000,"StatusCode":"Unset","StatusMessage":"","EventTimes":[],"EventNames":[],"EventAttrs":[],"LinkTraceIds":["CD02"],"LinkSpanIds":["C3"],"LinkTraceStates":[""],"LinkAttrs":[{}]}
+{"TraceId":"AB01","SpanId":"C3","ParentSpanId":"B2","TraceState":"","SpanName":"query","SpanKind":"Server","ServiceName":"db","ResourceAttributes":{},"ScopeName":"otelhttp","ScopeVersion":"0.49.0","SpanAttributes":{},"start_ns":1700000000001100000,"end_ns":1700000000001900000,"StatusCode":"Ok","StatusMessage":"","EventTimes":[],"EventNames":[],"EventAttrs":[],"LinkTraceIds":[],"LinkSpanIds":[],"LinkTraceStates":[],"LinkAttrs":[]}
+`
+
+func TestExport_OTLPGroupsByResourceAndScope(t *testing.T) {
+	ts := fakeCH(t, exportRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/traces/:traceId/export", Export(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/AB01/export?format=otlp", nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), `filename="trace-AB01-otlp.json"`) {
+		t.Fatalf("Content-Disposition=%q", w.Header().Get("Content-Disposition"))
+	}
+
+	var out otlpTraces
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if len(out.ResourceSpans) != 2 {
+		t.Fatalf("resourceSpans=%d want 2 (web, db)", len(out.ResourceSpans))
+	}
+	web := out.ResourceSpans[0]
+	if len(web.ScopeSpans) != 2 || web.ScopeSpans[0].Scope.Name != "otelhttp" || web.ScopeSpans[1].Scope.Name != "database/sql" {
+		t.Fatalf("web scopes=%+v", web.ScopeSpans)
+	}
+	root := web.ScopeSpans[0].Spans[0]
+	if root.TraceId != "ab01" || root.Kind != 2 || root.Status.Code != 2 || root.Status.Message != "boom" {
+		t.Fatalf("root=%+v", root)
+	}
+	if root.StartTimeUnixNano != "1700000000000000000" || root.EndTimeUnixNano != "1700000000005000000" {
+		t.Fatalf("times=%s..%s", root.StartTimeUnixNano, root.EndTimeUnixNano)
+	}
+	if len(root.Events) != 1 || root.Events[0].Name != "exception" || root.Events[0].TimeUnixNano != "1700000000000500000" ||
+		root.Events[0].Attributes[0].Value.StringValue != "IOError" {
+		t.Fatalf("events=%+v", root.Events)
+	}
+	client := web.ScopeSpans[1].Spans[0]
+	if client.Kind != 3 || client.ParentSpanId != "a1" || len(client.Links) != 1 || client.Links[0].SpanId != "c3" {
+		t.Fatalf("client=%+v", client)
+	}
+
+	// db had no resource attributes; service.name is filled from ServiceName.
+	db := out.ResourceSpans[1]
+	if len(db.Resource.Attributes) != 1 || db.Resource.Attributes[0].Key != "service.name" || db.Resource.Attributes[0].Value.StringValue != "db" {
+		t.Fatalf("db resource=%+v", db.Resource)
+	}
+	if db.ScopeSpans[0].Spans[0].Status.Code != 1 {
+		t.Fatalf("db status=%+v", db.ScopeSpans[0].Spans[0].Status)
+	}
+}
+
+func TestExport_Errors(t *testing.T) {
+	ts := fakeCH(t, "")
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/traces/:traceId/export", Export(src))
+
+	for path, want := range map[string]int{
+		"/api/traces/nope/export":             404,
+		"/api/traces/nope/export?format=xml":  400,
+		"/api/traces/nope/export?format=otlp": 404,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Fatalf("%s: status=%d want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestExport_RefusesTracesOverTheSpanLimit(t *testing.T) {
+	ts, queries := captureCH(t, exportRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client(), TraceMaxSpans: 2}
+	r := newRouter("/api/traces/:traceId/export", Export(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/AB01/export", nil))
+	if w.Code != 413 || !strings.Contains(w.Body.String(), `"truncated":true`) {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	if len(*queries) != 1 || strings.Contains((*queries)[0], "EventTimes") {
+		t.Fatalf("read span rows of a refused trace: %q", *queries)
+	}
+}
+
+func TestRecordsSQL_SelectsEventsLinksAndScope(t *testing.T) {
+	sql := recordsSQL("obs", sources.TraceSchema{AttributeStorage: "json"}, "x'y")
+	for _, want := range []string{
+		"FROM obs.otel_traces",
+		"WHERE TraceId IN ('x\\'y')",
+		"arrayMap(x -> toUnixTimestamp64Nano(x), Events.Timestamp) AS EventTimes",
+		"Links.SpanId AS LinkSpanIds",
+		"ScopeName AS ScopeName",
+		"CAST(JSONExtractKeysAndValues(ResourceAttributes, 'String'), 'Map(String, String)') AS ResourceAttributes",
+		"arrayMap(a -> CAST(JSONExtractKeysAndValues(a, 'String'), 'Map(String, String)'), Events.Attributes)",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("sql missing %q:\n%s", want, sql)
+		}
+	}
+}
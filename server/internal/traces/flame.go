@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/example/otel-stack-demo/internal/sources"
@@ -33,6 +34,7 @@ type flameRow struct {
 	ParentSpanId string `json:"ParentSpanId"`
 	SpanName     string `json:"SpanName"`
 	ServiceName  string `json:"ServiceName"`
+	SpanKind     string `json:"SpanKind"`
 	StartNS      int64  `json:"start_ns"`
 	EndNS        int64  `json:"end_ns"`
 }
@@ -42,31 +44,77 @@ type FlameNode struct {
 	Name     string      `json:"name"`
 	Value    int64       `json:"value"` // microseconds
 	Children []FlameNode `json:"children,omitempty"`
+	// Count is how many spans a merged (collapse=true) or "other" node
+	// stands for; omitted for single spans.
+	Count int `json:"count,omitempty"`
+	// Warnings is set on the root only; see analyzeTrace.
+	Warnings []TraceWarning `json:"warnings,omitempty"`
+
+	total, self int64 // µs, whatever Value shows; used by the profile formats
 }
 
-// NOTE on units:
-//   - Most OTEL→ClickHouse pipelines store Duration in *milliseconds*.
-//     If yours stores *nanoseconds*, change "+ (Duration * 1000000)" below to "+ Duration".
-const flameSQL = `
+// flameSQL selects span intervals using the configured or detected column
+// names, timestamp type and duration unit (sources.TraceSchema).
+func flameSQL(ts sources.TraceSchema) string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	return fmt.Sprintf(`
 SELECT
-  SpanId,
-  ifNull(ParentSpanId, '') AS ParentSpanId,
-  SpanName AS SpanName,
-  ServiceName AS ServiceName,
-  toInt64(toUnixTimestamp64Nano(Timestamp)) AS start_ns,
-  toInt64(toUnixTimestamp64Nano(Timestamp) + (Duration * 1000000)) AS end_ns
-FROM {db:Identifier}.otel_traces
-WHERE lower(TraceId) = lower({traceId:String})
+  %s AS SpanId,
+  ifNull(%s, '') AS ParentSpanId,
+  %s AS SpanName,
+  %s AS ServiceName,
+  %s AS SpanKind,
+  toInt64(%s) AS start_ns,
+  toInt64(%[6]s + %s) AS end_ns
+FROM {db:Identifier}.%s
+WHERE lower(%s) = lower({traceId:String})
 ORDER BY start_ns ASC
 FORMAT JSONEachRow
-`
+`, col.SpanId, col.ParentSpanId, col.SpanName, col.ServiceName, col.SpanKind,
+		ts.StartNs(""), ts.DurationNs(""), ts.Tables.Spans, col.TraceId)
+}
 
-// Flame returns a flamegraph-compatible tree for a trace
+// Flame returns a flamegraph-compatible tree for a trace, with the
+// trace-quality warnings on its root; ?adjustSkew=true corrects clock skew
+// before the tree is built. format=folded and format=pprof return the same
+// tree as profiles (see flame_formats.go).
 func Flame(src *sources.Sources) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		traceID := strings.ToLower(c.Param("traceId"))
-		groupBy := c.DefaultQuery("groupBy", "service_operation") // service|operation|name|service_operation
-		mode := c.DefaultQuery("mode", "total")                   // total|self
+		opts := flameOptions{
+			GroupBy:    c.DefaultQuery("groupBy", "service_operation"), // service|operation|name|service_operation
+			Mode:       c.DefaultQuery("mode", "total"),                // total|self
+			AdjustSkew: c.Query("adjustSkew") == "true",
+			Collapse:   c.Query("collapse") == "true",
+		}
+		format := c.DefaultQuery("format", "json") // json|folded|pprof
+		if !flameFormats[format] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown format " + strconv.Quote(format)})
+			return
+		}
+		if v := c.Query("minValue"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "minValue must be a non-negative number of µs"})
+				return
+			}
+			opts.MinValue = n
+		}
+
+		if isImportID(traceID) {
+			recs, ok := importedRecords(src, traceID)
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "imported trace expired or unknown"})
+				return
+			}
+			spans := make(map[string]*Span, len(recs))
+			for _, s := range recordSpans(recs) {
+				spans[s.SpanID] = &s
+			}
+			writeFlame(c, traceID, checkedFlameTree(traceID, spans, recordEdges(recs), opts), format)
+			return
+		}
 
 		// Build ClickHouse HTTP request.
 		// Bind both the default database (for HTTP context) and the query param {db:Identifier}.
@@ -75,7 +123,7 @@ func Flame(src *sources.Sources) gin.HandlerFunc {
 			src.CHDB, traceID, src.CHDB,
 		)
 
-		req, err := http.NewRequest(http.MethodPost, chURL, strings.NewReader(flameSQL))
+		req, err := http.NewRequest(http.MethodPost, chURL, strings.NewReader(flameSQL(src.Traces)))
 		if err != nil {
 			c.JSON(http.StatusBadGateway, gin.H{"error": "build CH request: " + err.Error()})
 			return
@@ -99,6 +147,7 @@ func Flame(src *sources.Sources) gin.HandlerFunc {
 
 		// Decode JSONEachRow
 		spans := make(map[string]*Span, 128)
+		var edges []spanEdge
 		dec := json.NewDecoder(bufio.NewReader(resp.Body))
 		for {
 			var r flameRow
@@ -118,62 +167,103 @@ func Flame(src *sources.Sources) gin.HandlerFunc {
 				EndUnixNanos:   r.EndNS,
 			}
 			spans[s.SpanID] = s
+			edges = append(edges, spanEdge{SpanId: r.SpanId, ParentSpanId: r.ParentSpanId,
+				ServiceName: r.ServiceName, SpanKind: r.SpanKind, StartNS: r.StartNS, EndNS: r.EndNS})
 		}
 
-		if len(spans) == 0 {
-			c.JSON(http.StatusOK, FlameNode{Name: "trace:" + traceID, Value: 0, Children: nil})
-			return
-		}
+		writeFlame(c, traceID, checkedFlameTree(traceID, spans, edges, opts), format)
+	}
+}
 
-		// Build adjacency (parent -> children)
-		children := map[string][]string{}
-		roots := make([]string, 0, 4)
-		for _, s := range spans {
-			if s.ParentSpanID == "" || spans[s.ParentSpanID] == nil {
-				roots = append(roots, s.SpanID)
-			} else {
-				children[s.ParentSpanID] = append(children[s.ParentSpanID], s.SpanID)
-			}
+// flameOptions are Flame's query parameters that shape the tree.
+type flameOptions struct {
+	GroupBy, Mode string
+	AdjustSkew    bool
+	Collapse      bool  // merge siblings with the same label
+	MinValue      int64 // µs; smaller frames are folded into "other"
+}
+
+// checkedFlameTree runs the trace-quality checks, applies any clock-skew
+// shifts to spans and builds the tree.
+func checkedFlameTree(traceID string, spans map[string]*Span, edges []spanEdge, o flameOptions) FlameNode {
+	q := analyzeTrace(newSpanTree(edges), o.AdjustSkew)
+	for id, d := range q.Shift {
+		if s := spans[id]; s != nil {
+			shiftSpan(s, d)
 		}
-		sort.Strings(roots)
+	}
+	root := flameTree(traceID, spans, o.GroupBy, o.Mode)
+	if o.Collapse {
+		root = collapseFlame(root)
+	}
+	if o.MinValue > 0 {
+		root = pruneFlame(root, o.MinValue, o.Mode)
+	}
+	root.Warnings = q.Warnings
+	return root
+}
+
+// flameTree assembles spans into one tree; several roots hang under a
+// synthetic "trace:<id>" node.
+func flameTree(traceID string, spans map[string]*Span, groupBy, mode string) FlameNode {
+	if len(spans) == 0 {
+		return FlameNode{Name: "trace:" + traceID, Value: 0, Children: nil}
+	}
 
-		// Assemble tree
-		var root FlameNode
-		if len(roots) == 1 {
-			root = buildFlame(roots[0], spans, children, groupBy, mode)
+	// Build adjacency (parent -> children)
+	children := map[string][]string{}
+	roots := make([]string, 0, 4)
+	for _, s := range spans {
+		if s.ParentSpanID == "" || spans[s.ParentSpanID] == nil {
+			roots = append(roots, s.SpanID)
 		} else {
-			root = FlameNode{Name: "trace:" + traceID}
-			for _, rid := range roots {
-				ch := buildFlame(rid, spans, children, groupBy, mode)
-				root.Children = append(root.Children, ch)
-				root.Value += ch.Value
-			}
+			children[s.ParentSpanID] = append(children[s.ParentSpanID], s.SpanID)
 		}
-		c.JSON(http.StatusOK, root)
 	}
+	sort.Strings(roots)
+	// Children in start order, so output (and collapsing) is deterministic.
+	for _, ids := range children {
+		sort.Slice(ids, func(i, j int) bool {
+			a, b := spans[ids[i]], spans[ids[j]]
+			if a.StartUnixNanos != b.StartUnixNanos {
+				return a.StartUnixNanos < b.StartUnixNanos
+			}
+			return a.SpanID < b.SpanID
+		})
+	}
+
+	// Assemble tree
+	if len(roots) == 1 {
+		return buildFlame(roots[0], spans, children, groupBy, mode)
+	}
+	root := FlameNode{Name: "trace:" + traceID}
+	for _, rid := range roots {
+		ch := buildFlame(rid, spans, children, groupBy, mode)
+		root.Children = append(root.Children, ch)
+		root.Value += ch.Value
+		root.total += ch.total
+	}
+	return root
 }
 
 func buildFlame(id string, spans map[string]*Span, children map[string][]string, groupBy, mode string) FlameNode {
 	s := spans[id]
 	totalUS := (s.EndUnixNanos - s.StartUnixNanos) / 1000 // ns -> µs for d3-flame-graph
-	node := FlameNode{Name: label(s, groupBy), Value: totalUS}
+	node := FlameNode{Name: label(s, groupBy), total: totalUS}
 
 	// Recurse
+	iv := make([][2]int64, 0, len(children[id]))
 	for _, cid := range children[id] {
 		ch := buildFlame(cid, spans, children, groupBy, mode)
 		node.Children = append(node.Children, ch)
+		c := spans[cid]
+		iv = append(iv, [2]int64{c.StartUnixNanos, c.EndUnixNanos})
 	}
 
+	node.self = selfNanos(s.StartUnixNanos, s.EndUnixNanos, iv) / 1000
+	node.Value = node.total
 	if mode == "self" {
-		var sum int64
-		for _, ch := range node.Children {
-			sum += ch.Value
-		}
-		if sum < node.Value {
-			node.Value -= sum
-		} else {
-			node.Value = 0
-		}
+		node.Value = node.self
 	}
 	return node
 }
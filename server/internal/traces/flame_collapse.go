@@ -0,0 +1,77 @@
+package traces
+
+// collapseFlame merges siblings with the same name into one node whose
+// value, children and Count are the sums of theirs, then does the same one
+// level down. An N+1 loop of 2,000 "db:SELECT" calls becomes one frame.
+func collapseFlame(n FlameNode) FlameNode {
+	if len(n.Children) == 0 {
+		return n
+	}
+	idx := map[string]int{}
+	var out []FlameNode
+	for _, ch := range n.Children {
+		i, ok := idx[ch.Name]
+		if !ok {
+			idx[ch.Name] = len(out)
+			ch.Count = max(ch.Count, 1)
+			ch.Children = append([]FlameNode(nil), ch.Children...)
+			out = append(out, ch)
+			continue
+		}
+		m := &out[i]
+		m.Value += ch.Value
+		m.total += ch.total
+		m.self += ch.self
+		m.Count += max(ch.Count, 1)
+		m.Children = append(m.Children, ch.Children...)
+	}
+	for i := range out {
+		out[i] = collapseFlame(out[i])
+		if out[i].Count == 1 {
+			out[i].Count = 0
+		}
+	}
+	n.Children = out
+	return n
+}
+
+// pruneFlame folds every subtree whose total is under minValue µs into one
+// "other" node per parent, keeping the parent's value intact.
+func pruneFlame(n FlameNode, minValue int64, mode string) FlameNode {
+	var kept []FlameNode
+	other := FlameNode{Name: "other"}
+	for _, ch := range n.Children {
+		if ch.total >= minValue {
+			kept = append(kept, pruneFlame(ch, minValue, mode))
+			continue
+		}
+		other.total += ch.total
+		other.self += subtreeSelf(ch)
+		other.Count += subtreeCount(ch)
+	}
+	if other.Count > 0 {
+		other.Value = other.total
+		if mode == "self" {
+			other.Value = other.self
+		}
+		kept = append(kept, other)
+	}
+	n.Children = kept
+	return n
+}
+
+func subtreeSelf(n FlameNode) int64 {
+	sum := n.self
+	for _, ch := range n.Children {
+		sum += subtreeSelf(ch)
+	}
+	return sum
+}
+
+func subtreeCount(n FlameNode) int {
+	sum := max(n.Count, 1)
+	for _, ch := range n.Children {
+		sum += subtreeCount(ch)
+	}
+	return sum
+}
@@ -0,0 +1,85 @@
+package traces
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// An N+1 loop: GET (10ms) runs five 1ms SELECTs, each with a 200µs
+// connection checkout, then a 100µs cache call.
+func nPlusOneRows() string {
+	var b strings.Builder
+	b.WriteString(`{"SpanId":"R","ParentSpanId":"","SpanName":"GET","ServiceName":"web","start_ns":0,"end_ns":10000000}` + "\n")
+	for i := 0; i < 5; i++ {
+		start := int64(i) * 1_000_000
+		fmt.Fprintf(&b, `{"SpanId":"S%d","ParentSpanId":"R","SpanName":"SELECT","ServiceName":"db","start_ns":%d,"end_ns":%d}`+"\n", i, start, start+1_000_000)
+		fmt.Fprintf(&b, `{"SpanId":"C%d","ParentSpanId":"S%d","SpanName":"conn","ServiceName":"db","start_ns":%d,"end_ns":%d}`+"\n", i, i, start, start+200_000)
+	}
+	b.WriteString(`{"SpanId":"K","ParentSpanId":"R","SpanName":"GET","ServiceName":"cache","start_ns":6000000,"end_ns":6100000}` + "\n")
+	return b.String()
+}
+
+func flameJSON(t *testing.T, query string) FlameNode {
+	t.Helper()
+	ts := fakeCH(t, nPlusOneRows())
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	w := httptest.NewRecorder()
+	newRouter("/api/traces/:traceId/flame", Flame(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/t/flame?"+query, nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	var root FlameNode
+	if err := json.Unmarshal(w.Body.Bytes(), &root); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	return root
+}
+
+func TestFlame_CollapseSiblings(t *testing.T) {
+	if root := flameJSON(t, ""); len(root.Children) != 6 {
+		t.Fatalf("uncollapsed children=%d want 6", len(root.Children))
+	}
+
+	root := flameJSON(t, "collapse=true")
+	if len(root.Children) != 2 {
+		t.Fatalf("children=%+v", root.Children)
+	}
+	sel := root.Children[0]
+	if sel.Name != "db:SELECT" || sel.Value != 5000 || sel.Count != 5 {
+		t.Fatalf("merged=%+v", sel)
+	}
+	if len(sel.Children) != 1 || sel.Children[0].Name != "db:conn" || sel.Children[0].Value != 1000 || sel.Children[0].Count != 5 {
+		t.Fatalf("merged grandchildren=%+v", sel.Children)
+	}
+	if c := root.Children[1]; c.Name != "cache:GET" || c.Count != 0 {
+		t.Fatalf("single span node=%+v", c)
+	}
+}
+
+func TestFlame_MinValueFoldsIntoOther(t *testing.T) {
+	root := flameJSON(t, "collapse=true&minValue=500")
+	if len(root.Children) != 2 {
+		t.Fatalf("children=%+v", root.Children)
+	}
+	if o := root.Children[1]; o.Name != "other" || o.Value != 100 || o.Count != 1 {
+		t.Fatalf("other=%+v", o)
+	}
+	// The 1000µs of merged conn frames clears the threshold.
+	if sel := root.Children[0]; len(sel.Children) != 1 || sel.Children[0].Name != "db:conn" {
+		t.Fatalf("select children=%+v", sel.Children)
+	}
+
+	// Without collapsing each 200µs conn folds on its own.
+	root = flameJSON(t, "minValue=500")
+	for _, sel := range root.Children[:5] {
+		if len(sel.Children) != 1 || sel.Children[0].Name != "other" || sel.Children[0].Value != 200 {
+			t.Fatalf("select children=%+v", sel.Children)
+		}
+	}
+}
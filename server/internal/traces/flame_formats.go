@@ -0,0 +1,169 @@
+package traces
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Profile formats for Flame, so a trace opens in profiling tools: each span
+// is a frame labelled like the JSON tree (groupBy) and each stack's sample is
+// its spans' self time in µs.
+var flameFormats = map[string]bool{"json": true, "folded": true, "pprof": true}
+
+// writeFlame answers in the requested format; format is already validated.
+func writeFlame(c *gin.Context, traceID string, root FlameNode, format string) {
+	switch format {
+	case "folded":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(foldedText(root)))
+	case "pprof":
+		b, err := pprofProfile(root)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="trace-%s.pb.gz"`, safeFilename(traceID)))
+		c.Data(http.StatusOK, "application/octet-stream", b)
+	default:
+		c.JSON(http.StatusOK, root)
+	}
+}
+
+// flameStack is one distinct root-to-leaf frame path with its summed self time.
+type flameStack struct {
+	frames []string // root first
+	value  int64    // µs
+}
+
+// flameStacks flattens the tree into distinct stacks in first-seen order,
+// dropping the ones with no self time.
+func flameStacks(root FlameNode) []flameStack {
+	var out []flameStack
+	idx := map[string]int{}
+	var walk func(n FlameNode, path []string)
+	walk = func(n FlameNode, path []string) {
+		path = append(path[:len(path):len(path)], n.Name)
+		if n.self > 0 {
+			key := strings.Join(path, "\x00")
+			if i, ok := idx[key]; ok {
+				out[i].value += n.self
+			} else {
+				idx[key] = len(out)
+				out = append(out, flameStack{frames: path, value: n.self})
+			}
+		}
+		for _, ch := range n.Children {
+			walk(ch, path)
+		}
+	}
+	walk(root, nil)
+	return out
+}
+
+// foldedText renders Brendan Gregg's collapsed stacks ("a;b;c 123" per
+// line, sorted), as read by flamegraph.pl and speedscope.
+func foldedText(root FlameNode) string {
+	frame := strings.NewReplacer(";", ":", "\n", " ", "\r", " ")
+	var lines []string
+	for _, st := range flameStacks(root) {
+		fs := make([]string, len(st.frames))
+		for i, f := range st.frames {
+			fs[i] = frame.Replace(f)
+		}
+		lines = append(lines, fmt.Sprintf("%s %d", strings.Join(fs, ";"), st.value))
+	}
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// pprofProfile encodes the stacks as a gzipped profile.proto
+// (github.com/google/pprof/proto/profile.proto), one function and location
+// per distinct frame label.
+func pprofProfile(root FlameNode) ([]byte, error) {
+	strs := []string{""} // string_table[0] must be empty
+	strIdx := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		if i, ok := strIdx[s]; ok {
+			return i
+		}
+		strIdx[s] = uint64(len(strs))
+		strs = append(strs, s)
+		return strIdx[s]
+	}
+	valueType := func(typ, unit string) []byte {
+		b := protowire.AppendTag(nil, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, str(typ))
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		return protowire.AppendVarint(b, str(unit))
+	}
+	field := func(b []byte, num protowire.Number, msg []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, msg)
+	}
+	varint := func(b []byte, num protowire.Number, v uint64) []byte {
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, v)
+	}
+
+	var out []byte
+	out = field(out, 1, valueType("self_time", "microseconds")) // sample_type
+
+	funcID := map[string]uint64{}
+	var funcs []string
+	for _, st := range flameStacks(root) {
+		var locs []byte
+		for i := len(st.frames) - 1; i >= 0; i-- { // leaf first
+			id, ok := funcID[st.frames[i]]
+			if !ok {
+				funcs = append(funcs, st.frames[i])
+				id = uint64(len(funcs))
+				funcID[st.frames[i]] = id
+			}
+			locs = protowire.AppendVarint(locs, id)
+		}
+		sample := field(nil, 1, locs) // location_id, packed
+		sample = field(sample, 2, protowire.AppendVarint(nil, uint64(st.value)))
+		out = field(out, 2, sample)
+	}
+	for i, name := range funcs {
+		id := uint64(i + 1)
+		line := varint(nil, 1, id) // function_id
+		loc := varint(nil, 1, id)
+		loc = field(loc, 4, line)
+		out = field(out, 4, loc) // location
+
+		// Frames are "service:operation"; the service doubles as the file.
+		file, _, _ := strings.Cut(name, ":")
+		fn := varint(nil, 1, id)
+		fn = varint(fn, 2, str(name))
+		fn = varint(fn, 3, str(name))
+		fn = varint(fn, 4, str(file))
+		out = field(out, 5, fn) // function
+	}
+	out = field(out, 11, valueType("self_time", "microseconds")) // period_type
+	out = varint(out, 12, 1)                                     // period
+	out = varint(out, 10, uint64(root.total)*1000)               // duration_nanos
+	for _, s := range strs {
+		out = protowire.AppendTag(out, 6, protowire.BytesType)
+		out = protowire.AppendString(out, s)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(out); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
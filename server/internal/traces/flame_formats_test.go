@@ -0,0 +1,120 @@
+package traces
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// root A (1000µs) with B (200µs) and C (300µs), as in TestFlame_TotalAndSelf,
+// plus a grandchild D (100µs) under B.
+const flameFormatRows = `{"SpanId":"A","ParentSpanId":"","SpanName":"A","ServiceName":"web","start_ns":0,"end_ns":1000000}
+{"SpanId":"B","ParentSpanId":"A","SpanName":"B","ServiceName":"cart","start_ns":100000,"end_ns":300000}
+{"SpanId":"D","ParentSpanId":"B","SpanName":"D;x","ServiceName":"db","start_ns":150000,"end_ns":250000}
+{"SpanId":"C","ParentSpanId":"A","SpanName":"C","ServiceName":"pay","start_ns":400000,"end_ns":700000}
+`
+
+func flameFormat(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	ts := fakeCH(t, flameFormatRows)
+	t.Cleanup(ts.Close)
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	w := httptest.NewRecorder()
+	newRouter("/api/traces/:traceId/flame", Flame(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/t1/flame?"+query, nil))
+	return w
+}
+
+func TestFlame_Folded(t *testing.T) {
+	w := flameFormat(t, "format=folded")
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("status=%d type=%s", w.Code, w.Header().Get("Content-Type"))
+	}
+	want := "web:A 500\n" +
+		"web:A;cart:B 100\n" +
+		"web:A;cart:B;db:D:x 100\n" +
+		"web:A;pay:C 300\n"
+	if got := w.Body.String(); got != want {
+		t.Fatalf("folded:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFlame_Pprof(t *testing.T) {
+	w := flameFormat(t, "format=pprof&groupBy=service")
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	raw, _ := io.ReadAll(zr)
+
+	var (
+		strs    []string
+		samples int
+		total   uint64
+		funcs   = map[uint64]uint64{} // function id -> name index
+		leaves  []uint64
+	)
+	err = eachField(raw, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 2: // sample
+			samples++
+			return eachField(v, func(num protowire.Number, v []byte, x uint64) error {
+				switch num {
+				case 1:
+					id, _ := protowire.ConsumeVarint(v)
+					leaves = append(leaves, id)
+				case 2:
+					val, _ := protowire.ConsumeVarint(v)
+					total += val
+				}
+				return nil
+			})
+		case 5: // function
+			var id, name uint64
+			eachField(v, func(num protowire.Number, _ []byte, x uint64) error {
+				switch num {
+				case 1:
+					id = x
+				case 2:
+					name = x
+				}
+				return nil
+			})
+			funcs[id] = name
+		case 6:
+			strs = append(strs, string(v))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if samples != 4 || total != 1000 {
+		t.Fatalf("samples=%d total=%dµs, want 4 and 1000", samples, total)
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table must start with \"\": %q", strs)
+	}
+	var names []string
+	for _, id := range leaves {
+		names = append(names, strs[funcs[id]])
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "cart,db,pay,web" {
+		t.Fatalf("leaf frames=%v", names)
+	}
+}
+
+func TestFlame_UnknownFormat(t *testing.T) {
+	if w := flameFormat(t, "format=svg"); w.Code != 400 {
+		t.Fatalf("status=%d", w.Code)
+	}
+}
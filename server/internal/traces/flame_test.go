@@ -3,6 +3,7 @@ package traces
 import (
 	"encoding/json"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/example/otel-stack-demo/internal/sources"
@@ -110,3 +111,23 @@ func TestFlame_MultiRootAggregates(t *testing.T) {
 		t.Fatalf("aggregate: %+v", root)
 	}
 }
+
+func TestFlame_UsesConfiguredDurationUnit(t *testing.T) {
+	ts, queries := captureCH(t, "")
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client(),
+		Traces: sources.TraceSchema{DurationColumn: "Duration", DurationUnit: "ms"}}
+	r := newRouter("/api/traces/:traceId/flame", Flame(src))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/traces/T/flame", nil))
+	if sql := (*queries)[0]; !strings.Contains(sql, "toUnixTimestamp64Nano(Timestamp) + (Duration * 1000000)") {
+		t.Fatalf("ms durations not scaled:\n%s", sql)
+	}
+
+	src.Traces = sources.DefaultTraceSchema
+	r = newRouter("/api/traces/:traceId/flame", Flame(src))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/traces/T/flame", nil))
+	if sql := (*queries)[1]; !strings.Contains(sql, "toUnixTimestamp64Nano(Timestamp) + Duration)") {
+		t.Fatalf("ns durations should be used as-is:\n%s", sql)
+	}
+}
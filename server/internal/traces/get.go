@@ -1,12 +1,7 @@
 package traces
 
 import (
-  "bufio"
-  "encoding/json"
-  "fmt"
-  "io"
   "net/http"
-  "strings"
 
   "github.com/gin-gonic/gin"
   "github.com/example/otel-stack-demo/internal/sources"
@@ -16,53 +11,46 @@ type Span struct {
   SpanID string `json:"spanId"`; ParentSpanID string `json:"parentSpanId,omitempty"`
   Name string `json:"name"`; Kind string `json:"kind"`; Service string `json:"service"`
   StartUnixNanos int64 `json:"startUnixNanos"`; EndUnixNanos int64 `json:"endUnixNanos"`
+  // SelfNanos is the time not covered by any child; parallel children count once.
+  SelfNanos int64 `json:"selfNanos"`
   Attributes map[string]string `json:"attributes,omitempty"`
   StatusCode string `json:"statusCode,omitempty"`; StatusMessage string `json:"statusMessage,omitempty"`
+  TraceState string `json:"traceState,omitempty"`
+  ResourceAttributes map[string]string `json:"resourceAttributes,omitempty"`
+  ScopeName string `json:"scopeName,omitempty"`; ScopeVersion string `json:"scopeVersion,omitempty"`
+  Events []SpanEvent `json:"events,omitempty"`
+  Links []SpanLink `json:"links,omitempty"`
+  // HiddenChildren counts children left out of a truncated trace; fetch them with Subtree.
+  HiddenChildren int `json:"hiddenChildren,omitempty"`
 }
 
+// SpanEvent is a timestamped annotation on a span; recorded exceptions are
+// events named "exception" with exception.* attributes.
+type SpanEvent struct {
+  TimeUnixNanos int64 `json:"timeUnixNanos"`; Name string `json:"name"`
+  Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// SpanLink points at a span in this or another trace.
+type SpanLink struct {
+  TraceID string `json:"traceId"`; SpanID string `json:"spanId"`
+  TraceState string `json:"traceState,omitempty"`
+  Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Get streams a trace's spans in start order, at most TraceMaxSpans (or
+// ?maxSpans=) of them; see large.go for how bigger traces are cut down.
+// Trace-quality warnings come first; ?adjustSkew=true corrects clock skew.
 func Get(src *sources.Sources) gin.HandlerFunc {
   return func(c *gin.Context){
     traceID := c.Param("traceId")
-    sql := fmt.Sprintf(`
-      SELECT TraceId, SpanId, ParentSpanId, SpanName, SpanKind, ServiceName,
-             toUnixTimestamp64Nano(Timestamp) AS start_ns,
-             toUnixTimestamp64Nano(Timestamp) + (Duration * 1000000) AS end_ns,
-             SpanAttributes, StatusCode, StatusMessage
-      FROM %s.otel_traces
-      WHERE TraceId = '%s'
-      ORDER BY start_ns ASC
-      FORMAT JSONEachRow
-    `, src.CHDB, traceID)
-
-    req, _ := http.NewRequest("POST", src.CHURL, strings.NewReader(sql))
-    if src.CHUser != "" { req.SetBasicAuth(src.CHUser, src.CHPass) }
-    resp, err := src.Client.Do(req)
-    if err != nil { c.JSON(502, gin.H{"error": err.Error()}); return }
-    defer resp.Body.Close()
-
-    type Row struct {
-      SpanId string `json:"SpanId"`; ParentSpanId string `json:"ParentSpanId"`
-      SpanName string `json:"SpanName"`; SpanKind string `json:"SpanKind"`; ServiceName string `json:"ServiceName"`
-      StartNS int64 `json:"start_ns"`; EndNS int64 `json:"end_ns"`
-      SpanAttributes map[string]any `json:"SpanAttributes"`; StatusCode string `json:"StatusCode"`; StatusMessage string `json:"StatusMessage"`
-    }
-    out := []Span{}
-    rdr := bufio.NewReader(resp.Body)
-    for {
-      line, err := rdr.ReadBytes('\n')
-      if len(line)>0 {
-        var r Row
-        if json.Unmarshal(line, &r)==nil {
-          out = append(out, Span{
-            SpanID: r.SpanId, ParentSpanID: r.ParentSpanId, Name: r.SpanName, Kind: r.SpanKind, Service: r.ServiceName,
-            StartUnixNanos: r.StartNS, EndUnixNanos: r.EndNS, Attributes: strMap(r.SpanAttributes),
-            StatusCode: r.StatusCode, StatusMessage: r.StatusMessage,
-          })
-        }
-      }
-      if err==io.EOF { break }
-      if err!=nil { break }
-    }
-    c.JSON(200, gin.H{"traceId": traceID, "spans": out})
+    limit, err := spanLimit(c, src)
+    if err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
+    tree, err := loadSpanTree(src, traceID)
+    if err == errTraceNotFound { c.JSON(404, gin.H{"error": "imported trace expired or unknown"}); return }
+    if err != nil { c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()}); return }
+    v := traceView{tree: tree, total: len(tree.order), quality: analyzeTrace(tree, c.Query("adjustSkew") == "true"), warnings: true}
+    v.keep, v.hidden = tree.pick(tree.roots(), limit)
+    streamSpans(c, src, traceID, v)
   }
 }
@@ -3,6 +3,7 @@ package traces
 import (
 	"encoding/json"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/example/otel-stack-demo/internal/sources"
@@ -47,3 +48,65 @@ func TestGet_ReturnsTimelineSpans(t *testing.T) {
 		t.Fatalf("attr not decoded: %+v", out.Spans[1].Attributes)
 	}
 }
+
+func TestGet_UsesSchemaMapping(t *testing.T) {
+	ts, queries := captureCH(t, `{"SpanId":"a1","ParentSpanId":""}`+"\n")
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "obs", Client: ts.Client(), Traces: sources.TraceSchema{
+		Tables:           sources.TraceTables{Spans: "spans_v2"},
+		Columns:          sources.TraceColumns{TraceId: "trace_id", ServiceName: "service"},
+		AttributeStorage: "json",
+	}}
+	r := newRouter("/api/traces/:traceId", Get(src))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/traces/abc", nil))
+
+	sql := strings.Join(*queries, "\n")
+	for _, want := range []string{
+		"FROM obs.spans_v2",
+		"WHERE trace_id = 'abc'",
+		"WHERE trace_id IN ('abc')",
+		"Events.Name AS EventNames",
+		"Links.TraceId AS LinkTraceIds",
+		"service AS ServiceName",
+		"JSONExtractKeysAndValues(SpanAttributes, 'String')",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("sql missing %q:\n%s", want, sql)
+		}
+	}
+}
+
+func TestGet_IncludesEventsLinksAndResource(t *testing.T) {
+	body := `{"TraceId":"T","SpanId":"A","SpanName":"GET /checkout","SpanKind":"SPAN_KIND_SERVER","ServiceName":"web",` +
+		`"TraceState":"vendor=1","ResourceAttributes":{"service.name":"web","host.name":"h1"},"ScopeName":"otelhttp","ScopeVersion":"0.49.0",` +
+		`"SpanAttributes":{},"start_ns":1000,"end_ns":5000,"StatusCode":"STATUS_CODE_ERROR","StatusMessage":"boom",` +
+		`"EventTimes":[2000],"EventNames":["exception"],"EventAttrs":[{"exception.type":"IOError","exception.stacktrace":"at x"}],` +
+		`"LinkTraceIds":["L"],"LinkSpanIds":["S"],"LinkTraceStates":[""],"LinkAttrs":[{}]}` + "\n"
+	ts := fakeCH(t, body)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := httptest.NewRecorder()
+	newRouter("/api/traces/:traceId", Get(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/T", nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	var out struct {
+		Spans []Span `json:"spans"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || len(out.Spans) != 1 {
+		t.Fatalf("decode: %v %s", err, w.Body.String())
+	}
+	s := out.Spans[0]
+	if len(s.Events) != 1 || s.Events[0].Name != "exception" || s.Events[0].TimeUnixNanos != 2000 ||
+		s.Events[0].Attributes["exception.type"] != "IOError" {
+		t.Fatalf("events=%+v", s.Events)
+	}
+	if len(s.Links) != 1 || s.Links[0].TraceID != "L" || s.Links[0].SpanID != "S" || s.Links[0].Attributes != nil {
+		t.Fatalf("links=%+v", s.Links)
+	}
+	if s.ResourceAttributes["host.name"] != "h1" || s.ScopeName != "otelhttp" || s.ScopeVersion != "0.49.0" || s.TraceState != "vendor=1" {
+		t.Fatalf("span=%+v", s)
+	}
+}
@@ -0,0 +1,438 @@
+package traces
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultImportTTL      = time.Hour
+	defaultImportMaxSpans = 1_000_000
+	maxImportBytes        = 64 << 20
+
+	importIDPrefix = "imp-"
+)
+
+// Import accepts an OTLP trace dump and keeps it in memory for ImportTTL so
+// it can be opened with Get, Flame and Export under the returned ID. The body
+// is OTLP/JSON (one ExportTraceServiceRequest, or one per line as written by
+// the collector's file exporter) or OTLP protobuf when the Content-Type is
+// application/x-protobuf. A multipart upload with a "file" field works too;
+// *.pb / *.bin files are read as protobuf. gzip Content-Encoding is honored.
+func Import(src *sources.Sources) gin.HandlerFunc {
+	ttl := src.ImportTTL
+	if ttl <= 0 {
+		ttl = defaultImportTTL
+	}
+	maxSpans := src.ImportMaxSpans
+	if maxSpans <= 0 {
+		maxSpans = defaultImportMaxSpans
+	}
+	return func(c *gin.Context) {
+		body, proto, err := importBody(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var req importRequest
+		if proto {
+			req, err = decodeOTLPProto(body)
+		} else {
+			req, err = decodeOTLPJSON(body)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		byTrace, err := req.records()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(byTrace) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no spans in upload"})
+			return
+		}
+
+		expires := time.Now().Add(ttl)
+		type item struct {
+			ID       string   `json:"id"`
+			TraceID  string   `json:"traceId"`
+			Spans    int      `json:"spans"`
+			Services []string `json:"services"`
+		}
+		out := []item{}
+		var upload []sources.ImportedTrace
+		for _, tid := range sortedTraceIDs(byTrace) {
+			recs := byTrace[tid]
+			id, err := newImportID()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			upload = append(upload, sources.ImportedTrace{ID: id, Spans: recs, N: len(recs)})
+			out = append(out, item{ID: id, TraceID: tid, Spans: len(recs), Services: recordServices(recs)})
+		}
+		if err := src.Imports().Put(upload, expires, maxSpans); err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"traces": out, "expiresAt": expires.UTC().Format(time.RFC3339)})
+	}
+}
+
+// importBody returns the (decompressed) upload and whether it is protobuf.
+func importBody(c *gin.Context) ([]byte, bool, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	ct, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	var (
+		r     io.Reader = c.Request.Body
+		proto           = ct == "application/x-protobuf" || ct == "application/protobuf"
+	)
+	if ct == "multipart/form-data" {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return nil, false, fmt.Errorf("multipart upload needs a \"file\" field")
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, false, err
+		}
+		defer f.Close()
+		r = f
+		name := strings.ToLower(fh.Filename)
+		proto = strings.HasSuffix(name, ".pb") || strings.HasSuffix(name, ".bin") ||
+			strings.HasSuffix(name, ".pb.gz") || strings.HasSuffix(name, ".bin.gz")
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("read upload: %w", err)
+	}
+	// Accept gzip by header or by magic bytes, since uploaded files rarely
+	// come with a Content-Encoding.
+	if c.GetHeader("Content-Encoding") == "gzip" || bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, false, fmt.Errorf("gzip: %w", err)
+		}
+		if b, err = io.ReadAll(io.LimitReader(zr, 4*maxImportBytes)); err != nil {
+			return nil, false, fmt.Errorf("gzip: %w", err)
+		}
+	}
+	return b, proto, nil
+}
+
+// OTLP input types. Unlike the export types they accept every encoding
+// producers use: IDs in hex or base64, enums as numbers or names, 64-bit
+// integers as numbers or strings, and every AnyValue variant.
+type (
+	importRequest struct {
+		ResourceSpans []importResourceSpans `json:"resourceSpans"`
+	}
+	importResourceSpans struct {
+		Resource   importResource     `json:"resource"`
+		ScopeSpans []importScopeSpans `json:"scopeSpans"`
+	}
+	importResource struct {
+		Attributes []importKV `json:"attributes"`
+	}
+	importScopeSpans struct {
+		Scope importScope  `json:"scope"`
+		Spans []importSpan `json:"spans"`
+	}
+	importScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	importSpan struct {
+		TraceId           string        `json:"traceId"`
+		SpanId            string        `json:"spanId"`
+		TraceState        string        `json:"traceState"`
+		ParentSpanId      string        `json:"parentSpanId"`
+		Name              string        `json:"name"`
+		Kind              otlpEnum      `json:"kind"`
+		StartTimeUnixNano flexInt       `json:"startTimeUnixNano"`
+		EndTimeUnixNano   flexInt       `json:"endTimeUnixNano"`
+		Attributes        []importKV    `json:"attributes"`
+		Events            []importEvent `json:"events"`
+		Links             []importLink  `json:"links"`
+		Status            importStatus  `json:"status"`
+	}
+	importEvent struct {
+		TimeUnixNano flexInt    `json:"timeUnixNano"`
+		Name         string     `json:"name"`
+		Attributes   []importKV `json:"attributes"`
+	}
+	importLink struct {
+		TraceId    string     `json:"traceId"`
+		SpanId     string     `json:"spanId"`
+		TraceState string     `json:"traceState"`
+		Attributes []importKV `json:"attributes"`
+	}
+	importStatus struct {
+		Code    otlpEnum `json:"code"`
+		Message string   `json:"message"`
+	}
+	importKV struct {
+		Key   string    `json:"key"`
+		Value importAny `json:"value"`
+	}
+	importAny struct {
+		StringValue *string       `json:"stringValue"`
+		BoolValue   *bool         `json:"boolValue"`
+		IntValue    *flexInt      `json:"intValue"`
+		DoubleValue *float64      `json:"doubleValue"`
+		ArrayValue  *importArray  `json:"arrayValue"`
+		KvlistValue *importKVList `json:"kvlistValue"`
+		BytesValue  *string       `json:"bytesValue"` // base64
+	}
+	importArray struct {
+		Values []importAny `json:"values"`
+	}
+	importKVList struct {
+		Values []importKV `json:"values"`
+	}
+)
+
+// flexInt is an int64 encoded as a JSON number or a decimal string.
+type flexInt int64
+
+func (f *flexInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// uint64 nanoseconds past 2262 do not fit; nobody sends those.
+		return fmt.Errorf("integer %s: %w", b, err)
+	}
+	*f = flexInt(n)
+	return nil
+}
+
+// otlpEnum is an enum encoded as its number or its name.
+type otlpEnum string
+
+func (e *otlpEnum) UnmarshalJSON(b []byte) error {
+	*e = otlpEnum(strings.Trim(string(b), `"`))
+	return nil
+}
+
+func (e otlpEnum) number(byName func(string) int) int {
+	if n, err := strconv.Atoi(string(e)); err == nil {
+		return n
+	}
+	return byName(string(e))
+}
+
+func decodeOTLPJSON(b []byte) (importRequest, error) {
+	var all importRequest
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var req importRequest
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return all, fmt.Errorf("OTLP/JSON: %w", err)
+		}
+		all.ResourceSpans = append(all.ResourceSpans, req.ResourceSpans...)
+	}
+	return all, nil
+}
+
+// records flattens the request into exporter-shaped spans grouped by trace.
+func (req importRequest) records() (map[string][]spanRecord, error) {
+	out := map[string][]spanRecord{}
+	for _, rs := range req.ResourceSpans {
+		res := flattenKVs(rs.Resource.Attributes)
+		for _, ss := range rs.ScopeSpans {
+			for _, sp := range ss.Spans {
+				r := spanRecord{
+					TraceId:            normID(sp.TraceId),
+					SpanId:             normID(sp.SpanId),
+					ParentSpanId:       normID(sp.ParentSpanId),
+					TraceState:         sp.TraceState,
+					SpanName:           sp.Name,
+					SpanKind:           spanKindName(sp.Kind.number(spanKindNumber)),
+					ServiceName:        res["service.name"],
+					ResourceAttributes: res,
+					ScopeName:          ss.Scope.Name,
+					ScopeVersion:       ss.Scope.Version,
+					SpanAttributes:     flattenKVs(sp.Attributes),
+					StartNS:            int64(sp.StartTimeUnixNano),
+					EndNS:              int64(sp.EndTimeUnixNano),
+					StatusCode:         statusCodeName(sp.Status.Code.number(statusCodeNumber)),
+					StatusMessage:      sp.Status.Message,
+				}
+				if r.TraceId == "" || r.SpanId == "" {
+					return nil, fmt.Errorf("span %q has no traceId or spanId", sp.Name)
+				}
+				for _, e := range sp.Events {
+					r.EventTimes = append(r.EventTimes, int64(e.TimeUnixNano))
+					r.EventNames = append(r.EventNames, e.Name)
+					r.EventAttrs = append(r.EventAttrs, flattenKVs(e.Attributes))
+				}
+				for _, l := range sp.Links {
+					r.LinkTraceIds = append(r.LinkTraceIds, normID(l.TraceId))
+					r.LinkSpanIds = append(r.LinkSpanIds, normID(l.SpanId))
+					r.LinkTraceStates = append(r.LinkTraceStates, l.TraceState)
+					r.LinkAttrs = append(r.LinkAttrs, flattenKVs(l.Attributes))
+				}
+				out[r.TraceId] = append(out[r.TraceId], r)
+			}
+		}
+	}
+	for _, recs := range out {
+		sort.SliceStable(recs, func(i, j int) bool { return recs[i].StartNS < recs[j].StartNS })
+	}
+	return out, nil
+}
+
+// flattenKVs stringifies attribute values the way the ClickHouse exporter
+// does: scalars as text, arrays and maps as JSON.
+func flattenKVs(kvs []importKV) map[string]string {
+	out := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		out[kv.Key] = kv.Value.String()
+	}
+	return out
+}
+
+func (v importAny) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil, v.KvlistValue != nil:
+		b, _ := json.Marshal(v.plain())
+		return string(b)
+	}
+	return ""
+}
+
+// plain converts to a Go value for JSON encoding of nested values.
+func (v importAny) plain() any {
+	switch {
+	case v.ArrayValue != nil:
+		out := make([]any, len(v.ArrayValue.Values))
+		for i, e := range v.ArrayValue.Values {
+			out[i] = e.plain()
+		}
+		return out
+	case v.KvlistValue != nil:
+		out := make(map[string]any, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			out[kv.Key] = kv.Value.plain()
+		}
+		return out
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	}
+	return v.String()
+}
+
+// normID returns a lowercase hex ID. OTLP/JSON specifies hex, but protojson
+// encoders emit base64, so accept that as well.
+func normID(s string) string {
+	if s == "" {
+		return ""
+	}
+	if _, err := hex.DecodeString(s); err == nil {
+		return strings.ToLower(s)
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return hex.EncodeToString(b)
+	}
+	return s
+}
+
+// spanKindName and statusCodeName give the names the ClickHouse exporter
+// stores, so imported spans look like stored ones.
+func spanKindName(n int) string {
+	return [...]string{"Unspecified", "Internal", "Server", "Client", "Producer", "Consumer"}[clampEnum(n, 5)]
+}
+
+func statusCodeName(n int) string {
+	return [...]string{"Unset", "Ok", "Error"}[clampEnum(n, 2)]
+}
+
+func clampEnum(n, max int) int {
+	if n < 0 || n > max {
+		return 0
+	}
+	return n
+}
+
+func sortedTraceIDs(m map[string][]spanRecord) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func recordServices(recs []spanRecord) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, r := range recs {
+		if r.ServiceName != "" && !seen[r.ServiceName] {
+			seen[r.ServiceName] = true
+			out = append(out, r.ServiceName)
+		}
+	}
+	return out
+}
+
+// isImportID reports whether id was issued by Import; those never hit ClickHouse.
+func isImportID(id string) bool { return strings.HasPrefix(id, importIDPrefix) }
+
+// importedRecords returns the spans of a trace stored by Import.
+func importedRecords(src *sources.Sources, id string) ([]spanRecord, bool) {
+	if !isImportID(id) {
+		return nil, false
+	}
+	v, ok := src.Imports().Get(strings.ToLower(id))
+	if !ok {
+		return nil, false
+	}
+	recs, ok := v.([]spanRecord)
+	return recs, ok
+}
+
+// newImportID returns a random ID for an imported trace.
+func newImportID() (string, error) {
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	return importIDPrefix + hex.EncodeToString(raw[:]), nil
+}
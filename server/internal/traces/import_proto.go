@@ -0,0 +1,253 @@
+package traces
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeOTLPProto reads a binary ExportTraceServiceRequest into the same
+// input types as OTLP/JSON. Field numbers follow
+// opentelemetry/proto/trace/v1/trace.proto and common/v1/common.proto;
+// unknown fields are skipped.
+func decodeOTLPProto(b []byte) (importRequest, error) {
+	var req importRequest
+	err := eachField(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		rs, err := decodeResourceSpans(v)
+		req.ResourceSpans = append(req.ResourceSpans, rs)
+		return err
+	})
+	if err != nil {
+		return req, fmt.Errorf("OTLP protobuf: %w", err)
+	}
+	return req, nil
+}
+
+// eachField walks a message, passing length-delimited payloads as v and
+// varint or fixed-width values as x.
+func eachField(b []byte, fn func(num protowire.Number, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var (
+			v []byte
+			x uint64
+		)
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var y uint32
+			y, n = protowire.ConsumeFixed32(b)
+			x = uint64(y)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeResourceSpans(b []byte) (importResourceSpans, error) {
+	var rs importResourceSpans
+	err := eachField(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1: // resource
+			return eachField(v, func(num protowire.Number, v []byte, _ uint64) error {
+				if num == 1 {
+					kv, err := decodeKV(v)
+					rs.Resource.Attributes = append(rs.Resource.Attributes, kv)
+					return err
+				}
+				return nil
+			})
+		case 2: // scope_spans
+			ss, err := decodeScopeSpans(v)
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+			return err
+		}
+		return nil
+	})
+	return rs, err
+}
+
+func decodeScopeSpans(b []byte) (importScopeSpans, error) {
+	var ss importScopeSpans
+	err := eachField(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1: // scope
+			return eachField(v, func(num protowire.Number, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					ss.Scope.Name = string(v)
+				case 2:
+					ss.Scope.Version = string(v)
+				}
+				return nil
+			})
+		case 2: // spans
+			sp, err := decodeSpan(v)
+			ss.Spans = append(ss.Spans, sp)
+			return err
+		}
+		return nil
+	})
+	return ss, err
+}
+
+func decodeSpan(b []byte) (importSpan, error) {
+	var sp importSpan
+	err := eachField(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			sp.TraceId = hex.EncodeToString(v)
+		case 2:
+			sp.SpanId = hex.EncodeToString(v)
+		case 3:
+			sp.TraceState = string(v)
+		case 4:
+			sp.ParentSpanId = hex.EncodeToString(v)
+		case 5:
+			sp.Name = string(v)
+		case 6:
+			sp.Kind = otlpEnum(strconv.FormatUint(x, 10))
+		case 7:
+			sp.StartTimeUnixNano = flexInt(x)
+		case 8:
+			sp.EndTimeUnixNano = flexInt(x)
+		case 9:
+			kv, err := decodeKV(v)
+			sp.Attributes = append(sp.Attributes, kv)
+			return err
+		case 11:
+			var e importEvent
+			err := eachField(v, func(num protowire.Number, v []byte, x uint64) error {
+				switch num {
+				case 1:
+					e.TimeUnixNano = flexInt(x)
+				case 2:
+					e.Name = string(v)
+				case 3:
+					kv, err := decodeKV(v)
+					e.Attributes = append(e.Attributes, kv)
+					return err
+				}
+				return nil
+			})
+			sp.Events = append(sp.Events, e)
+			return err
+		case 13:
+			var l importLink
+			err := eachField(v, func(num protowire.Number, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					l.TraceId = hex.EncodeToString(v)
+				case 2:
+					l.SpanId = hex.EncodeToString(v)
+				case 3:
+					l.TraceState = string(v)
+				case 4:
+					kv, err := decodeKV(v)
+					l.Attributes = append(l.Attributes, kv)
+					return err
+				}
+				return nil
+			})
+			sp.Links = append(sp.Links, l)
+			return err
+		case 15:
+			return eachField(v, func(num protowire.Number, v []byte, x uint64) error {
+				switch num {
+				case 2:
+					sp.Status.Message = string(v)
+				case 3:
+					sp.Status.Code = otlpEnum(strconv.FormatUint(x, 10))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return sp, err
+}
+
+func decodeKV(b []byte) (importKV, error) {
+	var kv importKV
+	err := eachField(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			kv.Key = string(v)
+		case 2:
+			var err error
+			kv.Value, err = decodeAny(v)
+			return err
+		}
+		return nil
+	})
+	return kv, err
+}
+
+func decodeAny(b []byte) (importAny, error) {
+	var a importAny
+	err := eachField(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			s := string(v)
+			a.StringValue = &s
+		case 2:
+			t := x != 0
+			a.BoolValue = &t
+		case 3:
+			i := flexInt(int64(x))
+			a.IntValue = &i
+		case 4:
+			f := math.Float64frombits(x)
+			a.DoubleValue = &f
+		case 5:
+			a.ArrayValue = &importArray{}
+			return eachField(v, func(num protowire.Number, v []byte, _ uint64) error {
+				if num == 1 {
+					e, err := decodeAny(v)
+					a.ArrayValue.Values = append(a.ArrayValue.Values, e)
+					return err
+				}
+				return nil
+			})
+		case 6:
+			a.KvlistValue = &importKVList{}
+			return eachField(v, func(num protowire.Number, v []byte, _ uint64) error {
+				if num == 1 {
+					kv, err := decodeKV(v)
+					a.KvlistValue.Values = append(a.KvlistValue.Values, kv)
+					return err
+				}
+				return nil
+			})
+		case 7:
+			s := base64.StdEncoding.EncodeToString(v)
+			a.BytesValue = &s
+		}
+		return nil
+	})
+	return a, err
+}
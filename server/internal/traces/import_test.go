@@ -0,0 +1,221 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const otlpDump = `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}},{"key":"k8s.pod.uid","value":{"intValue":"42"}}]},
+ "scopeSpans":[{"scope":{"name":"otelhttp"},"spans":[
+  {"traceId":"5B8EFFF798038103D269B633813FC60C","spanId":"EEE19B7EC3C1B174","name":"POST /pay","kind":2,
+   "startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000000010000000",
+   "attributes":[{"key":"http.status_code","value":{"intValue":500}},{"key":"retry","value":{"boolValue":true}},{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"doubleValue":1.5}]}}}],
+   "events":[{"timeUnixNano":"1700000000005000000","name":"exception","attributes":[{"key":"exception.type","value":{"stringValue":"Timeout"}}]}],
+   "status":{"code":"STATUS_CODE_ERROR","message":"upstream timeout"}},
+  {"traceId":"5B8EFFF798038103D269B633813FC60C","spanId":"AAA19B7EC3C1B174","parentSpanId":"EEE19B7EC3C1B174","name":"SELECT","kind":"SPAN_KIND_CLIENT",
+   "startTimeUnixNano":1700000000001000000,"endTimeUnixNano":1700000000004000000}
+ ]}]}]}
+{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"batch"}}]},"scopeSpans":[{"spans":[
+  {"traceId":"W47/95gDgQPSabYzgT/GDA==","spanId":"zMGbfsPBsXQ=","name":"other trace","startTimeUnixNano":"1","endTimeUnixNano":"2"}]}]}]}
+`
+
+func importRouter(src *sources.Sources) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/traces/import", Import(src))
+	r.GET("/api/traces/:traceId", Get(src))
+	r.GET("/api/traces/:traceId/flame", Flame(src))
+	r.GET("/api/traces/:traceId/export", Export(src))
+	return r
+}
+
+type importResp struct {
+	Traces []struct {
+		ID       string   `json:"id"`
+		TraceID  string   `json:"traceId"`
+		Spans    int      `json:"spans"`
+		Services []string `json:"services"`
+	} `json:"traces"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func doImport(t *testing.T, r *gin.Engine, contentType string, body []byte) importResp {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/traces/import", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	r.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("import status=%d body=%s", w.Code, w.Body.String())
+	}
+	var out importResp
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	return out
+}
+
+func TestImport_JSONViewableThroughGetFlameAndExport(t *testing.T) {
+	// No ClickHouse: imported IDs must never reach it.
+	r := importRouter(&sources.Sources{CHURL: "http://127.0.0.1:1", CHDB: "default"})
+	out := doImport(t, r, "application/json", []byte(otlpDump))
+
+	// The base64 IDs in the second request decode to the same trace ID, so
+	// both requests' spans land in one trace.
+	if len(out.Traces) != 1 || out.Traces[0].Spans != 3 || out.Traces[0].TraceID != "5b8efff798038103d269b633813fc60c" {
+		t.Fatalf("import=%+v", out)
+	}
+	if got := strings.Join(out.Traces[0].Services, ","); got != "batch,checkout" {
+		t.Fatalf("services=%s", got)
+	}
+	id := out.Traces[0].ID
+	if !strings.HasPrefix(id, "imp-") {
+		t.Fatalf("id=%q", id)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/"+id, nil))
+	var got struct {
+		TraceID string `json:"traceId"`
+		Spans   []Span `json:"spans"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != 200 {
+		t.Fatalf("get status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if got.TraceID != id || len(got.Spans) != 3 {
+		t.Fatalf("get=%+v", got)
+	}
+	pay := got.Spans[1]
+	if pay.Name != "POST /pay" || pay.Kind != "Server" || pay.StatusCode != "Error" || pay.Service != "checkout" {
+		t.Fatalf("pay=%+v", pay)
+	}
+	if pay.Attributes["http.status_code"] != "500" || pay.Attributes["retry"] != "true" || pay.Attributes["tags"] != `["a",1.5]` {
+		t.Fatalf("attrs=%v", pay.Attributes)
+	}
+	if got.Spans[2].Kind != "Client" || got.Spans[2].ParentSpanID != "eee19b7ec3c1b174" {
+		t.Fatalf("select=%+v", got.Spans[2])
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/"+id+"/flame", nil))
+	var flame FlameNode
+	if err := json.Unmarshal(w.Body.Bytes(), &flame); err != nil || w.Code != 200 {
+		t.Fatalf("flame status=%d err=%v", w.Code, err)
+	}
+	if flame.Name != "trace:"+id || len(flame.Children) != 2 {
+		t.Fatalf("flame=%+v", flame)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/"+id+"/export", nil))
+	var exp otlpTraces
+	if err := json.Unmarshal(w.Body.Bytes(), &exp); err != nil || w.Code != 200 {
+		t.Fatalf("export status=%d err=%v", w.Code, err)
+	}
+	if len(exp.ResourceSpans) != 2 || exp.ResourceSpans[1].ScopeSpans[0].Spans[0].Events[0].Name != "exception" {
+		t.Fatalf("export=%+v", exp)
+	}
+}
+
+func TestImport_Protobuf(t *testing.T) {
+	str := func(num protowire.Number, s string) []byte {
+		return protowire.AppendString(protowire.AppendTag(nil, num, protowire.BytesType), s)
+	}
+	msg := func(num protowire.Number, parts ...[]byte) []byte {
+		b := protowire.AppendTag(nil, num, protowire.BytesType)
+		return protowire.AppendBytes(b, bytes.Join(parts, nil))
+	}
+	fixed := func(num protowire.Number, v uint64) []byte {
+		return protowire.AppendFixed64(protowire.AppendTag(nil, num, protowire.Fixed64Type), v)
+	}
+	varint := func(num protowire.Number, v uint64) []byte {
+		return protowire.AppendVarint(protowire.AppendTag(nil, num, protowire.VarintType), v)
+	}
+	kv := func(key string, value []byte) []byte { return msg(1, str(1, key), msg(2, value)) }
+	idBytes := func(num protowire.Number, hexID string) []byte {
+		return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), []byte(hexID))
+	}
+
+	span := msg(2,
+		idBytes(1, "\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10"),
+		idBytes(2, "\xaa\xbb\xcc\xdd\x00\x11\x22\x33"),
+		str(5, "GET /cart"),
+		varint(6, 3),
+		fixed(7, 1700000000000000000),
+		fixed(8, 1700000000002000000),
+		msg(9, str(1, "ratio"), msg(2, fixed(4, math.Float64bits(0.25)))),
+		msg(11, fixed(1, 1700000000001000000), str(2, "cache miss")),
+		msg(15, str(2, "nope"), varint(3, 2)),
+	)
+	body := msg(1,
+		msg(1, kv("service.name", str(1, "cart"))),
+		msg(2, msg(1, str(1, "grpc"), str(2, "1.2")), span),
+	)
+
+	src := &sources.Sources{CHURL: "http://127.0.0.1:1", CHDB: "default"}
+	r := importRouter(src)
+	out := doImport(t, r, "application/x-protobuf", body)
+	if len(out.Traces) != 1 || out.Traces[0].TraceID != "0102030405060708090a0b0c0d0e0f10" {
+		t.Fatalf("import=%+v", out)
+	}
+	recs, ok := importedRecords(src, out.Traces[0].ID)
+	if !ok || len(recs) != 1 {
+		t.Fatalf("store: ok=%v recs=%d", ok, len(recs))
+	}
+	got := recs[0]
+	if got.SpanId != "aabbccdd00112233" || got.SpanName != "GET /cart" || got.SpanKind != "Client" || got.ServiceName != "cart" {
+		t.Fatalf("span=%+v", got)
+	}
+	if got.EndNS-got.StartNS != 2000000 || got.StatusCode != "Error" || got.StatusMessage != "nope" {
+		t.Fatalf("timing/status=%+v", got)
+	}
+	if got.ScopeName != "grpc" || got.ScopeVersion != "1.2" || got.SpanAttributes["ratio"] != "0.25" {
+		t.Fatalf("scope/attrs=%+v", got)
+	}
+	if len(got.EventNames) != 1 || got.EventNames[0] != "cache miss" || got.EventTimes[0] != 1700000000001000000 {
+		t.Fatalf("events=%+v", got)
+	}
+}
+
+func TestImport_RejectsBadInput(t *testing.T) {
+	r := importRouter(&sources.Sources{})
+	for name, body := range map[string]string{
+		"not json": "{",
+		"no spans": `{"resourceSpans":[]}`,
+		"no ids":   `{"resourceSpans":[{"scopeSpans":[{"spans":[{"name":"x"}]}]}]}`,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/traces/import", strings.NewReader(body)))
+		if w.Code != 400 {
+			t.Fatalf("%s: status=%d body=%s", name, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/imp-0000000000000000", nil))
+	if w.Code != 404 {
+		t.Fatalf("unknown import id: status=%d", w.Code)
+	}
+}
+
+func TestImport_OverSpanCapStoresNothing(t *testing.T) {
+	src := &sources.Sources{ImportMaxSpans: 2}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/traces/import", strings.NewReader(otlpDump))
+	req.Header.Set("Content-Type", "application/json")
+	importRouter(src).ServeHTTP(w, req)
+	if w.Code != 413 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "imp-") {
+		t.Fatalf("rejected upload reported IDs: %s", w.Body.String())
+	}
+}
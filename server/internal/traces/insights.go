@@ -0,0 +1,360 @@
+package traces
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// Anti-pattern detection over one trace. Each detector looks at the
+// children of one span at a time; findings are ranked by how much wall time
+// fixing them could plausibly save (impactNanos).
+
+// Detector thresholds.
+const (
+	insightNPlusOneMin   = 5   // identical statements under one parent
+	insightSequentialMin = 3   // back-to-back outgoing calls under one parent
+	insightFanOutMin     = 100 // direct children of one span
+	insightGapMin        = 100 * time.Millisecond
+	insightGapShare      = 0.25 // of the parent's duration
+)
+
+// Insight types.
+const (
+	insightNPlusOne   = "n_plus_one"
+	insightSequential = "sequential_calls"
+	insightFanOut     = "fan_out"
+	insightGap        = "gap"
+	insightRetry      = "retry"
+)
+
+// Insight is one finding, pointing at the spans involved.
+type Insight struct {
+	Type         string   `json:"type"`
+	Title        string   `json:"title"`
+	Detail       string   `json:"detail"`
+	ParentSpanID string   `json:"parentSpanId,omitempty"`
+	SpanIDs      []string `json:"spanIds"`
+	Count        int      `json:"count"`
+	// ImpactNanos estimates the time a fix would save, used for ranking.
+	ImpactNanos int64 `json:"impactNanos"`
+}
+
+// Insights serves GET /api/traces/{traceId}/insights. The detectors need
+// every span in memory, so traces over TraceMaxSpans (or ?maxSpans=) are
+// refused with 413 after reading only their shape.
+func Insights(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traceID := c.Param("traceId")
+		if !underSpanLimit(c, src, traceID, "insights") {
+			return
+		}
+		recs, err := fetchRecords(src, traceID)
+		if err == errTraceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "imported trace expired or unknown"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if len(recs) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "trace not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"traceId": traceID, "spans": len(recs), "insights": findInsights(recs)})
+	}
+}
+
+// findInsights runs every detector and ranks the findings, biggest impact
+// first.
+func findInsights(recs []spanRecord) []Insight {
+	byID := make(map[string]*spanRecord, len(recs))
+	children := map[string][]*spanRecord{}
+	for i := range recs {
+		r := &recs[i]
+		if _, dup := byID[r.SpanId]; dup {
+			continue
+		}
+		byID[r.SpanId] = r
+	}
+	for _, r := range byID {
+		if r.ParentSpanId != "" && byID[r.ParentSpanId] != nil {
+			children[r.ParentSpanId] = append(children[r.ParentSpanId], r)
+		}
+	}
+
+	out := []Insight{}
+	for pid, kids := range children {
+		sort.Slice(kids, func(i, j int) bool {
+			if kids[i].StartNS != kids[j].StartNS {
+				return kids[i].StartNS < kids[j].StartNS
+			}
+			return kids[i].SpanId < kids[j].SpanId
+		})
+		parent := byID[pid]
+		// Spans explained by an N+1 or retry finding are not reported
+		// again as sequential calls.
+		claimed := map[string]bool{}
+		for _, f := range append(nPlusOne(pid, kids), retries(pid, kids)...) {
+			for _, id := range f.SpanIDs {
+				claimed[id] = true
+			}
+			out = append(out, f)
+		}
+		out = append(out, sequentialCalls(pid, kids, claimed)...)
+		if f, ok := fanOut(parent, kids); ok {
+			out = append(out, f)
+		}
+		if f, ok := childGap(parent, kids); ok {
+			out = append(out, f)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].ImpactNanos != out[j].ImpactNanos {
+			return out[i].ImpactNanos > out[j].ImpactNanos
+		}
+		if out[i].Type != out[j].Type {
+			return out[i].Type < out[j].Type
+		}
+		return out[i].ParentSpanID < out[j].ParentSpanID
+	})
+	return out
+}
+
+var (
+	sqlStrings = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumbers = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlInLists = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlSpaces  = regexp.MustCompile(`\s+`)
+)
+
+// normalizeStatement replaces literals so queries differing only in their
+// parameters compare equal.
+func normalizeStatement(s string) string {
+	s = sqlStrings.ReplaceAllString(s, "?")
+	s = sqlNumbers.ReplaceAllString(s, "?")
+	s = sqlInLists.ReplaceAllString(s, "IN (?)")
+	return strings.TrimSpace(sqlSpaces.ReplaceAllString(s, " "))
+}
+
+// dbStatement returns the span's normalized statement, or "" for non-DB spans.
+func dbStatement(r *spanRecord) string {
+	a := r.SpanAttributes
+	stmt := a["db.query.text"]
+	if stmt == "" {
+		stmt = a["db.statement"]
+	}
+	if stmt == "" {
+		if a["db.system"] == "" && a["db.system.name"] == "" {
+			return ""
+		}
+		stmt = r.SpanName
+	}
+	return normalizeStatement(stmt)
+}
+
+func nPlusOne(pid string, kids []*spanRecord) []Insight {
+	groups := map[string][]*spanRecord{}
+	var order []string
+	for _, k := range kids {
+		stmt := dbStatement(k)
+		if stmt == "" {
+			continue
+		}
+		key := k.ServiceName + "\x00" + stmt
+		if len(groups[key]) == 0 {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], k)
+	}
+	var out []Insight
+	for _, key := range order {
+		g := groups[key]
+		if len(g) < insightNPlusOneMin {
+			continue
+		}
+		_, stmt, _ := strings.Cut(key, "\x00")
+		sum, longest := spanTotals(g)
+		out = append(out, Insight{
+			Type:         insightNPlusOne,
+			Title:        fmt.Sprintf("%d identical queries from %s", len(g), g[0].ServiceName),
+			Detail:       stmt,
+			ParentSpanID: pid,
+			SpanIDs:      spanIDsOf(g),
+			Count:        len(g),
+			ImpactNanos:  sum - longest, // one batched query instead
+		})
+	}
+	return out
+}
+
+// retries finds chains of same-named sibling calls where each attempt
+// starts after a failed one ended.
+func retries(pid string, kids []*spanRecord) []Insight {
+	byLabel := map[string][]*spanRecord{}
+	var order []string
+	for _, k := range kids {
+		key := k.ServiceName + "\x00" + k.SpanName
+		if len(byLabel[key]) == 0 {
+			order = append(order, key)
+		}
+		byLabel[key] = append(byLabel[key], k)
+	}
+	var out []Insight
+	for _, key := range order {
+		var chain []*spanRecord
+		flush := func() {
+			if len(chain) >= 2 {
+				sum, _ := spanTotals(chain[:len(chain)-1])
+				last := chain[len(chain)-1]
+				outcome := "then succeeded"
+				if statusCodeNumber(last.StatusCode) == 2 {
+					outcome = "all failed"
+				}
+				out = append(out, Insight{
+					Type:         insightRetry,
+					Title:        fmt.Sprintf("%s retried %d times", last.SpanName, len(chain)-1),
+					Detail:       fmt.Sprintf("%s: %d attempts, %s", last.ServiceName, len(chain), outcome),
+					ParentSpanID: pid,
+					SpanIDs:      spanIDsOf(chain),
+					Count:        len(chain),
+					ImpactNanos:  sum, // time spent on failed attempts
+				})
+			}
+			chain = nil
+		}
+		for _, k := range byLabel[key] {
+			failed := statusCodeNumber(k.StatusCode) == 2
+			switch {
+			case len(chain) > 0 && k.StartNS >= chain[len(chain)-1].EndNS:
+				chain = append(chain, k)
+				if !failed {
+					flush()
+				}
+			case failed:
+				flush()
+				chain = []*spanRecord{k}
+			default:
+				flush()
+			}
+		}
+		flush()
+	}
+	return out
+}
+
+// isOutgoingCall reports client spans and DB calls.
+func isOutgoingCall(r *spanRecord) bool {
+	k := normEnum(r.SpanKind, "SPAN_KIND_")
+	return k == "CLIENT" || (k != "SERVER" && k != "CONSUMER" && dbStatement(r) != "")
+}
+
+// sequentialCalls finds runs of outgoing calls where each starts only after
+// the previous one ended; if independent they could run in parallel.
+func sequentialCalls(pid string, kids []*spanRecord, claimed map[string]bool) []Insight {
+	var out []Insight
+	var run []*spanRecord
+	flush := func() {
+		if len(run) >= insightSequentialMin {
+			sum, longest := spanTotals(run)
+			names := make([]string, 0, len(run))
+			for _, r := range run {
+				names = append(names, r.SpanName)
+			}
+			out = append(out, Insight{
+				Type:         insightSequential,
+				Title:        fmt.Sprintf("%d calls made one after another", len(run)),
+				Detail:       strings.Join(names, " → "),
+				ParentSpanID: pid,
+				SpanIDs:      spanIDsOf(run),
+				Count:        len(run),
+				ImpactNanos:  sum - longest, // if run concurrently
+			})
+		}
+		run = nil
+	}
+	for _, k := range kids {
+		if claimed[k.SpanId] || !isOutgoingCall(k) {
+			continue
+		}
+		if len(run) > 0 && k.StartNS < run[len(run)-1].EndNS {
+			flush()
+		}
+		run = append(run, k)
+	}
+	flush()
+	return out
+}
+
+func fanOut(parent *spanRecord, kids []*spanRecord) (Insight, bool) {
+	if len(kids) < insightFanOutMin {
+		return Insight{}, false
+	}
+	return Insight{
+		Type:         insightFanOut,
+		Title:        fmt.Sprintf("%s has %d child spans", parent.SpanName, len(kids)),
+		Detail:       parent.ServiceName,
+		ParentSpanID: parent.SpanId,
+		SpanIDs:      []string{parent.SpanId},
+		Count:        len(kids),
+		ImpactNanos:  parent.EndNS - parent.StartNS,
+	}, true
+}
+
+// childGap finds the longest stretch of a span with no child running, when
+// it is long both in absolute terms and relative to the span.
+func childGap(parent *spanRecord, kids []*spanRecord) (Insight, bool) {
+	dur := parent.EndNS - parent.StartNS
+	if dur <= 0 {
+		return Insight{}, false
+	}
+	var gap, gapStart int64
+	cursor := parent.StartNS
+	for _, k := range kids { // in start order
+		s, e := max(k.StartNS, parent.StartNS), min(k.EndNS, parent.EndNS)
+		if s > cursor && s-cursor > gap {
+			gap, gapStart = s-cursor, cursor
+		}
+		cursor = max(cursor, e)
+	}
+	if parent.EndNS-cursor > gap {
+		gap, gapStart = parent.EndNS-cursor, cursor
+	}
+	if time.Duration(gap) < insightGapMin || float64(gap) < insightGapShare*float64(dur) {
+		return Insight{}, false
+	}
+	return Insight{
+		Type:  insightGap,
+		Title: fmt.Sprintf("%v with no child activity in %s", time.Duration(gap).Round(time.Millisecond), parent.SpanName),
+		Detail: fmt.Sprintf("%s: idle from +%v to +%v of %v; uninstrumented work or waiting",
+			parent.ServiceName, time.Duration(gapStart-parent.StartNS), time.Duration(gapStart+gap-parent.StartNS), time.Duration(dur)),
+		ParentSpanID: parent.SpanId,
+		SpanIDs:      []string{parent.SpanId},
+		Count:        1,
+		ImpactNanos:  gap,
+	}, true
+}
+
+func spanTotals(rs []*spanRecord) (sum, longest int64) {
+	for _, r := range rs {
+		d := r.EndNS - r.StartNS
+		sum += d
+		longest = max(longest, d)
+	}
+	return sum, longest
+}
+
+func spanIDsOf(rs []*spanRecord) []string {
+	ids := make([]string, len(rs))
+	for i, r := range rs {
+		ids[i] = r.SpanId
+	}
+	return ids
+}
@@ -0,0 +1,134 @@
+package traces
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func rec(id, parent, service, name string, startMs, endMs int64) spanRecord {
+	return spanRecord{TraceId: "T", SpanId: id, ParentSpanId: parent, ServiceName: service, SpanName: name,
+		SpanKind: "SPAN_KIND_INTERNAL", StartNS: startMs * ms, EndNS: endMs * ms, SpanAttributes: map[string]string{}}
+}
+
+func insightsOf(list []Insight, typ string) []Insight {
+	var out []Insight
+	for _, in := range list {
+		if in.Type == typ {
+			out = append(out, in)
+		}
+	}
+	return out
+}
+
+func TestFindInsights_NPlusOne(t *testing.T) {
+	recs := []spanRecord{rec("P", "", "api", "GET /users", 0, 100)}
+	for i := 0; i < 6; i++ {
+		r := rec(fmt.Sprint("q", i), "P", "api", "SELECT users", int64(10+i*10), int64(18+i*10))
+		r.SpanKind = "SPAN_KIND_CLIENT"
+		r.SpanAttributes["db.statement"] = fmt.Sprintf("SELECT * FROM users WHERE id = %d AND name = 'u%d'", i, i)
+		recs = append(recs, r)
+	}
+	got := findInsights(recs)
+	n1 := insightsOf(got, insightNPlusOne)
+	if len(n1) != 1 || n1[0].Count != 6 || n1[0].ParentSpanID != "P" || n1[0].ImpactNanos != 40*ms {
+		t.Fatalf("n+1=%+v", n1)
+	}
+	if n1[0].Detail != "SELECT * FROM users WHERE id = ? AND name = ?" {
+		t.Fatalf("normalized=%q", n1[0].Detail)
+	}
+	// The same spans are not also reported as sequential calls.
+	if seq := insightsOf(got, insightSequential); len(seq) != 0 {
+		t.Fatalf("sequential=%+v", seq)
+	}
+}
+
+func TestFindInsights_SequentialCalls(t *testing.T) {
+	recs := []spanRecord{rec("P", "", "web", "checkout", 0, 100)}
+	for i, name := range []string{"GET /cart", "GET /user", "GET /prices"} {
+		r := rec(fmt.Sprint("c", i), "P", "web", name, int64(i*30), int64(i*30+25))
+		r.SpanKind = "SPAN_KIND_CLIENT"
+		recs = append(recs, r)
+	}
+	// Overlapping calls are already parallel.
+	for i := 0; i < 3; i++ {
+		r := rec(fmt.Sprint("p", i), "c0", "web", "fetch", 1, 20)
+		r.SpanKind = "SPAN_KIND_CLIENT"
+		recs = append(recs, r)
+	}
+	seq := insightsOf(findInsights(recs), insightSequential)
+	if len(seq) != 1 || seq[0].Count != 3 || seq[0].ImpactNanos != 50*ms || seq[0].ParentSpanID != "P" {
+		t.Fatalf("sequential=%+v", seq)
+	}
+}
+
+func TestFindInsights_Retry(t *testing.T) {
+	recs := []spanRecord{rec("P", "", "web", "pay", 0, 100)}
+	for i, status := range []string{"STATUS_CODE_ERROR", "STATUS_CODE_ERROR", "STATUS_CODE_OK"} {
+		r := rec(fmt.Sprint("r", i), "P", "web", "POST /charge", int64(i*30), int64(i*30+20))
+		r.StatusCode = status
+		recs = append(recs, r)
+	}
+	rt := insightsOf(findInsights(recs), insightRetry)
+	if len(rt) != 1 || rt[0].Count != 3 || rt[0].ImpactNanos != 40*ms {
+		t.Fatalf("retry=%+v", rt)
+	}
+}
+
+func TestFindInsights_FanOutAndGap(t *testing.T) {
+	recs := []spanRecord{rec("P", "", "batch", "run", 0, 1000)}
+	for i := 0; i < insightFanOutMin; i++ {
+		recs = append(recs, rec(fmt.Sprint("k", i), "P", "batch", "item", 0, 100))
+	}
+	got := findInsights(recs)
+	if fo := insightsOf(got, insightFanOut); len(fo) != 1 || fo[0].Count != insightFanOutMin {
+		t.Fatalf("fan-out=%+v", fo)
+	}
+	gap := insightsOf(got, insightGap)
+	if len(gap) != 1 || gap[0].ImpactNanos != 900*ms {
+		t.Fatalf("gap=%+v", gap)
+	}
+	// Ranked by impact: the 1s fan-out, then the 900ms gap.
+	if got[0].Type != insightFanOut || got[1].Type != insightGap {
+		t.Fatalf("order: %s, %s", got[0].Type, got[1].Type)
+	}
+}
+
+func TestInsights_Handler(t *testing.T) {
+	ts := fakeCH(t, fanOutRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/traces/:traceId/insights", Insights(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/T/insights", nil))
+	var out struct {
+		Spans    int       `json:"spans"`
+		Insights []Insight `json:"insights"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != 200 {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if out.Spans != 7 || out.Insights == nil {
+		t.Fatalf("out=%+v", out)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/T/insights?maxSpans=5", nil))
+	if w.Code != 413 || !strings.Contains(w.Body.String(), `"truncated":true`) {
+		t.Fatalf("over the span limit: status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	empty := fakeCH(t, "")
+	defer empty.Close()
+	w = httptest.NewRecorder()
+	newRouter("/api/traces/:traceId/insights", Insights(&sources.Sources{CHURL: empty.URL, Client: empty.Client()})).
+		ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/none/insights", nil))
+	if w.Code != 404 {
+		t.Fatalf("empty trace status=%d", w.Code)
+	}
+}
@@ -0,0 +1,322 @@
+package traces
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// The Jaeger HTTP query API (what jaeger-query serves to Jaeger UI and
+// Grafana's Jaeger datasource), mounted under /jaeger so its /api/traces/{id}
+// does not shadow ours. Services and operations come from the suggest
+// rollups; search and trace fetches read the spans table.
+
+const (
+	defaultJaegerLimit    = 20
+	maxJaegerLimit        = 100
+	defaultJaegerLookback = time.Hour
+)
+
+// JaegerServices serves GET /api/services.
+func JaegerServices(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sql := fmt.Sprintf(`
+SELECT DISTINCT ServiceName AS name
+FROM %s.%s
+ORDER BY name
+FORMAT JSONEachRow
+`, src.CHDB, src.Traces.WithDefaults().Tables.ServiceSuggest)
+		jaegerNames(c, src, sql)
+	}
+}
+
+// JaegerOperations serves GET /api/services/{service}/operations.
+func JaegerOperations(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sql := fmt.Sprintf(`
+SELECT DISTINCT SpanName AS name
+FROM %s.%s
+WHERE ServiceName = %s
+ORDER BY name
+FORMAT JSONEachRow
+`, src.CHDB, src.Traces.WithDefaults().Tables.OperationSuggest, joinQuoted([]string{c.Param("service")}))
+		jaegerNames(c, src, sql)
+	}
+}
+
+func jaegerNames(c *gin.Context, src *sources.Sources, sql string) {
+	b, err := src.QueryCH(sql)
+	if err != nil {
+		jaegerFail(c, http.StatusBadGateway, err.Error())
+		return
+	}
+	names := []string{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var row struct {
+			Name string `json:"name"`
+		}
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			jaegerFail(c, http.StatusBadGateway, fmt.Sprintf("decode CH rows: %v", err))
+			return
+		}
+		names = append(names, row.Name)
+	}
+	c.JSON(http.StatusOK, jaegerResponse{Data: names, Total: len(names)})
+}
+
+// JaegerTrace serves GET /api/traces/{id}, with at most TraceMaxSpans (or
+// ?maxSpans=) spans.
+func JaegerTrace(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := spanLimit(c, src)
+		if err != nil {
+			jaegerFail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		t, err := loadJaegerTrace(c.Request.Context(), src, c.Param("traceId"), limit)
+		if err == errTraceNotFound {
+			jaegerFail(c, http.StatusNotFound, "trace not found")
+			return
+		}
+		if err != nil {
+			jaegerFail(c, http.StatusBadGateway, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, jaegerResponse{Data: []jaegerTrace{t}})
+	}
+}
+
+// JaegerSearch serves GET /api/traces?service=&operation=&tags=&minDuration=
+// &maxDuration=&start=&end=&lookback=&limit=. Like jaeger-query, the filters
+// select spans (a trace matches if any one span does) and the newest
+// matching traces are returned, each cut down to TraceMaxSpans (or
+// ?maxSpans=) spans like JaegerTrace.
+func JaegerSearch(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, err := parseJaegerQuery(c)
+		if err != nil {
+			jaegerFail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit, err := spanLimit(c, src)
+		if err != nil {
+			jaegerFail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		b, err := src.QueryCH(jaegerSearchSQL(src.CHDB, src.Traces, q))
+		if err != nil {
+			jaegerFail(c, http.StatusBadGateway, err.Error())
+			return
+		}
+		var ids []string
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			var row struct {
+				TraceId string `json:"TraceId"`
+			}
+			if err := dec.Decode(&row); err != nil {
+				if err == io.EOF {
+					break
+				}
+				jaegerFail(c, http.StatusBadGateway, fmt.Sprintf("decode CH rows: %v", err))
+				return
+			}
+			ids = append(ids, row.TraceId)
+		}
+		out := []jaegerTrace{}
+		for _, id := range ids {
+			t, err := loadJaegerTrace(c.Request.Context(), src, id, limit)
+			if err == errTraceNotFound {
+				continue
+			}
+			if err != nil {
+				jaegerFail(c, http.StatusBadGateway, err.Error())
+				return
+			}
+			out = append(out, t)
+		}
+		c.JSON(http.StatusOK, jaegerResponse{Data: out, Total: len(out), Limit: q.Limit})
+	}
+}
+
+// loadJaegerTrace converts traceID with at most limit spans. Like Get, a
+// bigger trace keeps the spans nearest its roots, and a warning on the trace
+// says how many were left out.
+func loadJaegerTrace(ctx context.Context, src *sources.Sources, traceID string, limit int) (jaegerTrace, error) {
+	tree, err := loadSpanTree(src, traceID)
+	if err != nil {
+		return jaegerTrace{}, err
+	}
+	if len(tree.order) == 0 {
+		return jaegerTrace{}, errTraceNotFound
+	}
+	var keep map[string]bool
+	if len(tree.order) > limit {
+		keep, _ = tree.pick(tree.roots(), limit)
+	}
+	next, stop, err := openRecords(ctx, src, traceID, keep)
+	if err != nil {
+		return jaegerTrace{}, err
+	}
+	defer stop()
+	var recs []spanRecord
+	for {
+		r, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return jaegerTrace{}, err
+		}
+		if keep == nil || keep[r.SpanId] {
+			recs = append(recs, r)
+		}
+	}
+	t := toJaeger(recs)
+	if keep != nil {
+		t.Warnings = append(t.Warnings, fmt.Sprintf("trace has %d spans; showing the %d nearest the root", len(tree.order), len(recs)))
+	}
+	return t, nil
+}
+
+func jaegerFail(c *gin.Context, code int, msg string) {
+	c.JSON(code, jaegerResponse{Errors: []jaegerError{{Code: code, Msg: msg}}})
+}
+
+// jaegerQuery is a parsed Jaeger trace search.
+type jaegerQuery struct {
+	Service, Operation       string
+	Tags                     map[string]string
+	MinDuration, MaxDuration time.Duration
+	Start, End               time.Time
+	Limit                    int
+}
+
+func parseJaegerQuery(c *gin.Context) (jaegerQuery, error) {
+	q := jaegerQuery{
+		Service:   c.Query("service"),
+		Operation: c.Query("operation"),
+		Tags:      map[string]string{},
+		Limit:     defaultJaegerLimit,
+	}
+	if q.Service == "" {
+		return q, fmt.Errorf("parameter 'service' is required")
+	}
+	// Jaeger UI sends tags as a JSON object; the API also takes repeated
+	// tag=key:value.
+	if v := c.Query("tags"); v != "" {
+		if err := json.Unmarshal([]byte(v), &q.Tags); err != nil {
+			return q, fmt.Errorf("malformed 'tags' parameter: %v", err)
+		}
+	}
+	for _, t := range c.QueryArray("tag") {
+		k, v, ok := strings.Cut(t, ":")
+		if !ok {
+			return q, fmt.Errorf("malformed 'tag' parameter %q, want key:value", t)
+		}
+		q.Tags[k] = v
+	}
+	var err error
+	if v := c.Query("minDuration"); v != "" {
+		if q.MinDuration, err = time.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("malformed 'minDuration': %v", err)
+		}
+	}
+	if v := c.Query("maxDuration"); v != "" {
+		if q.MaxDuration, err = time.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("malformed 'maxDuration': %v", err)
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("malformed 'limit'")
+		}
+		if q.Limit > maxJaegerLimit {
+			q.Limit = maxJaegerLimit
+		}
+	}
+
+	// start/end are Unix microseconds; lookback ("2h") applies when start is absent.
+	q.End = time.Now()
+	if v := c.Query("end"); v != "" {
+		us, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("malformed 'end'")
+		}
+		q.End = time.UnixMicro(us)
+	}
+	lookback := defaultJaegerLookback
+	if v := c.Query("lookback"); v != "" && v != "custom" {
+		if lookback, err = time.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("malformed 'lookback': %v", err)
+		}
+	}
+	q.Start = q.End.Add(-lookback)
+	if v := c.Query("start"); v != "" {
+		us, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("malformed 'start'")
+		}
+		q.Start = time.UnixMicro(us)
+	}
+	return q, nil
+}
+
+// jaegerSearchSQL returns the IDs of the newest traces with a span matching q.
+func jaegerSearchSQL(db string, ts sources.TraceSchema, q jaegerQuery) string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	quote := func(s string) string { return joinQuoted([]string{s}) }
+	where := []string{
+		fmt.Sprintf("%s BETWEEN toDateTime(%d) AND toDateTime(%d)", ts.StartTime(""), q.Start.Unix(), q.End.Unix()+1),
+		fmt.Sprintf("%s = %s", col.ServiceName, quote(q.Service)),
+	}
+	if q.Operation != "" {
+		where = append(where, fmt.Sprintf("%s = %s", col.SpanName, quote(q.Operation)))
+	}
+	if q.MinDuration > 0 {
+		where = append(where, fmt.Sprintf("%s >= %d", ts.DurationNs(""), q.MinDuration.Nanoseconds()))
+	}
+	if q.MaxDuration > 0 {
+		where = append(where, fmt.Sprintf("%s <= %d", ts.DurationNs(""), q.MaxDuration.Nanoseconds()))
+	}
+	for _, k := range sortedKeys(q.Tags) {
+		v := q.Tags[k]
+		switch k {
+		// Jaeger-side names for what OTel keeps in dedicated columns.
+		case "error":
+			op := "IN"
+			if v != "true" {
+				op = "NOT IN"
+			}
+			where = append(where, fmt.Sprintf("upper(%s) %s ('ERROR', 'STATUS_CODE_ERROR')", col.StatusCode, op))
+		case "span.kind":
+			where = append(where, fmt.Sprintf("lower(replaceOne(%s, 'SPAN_KIND_', '')) = lower(%s)", col.SpanKind, quote(v)))
+		default:
+			where = append(where, fmt.Sprintf("(%s = %s OR %s = %[2]s)",
+				ts.Attr("", col.SpanAttributes, quote(k)), quote(v), ts.Attr("", col.ResourceAttributes, quote(k))))
+		}
+	}
+	return fmt.Sprintf(`
+SELECT %s AS TraceId, max(%s) AS last_ns
+FROM %s.%s
+WHERE %s
+GROUP BY TraceId
+ORDER BY last_ns DESC
+LIMIT %d
+FORMAT JSONEachRow
+`, col.TraceId, ts.StartNs(""), db, ts.Tables.Spans, strings.Join(where, " AND "), q.Limit)
+}
@@ -0,0 +1,178 @@
+package traces
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// jaegerCH answers the rollup, search, topology and record queries and
+// remembers them.
+func jaegerCH(t *testing.T) (*httptest.Server, *[]string) {
+	t.Helper()
+	return captureCHFunc(t, func(sql string) string {
+		switch {
+		case strings.Contains(sql, "service_suggest"):
+			return `{"name":"db"}` + "\n" + `{"name":"web"}` + "\n"
+		case strings.Contains(sql, "operation_suggest"):
+			return `{"name":"GET /"}` + "\n"
+		case strings.Contains(sql, "GROUP BY TraceId"):
+			return `{"TraceId":"AB01","last_ns":1}` + "\n"
+		case strings.Contains(sql, "start_ns"):
+			return exportRows
+		}
+		return ""
+	})
+}
+
+func jaegerRouter(src *sources.Sources) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/services", JaegerServices(src))
+	r.GET("/api/services/:service/operations", JaegerOperations(src))
+	r.GET("/api/traces", JaegerSearch(src))
+	r.GET("/api/traces/:traceId", JaegerTrace(src))
+	return r
+}
+
+func getJaeger(t *testing.T, r *gin.Engine, path string) (int, jaegerResponse, json.RawMessage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var out struct {
+		jaegerResponse
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s: json: %v (%s)", path, err, w.Body.String())
+	}
+	return w.Code, out.jaegerResponse, out.Data
+}
+
+func TestJaeger_ServicesAndOperations(t *testing.T) {
+	ts, queries := jaegerCH(t)
+	defer ts.Close()
+	r := jaegerRouter(&sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()})
+
+	code, resp, data := getJaeger(t, r, "/api/services")
+	if code != 200 || resp.Total != 2 || string(data) != `["db","web"]` {
+		t.Fatalf("services: %d %+v %s", code, resp, data)
+	}
+	code, _, data = getJaeger(t, r, "/api/services/O'Brien/operations")
+	if code != 200 || string(data) != `["GET /"]` {
+		t.Fatalf("operations: %d %s", code, data)
+	}
+	if !strings.Contains((*queries)[1], "WHERE ServiceName = 'O\\'Brien'") {
+		t.Fatalf("operations sql:\n%s", (*queries)[1])
+	}
+}
+
+func TestJaeger_SearchTranslatesFilters(t *testing.T) {
+	ts, queries := jaegerCH(t)
+	defer ts.Close()
+	r := jaegerRouter(&sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()})
+
+	params := url.Values{
+		"service":     {"web"},
+		"operation":   {"GET /"},
+		"tags":        {`{"http.method":"GET","error":"true"}`},
+		"minDuration": {"1.5ms"},
+		"start":       {"1700000000000000"},
+		"end":         {"1700000060000000"},
+		"limit":       {"5"},
+	}
+	code, resp, data := getJaeger(t, r, "/api/traces?"+params.Encode())
+	if code != 200 || resp.Total != 1 || resp.Limit != 5 {
+		t.Fatalf("search: %d %+v", code, resp)
+	}
+	var traces []jaegerTrace
+	_ = json.Unmarshal(data, &traces)
+	if len(traces) != 1 || traces[0].TraceID != "ab01" || len(traces[0].Spans) != 3 {
+		t.Fatalf("traces=%+v", traces)
+	}
+
+	search := (*queries)[0]
+	for _, want := range []string{
+		"Timestamp BETWEEN toDateTime(1700000000) AND toDateTime(1700000061)",
+		"ServiceName = 'web'",
+		"SpanName = 'GET /'",
+		"Duration >= 1500000",
+		"upper(StatusCode) IN ('ERROR', 'STATUS_CODE_ERROR')",
+		"(SpanAttributes['http.method'] = 'GET' OR ResourceAttributes['http.method'] = 'GET')",
+		"LIMIT 5",
+	} {
+		if !strings.Contains(search, want) {
+			t.Fatalf("search sql missing %q:\n%s", want, search)
+		}
+	}
+	if !strings.Contains((*queries)[2], "IN ('AB01')") {
+		t.Fatalf("records sql:\n%s", (*queries)[2])
+	}
+}
+
+func TestJaeger_CapsTracesAndSpansPerTrace(t *testing.T) {
+	ts, queries := jaegerCH(t)
+	defer ts.Close()
+	r := jaegerRouter(&sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()})
+
+	code, resp, data := getJaeger(t, r, "/api/traces?service=web&limit=5000&maxSpans=2")
+	if code != 200 || resp.Limit != maxJaegerLimit {
+		t.Fatalf("search: %d %+v", code, resp)
+	}
+	if !strings.Contains((*queries)[0], fmt.Sprintf("LIMIT %d\n", maxJaegerLimit)) {
+		t.Fatalf("search sql:\n%s", (*queries)[0])
+	}
+	var traces []jaegerTrace
+	_ = json.Unmarshal(data, &traces)
+	if len(traces) != 1 || len(traces[0].Spans) != 2 || len(traces[0].Warnings) != 1 ||
+		!strings.Contains(traces[0].Warnings[0], "trace has 3 spans") {
+		t.Fatalf("traces=%+v", traces)
+	}
+	if !strings.Contains((*queries)[2], "SpanId IN ('A1', 'B2')") {
+		t.Fatalf("records sql:\n%s", (*queries)[2])
+	}
+
+	code, _, data = getJaeger(t, r, "/api/traces/AB01?maxSpans=1")
+	_ = json.Unmarshal(data, &traces)
+	if code != 200 || len(traces) != 1 || len(traces[0].Spans) != 1 || traces[0].Spans[0].SpanID != "a1" {
+		t.Fatalf("trace: %d %+v", code, traces)
+	}
+}
+
+func TestJaeger_Errors(t *testing.T) {
+	ts, _ := jaegerCH(t)
+	defer ts.Close()
+	r := jaegerRouter(&sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()})
+
+	for path, want := range map[string]int{
+		"/api/traces":                           400,
+		"/api/traces?service=web&tags=nope":     400,
+		"/api/traces?service=web&minDuration=x": 400,
+		"/api/traces/AB01?maxSpans=0":           400,
+		"/api/traces/imp-00":                    404,
+	} {
+		code, resp, _ := getJaeger(t, r, path)
+		if code != want || len(resp.Errors) != 1 || resp.Errors[0].Code != want {
+			t.Fatalf("%s: %d %+v", path, code, resp)
+		}
+	}
+}
+
+func TestJaeger_UndecodableRowsAre502(t *testing.T) {
+	ts, _ := captureCHFunc(t, func(string) string { return `{"name":"db"}` + "\n" + `<html>proxy error</html>` })
+	defer ts.Close()
+	r := jaegerRouter(&sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()})
+
+	for _, path := range []string{"/api/services", "/api/services/web/operations", "/api/traces?service=web"} {
+		code, resp, _ := getJaeger(t, r, path)
+		if code != 502 || len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Msg, "decode CH rows") {
+			t.Fatalf("%s: %d %+v", path, code, resp)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package traces
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// Large traces. Get and Subtree never hold a trace's full rows in memory:
+// they first read the shape of the span tree (IDs and parents only), choose
+// which spans to return, then stream only their full rows from ClickHouse
+// into the response. A trace with more spans than the limit comes back as a
+// skeleton, the spans nearest its roots breadth first, with hiddenChildren
+// set where children were cut off; the UI expands those through Subtree.
+
+const (
+	defaultTraceMaxSpans = 10_000
+	flushEvery           = 500 // spans between flushes of a streamed body
+
+	// maxInlineSpanIDs is the most span IDs written into the SQL of
+	// openRecords; larger sets go to ClickHouse as an external table.
+	maxInlineSpanIDs = 1000
+)
+
+// spanEdge is one span's place in the tree, with what the trace-quality
+// checks need to know about it.
+type spanEdge struct {
+	SpanId       string `json:"SpanId"`
+	ParentSpanId string `json:"ParentSpanId"`
+	ServiceName  string `json:"ServiceName"`
+	SpanKind     string `json:"SpanKind"`
+	StartNS      int64  `json:"start_ns"`
+	EndNS        int64  `json:"end_ns"`
+}
+
+// spanTree indexes a trace's parent links. Children are kept in start order.
+type spanTree struct {
+	order    []string // span IDs by start time
+	spans    map[string]spanEdge
+	children map[string][]string
+}
+
+func newSpanTree(edges []spanEdge) *spanTree {
+	t := &spanTree{spans: map[string]spanEdge{}, children: map[string][]string{}}
+	for _, e := range edges {
+		if _, dup := t.spans[e.SpanId]; dup {
+			continue
+		}
+		t.order = append(t.order, e.SpanId)
+		t.spans[e.SpanId] = e
+	}
+	for _, id := range t.order {
+		if p := t.spans[id].ParentSpanId; p != "" && p != id {
+			t.children[p] = append(t.children[p], id)
+		}
+	}
+	return t
+}
+
+func (t *spanTree) has(id string) bool {
+	_, ok := t.spans[id]
+	return ok
+}
+
+// roots are the spans whose parent is not in the trace, including orphans
+// whose parent was never received.
+func (t *spanTree) roots() []string {
+	var out []string
+	for _, id := range t.order {
+		if p := t.spans[id].ParentSpanId; p == "" || p == id || !t.has(p) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// pick walks breadth first from starts and keeps up to limit spans. For kept
+// spans with children that were not kept, hidden holds how many were left out.
+func (t *spanTree) pick(starts []string, limit int) (keep map[string]bool, hidden map[string]int) {
+	keep, hidden = map[string]bool{}, map[string]int{}
+	queue := append([]string(nil), starts...)
+	for len(queue) > 0 && len(keep) < limit {
+		id := queue[0]
+		queue = queue[1:]
+		if keep[id] {
+			continue // parent cycles in bad data
+		}
+		keep[id] = true
+		queue = append(queue, t.children[id]...)
+	}
+	for id := range keep {
+		for _, ch := range t.children[id] {
+			if !keep[ch] {
+				hidden[id]++
+			}
+		}
+	}
+	return keep, hidden
+}
+
+// topologySQL selects the shape of a trace (IDs, parents, services, kinds
+// and intervals) in start order.
+func topologySQL(db string, ts sources.TraceSchema, traceID string) string {
+	ts = ts.WithDefaults()
+	col := ts.Columns
+	return fmt.Sprintf(`
+SELECT %s AS SpanId, %s AS ParentSpanId, %s AS ServiceName, %s AS SpanKind,
+  %s AS start_ns, %[5]s + %s AS end_ns
+FROM %s.%s
+WHERE %s = %s
+ORDER BY start_ns ASC
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, col.SpanId, col.ParentSpanId, col.ServiceName, col.SpanKind, ts.StartNs(""), ts.DurationNs(""),
+		db, ts.Tables.Spans, col.TraceId, joinQuoted([]string{traceID}))
+}
+
+// loadSpanTree reads a trace's tree shape from ClickHouse or the import store.
+func loadSpanTree(src *sources.Sources, traceID string) (*spanTree, error) {
+	if isImportID(traceID) {
+		recs, ok := importedRecords(src, traceID)
+		if !ok {
+			return nil, errTraceNotFound
+		}
+		return newSpanTree(recordEdges(recs)), nil
+	}
+	b, err := src.QueryCH(topologySQL(src.CHDB, src.Traces, traceID))
+	if err != nil {
+		return nil, err
+	}
+	var edges []spanEdge
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var e spanEdge
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return newSpanTree(edges), nil
+			}
+			return nil, fmt.Errorf("decode CH rows: %w", err)
+		}
+		edges = append(edges, e)
+	}
+}
+
+func recordEdges(recs []spanRecord) []spanEdge {
+	edges := make([]spanEdge, 0, len(recs))
+	for _, r := range recs {
+		edges = append(edges, spanEdge{SpanId: r.SpanId, ParentSpanId: r.ParentSpanId,
+			ServiceName: r.ServiceName, SpanKind: r.SpanKind, StartNS: r.StartNS, EndNS: r.EndNS})
+	}
+	return edges
+}
+
+// openRecords starts reading a trace's full span rows in start order, only
+// those in keep unless it is nil; next returns io.EOF after the last one and
+// stop must always be called. ctx bounds the ClickHouse read.
+func openRecords(ctx context.Context, src *sources.Sources, traceID string, keep map[string]bool) (next func() (spanRecord, error), stop func(), err error) {
+	if isImportID(traceID) {
+		recs, ok := importedRecords(src, traceID)
+		if !ok {
+			return nil, nil, errTraceNotFound
+		}
+		i := 0
+		return func() (spanRecord, error) {
+			if i == len(recs) {
+				return spanRecord{}, io.EOF
+			}
+			i++
+			return recs[i-1], nil
+		}, func() {}, nil
+	}
+	body, err := streamRecords(ctx, src, traceID, keep)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(body)
+	return func() (spanRecord, error) {
+		var r spanRecord
+		err := dec.Decode(&r)
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("decode CH rows: %w", err)
+		}
+		return r, err
+	}, func() { body.Close() }, nil
+}
+
+// streamRecords asks ClickHouse for the rows of traceID whose span is in
+// keep, or for all of them when keep is nil.
+func streamRecords(ctx context.Context, src *sources.Sources, traceID string, keep map[string]bool) (io.ReadCloser, error) {
+	if keep == nil {
+		return src.StreamCH(ctx, recordsSQL(src.CHDB, src.Traces, traceID))
+	}
+	ids := make([]string, 0, len(keep))
+	for id := range keep {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) <= maxInlineSpanIDs {
+		return src.StreamCH(ctx, recordsWhereSQL(src.CHDB, src.Traces, "IN ("+joinQuoted(ids)+")", traceID))
+	}
+	return src.StreamCHWith(ctx, recordsWhereSQL(src.CHDB, src.Traces, "IN keep_spans", traceID),
+		sources.ExternalTable{Name: "keep_spans", Structure: "SpanId String", Rows: ids})
+}
+
+// spanLimit is the configured span limit, lowered by ?maxSpans= if given.
+func spanLimit(c *gin.Context, src *sources.Sources) (int, error) {
+	limit := src.TraceMaxSpans
+	if limit <= 0 {
+		limit = defaultTraceMaxSpans
+	}
+	if v := c.Query("maxSpans"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("maxSpans must be a positive integer")
+		}
+		limit = min(limit, n)
+	}
+	return limit, nil
+}
+
+// underSpanLimit reads only the shape of traceID and answers the request
+// unless it has at most spanLimit spans: 400 for a bad ?maxSpans, 404 for an
+// unknown import, 502 when ClickHouse fails and 413 when the trace is
+// bigger. Handlers that need every span in memory call it first; what names
+// their result in the 413 message.
+func underSpanLimit(c *gin.Context, src *sources.Sources, traceID, what string) bool {
+	limit, err := spanLimit(c, src)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	tree, err := loadSpanTree(src, traceID)
+	if err == errTraceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "imported trace expired or unknown"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return false
+	}
+	if n := len(tree.order); n > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("trace has %d spans; %s are limited to %d", n, what, limit),
+			"spans": n, "truncated": true,
+		})
+		return false
+	}
+	return true
+}
+
+// traceView is what streamSpans writes out of a trace.
+type traceView struct {
+	tree     *spanTree
+	total    int             // spans in the trace (or subtree)
+	keep     map[string]bool // spans to write
+	hidden   map[string]int  // kept spans' children that were left out
+	quality  traceQuality    // warnings and clock-skew shifts
+	warnings bool            // include quality.Warnings in the body
+}
+
+// streamSpans writes {"traceId","totalSpans","truncated","warnings",
+// "spans":[...]} for the kept spans, flushing as it goes. Once the body has
+// started an error can no longer change the status, so it is reported in an
+// "error" field after the spans.
+func streamSpans(c *gin.Context, src *sources.Sources, traceID string, v traceView) {
+	next, stop := func() (spanRecord, error) { return spanRecord{}, io.EOF }, func() {}
+	if len(v.keep) > 0 {
+		var err error
+		// Every span kept, as for most traces: no need to list them.
+		keep := v.keep
+		if len(keep) == len(v.tree.order) {
+			keep = nil
+		}
+		if next, stop, err = openRecords(c.Request.Context(), src, traceID, keep); err != nil {
+			code := http.StatusBadGateway
+			if err == errTraceNotFound {
+				code = http.StatusNotFound
+			}
+			c.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	defer stop()
+
+	id, _ := json.Marshal(traceID)
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := c.Writer
+	fmt.Fprintf(w, `{"traceId":%s,"totalSpans":%d,"truncated":%t,`, id, v.total, len(v.keep) < v.total)
+	if v.warnings {
+		warns := v.quality.Warnings
+		if warns == nil {
+			warns = []TraceWarning{}
+		}
+		b, _ := json.Marshal(warns)
+		fmt.Fprintf(w, `"warnings":%s,`, b)
+	}
+	w.WriteString(`"spans":[`)
+	enc := json.NewEncoder(w)
+	n := 0
+	var streamErr error
+	for {
+		r, err := next()
+		if err != nil {
+			if err != io.EOF {
+				streamErr = err
+			}
+			break
+		}
+		if !v.keep[r.SpanId] {
+			continue
+		}
+		s := recordSpan(r)
+		s.HiddenChildren = v.hidden[r.SpanId]
+		s.SelfNanos = v.tree.selfNanos(r.SpanId, v.quality.Shift)
+		shiftSpan(&s, v.quality.Shift[r.SpanId])
+		if n > 0 {
+			w.WriteString(",")
+		}
+		if err := enc.Encode(s); err != nil {
+			return // client went away
+		}
+		if n++; n%flushEvery == 0 {
+			w.Flush()
+		}
+	}
+	w.WriteString("]")
+	if streamErr != nil {
+		log.Printf("trace %s: %v", traceID, streamErr)
+		msg, _ := json.Marshal(streamErr.Error())
+		fmt.Fprintf(w, `,"error":%s`, msg)
+	}
+	w.WriteString("}")
+}
+
+// shiftSpan moves a span and its events by d nanoseconds.
+func shiftSpan(s *Span, d int64) {
+	if d == 0 {
+		return
+	}
+	s.StartUnixNanos += d
+	s.EndUnixNanos += d
+	for i := range s.Events {
+		s.Events[i].TimeUnixNanos += d
+	}
+}
+
+// Subtree serves GET /api/traces/{traceId}/spans/{spanId}/subtree: the span
+// and its descendants, breadth first and limited like Get, in Get's shape
+// minus the warnings (which Get already reported for the whole trace).
+func Subtree(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traceID, spanID := c.Param("traceId"), c.Param("spanId")
+		limit, err := spanLimit(c, src)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tree, err := loadSpanTree(src, traceID)
+		if err == errTraceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "imported trace expired or unknown"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if !tree.has(spanID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "span not found"})
+			return
+		}
+		all, _ := tree.pick([]string{spanID}, len(tree.order))
+		v := traceView{tree: tree, total: len(all), quality: analyzeTrace(tree, c.Query("adjustSkew") == "true")}
+		v.keep, v.hidden = tree.pick([]string{spanID}, limit)
+		streamSpans(c, src, traceID, v)
+	}
+}
@@ -0,0 +1,142 @@
+package traces
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// A -> (B -> (D, E), C), in start order.
+const treeRows = `{"TraceId":"T","SpanId":"A","ParentSpanId":"","SpanName":"root","start_ns":0,"end_ns":100}
+{"TraceId":"T","SpanId":"B","ParentSpanId":"A","SpanName":"b","start_ns":10,"end_ns":60}
+{"TraceId":"T","SpanId":"C","ParentSpanId":"A","SpanName":"c","start_ns":20,"end_ns":90}
+{"TraceId":"T","SpanId":"D","ParentSpanId":"B","SpanName":"d","start_ns":30,"end_ns":40}
+{"TraceId":"T","SpanId":"E","ParentSpanId":"B","SpanName":"e","start_ns":40,"end_ns":50}
+`
+
+type streamedTrace struct {
+	TraceID    string `json:"traceId"`
+	TotalSpans int    `json:"totalSpans"`
+	Truncated  bool   `json:"truncated"`
+	Spans      []Span `json:"spans"`
+}
+
+func getStreamed(t *testing.T, path, url string, src *sources.Sources, h func(*sources.Sources) gin.HandlerFunc) (int, streamedTrace) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	newRouter(path, h(src)).ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	var out streamedTrace
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatalf("invalid JSON: %v\n%s", err, w.Body.String())
+		}
+	}
+	return w.Code, out
+}
+
+func spanIDs(spans []Span) []string {
+	var ids []string
+	for _, s := range spans {
+		ids = append(ids, s.SpanID)
+	}
+	return ids
+}
+
+func TestGet_TruncatesToSkeleton(t *testing.T) {
+	ts := fakeCH(t, treeRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client(), TraceMaxSpans: 10}
+
+	code, out := getStreamed(t, "/api/traces/:traceId", "/api/traces/T?maxSpans=3", src, Get)
+	if code != 200 {
+		t.Fatalf("status=%d", code)
+	}
+	if !out.Truncated || out.TotalSpans != 5 {
+		t.Fatalf("truncated=%v total=%d", out.Truncated, out.TotalSpans)
+	}
+	if got := spanIDs(out.Spans); len(got) != 3 || got[0] != "A" || got[1] != "B" || got[2] != "C" {
+		t.Fatalf("skeleton=%v want [A B C]", got)
+	}
+	if out.Spans[1].HiddenChildren != 2 || out.Spans[0].HiddenChildren != 0 {
+		t.Fatalf("hiddenChildren: %+v", out.Spans)
+	}
+
+	// Under the limit everything comes back.
+	_, out = getStreamed(t, "/api/traces/:traceId", "/api/traces/T", src, Get)
+	if out.Truncated || len(out.Spans) != 5 {
+		t.Fatalf("truncated=%v spans=%d", out.Truncated, len(out.Spans))
+	}
+
+	if code, _ := getStreamed(t, "/api/traces/:traceId", "/api/traces/T?maxSpans=x", src, Get); code != 400 {
+		t.Fatalf("bad maxSpans: status=%d", code)
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	ts := fakeCH(t, treeRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	const path = "/api/traces/:traceId/spans/:spanId/subtree"
+
+	code, out := getStreamed(t, path, "/api/traces/T/spans/B/subtree", src, Subtree)
+	if code != 200 {
+		t.Fatalf("status=%d", code)
+	}
+	if got := spanIDs(out.Spans); len(got) != 3 || got[0] != "B" || out.TotalSpans != 3 || out.Truncated {
+		t.Fatalf("subtree=%v total=%d truncated=%v", got, out.TotalSpans, out.Truncated)
+	}
+
+	_, out = getStreamed(t, path, "/api/traces/T/spans/B/subtree?maxSpans=1", src, Subtree)
+	if len(out.Spans) != 1 || !out.Truncated || out.Spans[0].HiddenChildren != 2 {
+		t.Fatalf("limited subtree: %+v", out)
+	}
+
+	if code, _ := getStreamed(t, path, "/api/traces/T/spans/Z/subtree", src, Subtree); code != 404 {
+		t.Fatalf("unknown span: status=%d", code)
+	}
+}
+
+func TestSpanTree_OrphansAndCycles(t *testing.T) {
+	tree := newSpanTree([]spanEdge{
+		{SpanId: "A"},
+		{SpanId: "O", ParentSpanId: "missing"},
+		{SpanId: "X", ParentSpanId: "Y"},
+		{SpanId: "Y", ParentSpanId: "X"},
+		{SpanId: "B", ParentSpanId: "A"},
+		{SpanId: "B", ParentSpanId: "A"}, // duplicate row
+	})
+	if got := tree.roots(); len(got) != 2 || got[0] != "A" || got[1] != "O" {
+		t.Fatalf("roots=%v want [A O]", got)
+	}
+	keep, _ := tree.pick([]string{"X"}, 10)
+	var ids []string
+	for id := range keep {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "X" || ids[1] != "Y" {
+		t.Fatalf("cycle pick=%v", ids)
+	}
+}
+
+func TestGet_ReadsOnlyKeptSpans(t *testing.T) {
+	ch, queries := captureCH(t, treeRows)
+	defer ch.Close()
+	src := &sources.Sources{CHURL: ch.URL, CHDB: "default", Client: ch.Client()}
+
+	getStreamed(t, "/api/traces/:traceId", "/api/traces/T?maxSpans=3", src, Get)
+	if q := *queries; len(q) != 2 || !strings.Contains(q[1], "AND SpanId IN ('A', 'B', 'C')") {
+		t.Fatalf("records query not limited to the skeleton:\n%s", q[len(q)-1])
+	}
+
+	*queries = nil
+	getStreamed(t, "/api/traces/:traceId", "/api/traces/T", src, Get)
+	if q := *queries; len(q) != 2 || strings.Contains(q[1], "AND SpanId") {
+		t.Fatalf("whole trace should not list span IDs:\n%s", q[len(q)-1])
+	}
+}
@@ -0,0 +1,283 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/gin-gonic/gin"
+)
+
+// Latency distributions over trace_roots, filtered exactly like List so a
+// band brushed on the chart can be passed back as filters.durationMs
+// {gte: lowMs, lte: highMs} to get the matching traces.
+//
+// Buckets are log-scaled with fixed edges: bucket b covers
+// [10^(b/k), 10^((b+1)/k)) ms for k buckets per decade, so histograms and
+// heatmap rows from different queries line up.
+
+const (
+	defaultBucketsPerDecade = 10
+	maxBucketsPerDecade     = 100
+	defaultHeatmapColumns   = 60
+	maxHeatmapColumns       = 1000
+	minLatencyMs            = 0.001 // durations below 1µs share the lowest bucket
+	defaultLatencyCacheSize = 128
+)
+
+// LatencyReq is TraceListReq plus the chart's resolution.
+type LatencyReq struct {
+	TraceListReq
+	BucketsPerDecade int `json:"bucketsPerDecade"`
+	// StepSeconds is the heatmap column width; by default the range is split
+	// into about 60 columns.
+	StepSeconds int64 `json:"stepSeconds"`
+}
+
+// LatencyBucket is one duration band.
+type LatencyBucket struct {
+	LowMs  float64 `json:"lowMs"`
+	HighMs float64 `json:"highMs"`
+	Count  int64   `json:"count,omitempty"`
+}
+
+// Percentiles of trace duration in ms.
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func (r *LatencyReq) normalize(ttl time.Duration) {
+	r.defaultRange(ttl)
+	if r.BucketsPerDecade <= 0 {
+		r.BucketsPerDecade = defaultBucketsPerDecade
+	}
+	r.BucketsPerDecade = min(r.BucketsPerDecade, maxBucketsPerDecade)
+	span := max(int64(r.To-r.From), 1)
+	if r.StepSeconds <= 0 {
+		r.StepSeconds = max((span+defaultHeatmapColumns-1)/defaultHeatmapColumns, 1)
+	}
+	// Keep the response bounded whatever step was asked for.
+	r.StepSeconds = max(r.StepSeconds, (span+maxHeatmapColumns-1)/maxHeatmapColumns)
+}
+
+// bucketExpr maps DurationMs to its bucket index.
+func (r LatencyReq) bucketExpr() string {
+	return fmt.Sprintf("toInt32(floor(log10(greatest(DurationMs, %g)) * %d))", minLatencyMs, r.BucketsPerDecade)
+}
+
+func (r LatencyReq) bucket(b int) LatencyBucket {
+	k := float64(r.BucketsPerDecade)
+	return LatencyBucket{LowMs: roundSig(math.Pow(10, float64(b)/k)), HighMs: roundSig(math.Pow(10, float64(b+1)/k))}
+}
+
+// roundSig rounds to 6 significant digits so edges read as 1, 1.25893, ...
+func roundSig(v float64) float64 {
+	if v == 0 {
+		return 0
+	}
+	p := math.Pow(10, 5-math.Floor(math.Log10(math.Abs(v))))
+	return math.Round(v*p) / p
+}
+
+// histogramSQL returns one row: total, quantiles and a sumMap of bucket counts.
+func histogramSQL(db, table string, r LatencyReq) string {
+	return fmt.Sprintf(`
+SELECT count() AS total, quantiles(0.5, 0.95, 0.99)(DurationMs) AS q,
+  sumMap([%s], [toUInt64(1)]) AS hist
+FROM %s.%s
+WHERE %s
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, r.bucketExpr(), db, table, strings.Join(r.where(), " AND "))
+}
+
+// heatmapSQL returns the same per time column.
+func heatmapSQL(db, table string, r LatencyReq) string {
+	return fmt.Sprintf(`
+SELECT toInt64(intDiv(toUnixTimestamp(StartTs), %[1]d) * %[1]d) AS t,
+  count() AS total, quantiles(0.5, 0.95, 0.99)(DurationMs) AS q,
+  sumMap([%[2]s], [toUInt64(1)]) AS hist
+FROM %[3]s.%[4]s
+WHERE %[5]s
+GROUP BY t
+ORDER BY t
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, r.StepSeconds, r.bucketExpr(), db, table, strings.Join(r.where(), " AND "))
+}
+
+// latencyRow is one histogramSQL / heatmapSQL row.
+type latencyRow struct {
+	T     int64      `json:"t"`
+	Total int64      `json:"total"`
+	Q     []*float64 `json:"q"` // null when there are no rows
+	Hist  [2][]int64 `json:"hist"`
+}
+
+func (row latencyRow) percentiles() Percentiles {
+	var p [3]float64
+	for i := range p {
+		if i < len(row.Q) && row.Q[i] != nil && !math.IsNaN(*row.Q[i]) {
+			p[i] = *row.Q[i]
+		}
+	}
+	return Percentiles{P50: p[0], P95: p[1], P99: p[2]}
+}
+
+func (row latencyRow) counts() map[int]int64 {
+	out := map[int]int64{}
+	keys, vals := row.Hist[0], row.Hist[1]
+	for i := range keys {
+		if i < len(vals) {
+			out[int(keys[i])] += vals[i]
+		}
+	}
+	return out
+}
+
+func decodeLatencyRows(b []byte) ([]latencyRow, error) {
+	var rows []latencyRow
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var row latencyRow
+		if err := dec.Decode(&row); err != nil {
+			return nil, fmt.Errorf("decode CH rows: %w", err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// bucketRange is the smallest and largest index in any of the counts.
+func bucketRange(all ...map[int]int64) (lo, hi int, ok bool) {
+	for _, m := range all {
+		for b := range m {
+			if !ok || b < lo {
+				lo = b
+			}
+			if !ok || b > hi {
+				hi = b
+			}
+			ok = true
+		}
+	}
+	return lo, hi, ok
+}
+
+func bindLatencyReq(c *gin.Context, ttl time.Duration) (LatencyReq, bool) {
+	var r LatencyReq
+	if err := c.BindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+		return r, false
+	}
+	r.normalize(ttl)
+	if r.From >= r.To {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return r, false
+	}
+	return r, true
+}
+
+// LatencyHistogram serves POST /api/traces/latency-histogram: trace counts
+// per log-scaled duration bucket (contiguous, empty ones included) and the
+// p50/p95/p99 durations.
+func LatencyHistogram(src *sources.Sources) gin.HandlerFunc {
+	cc := newCache(src, "latency_histogram", defaultLatencyCacheSize)
+	return func(c *gin.Context) {
+		r, ok := bindLatencyReq(c, cc.TTL())
+		if !ok {
+			return
+		}
+		sql := histogramSQL(src.CHDB, src.Traces.WithDefaults().Tables.TraceRoots, r)
+		serveCached(c, cc, sql, func() ([]byte, error) {
+			b, err := src.QueryCH(sql)
+			if err != nil {
+				return nil, err
+			}
+			rows, err := decodeLatencyRows(b)
+			if err != nil {
+				return nil, err
+			}
+			var row latencyRow
+			if len(rows) > 0 {
+				row = rows[0]
+			}
+			counts := row.counts()
+			buckets := []LatencyBucket{}
+			if lo, hi, ok := bucketRange(counts); ok {
+				for i := lo; i <= hi; i++ {
+					bk := r.bucket(i)
+					bk.Count = counts[i]
+					buckets = append(buckets, bk)
+				}
+			}
+			return json.Marshal(gin.H{
+				"from": r.From, "to": r.To, "bucketsPerDecade": r.BucketsPerDecade,
+				"total": row.Total, "percentiles": row.percentiles(), "buckets": buckets,
+			})
+		})
+	}
+}
+
+// LatencyHeatmap serves POST /api/traces/latency-heatmap: the histogram per
+// StepSeconds column. counts[i][j] is the number of traces starting in
+// times[i] whose duration falls in buckets[j]; percentiles[i] belong to
+// times[i]. Columns with no traces are included.
+func LatencyHeatmap(src *sources.Sources) gin.HandlerFunc {
+	cc := newCache(src, "latency_heatmap", defaultLatencyCacheSize)
+	return func(c *gin.Context) {
+		r, ok := bindLatencyReq(c, cc.TTL())
+		if !ok {
+			return
+		}
+		sql := heatmapSQL(src.CHDB, src.Traces.WithDefaults().Tables.TraceRoots, r)
+		serveCached(c, cc, sql, func() ([]byte, error) {
+			b, err := src.QueryCH(sql)
+			if err != nil {
+				return nil, err
+			}
+			rows, err := decodeLatencyRows(b)
+			if err != nil {
+				return nil, err
+			}
+			byT := map[int64]latencyRow{}
+			var all []map[int]int64
+			for _, row := range rows {
+				byT[row.T] = row
+				all = append(all, row.counts())
+			}
+			buckets := []LatencyBucket{}
+			lo, hi, found := bucketRange(all...)
+			if found {
+				for i := lo; i <= hi; i++ {
+					buckets = append(buckets, r.bucket(i))
+				}
+			}
+
+			step := r.StepSeconds
+			times, counts, pcts, totals := []int64{}, [][]int64{}, []Percentiles{}, []int64{}
+			for t := int64(r.From) / step * step; t <= int64(r.To); t += step {
+				row := byT[t]
+				col := make([]int64, len(buckets))
+				for b, n := range row.counts() {
+					col[b-lo] = n
+				}
+				times = append(times, t)
+				counts = append(counts, col)
+				pcts = append(pcts, row.percentiles())
+				totals = append(totals, row.Total)
+			}
+			return json.Marshal(gin.H{
+				"from": r.From, "to": r.To, "stepSeconds": step, "bucketsPerDecade": r.BucketsPerDecade,
+				"buckets": buckets, "times": times, "totals": totals, "counts": counts, "percentiles": pcts,
+			})
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package traces
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func TestLatencyHistogram_SQLUsesListFilters(t *testing.T) {
+	ts, queries := captureCH(t, "")
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := postJSON(t, "/h", LatencyHistogram(src),
+		`{"from":1704103200,"to":1704106800,"filters":{"status":["ERROR"],"service":["web"]},"bucketsPerDecade":5}`)
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	sql := strings.Join(*queries, "\n")
+	for _, want := range []string{
+		"FROM default.trace_roots",
+		"StartTs BETWEEN toDateTime(1704103200) AND toDateTime(1704106800)",
+		"RootService IN ('web')",
+		"Status IN ('ERROR')",
+		"log10(greatest(DurationMs, 0.001)) * 5",
+		"output_format_json_quote_64bit_integers = 0",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("missing %q in:\n%s", want, sql)
+		}
+	}
+}
+
+func TestLatencyHistogram_ContiguousBuckets(t *testing.T) {
+	// Buckets 10 (10ms) and 13 (~20ms) at 10 per decade; 11 and 12 are empty.
+	ts := fakeCH(t, `{"total":5,"q":[12.5,19,20],"hist":[[10,13],[3,2]]}`+"\n")
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := postJSON(t, "/h", LatencyHistogram(src), `{"from":1704103200,"to":1704106800}`)
+	var out struct {
+		Total       int64           `json:"total"`
+		Percentiles Percentiles     `json:"percentiles"`
+		Buckets     []LatencyBucket `json:"buckets"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != 200 {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if out.Total != 5 || out.Percentiles.P95 != 19 {
+		t.Fatalf("out=%+v", out)
+	}
+	if len(out.Buckets) != 4 {
+		t.Fatalf("buckets=%+v", out.Buckets)
+	}
+	if b := out.Buckets[0]; b.LowMs != 10 || b.HighMs != 12.5893 || b.Count != 3 {
+		t.Fatalf("first=%+v", b)
+	}
+	if out.Buckets[1].Count != 0 || out.Buckets[2].Count != 0 || out.Buckets[3].Count != 2 {
+		t.Fatalf("counts=%+v", out.Buckets)
+	}
+}
+
+func TestLatencyHeatmap_FillsColumns(t *testing.T) {
+	// Step 60s over 4 minutes; only the first and third columns have traces.
+	body := `{"t":1704103200,"total":2,"q":[1,2,2],"hist":[[0,1],[1,1]]}` + "\n" +
+		`{"t":1704103320,"total":1,"q":[100,100,100],"hist":[[20],[1]]}` + "\n"
+	ts := fakeCH(t, body)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := postJSON(t, "/m", LatencyHeatmap(src), `{"from":1704103200,"to":1704103439,"stepSeconds":60}`)
+	var out struct {
+		Buckets     []LatencyBucket `json:"buckets"`
+		Times       []int64         `json:"times"`
+		Totals      []int64         `json:"totals"`
+		Counts      [][]int64       `json:"counts"`
+		Percentiles []Percentiles   `json:"percentiles"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || w.Code != 200 {
+		t.Fatalf("status=%d err=%v body=%s", w.Code, err, w.Body.String())
+	}
+	if len(out.Buckets) != 21 || len(out.Times) != 4 || len(out.Counts) != 4 || len(out.Percentiles) != 4 {
+		t.Fatalf("shape: buckets=%d times=%v counts=%d", len(out.Buckets), out.Times, len(out.Counts))
+	}
+	if out.Times[1] != 1704103260 || out.Totals[1] != 0 || len(out.Counts[1]) != 21 {
+		t.Fatalf("empty column: t=%d total=%d", out.Times[1], out.Totals[1])
+	}
+	if out.Counts[0][0] != 1 || out.Counts[0][1] != 1 || out.Counts[2][20] != 1 {
+		t.Fatalf("counts=%v", out.Counts)
+	}
+	if out.Percentiles[2].P99 != 100 {
+		t.Fatalf("percentiles=%+v", out.Percentiles)
+	}
+}
+
+func TestLatency_BadRequest(t *testing.T) {
+	src := &sources.Sources{}
+	if w := postJSON(t, "/h", LatencyHistogram(src), `{`); w.Code != 400 {
+		t.Fatalf("bad json status=%d", w.Code)
+	}
+	if w := postJSON(t, "/m", LatencyHeatmap(src), `{"from":200,"to":100}`); w.Code != 400 {
+		t.Fatalf("inverted range status=%d", w.Code)
+	}
+}
@@ -1,10 +1,9 @@
 package traces
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 	"time"
 
@@ -34,18 +33,14 @@ type TraceListReq struct {
 }
 
 func List(src *sources.Sources) gin.HandlerFunc {
+	cc := newCache(src, "list", defaultListCacheSize)
 	return func(c *gin.Context) {
 		var r TraceListReq
 		if err := c.BindJSON(&r); err != nil {
 			c.JSON(400, gin.H{"error": "bad json"})
 			return
 		}
-		if r.To == 0 {
-			r.To = float64(time.Now().Unix())
-		}
-		if r.From == 0 {
-			r.From = r.To - 3600
-		}
+		r.defaultRange(cc.TTL())
 		if r.Page.Size <= 0 || r.Page.Size > 500 {
 			r.Page.Size = 100
 		}
@@ -58,24 +53,7 @@ func List(src *sources.Sources) gin.HandlerFunc {
 			order = "DESC"
 		}
 
-		where := []string{
-			fmt.Sprintf("StartTs BETWEEN toDateTime(%d) AND toDateTime(%d)", int64(r.From), int64(r.To)),
-		}
-		if len(r.Filters.Service) > 0 {
-			where = append(where, "RootService IN ("+joinQuoted(r.Filters.Service)+")")
-		}
-		if len(r.Filters.Operation) > 0 {
-			where = append(where, "RootOperation IN ("+joinQuoted(r.Filters.Operation)+")")
-		}
-		if len(r.Filters.Status) > 0 {
-			where = append(where, "Status IN ("+joinQuoted(r.Filters.Status)+")")
-		}
-		if r.Filters.Duration.Gte != nil {
-			where = append(where, fmt.Sprintf("DurationMs >= %f", *r.Filters.Duration.Gte))
-		}
-		if r.Filters.Duration.Lte != nil {
-			where = append(where, fmt.Sprintf("DurationMs <= %f", *r.Filters.Duration.Lte))
-		}
+		where := r.where()
 
 		orderExpr := "DurationMs"
 		switch by {
@@ -87,67 +65,100 @@ func List(src *sources.Sources) gin.HandlerFunc {
 
 		sql := fmt.Sprintf(`
       SELECT TraceId, StartTs, DurationMs, RootService, RootOperation, Status, SpanCount, TopService, TopServiceMs
-      FROM %s.trace_roots
+      FROM %s.%s
       WHERE %s
       ORDER BY %s %s
       LIMIT %d
       FORMAT JSONEachRow
-    `, src.CHDB, strings.Join(where, " AND "), orderExpr, order, r.Page.Size)
+    `, src.CHDB, src.Traces.WithDefaults().Tables.TraceRoots, strings.Join(where, " AND "), orderExpr, order, r.Page.Size)
 
-		req, _ := http.NewRequest("POST", src.CHURL, strings.NewReader(sql))
-		if src.CHUser != "" {
-			req.SetBasicAuth(src.CHUser, src.CHPass)
-		}
-		resp, err := src.Client.Do(req)
-		if err != nil {
-			c.JSON(502, gin.H{"error": err.Error()})
-			return
-		}
-		defer resp.Body.Close()
-		b, _ := io.ReadAll(resp.Body)
+		serveCached(c, cc, sql, func() ([]byte, error) {
+			b, err := src.QueryCH(sql)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(gin.H{"items": listItems(b)})
+		})
+	}
+}
 
-		type Row struct {
-			TraceId       string  `json:"TraceId"`
-			StartTs       string  `json:"StartTs"`
-			DurationMs    float64 `json:"DurationMs"`
-			RootService   string  `json:"RootService"`
-			RootOperation string  `json:"RootOperation"`
-			Status        string  `json:"Status"`
-			SpanCount     int     `json:"SpanCount"`
-			TopService    string  `json:"TopService"`
-			TopServiceMs  float64 `json:"TopServiceMs"`
-		}
+// defaultRange fills in the last hour for a missing from/to; a missing to is
+// rounded up to ttl (see openEnd).
+func (r *TraceListReq) defaultRange(ttl time.Duration) {
+	if r.To == 0 {
+		r.To = float64(openEnd(ttl))
+	}
+	if r.From == 0 {
+		r.From = r.To - 3600
+	}
+}
 
-		dec := json.NewDecoder(strings.NewReader(string(b)))
-		items := []map[string]any{}
-		for {
-			var row Row
-			if err := dec.Decode(&row); err != nil {
-				break
-			}
-			items = append(items, map[string]any{
-				"traceId":       row.TraceId,
-				"startTs":       row.StartTs,
-				"durationMs":    row.DurationMs,
-				"rootService":   row.RootService,
-				"rootOperation": row.RootOperation,
-				"status":        row.Status,
-				"spanCount":     row.SpanCount,
-				"svcBreakdown":  [][2]any{{row.TopService, row.TopServiceMs}},
-			})
-		}
-		c.JSON(200, gin.H{"items": items})
+// where returns the trace_roots conditions for r's time range and filters.
+func (r TraceListReq) where() []string {
+	where := []string{
+		fmt.Sprintf("StartTs BETWEEN toDateTime(%d) AND toDateTime(%d)", int64(r.From), int64(r.To)),
+	}
+	if len(r.Filters.Service) > 0 {
+		where = append(where, "RootService IN ("+joinQuoted(r.Filters.Service)+")")
+	}
+	if len(r.Filters.Operation) > 0 {
+		where = append(where, "RootOperation IN ("+joinQuoted(r.Filters.Operation)+")")
+	}
+	if len(r.Filters.Status) > 0 {
+		where = append(where, "Status IN ("+joinQuoted(r.Filters.Status)+")")
+	}
+	if r.Filters.Duration.Gte != nil {
+		where = append(where, fmt.Sprintf("DurationMs >= %f", *r.Filters.Duration.Gte))
+	}
+	if r.Filters.Duration.Lte != nil {
+		where = append(where, fmt.Sprintf("DurationMs <= %f", *r.Filters.Duration.Lte))
+	}
+	return where
+}
+
+// listItems maps trace_roots JSONEachRow output onto the Finder's item shape.
+func listItems(b []byte) []map[string]any {
+	type Row struct {
+		TraceId       string  `json:"TraceId"`
+		StartTs       string  `json:"StartTs"`
+		DurationMs    float64 `json:"DurationMs"`
+		RootService   string  `json:"RootService"`
+		RootOperation string  `json:"RootOperation"`
+		Status        string  `json:"Status"`
+		SpanCount     int     `json:"SpanCount"`
+		TopService    string  `json:"TopService"`
+		TopServiceMs  float64 `json:"TopServiceMs"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	items := []map[string]any{}
+	for {
+		var row Row
+		if err := dec.Decode(&row); err != nil {
+			break
+		}
+		items = append(items, map[string]any{
+			"traceId":       row.TraceId,
+			"startTs":       row.StartTs,
+			"durationMs":    row.DurationMs,
+			"rootService":   row.RootService,
+			"rootOperation": row.RootOperation,
+			"status":        row.Status,
+			"spanCount":     row.SpanCount,
+			"svcBreakdown":  [][2]any{{row.TopService, row.TopServiceMs}},
+		})
 	}
+	return items
 }
 
-// joinQuoted returns "'a', 'b', 'c'" with single quotes safely escaped for SQL.
+// joinQuoted returns "'a', 'b', 'c'", each a sources.Quote literal.
 func joinQuoted(vals []string) string {
 	if len(vals) == 0 {
 		return ""
 	}
 	escaped := make([]string, 0, len(vals))
 	for _, v := range vals {
-		escaped = append(escaped, "'"+strings.ReplaceAll(v, "'", "''")+"'")
+		escaped = append(escaped, sources.Quote(v))
 	}
 	return strings.Join(escaped, ", ")
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/example/otel-stack-demo/internal/sources"
 	"github.com/gin-gonic/gin"
@@ -51,3 +52,20 @@ func TestList_ParsesTraceRootsAndMapsFields(t *testing.T) {
 		t.Fatalf("row[1] unexpected: %+v", out.Items[1])
 	}
 }
+
+func TestDefaultRange_RoundsOpenEndToTTL(t *testing.T) {
+	now := time.Now().Unix()
+	var r TraceListReq
+	r.defaultRange(time.Hour)
+	to := int64(r.To)
+	if to%3600 != 0 || to < now || to-now >= 3600 || r.From != r.To-3600 {
+		t.Fatalf("now=%d got from=%v to=%v", now, r.From, r.To)
+	}
+
+	// Without a cache the range ends now.
+	r = TraceListReq{}
+	r.defaultRange(0)
+	if int64(r.To) < now || int64(r.To)-now > 5 {
+		t.Fatalf("now=%d got to=%v", now, r.To)
+	}
+}
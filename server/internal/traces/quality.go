@@ -0,0 +1,196 @@
+package traces
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Trace-quality checks shared by Get and Flame. Broken instrumentation and
+// partial ingestion show up as spans whose parent never arrived; hosts with
+// drifting clocks show up as child spans starting before their parent. Both
+// would otherwise be drawn as if they were real, so they are reported as
+// warnings, and with ?adjustSkew=true child spans from another service are
+// shifted back inside their parent the way Jaeger's clock-skew adjuster does.
+
+// Warning codes.
+const (
+	warnMissingParent    = "missing_parent"     // a parent ID referenced by spans that are not in the trace
+	warnOrphan           = "orphan"             // a span whose parent is missing; shown as a root
+	warnClockSkew        = "clock_skew"         // a child from another service outside its parent's interval
+	warnNegativeSelfTime = "negative_self_time" // children cover more time than their parent lasted
+	warnMore             = "more"               // the list was cut at maxTraceWarnings
+)
+
+const maxTraceWarnings = 100
+
+// TraceWarning is one finding about how a trace was assembled.
+type TraceWarning struct {
+	Code         string `json:"code"`
+	SpanID       string `json:"spanId,omitempty"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	// SkewNanos is the clock_skew correction, which ?adjustSkew=true adds to
+	// the span and its same-service descendants.
+	SkewNanos int64  `json:"skewNanos,omitempty"`
+	Message   string `json:"message"`
+}
+
+type traceQuality struct {
+	Warnings []TraceWarning
+	// Shift holds, per adjusted span, the nanoseconds to add to its start,
+	// end and event times; it is empty unless adjustment was requested.
+	Shift map[string]int64
+}
+
+// analyzeTrace checks t and, if adjust is set, computes clock-skew shifts.
+func analyzeTrace(t *spanTree, adjust bool) traceQuality {
+	var warns []TraceWarning
+	more := 0
+	warn := func(w TraceWarning) {
+		if len(warns) < maxTraceWarnings {
+			warns = append(warns, w)
+		} else {
+			more++
+		}
+	}
+
+	// Missing parents, reported once each, then every orphan.
+	var missing []string
+	orphans := map[string][]string{}
+	for _, id := range t.order {
+		p := t.spans[id].ParentSpanId
+		if p == "" || p == id || t.has(p) {
+			continue
+		}
+		if len(orphans[p]) == 0 {
+			missing = append(missing, p)
+		}
+		orphans[p] = append(orphans[p], id)
+	}
+	for _, p := range missing {
+		warn(TraceWarning{Code: warnMissingParent, ParentSpanID: p,
+			Message: fmt.Sprintf("%d span(s) reference parent %s, which is not in the trace", len(orphans[p]), p)})
+	}
+	for _, p := range missing {
+		for _, id := range orphans[p] {
+			warn(TraceWarning{Code: warnOrphan, SpanID: id, ParentSpanID: p,
+				Message: fmt.Sprintf("parent %s is missing; shown as a root", p)})
+		}
+	}
+
+	// Skew, top down: a child on the same service shares its parent's clock
+	// and so its correction; a child on another service gets its own.
+	delta := map[string]int64{}
+	seen := map[string]bool{}
+	queue := t.roots()
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		p := t.spans[id]
+		ps, pe := p.StartNS+delta[id], p.EndNS+delta[id]
+		for _, cid := range t.children[id] {
+			ch := t.spans[cid]
+			d := delta[id]
+			if ch.ServiceName != p.ServiceName && !asyncChild(p, ch) {
+				d = skewCorrection(ps, pe, ch.StartNS, ch.EndNS)
+				if d != 0 {
+					warn(TraceWarning{Code: warnClockSkew, SpanID: cid, ParentSpanID: id, SkewNanos: d,
+						Message: fmt.Sprintf("%s span lies outside its %s parent; clocks look %v apart",
+							ch.ServiceName, p.ServiceName, time.Duration(abs64(d)))})
+				}
+			}
+			delta[cid] = d
+			queue = append(queue, cid)
+		}
+	}
+
+	q := traceQuality{Shift: map[string]int64{}}
+	if adjust {
+		for id, d := range delta {
+			if d != 0 {
+				q.Shift[id] = d
+			}
+		}
+	}
+
+	// Self time against the (possibly adjusted) union of child intervals.
+	for _, id := range t.order {
+		kids := t.children[id]
+		if len(kids) == 0 {
+			continue
+		}
+		s := t.spans[id]
+		iv := make([][2]int64, 0, len(kids))
+		for _, cid := range kids {
+			ch := t.spans[cid]
+			iv = append(iv, [2]int64{ch.StartNS + q.Shift[cid], ch.EndNS + q.Shift[cid]})
+		}
+		if self := (s.EndNS - s.StartNS) - unionNanos(iv); self < 0 {
+			warn(TraceWarning{Code: warnNegativeSelfTime, SpanID: id,
+				Message: fmt.Sprintf("children run %v longer than the span itself", time.Duration(-self))})
+		}
+	}
+
+	if more > 0 {
+		warns = append(warns, TraceWarning{Code: warnMore, Message: fmt.Sprintf("%d more warning(s) not shown", more)})
+	}
+	q.Warnings = warns
+	return q
+}
+
+// skewCorrection returns how far to move a child interval so that it sits
+// inside its parent: centred, splitting the unseen network latency evenly,
+// or aligned to the parent's start when the child is the longer one.
+func skewCorrection(ps, pe, cs, ce int64) int64 {
+	if cs >= ps && ce <= pe {
+		return 0
+	}
+	pd, cd := pe-ps, ce-cs
+	if cd <= pd {
+		return ps + (pd-cd)/2 - cs
+	}
+	return ps - cs
+}
+
+// asyncChild reports messaging children, which legitimately start after
+// their producer span has ended.
+func asyncChild(parent, child spanEdge) bool {
+	return normEnum(parent.SpanKind, "SPAN_KIND_") == "PRODUCER" || normEnum(child.SpanKind, "SPAN_KIND_") == "CONSUMER"
+}
+
+// unionNanos is the total length covered by the intervals.
+func unionNanos(iv [][2]int64) int64 {
+	sort.Slice(iv, func(i, j int) bool { return iv[i][0] < iv[j][0] })
+	var total, end int64
+	started := false
+	var start int64
+	for _, x := range iv {
+		if x[1] <= x[0] {
+			continue
+		}
+		switch {
+		case !started:
+			start, end, started = x[0], x[1], true
+		case x[0] > end:
+			total += end - start
+			start, end = x[0], x[1]
+		case x[1] > end:
+			end = x[1]
+		}
+	}
+	if started {
+		total += end - start
+	}
+	return total
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package traces
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+const ms = int64(1_000_000)
+
+func warningCodes(ws []TraceWarning) map[string]int {
+	out := map[string]int{}
+	for _, w := range ws {
+		out[w.Code]++
+	}
+	return out
+}
+
+func TestAnalyzeTrace_OrphansAndMissingParents(t *testing.T) {
+	q := analyzeTrace(newSpanTree([]spanEdge{
+		{SpanId: "A", ServiceName: "web", EndNS: 10 * ms},
+		{SpanId: "B", ParentSpanId: "gone", ServiceName: "web", StartNS: 1 * ms, EndNS: 2 * ms},
+		{SpanId: "C", ParentSpanId: "gone", ServiceName: "web", StartNS: 3 * ms, EndNS: 4 * ms},
+	}), false)
+	got := warningCodes(q.Warnings)
+	if got[warnMissingParent] != 1 || got[warnOrphan] != 2 || len(q.Warnings) != 3 {
+		t.Fatalf("warnings=%+v", q.Warnings)
+	}
+	if w := q.Warnings[0]; w.ParentSpanID != "gone" {
+		t.Fatalf("missing parent warning=%+v", w)
+	}
+}
+
+func TestAnalyzeTrace_ClockSkew(t *testing.T) {
+	tree := newSpanTree([]spanEdge{
+		{SpanId: "G", ParentSpanId: "C", ServiceName: "db", StartNS: -10 * ms, EndNS: 0},
+		{SpanId: "C", ParentSpanId: "P", ServiceName: "db", StartNS: -20 * ms, EndNS: 30 * ms},
+		{SpanId: "P", ServiceName: "web", StartNS: 0, EndNS: 100 * ms},
+		// Consumers may start after their producer ends.
+		{SpanId: "Q", ParentSpanId: "P", ServiceName: "worker", SpanKind: "SPAN_KIND_CONSUMER", StartNS: 200 * ms, EndNS: 210 * ms},
+	})
+
+	q := analyzeTrace(tree, false)
+	if len(q.Warnings) != 1 || q.Warnings[0].Code != warnClockSkew || q.Warnings[0].SpanID != "C" {
+		t.Fatalf("warnings=%+v", q.Warnings)
+	}
+	// A 50ms child centred in a 100ms parent starts at 25ms.
+	if q.Warnings[0].SkewNanos != 45*ms {
+		t.Fatalf("skew=%d want %d", q.Warnings[0].SkewNanos, 45*ms)
+	}
+	if len(q.Shift) != 0 {
+		t.Fatalf("shift without adjust: %v", q.Shift)
+	}
+
+	q = analyzeTrace(tree, true)
+	if q.Shift["C"] != 45*ms || q.Shift["G"] != 45*ms || q.Shift["P"] != 0 || q.Shift["Q"] != 0 {
+		t.Fatalf("shift=%v", q.Shift)
+	}
+}
+
+func TestAnalyzeTrace_NegativeSelfTime(t *testing.T) {
+	q := analyzeTrace(newSpanTree([]spanEdge{
+		{SpanId: "P", ServiceName: "web", EndNS: 10 * ms},
+		// Overlapping children are fine as long as they fit.
+		{SpanId: "A", ParentSpanId: "P", ServiceName: "web", StartNS: 1 * ms, EndNS: 9 * ms},
+		{SpanId: "B", ParentSpanId: "P", ServiceName: "web", StartNS: 2 * ms, EndNS: 8 * ms},
+		// Outlives its parent on the same clock.
+		{SpanId: "X", ParentSpanId: "A", ServiceName: "web", StartNS: 5 * ms, EndNS: 20 * ms},
+	}), false)
+	if len(q.Warnings) != 1 || q.Warnings[0].Code != warnNegativeSelfTime || q.Warnings[0].SpanID != "A" {
+		t.Fatalf("warnings=%+v", q.Warnings)
+	}
+}
+
+func TestAnalyzeTrace_CapsWarnings(t *testing.T) {
+	var edges []spanEdge
+	for i := 0; i < maxTraceWarnings; i++ {
+		edges = append(edges, spanEdge{SpanId: fmt.Sprint("s", i), ParentSpanId: fmt.Sprint("p", i)})
+	}
+	q := analyzeTrace(newSpanTree(edges), false)
+	last := q.Warnings[len(q.Warnings)-1]
+	if len(q.Warnings) != maxTraceWarnings+1 || last.Code != warnMore {
+		t.Fatalf("len=%d last=%+v", len(q.Warnings), last)
+	}
+}
+
+const skewedRows = `{"TraceId":"T","SpanId":"P","ParentSpanId":"","SpanName":"GET /","ServiceName":"web","start_ns":0,"end_ns":100000000}
+{"TraceId":"T","SpanId":"C","ParentSpanId":"P","SpanName":"SELECT","ServiceName":"db","start_ns":-20000000,"end_ns":30000000,"EventTimes":[-10000000],"EventNames":["retry"]}
+`
+
+func TestGet_ReportsAndAdjustsSkew(t *testing.T) {
+	ts := fakeCH(t, skewedRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	get := func(url string) (out struct {
+		Warnings []TraceWarning `json:"warnings"`
+		Spans    []Span         `json:"spans"`
+	}) {
+		w := httptest.NewRecorder()
+		newRouter("/api/traces/:traceId", Get(src)).ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatalf("json: %v\n%s", err, w.Body.String())
+		}
+		return out
+	}
+
+	out := get("/api/traces/T")
+	if len(out.Warnings) != 1 || out.Warnings[0].Code != warnClockSkew || out.Spans[1].StartUnixNanos != -20*ms {
+		t.Fatalf("unadjusted: %+v", out)
+	}
+	out = get("/api/traces/T?adjustSkew=true")
+	if c := out.Spans[1]; c.StartUnixNanos != 25*ms || c.EndUnixNanos != 75*ms || c.Events[0].TimeUnixNanos != 35*ms {
+		t.Fatalf("adjusted child: %+v", c)
+	}
+}
+
+func TestFlame_WarnsAboutOrphans(t *testing.T) {
+	ts := fakeCH(t, `{"SpanId":"A","ParentSpanId":"","SpanName":"root","ServiceName":"web","start_ns":0,"end_ns":10000000}
+{"SpanId":"B","ParentSpanId":"gone","SpanName":"late","ServiceName":"web","start_ns":0,"end_ns":5000000}
+`)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+
+	w := httptest.NewRecorder()
+	newRouter("/api/traces/:traceId/flame", Flame(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/t/flame", nil))
+	var root FlameNode
+	if err := json.Unmarshal(w.Body.Bytes(), &root); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if got := warningCodes(root.Warnings); got[warnMissingParent] != 1 || got[warnOrphan] != 1 {
+		t.Fatalf("warnings=%+v", root.Warnings)
+	}
+	if len(root.Children) != 2 || root.Children[0].Warnings != nil {
+		t.Fatalf("tree=%+v", root)
+	}
+}
@@ -0,0 +1,28 @@
+package traces
+
+// selfNanos is the part of [start, end) not covered by any child. Children
+// are clipped to the parent and overlapping ones count once, so a span that
+// fans out to parallel calls keeps the time it spent outside all of them
+// instead of dropping to zero.
+func selfNanos(start, end int64, children [][2]int64) int64 {
+	iv := make([][2]int64, 0, len(children))
+	for _, c := range children {
+		if s, e := max(c[0], start), min(c[1], end); e > s {
+			iv = append(iv, [2]int64{s, e})
+		}
+	}
+	return max(end-start-unionNanos(iv), 0)
+}
+
+// selfNanos computes a span's self time from the tree, after any clock-skew
+// shifts.
+func (t *spanTree) selfNanos(id string, shift map[string]int64) int64 {
+	s := t.spans[id]
+	kids := t.children[id]
+	iv := make([][2]int64, 0, len(kids))
+	for _, cid := range kids {
+		ch := t.spans[cid]
+		iv = append(iv, [2]int64{ch.StartNS + shift[cid], ch.EndNS + shift[cid]})
+	}
+	return selfNanos(s.StartNS+shift[id], s.EndNS+shift[id], iv)
+}
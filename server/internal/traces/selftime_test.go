@@ -0,0 +1,80 @@
+package traces
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+// Parallel fan-out: GET (0-100ms) calls three services at once (10-60ms), and
+// a batch step with two overlapping children (70-85ms, 80-95ms).
+const fanOutRows = `{"TraceId":"T","SpanId":"R","ParentSpanId":"","SpanName":"GET","ServiceName":"web","start_ns":0,"end_ns":100000000}
+{"TraceId":"T","SpanId":"A","ParentSpanId":"R","SpanName":"a","ServiceName":"web","start_ns":10000000,"end_ns":60000000}
+{"TraceId":"T","SpanId":"B","ParentSpanId":"R","SpanName":"b","ServiceName":"web","start_ns":10000000,"end_ns":60000000}
+{"TraceId":"T","SpanId":"C","ParentSpanId":"R","SpanName":"c","ServiceName":"web","start_ns":10000000,"end_ns":60000000}
+{"TraceId":"T","SpanId":"X","ParentSpanId":"R","SpanName":"x","ServiceName":"web","start_ns":65000000,"end_ns":98000000}
+{"TraceId":"T","SpanId":"X1","ParentSpanId":"X","SpanName":"x1","ServiceName":"web","start_ns":70000000,"end_ns":85000000}
+{"TraceId":"T","SpanId":"X2","ParentSpanId":"X","SpanName":"x2","ServiceName":"web","start_ns":80000000,"end_ns":95000000}
+`
+
+func TestSelfNanos(t *testing.T) {
+	cases := []struct {
+		name     string
+		children [][2]int64
+		want     int64
+	}{
+		{"leaf", nil, 100},
+		{"sequential", [][2]int64{{10, 20}, {30, 50}}, 70},
+		{"parallel", [][2]int64{{10, 60}, {10, 60}, {10, 60}}, 50},
+		{"overlapping", [][2]int64{{10, 40}, {30, 70}}, 40},
+		{"outlives parent", [][2]int64{{50, 300}}, 50},
+		{"before parent", [][2]int64{{-50, -10}}, 100},
+	}
+	for _, c := range cases {
+		if got := selfNanos(0, 100, c.children); got != c.want {
+			t.Errorf("%s: self=%d want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFlame_SelfTimeWithParallelChildren(t *testing.T) {
+	ts := fakeCH(t, fanOutRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	w := httptest.NewRecorder()
+	newRouter("/api/traces/:traceId/flame", Flame(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/T/flame?mode=self", nil))
+	var root FlameNode
+	if err := json.Unmarshal(w.Body.Bytes(), &root); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	// 100ms minus 10-60 and 65-98: 17ms, not 0 as with summed durations.
+	if root.Value != 17000 {
+		t.Fatalf("root self=%dµs want 17000", root.Value)
+	}
+	x := root.Children[3]
+	if x.Name != "web:x" || x.Value != 8000 {
+		t.Fatalf("x=%+v want self 8000µs (33ms minus 70-95)", x)
+	}
+}
+
+func TestGet_SelfNanos(t *testing.T) {
+	ts := fakeCH(t, fanOutRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	w := httptest.NewRecorder()
+	newRouter("/api/traces/:traceId", Get(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/T", nil))
+	var out struct {
+		Spans []Span `json:"spans"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	want := map[string]int64{"R": 17 * ms, "A": 50 * ms, "X": 8 * ms, "X1": 15 * ms}
+	for _, s := range out.Spans {
+		if w, ok := want[s.SpanID]; ok && s.SelfNanos != w {
+			t.Errorf("%s selfNanos=%d want %d", s.SpanID, s.SelfNanos, w)
+		}
+	}
+}
@@ -1,64 +1,148 @@
 package traces
 
 import (
+  "bytes"
+  "encoding/json"
   "fmt"
   "io"
-  "net/http"
+  "strconv"
   "strings"
+  "time"
 
   "github.com/gin-gonic/gin"
+  "github.com/example/otel-stack-demo/internal/cache"
   "github.com/example/otel-stack-demo/internal/sources"
 )
 
+const (
+  defaultSuggestLimit = 20
+  maxSuggestLimit     = 1000
+)
+
 func SuggestServices(src *sources.Sources) gin.HandlerFunc {
+  cc := newCache(src, "suggest_services", defaultSuggestCacheSize)
   return func(c *gin.Context){
-    q := c.Query("q")
-    where := "1=1"
-    if q != "" { where = fmt.Sprintf("ServiceName ILIKE '%%%s%%'", strings.ReplaceAll(q, "'", "''")) }
-    sql := fmt.Sprintf(`
+    where, limit, err := suggestScope(c, false)
+    if err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
+    if q := normQ(c.Query("q")); q != "" { where = append(where, "ServiceName ILIKE " + sources.Quote("%"+q+"%")) }
+    proxy(c, src, cc, servicesSQL(src, where, limit))
+  }
+}
+
+func servicesSQL(src *sources.Sources, where []string, limit int) string {
+  return fmt.Sprintf(`
       SELECT ServiceName, sum(Cnt) AS c
-      FROM %s.service_suggest
-      WHERE WindowStart > now() - INTERVAL 24 HOUR AND %s
-      GROUP BY ServiceName ORDER BY c DESC LIMIT 20 FORMAT JSONEachRow
-    `, src.CHDB, where)
-    proxy(c, src, sql)
+      FROM %s.%s
+      WHERE %s
+      GROUP BY ServiceName ORDER BY c DESC LIMIT %d FORMAT JSONEachRow
+    `, src.CHDB, src.Traces.WithDefaults().Tables.ServiceSuggest, strings.Join(where, " AND "), limit)
+}
+
+// ServiceNames runs SuggestServices' query for callers outside HTTP: the
+// services seen between from and to (unix seconds, 0 as in suggestScope),
+// busiest first.
+func ServiceNames(src *sources.Sources, from, to float64, limit int) ([]string, error) {
+  w, err := windowScope(from, to)
+  if err != nil { return nil, err }
+  b, err := src.QueryCH(servicesSQL(src, []string{w}, limit))
+  if err != nil { return nil, err }
+  var out []string
+  dec := json.NewDecoder(bytes.NewReader(b))
+  for {
+    var row struct{ ServiceName string }
+    if err := dec.Decode(&row); err == io.EOF { break } else if err != nil { return nil, fmt.Errorf("decode services: %w", err) }
+    out = append(out, row.ServiceName)
   }
+  return out, nil
 }
+
+// SuggestOperations narrows to the selected service(s) when ?service= is set.
 func SuggestOperations(src *sources.Sources) gin.HandlerFunc {
+  cc := newCache(src, "suggest_operations", defaultSuggestCacheSize)
   return func(c *gin.Context){
-    q := c.Query("q")
-    where := "1=1"
-    if q != "" { where = fmt.Sprintf("SpanName ILIKE '%%%s%%'", strings.ReplaceAll(q, "'", "''")) }
+    where, limit, err := suggestScope(c, true)
+    if err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
+    if q := normQ(c.Query("q")); q != "" { where = append(where, "SpanName ILIKE " + sources.Quote("%"+q+"%")) }
     sql := fmt.Sprintf(`
       SELECT SpanName, sum(Cnt) AS c
-      FROM %s.operation_suggest
-      WHERE WindowStart > now() - INTERVAL 24 HOUR AND %s
-      GROUP BY SpanName ORDER BY c DESC LIMIT 20 FORMAT JSONEachRow
-    `, src.CHDB, where)
-    proxy(c, src, sql)
+      FROM %s.%s
+      WHERE %s
+      GROUP BY SpanName ORDER BY c DESC LIMIT %d FORMAT JSONEachRow
+    `, src.CHDB, src.Traces.WithDefaults().Tables.OperationSuggest, strings.Join(where, " AND "), limit)
+    proxy(c, src, cc, sql)
   }
 }
+
+// SuggestAttributes narrows to the selected service(s) when ?service= is set.
 func SuggestAttributes(src *sources.Sources) gin.HandlerFunc {
+  cc := newCache(src, "suggest_attributes", defaultSuggestCacheSize)
   return func(c *gin.Context){
-    key := c.Query("key"); q := c.Query("q")
+    key := strings.TrimSpace(c.Query("key"))
     if key == "" { c.JSON(400, gin.H{"error":"key required"}); return }
-    where := fmt.Sprintf("Key = '%s'", strings.ReplaceAll(key, "'", "''"))
-    if q != "" { where += fmt.Sprintf(" AND Val ILIKE '%%%s%%'", strings.ReplaceAll(q, "'", "''")) }
+    where, limit, err := suggestScope(c, true)
+    if err != nil { c.JSON(400, gin.H{"error": err.Error()}); return }
+    where = append(where, "Key = " + sources.Quote(key))
+    if q := normQ(c.Query("q")); q != "" { where = append(where, "Val ILIKE " + sources.Quote("%"+q+"%")) }
     sql := fmt.Sprintf(`
       SELECT Val, sum(Cnt) AS c
-      FROM %s.attr_values
-      WHERE WindowStart > now() - INTERVAL 24 HOUR AND %s
-      GROUP BY Val ORDER BY c DESC LIMIT 20 FORMAT JSONEachRow
-    `, src.CHDB, where)
-    proxy(c, src, sql)
+      FROM %s.%s
+      WHERE %s
+      GROUP BY Val ORDER BY c DESC LIMIT %d FORMAT JSONEachRow
+    `, src.CHDB, src.Traces.WithDefaults().Tables.AttrValues, strings.Join(where, " AND "), limit)
+    proxy(c, src, cc, sql)
+  }
+}
+
+// suggestScope turns ?from=&to= (unix seconds) into a WindowStart predicate,
+// defaulting to the last 24 hours, and ?limit= into a bounded row count.
+// With scoped set, repeated ?service= values restrict rows to those services.
+func suggestScope(c *gin.Context, scoped bool) ([]string, int, error) {
+  from, err := floatQuery(c, "from"); if err != nil { return nil, 0, err }
+  to, err := floatQuery(c, "to"); if err != nil { return nil, 0, err }
+
+  w, err := windowScope(from, to)
+  if err != nil { return nil, 0, err }
+  where := []string{w}
+
+  if scoped {
+    var svcs []string
+    for _, s := range c.QueryArray("service") { if s = strings.TrimSpace(s); s != "" { svcs = append(svcs, s) } }
+    if len(svcs) > 0 { where = append(where, "ServiceName IN ("+joinQuoted(svcs)+")") }
+  }
+
+  limit := defaultSuggestLimit
+  if v := c.Query("limit"); v != "" {
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 { return nil, 0, fmt.Errorf("limit must be a positive integer") }
+    if n > maxSuggestLimit { n = maxSuggestLimit }
+    limit = n
   }
+  return where, limit, nil
 }
 
-func proxy(c *gin.Context, src *sources.Sources, sql string){
-  req, _ := http.NewRequest("POST", src.CHURL, strings.NewReader(sql))
-  if src.CHUser != "" { req.SetBasicAuth(src.CHUser, src.CHPass) }
-  resp, err := src.Client.Do(req)
-  if err != nil { c.JSON(502, gin.H{"error": err.Error()}); return }
-  defer resp.Body.Close(); b,_ := io.ReadAll(resp.Body)
-  c.Data(200, "application/json", b)
+// windowScope is the WindowStart predicate for from/to, see suggestScope.
+func windowScope(from, to float64) (string, error) {
+  if from == 0 && to == 0 { return "WindowStart > now() - INTERVAL 24 HOUR", nil }
+  if to == 0 { to = float64(time.Now().Unix()) }
+  if from == 0 { from = to - 86400 }
+  if from > to { return "", fmt.Errorf("from must be before to") }
+  // Rows are hourly buckets, so round from down to include its hour.
+  return fmt.Sprintf("WindowStart BETWEEN toStartOfHour(toDateTime(%d)) AND toDateTime(%d)", int64(from), int64(to)), nil
+}
+
+func floatQuery(c *gin.Context, k string) (float64, error) {
+  v := c.Query(k)
+  if v == "" { return 0, nil }
+  f, err := strconv.ParseFloat(v, 64)
+  if err != nil || f < 0 { return 0, fmt.Errorf("%s must be unix seconds", k) }
+  return f, nil
+}
+
+// normQ trims and lowercases a search prefix; ILIKE ignores case anyway, so
+// "Check" and "check " share one cache entry.
+func normQ(q string) string { return strings.ToLower(strings.TrimSpace(q)) }
+
+// proxy answers with the ClickHouse rows for sql, keyed in cc by the SQL text.
+func proxy(c *gin.Context, src *sources.Sources, cc *cache.Cache, sql string){
+  serveCached(c, cc, sql, func() ([]byte, error) { return src.QueryCH(sql) })
 }
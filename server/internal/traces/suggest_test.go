@@ -1,8 +1,11 @@
 package traces
 
 import (
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/example/otel-stack-demo/internal/sources"
 	"github.com/gin-gonic/gin"
@@ -65,3 +68,97 @@ func TestSuggest_Attributes(t *testing.T) {
 		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
 	}
 }
+
+func TestSuggest_CachedWithETag(t *testing.T) {
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(`{"ServiceName":"checkout","c":120}` + "\n"))
+	}))
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client(), CacheTTL: time.Minute}
+	r := newRouter("/api/traces/suggest/services", SuggestServices(src))
+
+	w1 := httptest.NewRecorder()
+	r.ServeHTTP(w1, httptest.NewRequest("GET", "/api/traces/suggest/services?q=Check", nil))
+	etag := w1.Header().Get("ETag")
+	if w1.Code != 200 || etag == "" || w1.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first: status=%d headers=%v", w1.Code, w1.Header())
+	}
+	if !strings.Contains(w1.Header().Get("Cache-Control"), "max-age=60") {
+		t.Fatalf("cache-control=%q", w1.Header().Get("Cache-Control"))
+	}
+
+	// Same normalized prefix is served from memory.
+	w2 := httptest.NewRecorder()
+	r.ServeHTTP(w2, httptest.NewRequest("GET", "/api/traces/suggest/services?q=check", nil))
+	if w2.Header().Get("X-Cache") != "HIT" || hits != 1 {
+		t.Fatalf("second: x-cache=%q upstream hits=%d", w2.Header().Get("X-Cache"), hits)
+	}
+
+	// Revalidation with the ETag gets a bodyless 304.
+	w3 := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/traces/suggest/services?q=check", nil)
+	req.Header.Set("If-None-Match", etag)
+	r.ServeHTTP(w3, req)
+	if w3.Code != http.StatusNotModified || w3.Body.Len() != 0 {
+		t.Fatalf("revalidate: status=%d body=%q", w3.Code, w3.Body.String())
+	}
+}
+
+func TestSuggest_UpstreamErrorIsNotCached(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 60. Table does not exist", 404)
+	}))
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client(), CacheTTL: time.Minute}
+	r := newRouter("/api/traces/suggest/services", SuggestServices(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/suggest/services", nil))
+	if w.Code != 502 {
+		t.Fatalf("want 502 got %d", w.Code)
+	}
+}
+
+func TestSuggest_OperationsScopedByServiceAndWindow(t *testing.T) {
+	ts, queries := captureCH(t, `{"SpanName":"GET /cart","c":50}`+"\n")
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/traces/suggest/operations", SuggestOperations(src))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/suggest/operations?service=checkout&service=o'neil&from=1704103200&to=1704106800&limit=5", nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	sql := strings.Join(*queries, "\n")
+	for _, want := range []string{
+		"ServiceName IN ('checkout', 'o\\'neil')",
+		"WindowStart BETWEEN toStartOfHour(toDateTime(1704103200)) AND toDateTime(1704106800)",
+		"LIMIT 5",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("sql missing %q:\n%s", want, sql)
+		}
+	}
+	if strings.Contains(sql, "INTERVAL 24 HOUR") {
+		t.Fatalf("default window used despite from/to:\n%s", sql)
+	}
+}
+
+func TestSuggest_RejectsBadWindowAndLimit(t *testing.T) {
+	src := &sources.Sources{CHURL: "http://127.0.0.1:0", CHDB: "default", Client: http.DefaultClient}
+	r := newRouter("/api/traces/suggest/services", SuggestServices(src))
+
+	for _, q := range []string{"limit=abc", "limit=0", "from=yesterday", "from=200&to=100"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/traces/suggest/services?"+q, nil))
+		if w.Code != 400 {
+			t.Fatalf("[%s] want 400 got %d", q, w.Code)
+		}
+	}
+}
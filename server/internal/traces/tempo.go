@@ -0,0 +1,260 @@
+package traces
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+	"github.com/example/otel-stack-demo/internal/traceql"
+	"github.com/gin-gonic/gin"
+)
+
+// Tempo's search API (the part Grafana's Tempo datasource uses), backed by
+// the TraceQL subset in package traceql.
+
+const (
+	defaultTempoLimit    = 20
+	defaultTempoLookback = time.Hour
+)
+
+// Tempo search response types.
+type (
+	tempoSearchResponse struct {
+		Traces  []tempoTrace `json:"traces"`
+		Metrics tempoMetrics `json:"metrics"`
+	}
+	tempoMetrics struct {
+		InspectedTraces int `json:"inspectedTraces"`
+	}
+	tempoTrace struct {
+		TraceID           string         `json:"traceID"`
+		RootServiceName   string         `json:"rootServiceName"`
+		RootTraceName     string         `json:"rootTraceName,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		DurationMs        int64          `json:"durationMs"`
+		SpanSet           tempoSpanSet   `json:"spanSet"`
+		SpanSets          []tempoSpanSet `json:"spanSets"`
+	}
+	tempoSpanSet struct {
+		Spans   []tempoSpan `json:"spans"`
+		Matched int         `json:"matched"`
+	}
+	tempoSpan struct {
+		SpanID            string         `json:"spanID"`
+		Name              string         `json:"name"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		DurationNanos     string         `json:"durationNanos"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	}
+)
+
+// TempoSearch serves GET /api/search?q=<TraceQL>&start=&end=&limit=&spss=
+// &minDuration=&maxDuration=. start/end are Unix seconds (default: the last
+// hour); minDuration/maxDuration bound the whole trace's duration.
+func TempoSearch(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expr, err := traceql.Parse(c.Query("q"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts, err := tempoOptions(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sql, err := traceql.SearchSQL(src.CHDB, src.Traces, expr, opts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		b, err := src.QueryCH(sql)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		type row struct {
+			TraceId string     `json:"TraceId"`
+			Matched int        `json:"matched"`
+			Spans   [][]string `json:"spans"`
+		}
+		var rows []row
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			var r row
+			if err := dec.Decode(&r); err != nil {
+				if err == io.EOF {
+					break
+				}
+				c.JSON(http.StatusBadGateway, gin.H{"error": "decode CH rows: " + err.Error()})
+				return
+			}
+			rows = append(rows, r)
+		}
+
+		ids := make([]string, len(rows))
+		for i, r := range rows {
+			ids[i] = r.TraceId
+		}
+		roots, err := traceRootInfo(src, ids)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		out := tempoSearchResponse{Traces: []tempoTrace{}, Metrics: tempoMetrics{InspectedTraces: len(rows)}}
+		for _, r := range rows {
+			set := tempoSpanSet{Spans: []tempoSpan{}, Matched: r.Matched}
+			first := int64(0)
+			for _, s := range r.Spans {
+				if len(s) < 6 {
+					continue
+				}
+				if ns, _ := strconv.ParseInt(s[2], 10, 64); first == 0 || ns < first {
+					first = ns
+				}
+				set.Spans = append(set.Spans, tempoSpan{
+					SpanID: s[0], StartTimeUnixNano: s[2], DurationNanos: s[3], Name: s[5],
+					Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: s[4]}}},
+				})
+			}
+			t := tempoTrace{
+				TraceID:           r.TraceId,
+				RootServiceName:   "<root span not yet received>",
+				StartTimeUnixNano: strconv.FormatInt(first, 10),
+				SpanSet:           set,
+				SpanSets:          []tempoSpanSet{set},
+			}
+			if info, ok := roots[r.TraceId]; ok {
+				if info.RootService != "" {
+					t.RootServiceName, t.RootTraceName = info.RootService, info.RootOperation
+				}
+				t.StartTimeUnixNano = strconv.FormatInt(info.StartS*int64(time.Second), 10)
+				t.DurationMs = int64(info.DurationMs)
+			}
+			out.Traces = append(out.Traces, t)
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func tempoOptions(c *gin.Context) (traceql.SearchOptions, error) {
+	o := traceql.SearchOptions{Limit: defaultTempoLimit, End: time.Now()}
+	intParam := func(k string) (int64, bool, error) {
+		v := c.Query(k)
+		if v == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("%s must be a non-negative integer", k)
+		}
+		return n, true, nil
+	}
+	if n, ok, err := intParam("end"); err != nil {
+		return o, err
+	} else if ok {
+		o.End = time.Unix(n, 0)
+	}
+	o.Start = o.End.Add(-defaultTempoLookback)
+	if n, ok, err := intParam("start"); err != nil {
+		return o, err
+	} else if ok {
+		o.Start = time.Unix(n, 0)
+	}
+	if o.Start.After(o.End) {
+		return o, fmt.Errorf("start must be before end")
+	}
+	if n, ok, err := intParam("limit"); err != nil {
+		return o, err
+	} else if ok && n > 0 {
+		o.Limit = int(min(n, maxSuggestLimit))
+	}
+	if n, ok, err := intParam("spss"); err != nil {
+		return o, err
+	} else if ok {
+		o.SpansPerSpanset = int(min(n, 1000))
+	}
+	var err error
+	if v := c.Query("minDuration"); v != "" {
+		if o.MinDuration, err = time.ParseDuration(v); err != nil {
+			return o, fmt.Errorf("minDuration: %v", err)
+		}
+	}
+	if v := c.Query("maxDuration"); v != "" {
+		if o.MaxDuration, err = time.ParseDuration(v); err != nil {
+			return o, fmt.Errorf("maxDuration: %v", err)
+		}
+	}
+	return o, nil
+}
+
+type rootInfo struct {
+	StartS        int64   `json:"start_s"`
+	DurationMs    float64 `json:"DurationMs"`
+	RootService   string  `json:"RootService"`
+	RootOperation string  `json:"RootOperation"`
+}
+
+// traceRootInfo reads trace_roots for ids. The MV inserts one row per
+// insert block, so rows are merged per trace here.
+func traceRootInfo(src *sources.Sources, ids []string) (map[string]rootInfo, error) {
+	out := map[string]rootInfo{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	b, err := src.QueryCH(fmt.Sprintf(`
+SELECT TraceId, toInt64(toUnixTimestamp(min(StartTs))) AS start_s, max(DurationMs) AS DurationMs,
+  anyIf(RootService, RootService != '') AS RootService, anyIf(RootOperation, RootOperation != '') AS RootOperation
+FROM %s.%s
+WHERE TraceId IN (%s)
+GROUP BY TraceId
+SETTINGS output_format_json_quote_64bit_integers = 0
+FORMAT JSONEachRow
+`, src.CHDB, src.Traces.WithDefaults().Tables.TraceRoots, joinQuoted(ids)))
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var r struct {
+			TraceId string `json:"TraceId"`
+			rootInfo
+		}
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decode trace_roots: %w", err)
+		}
+		out[r.TraceId] = r.rootInfo
+	}
+	return out, nil
+}
+
+// TempoTrace serves GET /api/v2/traces/{traceId}: {"trace": <OTLP/JSON>}.
+// Traces over TraceMaxSpans (or ?maxSpans=) are refused with 413.
+func TempoTrace(src *sources.Sources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traceID := c.Param("traceId")
+		if !underSpanLimit(c, src, traceID, "traces") {
+			return
+		}
+		recs, err := fetchRecords(src, traceID)
+		if err != nil && err != errTraceNotFound {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if len(recs) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "trace not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"trace": toOTLP(recs)})
+	}
+}
@@ -0,0 +1,112 @@
+package traces
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/example/otel-stack-demo/internal/sources"
+)
+
+func TestTempoSearch_ResponseShape(t *testing.T) {
+	ts, queries := captureCHFunc(t, func(sql string) string {
+		switch {
+		case strings.Contains(sql, "all_matched"):
+			return `{"TraceId":"T1","last_ns":5,"matched":4,"spans":[["S2","S1","1700000000002000000","3000000","db","SELECT"],["S3","S1","1700000000001000000","1000000","db","SELECT"]]}` + "\n" +
+				`{"TraceId":"T2","last_ns":4,"matched":1,"spans":[["S9","","1700000000009000000","10","cart","GET"]]}` + "\n"
+		case strings.Contains(sql, "trace_roots"):
+			return `{"TraceId":"T1","start_s":1700000000,"DurationMs":12.7,"RootService":"web","RootOperation":"GET /"}` + "\n"
+		}
+		return ""
+	})
+	defer ts.Close()
+
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/search", TempoSearch(src))
+
+	q := url.Values{"q": {`{ resource.service.name = "db" && name = "SELECT" }`}, "start": {"1700000000"}, "end": {"1700003600"}, "limit": {"2"}}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/search?"+q.Encode(), nil))
+	if w.Code != 200 {
+		t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+	}
+	var out tempoSearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if len(out.Traces) != 2 || out.Metrics.InspectedTraces != 2 {
+		t.Fatalf("out=%+v", out)
+	}
+	t1 := out.Traces[0]
+	if t1.TraceID != "T1" || t1.RootServiceName != "web" || t1.RootTraceName != "GET /" || t1.DurationMs != 12 ||
+		t1.StartTimeUnixNano != "1700000000000000000" {
+		t.Fatalf("t1=%+v", t1)
+	}
+	if t1.SpanSet.Matched != 4 || len(t1.SpanSet.Spans) != 2 || t1.SpanSet.Spans[0].DurationNanos != "3000000" ||
+		t1.SpanSet.Spans[0].Attributes[0].Value.StringValue != "db" || len(t1.SpanSets) != 1 {
+		t.Fatalf("t1 spanset=%+v", t1.SpanSet)
+	}
+	// No trace_roots row yet: Tempo's placeholder and the earliest matched span.
+	t2 := out.Traces[1]
+	if t2.RootServiceName != "<root span not yet received>" || t2.StartTimeUnixNano != "1700000000009000000" {
+		t.Fatalf("t2=%+v", t2)
+	}
+	if q := *queries; !strings.Contains(q[0], "LIMIT 2") || !strings.Contains(q[1], "IN ('T1', 'T2')") {
+		t.Fatalf("queries=%q", q)
+	}
+}
+
+func TestTempoSearch_BadQuery(t *testing.T) {
+	r := newRouter("/api/search", TempoSearch(&sources.Sources{}))
+	for _, q := range []string{"q=" + url.QueryEscape("{ nope = 1 }"), "q=%7B%7D&start=x", "q=%7B%7D&start=20&end=10"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/search?"+q, nil))
+		if w.Code != 400 {
+			t.Fatalf("%s: status=%d", q, w.Code)
+		}
+	}
+}
+
+func TestTempoSearch_BadRowsAre502(t *testing.T) {
+	for name, respond := range map[string]func(string) string{
+		"search": func(string) string {
+			return `{"TraceId":"T1","matched":1,"spans":[]}` + "\n" + `Code: 241. DB::Exception: Memory limit exceeded`
+		},
+		"roots": func(sql string) string {
+			if strings.Contains(sql, "trace_roots") {
+				return `{"TraceId":` // cut off mid-row
+			}
+			return `{"TraceId":"T1","matched":1,"spans":[]}` + "\n"
+		},
+	} {
+		ts, _ := captureCHFunc(t, respond)
+		src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+		w := httptest.NewRecorder()
+		newRouter("/api/search", TempoSearch(src)).ServeHTTP(w, httptest.NewRequest("GET", "/api/search?q=%7B%7D&start=1700000000&end=1700003600", nil))
+		ts.Close()
+		if w.Code != 502 || !strings.Contains(w.Body.String(), "decode") {
+			t.Fatalf("%s: status=%d body=%s", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestTempoTrace_SpanLimit(t *testing.T) {
+	ts := fakeCH(t, exportRows)
+	defer ts.Close()
+	src := &sources.Sources{CHURL: ts.URL, CHDB: "default", Client: ts.Client()}
+	r := newRouter("/api/v2/traces/:traceId", TempoTrace(src))
+
+	for path, want := range map[string]int{
+		"/api/v2/traces/AB01":            200,
+		"/api/v2/traces/AB01?maxSpans=2": 413,
+		"/api/v2/traces/AB01?maxSpans=x": 400,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Fatalf("%s: status=%d want %d body=%s", path, w.Code, want, w.Body.String())
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package traces
 
 import (
+	"bytes"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -18,6 +21,29 @@ func fakeCH(t *testing.T, body string) *httptest.Server {
 	}))
 }
 
+// captureCH is fakeCH that also records the SQL of every query it gets, in
+// order.
+func captureCH(t *testing.T, body string) (*httptest.Server, *[]string) {
+	t.Helper()
+	return captureCHFunc(t, func(string) string { return body })
+}
+
+// captureCHFunc is captureCH answering each query with respond(sql).
+func captureCHFunc(t *testing.T, respond func(sql string) string) (*httptest.Server, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	queries := &[]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		*queries = append(*queries, string(b))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = io.WriteString(w, respond(string(b)))
+	}))
+	return ts, queries
+}
+
 // newRouter wires only the routes a test needs.
 func newRouter(path string, h gin.HandlerFunc) *gin.Engine {
 	gin.SetMode(gin.TestMode)
@@ -25,3 +51,16 @@ func newRouter(path string, h gin.HandlerFunc) *gin.Engine {
 	r.GET(path, h)
 	return r
 }
+
+// postJSON POSTs body to a router with only h on path.
+func postJSON(t *testing.T, path string, h gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST(path, h)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
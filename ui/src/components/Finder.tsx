@@ -11,11 +11,33 @@ type Item = {
   svcBreakdown?: [string, number][]
 }
 
+// suggest reads a JSONEachRow suggestion response and returns one column.
+async function suggest(url:string, field:string): Promise<string[]>{
+  try {
+    const r = await fetch(url)
+    if (!r.ok) return []
+    const text = await r.text()
+    return text.split('\n').filter(Boolean).map(l=>JSON.parse(l)[field])
+  } catch { return [] }
+}
+
 export default function Finder({ onOpen }:{ onOpen:(id:string)=>void }){
   const [service, setService] = useState('')
   const [operation, setOperation] = useState('')
   const [status, setStatus] = useState('')
   const [items, setItems] = useState<Item[]>([])
+  const [services, setServices] = useState<string[]>([])
+  const [operations, setOperations] = useState<string[]>([])
+
+  useEffect(()=>{
+    suggest(`/api/traces/suggest/services?q=${encodeURIComponent(service)}`, 'ServiceName').then(setServices)
+  }, [service])
+
+  // Operation suggestions follow the selected service.
+  useEffect(()=>{
+    const scope = service ? `&service=${encodeURIComponent(service)}` : ''
+    suggest(`/api/traces/suggest/operations?q=${encodeURIComponent(operation)}${scope}`, 'SpanName').then(setOperations)
+  }, [service, operation])
 
   async function load(){
     const body = {
@@ -39,8 +61,10 @@ export default function Finder({ onOpen }:{ onOpen:(id:string)=>void }){
   return (
     <div style={{padding:12, border:'1px solid #ddd', borderRadius:12}}>
       <div style={{display:'flex', gap:8, alignItems:'center', marginBottom:8}}>
-        <input placeholder='Service' value={service} onChange={e=>setService(e.target.value)} />
-        <input placeholder='Operation' value={operation} onChange={e=>setOperation(e.target.value)} />
+        <input placeholder='Service' list='finder-services' value={service} onChange={e=>setService(e.target.value)} />
+        <datalist id='finder-services'>{services.map(s=><option key={s} value={s} />)}</datalist>
+        <input placeholder='Operation' list='finder-operations' value={operation} onChange={e=>setOperation(e.target.value)} />
+        <datalist id='finder-operations'>{operations.map(o=><option key={o} value={o} />)}</datalist>
         <select value={status} onChange={e=>setStatus(e.target.value)}>
           <option value=''>Any status</option>
           <option value='OK'>OK</option>
@@ -10,6 +10,22 @@ type Span = {
   attributes?: Record<string, string>;
   statusCode?: string;
   statusMessage?: string;
+  traceState?: string;
+  resourceAttributes?: Record<string, string>;
+  scopeName?: string;
+  scopeVersion?: string;
+  events?: {
+    timeUnixNanos: number;
+    name: string;
+    attributes?: Record<string, string>;
+  }[];
+  links?: {
+    traceId: string;
+    spanId: string;
+    traceState?: string;
+    attributes?: Record<string, string>;
+  }[];
+  hiddenChildren?: number;
 };
 
 type FlameNode = {
@@ -18,14 +34,28 @@ type FlameNode = {
   children?: FlameNode[];
 };
 
+type TraceWarning = {
+  code: string;
+  spanId?: string;
+  parentSpanId?: string;
+  skewNanos?: number;
+  message: string;
+};
+
 type TraceResponse = {
   traceId: string;
+  totalSpans: number;
+  truncated: boolean;
+  warnings?: TraceWarning[];
   spans: Span[];
+  error?: string;
 };
 
 export default function TraceView({ traceId }: { traceId: string }) {
   const id = useMemo(() => (traceId || "").toLowerCase(), [traceId]);
   const [spans, setSpans] = useState<Span[]>([]);
+  const [totalSpans, setTotalSpans] = useState(0);
+  const [warnings, setWarnings] = useState<TraceWarning[]>([]);
   const [flame, setFlame] = useState<FlameNode | null>(null);
   const [error, setError] = useState<string | null>(null);
 
@@ -38,7 +68,11 @@ export default function TraceView({ traceId }: { traceId: string }) {
         const r = await fetch(`/api/traces/${id}`);
         if (!r.ok) throw new Error(`GET /api/traces/${id}: ${r.status}`);
         const j: TraceResponse = await r.json();
-        if (!abort) setSpans(j.spans || []);
+        if (abort) return;
+        setSpans(j.spans || []);
+        setTotalSpans(j.totalSpans ?? (j.spans || []).length);
+        setWarnings(j.warnings || []);
+        if (j.error) setError(j.error);
       } catch (e: any) {
         if (!abort) setError(e.message ?? String(e));
       }
@@ -71,6 +105,27 @@ export default function TraceView({ traceId }: { traceId: string }) {
     };
   }, [id]);
 
+  // Truncated traces leave hiddenChildren on the skeleton; fetch them on demand.
+  async function expand(spanId: string) {
+    try {
+      const r = await fetch(`/api/traces/${id}/spans/${spanId}/subtree`);
+      if (!r.ok) throw new Error(`GET subtree ${spanId}: ${r.status}`);
+      const j: TraceResponse = await r.json();
+      setSpans((prev) => {
+        const seen = new Set(prev.map((s) => s.spanId));
+        const merged = prev.map((s) =>
+          s.spanId === spanId ? { ...s, hiddenChildren: 0 } : s
+        );
+        for (const s of j.spans || []) {
+          if (!seen.has(s.spanId)) merged.push(s);
+        }
+        return merged.sort((a, b) => a.startUnixNanos - b.startUnixNanos);
+      });
+    } catch (e: any) {
+      setError(e.message ?? String(e));
+    }
+  }
+
   return (
     <div className="trace-view">
       <div style={{ marginBottom: 12 }}>
@@ -82,9 +137,26 @@ export default function TraceView({ traceId }: { traceId: string }) {
         )}
       </div>
 
+      {warnings.length > 0 && (
+        <details style={{ marginBottom: 12, color: "#a15c00" }}>
+          <summary>{warnings.length} trace warning(s)</summary>
+          <ul>
+            {warnings.map((w, i) => (
+              <li key={i}>
+                <code>{w.code}</code> {w.spanId && <code>{w.spanId}</code>}{" "}
+                {w.message}
+              </li>
+            ))}
+          </ul>
+        </details>
+      )}
+
       <div style={{ display: "grid", gridTemplateColumns: "1fr 1fr", gap: 16 }}>
         <div>
-          <h4>Timeline Spans ({spans.length})</h4>
+          <h4>
+            Timeline Spans ({spans.length}
+            {totalSpans > spans.length && ` of ${totalSpans}`})
+          </h4>
           <ul
             style={{
               maxHeight: 360,
@@ -96,6 +168,29 @@ export default function TraceView({ traceId }: { traceId: string }) {
             {spans.map((s) => (
               <li key={s.spanId}>
                 <code>{s.service}</code> — {s.name}
+                {!!s.hiddenChildren && (
+                  <button
+                    style={{ marginLeft: 8 }}
+                    onClick={() => expand(s.spanId)}
+                  >
+                    +{s.hiddenChildren}
+                  </button>
+                )}
+                {s.events?.map((e, i) => (
+                  <div
+                    key={i}
+                    style={{
+                      marginLeft: 16,
+                      color: e.name === "exception" ? "crimson" : undefined,
+                    }}
+                  >
+                    • {e.name}
+                    {e.attributes?.["exception.type"] &&
+                      `: ${e.attributes["exception.type"]}`}
+                    {e.attributes?.["exception.message"] &&
+                      ` — ${e.attributes["exception.message"]}`}
+                  </div>
+                ))}
               </li>
             ))}
           </ul>